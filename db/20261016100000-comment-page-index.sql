@@ -0,0 +1,2 @@
+-- Speed up paginated listing of comments having the given parent
+CREATE INDEX IF NOT EXISTS commentsDomainPathParentIndex ON comments(domain, path, parentHex);
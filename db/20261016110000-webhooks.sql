@@ -0,0 +1,31 @@
+-- Outgoing domain webhooks
+
+CREATE TABLE IF NOT EXISTS webhooks (
+  webhookHex               TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  domain                   TEXT          NOT NULL                           ,
+  url                      TEXT          NOT NULL                           ,
+  secret                   TEXT          NOT NULL                           ,
+  events                   TEXT          NOT NULL                           , -- Comma-separated list of subscribed events
+  creationDate             TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhooksDomainIndex ON webhooks(domain);
+
+-- Webhook delivery log
+
+CREATE TABLE IF NOT EXISTS webhookDeliveries (
+  deliveryHex              TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  webhookHex               TEXT          NOT NULL                           ,
+  event                    TEXT          NOT NULL                           ,
+  payload                  TEXT          NOT NULL                           ,
+  status                   TEXT          NOT NULL  DEFAULT 'pending'        ,
+  attempts                 INTEGER       NOT NULL  DEFAULT 0                ,
+  responseCode             INTEGER       NOT NULL  DEFAULT 0                ,
+  lastError                TEXT          NOT NULL  DEFAULT ''               ,
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  lastAttemptDate          TIMESTAMP                                        ,
+  nextAttemptDate          TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhookDeliveriesWebhookIndex ON webhookDeliveries(webhookHex, creationDate);
+CREATE INDEX IF NOT EXISTS webhookDeliveriesPendingIndex ON webhookDeliveries(status, nextAttemptDate);
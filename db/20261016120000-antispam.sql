@@ -0,0 +1,26 @@
+-- Per-domain antispam pipeline settings
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamThresholdUnapproved DOUBLE PRECISION NOT NULL DEFAULT 0.5;
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamThresholdFlagged    DOUBLE PRECISION NOT NULL DEFAULT 1.0;
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamLinkLimit           INTEGER          NOT NULL DEFAULT 0;
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamBlocklist           TEXT             NOT NULL DEFAULT '';
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamDenylist            TEXT             NOT NULL DEFAULT '';
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS spamBayesFilter         BOOLEAN          NOT NULL DEFAULT false;
+
+-- Bayesian spam classifier: token statistics
+
+CREATE TABLE IF NOT EXISTS spamTokens (
+  domain                   TEXT          NOT NULL                           ,
+  token                    TEXT          NOT NULL                           ,
+  spamCount                INTEGER       NOT NULL  DEFAULT 0                ,
+  hamCount                 INTEGER       NOT NULL  DEFAULT 0                ,
+  PRIMARY KEY (domain, token)
+);
+
+-- Bayesian spam classifier: number of trained messages
+
+CREATE TABLE IF NOT EXISTS spamCorpora (
+  domain                   TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  spamCount                INTEGER       NOT NULL  DEFAULT 0                ,
+  hamCount                 INTEGER       NOT NULL  DEFAULT 0
+);
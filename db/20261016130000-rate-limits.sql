@@ -0,0 +1,10 @@
+-- Rate limit token buckets, shared between replicas
+
+CREATE TABLE IF NOT EXISTS rateLimits (
+  key                      TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Operation and the key requests are attributed to
+  tokens                   FLOAT         NOT NULL                           , -- Number of requests left in the bucket
+  allowed                  BOOLEAN       NOT NULL                           , -- Whether the last request was allowed
+  updated                  TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rateLimitsUpdatedIndex ON rateLimits(updated);
@@ -0,0 +1,13 @@
+-- Comment edit history
+
+CREATE TABLE IF NOT EXISTS commentRevisions (
+  revisionHex              TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  commentHex               TEXT          NOT NULL                           ,
+  editorHex                TEXT          NOT NULL                           , -- Hex ID of the user who made the edit
+  markdown                 TEXT          NOT NULL                           , -- Comment text before the edit
+  editDate                 TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS commentRevisionsCommentIndex ON commentRevisions(commentHex, editDate);
+
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS editCount INTEGER NOT NULL DEFAULT 0;
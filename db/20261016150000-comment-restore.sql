@@ -0,0 +1,5 @@
+-- Keep the original text of deleted comments so that they can be restored until purged
+
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS deletedMarkdown TEXT; -- Comment text before the deletion
+
+CREATE INDEX IF NOT EXISTS commentsDeletionDateIndex ON comments(deletionDate) WHERE deleted = true;
@@ -0,0 +1,20 @@
+-- Per-domain commenter bans
+
+CREATE TABLE IF NOT EXISTS bans (
+  banHex                   TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  domain                   TEXT          NOT NULL                           ,
+  commenterHex             TEXT          NOT NULL  DEFAULT ''               , -- Banned commenter, if any
+  email                    TEXT          NOT NULL  DEFAULT ''               , -- Banned email, if any
+  ip                       TEXT          NOT NULL  DEFAULT ''               , -- Banned IP address or CIDR range, if any
+  shadow                   BOOLEAN       NOT NULL  DEFAULT false            , -- Whether comments are accepted but only visible to their author
+  reason                   TEXT          NOT NULL  DEFAULT ''               ,
+  creatorHex               TEXT          NOT NULL                           , -- Hex ID of the owner or moderator who created the ban
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  expiryDate               TIMESTAMP                                          -- Null means the ban never expires
+);
+
+CREATE INDEX IF NOT EXISTS bansDomainIndex ON bans(domain);
+
+-- Comments by shadow-banned commenters are only visible to their authors and moderators
+
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS shadowed BOOLEAN NOT NULL DEFAULT false;
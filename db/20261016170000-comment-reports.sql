@@ -0,0 +1,18 @@
+-- Comment reports submitted by readers
+
+CREATE TABLE IF NOT EXISTS commentReports (
+  reportHex                TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  commentHex               TEXT          NOT NULL                           ,
+  domain                   TEXT          NOT NULL                           ,
+  reporterHex              TEXT          NOT NULL                           , -- Hex ID of the commenter who submitted the report
+  category                 TEXT          NOT NULL                           , -- Reason category: spam, abuse, offtopic, other
+  details                  TEXT          NOT NULL  DEFAULT ''               , -- Free-text explanation by the reporter
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  UNIQUE (commentHex, reporterHex)
+);
+
+CREATE INDEX IF NOT EXISTS commentReportsDomainIndex ON commentReports(domain, creationDate);
+
+-- Number of reports that automatically flag a comment, 0 means comments are never flagged automatically
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS reportThreshold INTEGER NOT NULL DEFAULT 3;
@@ -0,0 +1,200 @@
+-- Unified users, replacing separate owners and commenters
+
+CREATE TABLE IF NOT EXISTS users (
+  userHex                  TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  email                    TEXT          NOT NULL  UNIQUE                   ,
+  name                     TEXT          NOT NULL                           ,
+  passwordHash             TEXT          NOT NULL  DEFAULT ''               , -- Empty if the user can't log in with a password
+  confirmedEmail           BOOLEAN       NOT NULL  DEFAULT false            ,
+  websiteUrl               TEXT          NOT NULL  DEFAULT ''               ,
+  avatarUrl                TEXT          NOT NULL  DEFAULT ''               ,
+  joinDate                 TIMESTAMP     NOT NULL
+);
+
+-- Ways a user can log in: 'commento' for the local password, a federated provider name, or 'sso:<domain>'
+
+CREATE TABLE IF NOT EXISTS userIdentities (
+  provider                 TEXT          NOT NULL                           ,
+  email                    TEXT          NOT NULL                           , -- Email reported by the identity provider
+  userHex                  TEXT          NOT NULL                           ,
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  PRIMARY KEY (provider, email)
+);
+
+CREATE INDEX IF NOT EXISTS userIdentitiesUserIndex ON userIdentities(userHex);
+
+-- Sessions of both the admin UI and the embedded comments. 'none' means a session not logged in yet
+
+CREATE TABLE IF NOT EXISTS userSessions (
+  token                    TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  userHex                  TEXT          NOT NULL  DEFAULT 'none'           ,
+  creationDate             TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS userSessionsUserIndex ON userSessions(userHex);
+
+-- Roles users have on domains: 'owner' or 'moderator'
+
+CREATE TABLE IF NOT EXISTS domainUsers (
+  domain                   TEXT          NOT NULL                           ,
+  userHex                  TEXT          NOT NULL                           ,
+  role                     TEXT          NOT NULL                           ,
+  addDate                  TIMESTAMP     NOT NULL                           ,
+  PRIMARY KEY (domain, userHex, role)
+);
+
+CREATE INDEX IF NOT EXISTS domainUsersUserIndex ON domainUsers(userHex);
+
+-- Map every owner and commenter account to a user. Only accounts whose email is proven, i.e. confirmed owners and OAuth
+-- commenters, are merged by email, into a single user whose hex ID is that of the owner account, or else of the earliest
+-- commenter. Local and SSO commenters and unconfirmed owners could have been registered by anyone with any email, so
+-- they stay separate users. Of all the users sharing an email, only the proven one, or else the earliest, keeps it
+
+CREATE TABLE userMigration AS
+  SELECT b.*, FIRST_VALUE(b.userHex) OVER (PARTITION BY b.email ORDER BY b.proven DESC, b.rank, b.joinDate, b.hex) AS emailUserHex
+  FROM (
+    SELECT a.*,
+           CASE WHEN a.proven
+             THEN FIRST_VALUE(a.hex) OVER (PARTITION BY a.email, a.proven ORDER BY a.rank, a.joinDate, a.hex)
+             ELSE a.hex
+           END AS userHex
+    FROM (
+      SELECT ownerHex AS hex, email, name, passwordHash, confirmedEmail::BOOLEAN AS confirmedEmail, '' AS link,
+             '' AS photo, 'commento' AS provider, joinDate, 0 AS rank, confirmedEmail::BOOLEAN AS proven
+        FROM owners
+      UNION ALL
+      SELECT commenterHex, email, name, passwordHash, false, link, photo, provider, joinDate,
+             CASE WHEN provider='commento' THEN 1 ELSE 2 END,
+             provider<>'commento' AND provider NOT LIKE 'sso:%'
+        FROM commenters
+    ) a
+  ) b;
+
+-- Users not keeping their email get a unique placeholder address, which receives no mail. The password hash always
+-- stays with its own account
+
+INSERT INTO users(userHex, email, name, passwordHash, confirmedEmail, websiteUrl, avatarUrl, joinDate)
+  SELECT userHex,
+         CASE WHEN userHex=emailUserHex THEN email ELSE userHex || '@unverified.invalid' END,
+         name, passwordHash, confirmedEmail AND userHex=emailUserHex,
+         CASE WHEN link='undefined' THEN '' ELSE link END,
+         CASE WHEN photo='undefined' THEN '' ELSE photo END,
+         joinDate
+    FROM userMigration
+    WHERE hex=userHex;
+
+-- Fill in the profile details the chosen account lacks from the other merged accounts
+
+UPDATE users u SET websiteUrl=m.link
+  FROM userMigration m
+  WHERE m.userHex=u.userHex AND u.websiteUrl='' AND m.link NOT IN ('', 'undefined');
+
+UPDATE users u SET avatarUrl=m.photo
+  FROM userMigration m
+  WHERE m.userHex=u.userHex AND u.avatarUrl='' AND m.photo NOT IN ('', 'undefined');
+
+-- Identities of users keeping their email take precedence over those of the others sharing it
+
+INSERT INTO userIdentities(provider, email, userHex, creationDate)
+  SELECT provider, email, userHex, MIN(joinDate)
+    FROM userMigration
+    WHERE userHex=emailUserHex
+    GROUP BY provider, email, userHex
+  ON CONFLICT DO NOTHING;
+
+-- Users not keeping their email sign in under their placeholder address instead. Their former email is remembered, so
+-- that they can still sign in with it and their own password
+
+INSERT INTO userIdentities(provider, email, userHex, creationDate)
+  SELECT provider, userHex || '@unverified.invalid', userHex, MIN(joinDate)
+    FROM userMigration
+    WHERE userHex<>emailUserHex
+    GROUP BY provider, userHex
+  ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS userFormerEmails (
+  userHex                  TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  email                    TEXT          NOT NULL                             -- Email the user had to give up to another user
+);
+
+CREATE INDEX IF NOT EXISTS userFormerEmailsEmailIndex ON userFormerEmails(email);
+
+INSERT INTO userFormerEmails(userHex, email)
+  SELECT DISTINCT userHex, email
+    FROM userMigration
+    WHERE userHex<>emailUserHex;
+
+-- Moderators who haven't registered yet become users without any identity, until their roles are turned into invitations
+
+INSERT INTO users(userHex, email, name, joinDate)
+  SELECT md5(random()::TEXT) || md5(random()::TEXT), email, split_part(email, '@', 1), MIN(addDate)
+    FROM moderators
+    WHERE email NOT IN (SELECT email FROM users)
+    GROUP BY email;
+
+INSERT INTO domainUsers(domain, userHex, role, addDate)
+  SELECT d.domain, m.userHex, 'owner', d.creationDate
+    FROM domains d
+    JOIN userMigration m ON m.hex=d.ownerHex
+  UNION ALL
+  SELECT o.domain, u.userHex, 'moderator', o.addDate
+    FROM moderators o
+    JOIN users u ON u.email=o.email;
+
+-- Sessions and tokens
+
+INSERT INTO userSessions(token, userHex, creationDate)
+  SELECT s.ownerToken, m.userHex, s.loginDate
+    FROM ownerSessions s
+    JOIN userMigration m ON m.hex=s.ownerHex
+  UNION ALL
+  SELECT s.commenterToken, COALESCE(m.userHex, 'none'), s.creationDate
+    FROM commenterSessions s
+    LEFT JOIN userMigration m ON m.hex=s.commenterHex
+  ON CONFLICT DO NOTHING;
+
+UPDATE ownerConfirmHexes c SET ownerHex=m.userHex FROM userMigration m WHERE m.hex=c.ownerHex;
+UPDATE resetHexes r SET hex=m.userHex FROM userMigration m WHERE m.hex=r.hex;
+
+-- References to merged accounts. Votes and reports are unique per user, so drop those duplicated by merging, keeping
+-- the ones of the chosen account or else of the lowest hex ID
+
+WITH d AS (
+  DELETE FROM votes v
+    USING userMigration m
+    WHERE m.hex=v.commenterHex AND m.hex<>m.userHex AND EXISTS (
+      SELECT 1 FROM votes w JOIN userMigration n ON n.hex=w.commenterHex
+        WHERE w.commentHex=v.commentHex AND n.userHex=m.userHex AND (n.hex=n.userHex OR n.hex<m.hex)
+    )
+    RETURNING v.commentHex, v.direction
+)
+UPDATE comments c SET score=c.score-s.total
+  FROM (SELECT commentHex, SUM(direction) AS total FROM d GROUP BY commentHex) s
+  WHERE s.commentHex=c.commentHex;
+
+DELETE FROM commentReports r
+  USING userMigration m
+  WHERE m.hex=r.reporterHex AND m.hex<>m.userHex AND EXISTS (
+    SELECT 1 FROM commentReports q JOIN userMigration n ON n.hex=q.reporterHex
+      WHERE q.commentHex=r.commentHex AND n.userHex=m.userHex AND (n.hex=n.userHex OR n.hex<m.hex)
+  );
+
+UPDATE votes v SET commenterHex=m.userHex FROM userMigration m WHERE m.hex=v.commenterHex AND m.hex<>m.userHex;
+UPDATE commentReports r SET reporterHex=m.userHex FROM userMigration m WHERE m.hex=r.reporterHex AND m.hex<>m.userHex;
+UPDATE comments c SET commenterHex=m.userHex FROM userMigration m WHERE m.hex=c.commenterHex AND m.hex<>m.userHex;
+UPDATE comments c SET deleterHex=m.userHex FROM userMigration m WHERE m.hex=c.deleterHex AND m.hex<>m.userHex;
+UPDATE commentRevisions r SET editorHex=m.userHex FROM userMigration m WHERE m.hex=r.editorHex AND m.hex<>m.userHex;
+UPDATE views v SET commenterHex=m.userHex FROM userMigration m WHERE m.hex=v.commenterHex AND m.hex<>m.userHex;
+UPDATE bans b SET commenterHex=m.userHex FROM userMigration m WHERE m.hex=b.commenterHex AND m.hex<>m.userHex;
+UPDATE bans b SET creatorHex=m.userHex FROM userMigration m WHERE m.hex=b.creatorHex AND m.hex<>m.userHex;
+
+-- Drop the old tables
+
+DROP TABLE userMigration;
+DROP TABLE ownerSessions;
+DROP TABLE commenterSessions;
+DROP TABLE moderators;
+DROP TABLE owners;
+DROP TABLE commenters;
+
+ALTER TABLE domains DROP COLUMN IF EXISTS ownerHex;
@@ -0,0 +1,32 @@
+-- TOTP (RFC 6238) two-factor authentication
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totpSecret   TEXT    NOT NULL DEFAULT '';    -- Base32-encoded secret, set on enrolment
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totpEnabled  BOOLEAN NOT NULL DEFAULT false; -- Whether the enrolment has been confirmed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totpLastStep BIGINT  NOT NULL DEFAULT 0;     -- Last time step a code was accepted for
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totpFailures INTEGER NOT NULL DEFAULT 0;     -- Number of wrong codes submitted in a row
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totpLockedUntil TIMESTAMP;                  -- Time until which no code is accepted
+
+-- One-time codes for signing in without the authenticator app
+
+CREATE TABLE IF NOT EXISTS userRecoveryCodes (
+  userHex                  TEXT          NOT NULL                           ,
+  codeHash                 TEXT          NOT NULL                           , -- SHA-256 hash of the code
+  PRIMARY KEY (userHex, codeHash)
+);
+
+-- Sign-ins waiting for the second step, after the password has been verified
+
+CREATE TABLE IF NOT EXISTS totpChallenges (
+  token                    TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  userHex                  TEXT          NOT NULL                           ,
+  attempts                 INTEGER       NOT NULL  DEFAULT 0                , -- Number of wrong codes submitted
+  creationDate             TIMESTAMP     NOT NULL
+);
+
+-- Whether the session has been signed in with a second factor
+
+ALTER TABLE userSessions ADD COLUMN IF NOT EXISTS totpVerified BOOLEAN NOT NULL DEFAULT false;
+
+-- Whether moderators of the domain must sign in with a second factor
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS requireModerator2fa BOOLEAN NOT NULL DEFAULT false;
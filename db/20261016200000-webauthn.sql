@@ -0,0 +1,21 @@
+-- WebAuthn credentials (passkeys) of users
+
+CREATE TABLE IF NOT EXISTS userWebauthnCredentials (
+  credentialId             TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Base64url-encoded credential ID
+  userHex                  TEXT          NOT NULL                           ,
+  name                     TEXT          NOT NULL                           , -- User-given name of the authenticator
+  publicKey                BYTEA         NOT NULL                           , -- PKIX-encoded public key
+  signCount                BIGINT        NOT NULL  DEFAULT 0                , -- Signature counter last reported
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  lastUsedDate             TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS userWebauthnCredentialsUserIndex ON userWebauthnCredentials(userHex);
+
+-- Registration and sign-in ceremonies in progress
+
+CREATE TABLE IF NOT EXISTS webauthnChallenges (
+  challenge                TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Base64url-encoded challenge
+  userHex                  TEXT          NOT NULL  DEFAULT ''               , -- User registering a credential, empty for a sign-in
+  creationDate             TIMESTAMP     NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Generic OpenID Connect identity providers enabled for the domain, such as 'oidc:keycloak'
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS oidcProviders TEXT[] NOT NULL DEFAULT '{}';
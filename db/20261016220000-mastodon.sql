@@ -0,0 +1,12 @@
+-- Client apps registered with Mastodon-compatible instances
+
+CREATE TABLE IF NOT EXISTS mastodonApps (
+  instance                 TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Host name of the instance
+  clientId                 TEXT          NOT NULL                           ,
+  clientSecret             TEXT          NOT NULL                           ,
+  creationDate             TIMESTAMP     NOT NULL
+);
+
+-- Whether the domain allows signing in via Mastodon-compatible instances
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS mastodonProvider BOOLEAN NOT NULL DEFAULT false;
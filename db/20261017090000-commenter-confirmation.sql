@@ -0,0 +1,3 @@
+-- Whether comments by locally registered commenters who haven't confirmed their email yet require moderation
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS moderateUnconfirmed BOOLEAN NOT NULL DEFAULT false;
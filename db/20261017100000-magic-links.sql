@@ -0,0 +1,10 @@
+-- Emailed one-time sign-in links
+
+CREATE TABLE IF NOT EXISTS magicLinks (
+  token                    TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Keyed hash of the link's token, or of the request token until bound
+  email                    TEXT          NOT NULL                           , -- Email the link has been sent to
+  name                     TEXT          NOT NULL                           , -- Name to sign up with, if there's no user with that email yet
+  sessionHex               TEXT          NOT NULL                           , -- Public ID of the commenter session to sign in
+  nonce                    TEXT          NOT NULL                           , -- Keyed hash of the nonce of the browser the link is bound to, empty until bound
+  creationDate             TIMESTAMP     NOT NULL
+);
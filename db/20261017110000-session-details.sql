@@ -0,0 +1,12 @@
+-- Session details, allowing users to review their sessions and sessions to expire
+
+ALTER TABLE userSessions ADD COLUMN IF NOT EXISTS sessionHex TEXT NOT NULL DEFAULT md5(random()::TEXT) || md5(random()::TEXT); -- Public session ID
+ALTER TABLE userSessions ALTER COLUMN sessionHex DROP DEFAULT;
+ALTER TABLE userSessions ADD COLUMN IF NOT EXISTS lastSeenDate TIMESTAMP;
+ALTER TABLE userSessions ADD COLUMN IF NOT EXISTS userAgent TEXT NOT NULL DEFAULT '';
+ALTER TABLE userSessions ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+
+UPDATE userSessions SET lastSeenDate=creationDate WHERE lastSeenDate IS NULL;
+ALTER TABLE userSessions ALTER COLUMN lastSeenDate SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS userSessionsSessionHexIndex ON userSessions(sessionHex);
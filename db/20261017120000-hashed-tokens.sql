@@ -0,0 +1,6 @@
+-- Tokens are persisted as keyed hashes from now on. Pending email confirmations and password resets are short-lived, so
+-- they're simply invalidated. Sessions and unsubscribe tokens are rehashed by the accompanying Go migration, since the
+-- key is only known to the application
+
+DELETE FROM ownerConfirmHexes;
+DELETE FROM resetHexes;
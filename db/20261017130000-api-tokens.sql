@@ -0,0 +1,14 @@
+-- Personal API tokens of owners, for automating domain management. Only keyed hashes of the tokens are stored
+
+CREATE TABLE IF NOT EXISTS apiTokens (
+  tokenHash                TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  tokenHex                 TEXT          NOT NULL  UNIQUE                   , -- Public ID of the token
+  userHex                  TEXT          NOT NULL                           ,
+  name                     TEXT          NOT NULL                           ,
+  scope                    TEXT          NOT NULL                           , -- 'stats', 'moderation', or 'admin'
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  expiryDate               TIMESTAMP     NOT NULL                           ,
+  lastUsedDate             TIMESTAMP                                          -- Null if the token has never been used
+);
+
+CREATE INDEX IF NOT EXISTS apiTokensUserIndex ON apiTokens(userHex);
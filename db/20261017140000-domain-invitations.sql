@@ -0,0 +1,15 @@
+-- Emailed invitations to take a role in a domain. Only keyed hashes of the tokens are stored
+
+CREATE TABLE IF NOT EXISTS domainInvitations (
+  invitationHex            TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  tokenHash                TEXT          NOT NULL  UNIQUE                   ,
+  domain                   TEXT          NOT NULL                           ,
+  email                    TEXT          NOT NULL                           , -- Email the invitation has been sent to
+  role                     TEXT          NOT NULL                           , -- Role to grant once accepted
+  inviterHex               TEXT          NOT NULL                           ,
+  creationDate             TIMESTAMP     NOT NULL                           ,
+  status                   TEXT          NOT NULL  DEFAULT 'pending'        , -- 'pending', 'accepted', or 'revoked'
+  statusDate               TIMESTAMP                                          -- When the invitation was accepted or revoked
+);
+
+CREATE INDEX IF NOT EXISTS domainInvitationsDomainIndex ON domainInvitations(domain);
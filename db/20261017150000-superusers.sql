@@ -0,0 +1,13 @@
+-- Instance administration
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS superuser BOOLEAN NOT NULL DEFAULT false; -- Whether the user administers the whole instance
+ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended BOOLEAN NOT NULL DEFAULT false; -- Whether the user is barred from signing in
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS adminFrozen BOOLEAN NOT NULL DEFAULT false; -- Whether the domain has been frozen by a superuser, which its owners can't undo
+
+-- Email domains allowed to sign up as owners. An empty list allows any email domain
+
+CREATE TABLE IF NOT EXISTS signupDomains (
+  emailDomain              TEXT          NOT NULL  UNIQUE  PRIMARY KEY      ,
+  addDate                  TIMESTAMP     NOT NULL
+);
@@ -0,0 +1,8 @@
+-- Domain ownership verification
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS verificationToken TEXT NOT NULL DEFAULT ''; -- Token to publish to prove the domain ownership, empty if exempt
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT false;    -- Whether the domain ownership has been proven
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS verificationCheckDate TIMESTAMP;             -- When the ownership proof was last checked
+
+-- Domains registered before ownership verification was introduced are trusted, and exempt from rechecks
+UPDATE domains SET verified = true;
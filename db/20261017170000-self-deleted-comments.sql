@@ -0,0 +1,3 @@
+-- Comments deleted by their authors must not be restorable, so discard their retained text
+
+UPDATE comments SET deletedMarkdown = NULL WHERE deleted = true AND deleterHex = commenterHex;
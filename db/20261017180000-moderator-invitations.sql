@@ -0,0 +1,25 @@
+-- Moderators added by email before invitations existed are placeholder users without any identity, password, or
+-- comment, whom anyone signing up with that email could claim. Turn their roles into pending invitations instead. No
+-- token has been mailed for these, so the owner has to invite them anew
+
+CREATE TABLE placeholderModerators AS
+  SELECT u.userHex, u.email
+    FROM users u
+    WHERE u.passwordHash=''
+      AND EXISTS (SELECT 1 FROM domainUsers du WHERE du.userHex=u.userHex AND du.role='moderator')
+      AND NOT EXISTS (SELECT 1 FROM domainUsers du WHERE du.userHex=u.userHex AND du.role<>'moderator')
+      AND NOT EXISTS (SELECT 1 FROM userIdentities i WHERE i.userHex=u.userHex)
+      AND NOT EXISTS (SELECT 1 FROM comments c WHERE c.commenterHex=u.userHex);
+
+INSERT INTO domainInvitations(invitationHex, tokenHash, domain, email, role, inviterHex, creationDate, status)
+  SELECT md5(random()::TEXT) || md5(random()::TEXT), md5(random()::TEXT) || md5(random()::TEXT), du.domain, p.email,
+         du.role, COALESCE((SELECT MIN(o.userHex) FROM domainUsers o WHERE o.domain=du.domain AND o.role='owner'), 'none'),
+         du.addDate, 'pending'
+    FROM domainUsers du
+    JOIN placeholderModerators p ON p.userHex=du.userHex;
+
+DELETE FROM domainUsers du USING placeholderModerators p WHERE p.userHex=du.userHex;
+
+DELETE FROM users u USING placeholderModerators p WHERE p.userHex=u.userHex;
+
+DROP TABLE placeholderModerators;
@@ -0,0 +1,8 @@
+-- When the domain ownership was first proven. Domains whose ownership has ever been proven are never released, even if
+-- the proof goes missing later
+
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS verifiedDate TIMESTAMP;
+
+-- Domains that are verified now, or have ever accepted comments, must have been verified at some point
+UPDATE domains SET verifiedDate = COALESCE(verificationCheckDate, creationDate)
+  WHERE verified OR verificationToken = '' OR EXISTS (SELECT 1 FROM comments c WHERE c.domain=domains.domain);
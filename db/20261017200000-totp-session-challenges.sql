@@ -0,0 +1,4 @@
+-- Sign-ins via a federated identity provider or an emailed link sign an existing session in, which then has to wait for
+-- the second step, too
+
+ALTER TABLE totpChallenges ADD COLUMN IF NOT EXISTS sessionHex TEXT NOT NULL DEFAULT ''; -- Session to sign in once the code is verified, if any
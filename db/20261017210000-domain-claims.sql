@@ -0,0 +1,12 @@
+-- Claims of domains already pending verification by someone else. Whoever proves the ownership first gets the domain
+
+CREATE TABLE IF NOT EXISTS domainClaims (
+  domain                   TEXT          NOT NULL                           , -- Domain being claimed
+  ownerHex                 TEXT          NOT NULL                           , -- User claiming the domain
+  name                     TEXT          NOT NULL                           , -- Name to give the domain once claimed
+  verificationToken        TEXT          NOT NULL                           , -- Token to publish to prove the domain ownership
+  creationDate             TIMESTAMP     NOT NULL                           , -- When the claim has been made
+  PRIMARY KEY (domain, ownerHex)
+);
+
+CREATE INDEX IF NOT EXISTS domainClaimsOwnerHexIndex ON domainClaims(ownerHex);
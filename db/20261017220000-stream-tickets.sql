@@ -0,0 +1,9 @@
+-- Single-use tickets for opening comment event streams, so that session tokens aren't passed in URLs
+
+CREATE TABLE IF NOT EXISTS streamTickets (
+  ticket                   TEXT          NOT NULL  UNIQUE  PRIMARY KEY      , -- Keyed hash of the ticket
+  sessionHex               TEXT          NOT NULL                           , -- Public ID of the commenter session the ticket belongs to
+  creationDate             TIMESTAMP     NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS streamTicketsCreationDateIndex ON streamTickets(creationDate);
@@ -1,46 +1,48 @@
 -- Clean up all existing data (except migrations)
-delete from commenters;
-delete from commentersessions;
 delete from comments;
 delete from config;
 delete from domains;
+delete from domainusers;
 delete from emails;
 delete from exports;
-delete from moderators;
 delete from ownerconfirmhexes;
-delete from owners;
-delete from ownersessions;
 delete from pages;
 delete from resethexes;
 delete from ssotokens;
+delete from useridentities;
+delete from users;
+delete from usersessions;
 delete from views;
 delete from votes;
 
 -- Insert seed test data
-insert into owners(ownerhex, email, name, passwordhash, confirmedemail, joindate)
+insert into users(userhex, email, name, passwordhash, confirmedemail, websiteurl, avatarurl, joindate)
     values
-        ('0000000000000000000000000000000000000000000000000000000000000001', 'ace@comentario.app', 'Captain Ace', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', 'true', '2023-01-17 17:55:47.008851'),
-        ('0000000000000000000000000000000000000000000000000000000000000002', 'king@comentario.app', 'Engineer King', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', 'true', '2023-01-17 17:55:47.008851'),
-        ('0000000000000000000000000000000000000000000000000000000000000003', 'queen@comentario.app', 'Cook Queen', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', 'true', '2023-01-17 17:55:47.008851'),
-        ('0000000000000000000000000000000000000000000000000000000000000004', 'jack@comentario.app', 'Navigator Jack', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', 'true', '2023-01-17 17:55:47.008851');
+        ('0000000000000000000000000000000000000000000000000000000000001001', 'ace@comentario.app', 'Captain Ace', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', true, '', '', '2023-01-17 18:23:43.604399'),
+        ('0000000000000000000000000000000000000000000000000000000000001002', 'king@comentario.app', 'Engineer King', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', true, '', '', '2023-01-17 18:23:43.604399'),
+        ('0000000000000000000000000000000000000000000000000000000000001003', 'queen@comentario.app', 'Cook Queen', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', true, '', '', '2023-01-17 18:23:43.604399'),
+        ('0000000000000000000000000000000000000000000000000000000000001004', 'jack@comentario.app', 'Navigator Jack', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu', true, '', '', '2023-01-17 18:23:43.604399'),
+        ('0000000000000000000000000000000000000000000000000000000000001010', 'one@blog.com', 'Commenter One', '$2a$10$3w4LEMCh1iKwJC2uMGCP0eb0BRULg77KmnZuvnlGBMs4ALDbJ5Syy', false, '', '', '2023-01-18 16:52:04.541982'),
+        ('0000000000000000000000000000000000000000000000000000000000001011', 'two@blog.com', 'Commenter Two', '$2a$10$3w4LEMCh1iKwJC2uMGCP0eb0BRULg77KmnZuvnlGBMs4ALDbJ5Syy', false, 'https://wikipedia.org/', '', '2023-01-18 16:52:04.541982'),
+        ('0000000000000000000000000000000000000000000000000000000000001000', 'root@comentario.app', 'root', '', false, '', '', '2023-01-17 17:56:10.968427');
 
-insert into commenters (commenterhex, email, name, link, photo, provider, joindate, state, passwordhash)
+insert into useridentities(provider, email, userhex, creationdate)
     values
-        ('0000000000000000000000000000000000000000000000000000000000001001', 'ace@comentario.app', 'Captain Ace', 'undefined', 'undefined', 'commento', '2023-01-17 18:23:43.604399', 'ok', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu'),
-        ('0000000000000000000000000000000000000000000000000000000000001002', 'king@comentario.app', 'Engineer King', 'undefined', 'undefined', 'commento', '2023-01-17 18:23:43.604399', 'ok', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu'),
-        ('0000000000000000000000000000000000000000000000000000000000001003', 'queen@comentario.app', 'Cook Queen', 'undefined', 'undefined', 'commento', '2023-01-17 18:23:43.604399', 'ok', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu'),
-        ('0000000000000000000000000000000000000000000000000000000000001004', 'jack@comentario.app', 'Navigator Jack', 'undefined', 'undefined', 'commento', '2023-01-17 18:23:43.604399', 'ok', '$2a$10$NRp62h1E765Rh.VqMfvz2OS9EG92v/BReep4NJbVa7PEKYTWAAJPu'),
-        ('0000000000000000000000000000000000000000000000000000000000001010', 'one@blog.com', 'Commenter One', 'undefined', 'undefined', 'commento', '2023-01-18 16:52:04.541982', 'ok', '$2a$10$3w4LEMCh1iKwJC2uMGCP0eb0BRULg77KmnZuvnlGBMs4ALDbJ5Syy'),
-        ('0000000000000000000000000000000000000000000000000000000000001011', 'two@blog.com', 'Commenter Two', 'https://wikipedia.org/', 'undefined', 'commento', '2023-01-18 16:52:04.541982', 'ok', '$2a$10$3w4LEMCh1iKwJC2uMGCP0eb0BRULg77KmnZuvnlGBMs4ALDbJ5Syy');
+        ('commento', 'ace@comentario.app', '0000000000000000000000000000000000000000000000000000000000001001', '2023-01-17 18:23:43.604399'),
+        ('commento', 'king@comentario.app', '0000000000000000000000000000000000000000000000000000000000001002', '2023-01-17 18:23:43.604399'),
+        ('commento', 'queen@comentario.app', '0000000000000000000000000000000000000000000000000000000000001003', '2023-01-17 18:23:43.604399'),
+        ('commento', 'jack@comentario.app', '0000000000000000000000000000000000000000000000000000000000001004', '2023-01-17 18:23:43.604399'),
+        ('commento', 'one@blog.com', '0000000000000000000000000000000000000000000000000000000000001010', '2023-01-18 16:52:04.541982'),
+        ('commento', 'two@blog.com', '0000000000000000000000000000000000000000000000000000000000001011', '2023-01-18 16:52:04.541982');
 
-insert into domains(domain, ownerhex, name, creationdate, state, importedcomments, autospamfilter,
+insert into domains(domain, name, creationdate, state, importedcomments, autospamfilter,
                     requiremoderation, requireidentification, viewsthismonth, moderateallanonymous,
                     emailnotificationpolicy, commentoprovider, googleprovider, twitterprovider, githubprovider,
-                    gitlabprovider, ssoprovider, ssosecret, ssourl, defaultsortpolicy)
+                    gitlabprovider, ssoprovider, ssosecret, ssourl, defaultsortpolicy, verified)
     values
-        ('localhost:8000', '0000000000000000000000000000000000000000000000000000000000000001', 'Test Domain',
+        ('localhost:8000', 'Test Domain',
          '2023-01-17 17:56:10.966890', 'unfrozen', 'false', true, false, false, 0, false, 'pending-moderation', true, true,
-         true, true, true, false, '', '', 'score-desc');
+         true, true, true, false, '', '', 'score-desc', true);
 
 insert into emails(email, unsubscribesecrethex, lastemailnotificationdate, pendingemails, sendreplynotifications, sendmoderatornotifications)
     values
@@ -51,10 +53,11 @@ insert into emails(email, unsubscribesecrethex, lastemailnotificationdate, pendi
         ('one@blog.com', '2690cab8b021140dfb7d6a56ac60ac49cae3e4706a2e90b4b5645584f59451c7', '2023-01-18 16:52:04.448105', 0, false, true),
         ('two@blog.com', '2690cab8b021140dfb7d6a56ac60ac49cae3e4706a2e90b4b5645584f59451c8', '2023-01-18 16:52:04.448105', 0, false, true);
 
-insert into moderators(domain, email, adddate)
+insert into domainusers(domain, userhex, role, adddate)
     values
-        ('localhost:8000', 'root@comentario.app', '2023-01-17 17:56:10.968427'),
-        ('localhost:8000', 'ace@comentario.app', '2023-02-21 12:11:33.329872');
+        ('localhost:8000', '0000000000000000000000000000000000000000000000000000000000001001', 'owner', '2023-01-17 17:56:10.966890'),
+        ('localhost:8000', '0000000000000000000000000000000000000000000000000000000000001000', 'moderator', '2023-01-17 17:56:10.968427'),
+        ('localhost:8000', '0000000000000000000000000000000000000000000000000000000000001001', 'moderator', '2023-02-21 12:11:33.329872');
 
 insert into pages(domain, path, islocked, commentcount, stickycommenthex, title)
     values
@@ -14,6 +14,7 @@ export interface ApiCommentListResponse {
     commenters:            Commenter[];
     configuredOauths:      { [k: string]: boolean };
     defaultSortPolicy:     SortPolicy;
+    nextCursor?:           string;
 }
 
 export interface ApiCommentNewResponse {
@@ -37,4 +38,6 @@ export interface ApiCommenterLoginResponse {
     commenterToken: string;
     commenter:      Commenter;
     email:          Email;
+    totpRequired?:  boolean;
+    loginToken?:    string;
 }
@@ -647,6 +647,15 @@ export class Comentario {
             this.setError();
             r = await this.apiClient.post<ApiCommenterLoginResponse>('commenter/login', undefined, {email, password});
 
+            // If the commenter has two-factor authentication enabled, ask for the code
+            if (r.totpRequired) {
+                const code = prompt('Enter the code from your authenticator app, or a recovery code:');
+                if (!code) {
+                    return;
+                }
+                r = await this.apiClient.post<ApiCommenterLoginResponse>('commenter/login/totp', undefined, {loginToken: r.loginToken, code});
+            }
+
         } catch (e) {
             this.setError(e);
             throw e;
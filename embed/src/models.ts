@@ -5,6 +5,9 @@ export interface Comment {
     readonly commenterHex: string;
     readonly parentHex:    string;
     readonly creationDate: string;
+    readonly replyCount?:  number;
+    readonly edited?:      boolean;
+    readonly editCount?:   number;
 
     // Mutable
     state:     'approved' | 'unapproved' | 'flagged';
@@ -7,6 +7,7 @@ import (
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
 	"net/http"
+	"strings"
 )
 
 // AuthCommenterByTokenHeader determines if the commenter token, contained in the X-Commenter-Token header, checks out
@@ -18,9 +19,45 @@ func AuthCommenterByTokenHeader(headerValue string) (data.Principal, error) {
 			return &data.AnonymousCommenter, nil
 		}
 
-		// Try to find the commenter by that token
-		if commenter, err := svc.TheUserService.FindCommenterByToken(token); err == nil {
-			return commenter, nil
+		// Try to find the user by that token
+		if user, err := svc.TheUserService.FindUserBySession(token); err == nil {
+			return user, nil
+		}
+	}
+
+	// Authentication failed
+	return nil, ErrUnauthorised
+}
+
+// AuthCommenterByStreamTicket determines if the stream ticket, contained in the ticket query parameter, checks out. The
+// anonymous commenter's ID is also accepted in place of a ticket
+func AuthCommenterByStreamTicket(paramValue string) (data.Principal, error) {
+	// Validate the ticket format
+	if ticket := models.HexID(paramValue); ticket.Validate(nil) == nil {
+		// If it's an anonymous commenter
+		if ticket == data.AnonymousCommenter.HexID {
+			return &data.AnonymousCommenter, nil
+		}
+
+		// Try to find the user by that ticket
+		if user, err := svc.TheUserService.FindUserByStreamTicket(ticket); err == nil {
+			return user, nil
+		}
+	}
+
+	// Authentication failed
+	return nil, ErrUnauthorised
+}
+
+// AuthOwnerByAPIToken determines if the API token, contained in the Authorization header as a bearer token, checks out
+func AuthOwnerByAPIToken(headerValue string) (data.Principal, error) {
+	// Validate the header and token format
+	if s, ok := strings.CutPrefix(headerValue, "Bearer "); ok {
+		if token := models.HexID(s); token.Validate(nil) == nil {
+			// Try to find the user by that token
+			if user, err := svc.TheUserService.FindUserByAPIToken(token); err == nil {
+				return user, nil
+			}
 		}
 	}
 
@@ -37,15 +74,15 @@ func AuthOwnerByCookieHeader(headerValue string) (data.Principal, error) {
 
 	// Check if there's a token cookie
 	if token := handlers.ExtractOwnerTokenFromCookie(r); token != "" {
-		if owner, err := svc.TheUserService.FindOwnerByToken(token); err == nil {
-			return owner, nil
+		if user, err := svc.TheUserService.FindOwnerBySession(token); err == nil {
+			return user, nil
 		}
 	}
 
 	// Check if there's a token cookie
 	if cookie, err := r.Cookie(util.CookieNameUserToken); err == nil {
-		if owner, err := svc.TheUserService.FindOwnerByToken(models.HexID(cookie.Value)); err == nil {
-			return owner, nil
+		if user, err := svc.TheUserService.FindOwnerBySession(models.HexID(cookie.Value)); err == nil {
+			return user, nil
 		}
 	}
 
@@ -47,6 +47,7 @@ func configureAPI(api *operations.ComentarioAPI) http.Handler {
 	api.JSONProducer = runtime.JSONProducer()
 	api.GzipProducer = runtime.ByteStreamProducer()
 	api.HTMLProducer = runtime.TextProducer()
+	api.TextEventStreamProducer = runtime.TextProducer() // Event streams are written directly by the handler
 	api.UrlformConsumer = runtime.DiscardConsumer
 
 	// Use a more strict email validator than the default, RFC5322-compliant one
@@ -70,31 +71,68 @@ func configureAPI(api *operations.ComentarioAPI) http.Handler {
 
 	// Set up auth handlers
 	api.CommenterTokenHeaderAuth = AuthCommenterByTokenHeader
+	api.OwnerAPITokenAuth = AuthOwnerByAPIToken
 	api.OwnerCookieAuth = AuthOwnerByCookieHeader
+	api.StreamTicketQueryAuth = AuthCommenterByStreamTicket
 
+	// Admin
+	api.AdminDomainFreezeHandler = operations.AdminDomainFreezeHandlerFunc(handlers.AdminDomainFreeze)
+	api.AdminDomainListHandler = operations.AdminDomainListHandlerFunc(handlers.AdminDomainList)
+	api.AdminDomainOwnerReassignHandler = operations.AdminDomainOwnerReassignHandlerFunc(handlers.AdminDomainOwnerReassign)
+	api.AdminSignupDomainDeleteHandler = operations.AdminSignupDomainDeleteHandlerFunc(handlers.AdminSignupDomainDelete)
+	api.AdminSignupDomainListHandler = operations.AdminSignupDomainListHandlerFunc(handlers.AdminSignupDomainList)
+	api.AdminSignupDomainNewHandler = operations.AdminSignupDomainNewHandlerFunc(handlers.AdminSignupDomainNew)
+	api.AdminStatsHandler = operations.AdminStatsHandlerFunc(handlers.AdminStats)
+	api.AdminUserListHandler = operations.AdminUserListHandlerFunc(handlers.AdminUserList)
+	api.AdminUserSuspendHandler = operations.AdminUserSuspendHandlerFunc(handlers.AdminUserSuspend)
 	// Comment
 	api.CommentApproveHandler = operations.CommentApproveHandlerFunc(handlers.CommentApprove)
 	api.CommentCountHandler = operations.CommentCountHandlerFunc(handlers.CommentCount)
 	api.CommentDeleteHandler = operations.CommentDeleteHandlerFunc(handlers.CommentDelete)
 	api.CommentEditHandler = operations.CommentEditHandlerFunc(handlers.CommentEdit)
+	api.CommentHistoryHandler = operations.CommentHistoryHandlerFunc(handlers.CommentHistory)
 	api.CommentListHandler = operations.CommentListHandlerFunc(handlers.CommentList)
+	api.CommentModerationBulkHandler = operations.CommentModerationBulkHandlerFunc(handlers.CommentModerationBulk)
+	api.CommentModerationListHandler = operations.CommentModerationListHandlerFunc(handlers.CommentModerationList)
 	api.CommentNewHandler = operations.CommentNewHandlerFunc(handlers.CommentNew)
+	api.CommentReportHandler = operations.CommentReportHandlerFunc(handlers.CommentReport)
+	api.CommentReportListHandler = operations.CommentReportListHandlerFunc(handlers.CommentReportList)
+	api.CommentRestoreHandler = operations.CommentRestoreHandlerFunc(handlers.CommentRestore)
+	api.CommentStreamHandler = operations.CommentStreamHandlerFunc(handlers.CommentStream)
+	api.CommentStreamTicketHandler = operations.CommentStreamTicketHandlerFunc(handlers.CommentStreamTicket)
 	api.CommentVoteHandler = operations.CommentVoteHandlerFunc(handlers.CommentVote)
 	// Commenter
+	api.CommenterConfirmHexHandler = operations.CommenterConfirmHexHandlerFunc(handlers.CommenterConfirmHex)
+	api.CommenterConfirmResendHandler = operations.CommenterConfirmResendHandlerFunc(handlers.CommenterConfirmResend)
 	api.CommenterLoginHandler = operations.CommenterLoginHandlerFunc(handlers.CommenterLogin)
+	api.CommenterLoginTotpHandler = operations.CommenterLoginTotpHandlerFunc(handlers.CommenterLoginTotp)
 	api.CommenterLogoutHandler = operations.CommenterLogoutHandlerFunc(handlers.CommenterLogout)
+	api.CommenterMagicLinkBindHandler = operations.CommenterMagicLinkBindHandlerFunc(handlers.CommenterMagicLinkBind)
+	api.CommenterMagicLinkLoginHandler = operations.CommenterMagicLinkLoginHandlerFunc(handlers.CommenterMagicLinkLogin)
+	api.CommenterMagicLinkLoginPageHandler = operations.CommenterMagicLinkLoginPageHandlerFunc(handlers.CommenterMagicLinkLoginPage)
+	api.CommenterMagicLinkNewHandler = operations.CommenterMagicLinkNewHandlerFunc(handlers.CommenterMagicLinkNew)
 	api.CommenterNewHandler = operations.CommenterNewHandlerFunc(handlers.CommenterNew)
 	api.CommenterPhotoHandler = operations.CommenterPhotoHandlerFunc(handlers.CommenterPhoto)
 	api.CommenterSelfHandler = operations.CommenterSelfHandlerFunc(handlers.CommenterSelf)
+	api.CommenterSessionDeleteHandler = operations.CommenterSessionDeleteHandlerFunc(handlers.CommenterSessionDelete)
+	api.CommenterSessionTotpHandler = operations.CommenterSessionTotpHandlerFunc(handlers.CommenterSessionTotp)
+	api.CommenterSessionsHandler = operations.CommenterSessionsHandlerFunc(handlers.CommenterSessions)
+	api.CommenterSessionsDeleteOthersHandler = operations.CommenterSessionsDeleteOthersHandlerFunc(handlers.CommenterSessionsDeleteOthers)
 	api.CommenterTokenNewHandler = operations.CommenterTokenNewHandlerFunc(handlers.CommenterTokenNew)
 	api.CommenterUpdateHandler = operations.CommenterUpdateHandlerFunc(handlers.CommenterUpdate)
 	// Domain
+	api.DomainBanDeleteHandler = operations.DomainBanDeleteHandlerFunc(handlers.DomainBanDelete)
+	api.DomainBanListHandler = operations.DomainBanListHandlerFunc(handlers.DomainBanList)
+	api.DomainBanNewHandler = operations.DomainBanNewHandlerFunc(handlers.DomainBanNew)
 	api.DomainClearHandler = operations.DomainClearHandlerFunc(handlers.DomainClear)
 	api.DomainDeleteHandler = operations.DomainDeleteHandlerFunc(handlers.DomainDelete)
+	api.DomainDeletedPurgeHandler = operations.DomainDeletedPurgeHandlerFunc(handlers.DomainDeletedPurge)
 	api.DomainExportBeginHandler = operations.DomainExportBeginHandlerFunc(handlers.DomainExportBegin)
 	api.DomainExportDownloadHandler = operations.DomainExportDownloadHandlerFunc(handlers.DomainExportDownload)
 	api.DomainImportCommentoHandler = operations.DomainImportCommentoHandlerFunc(handlers.DomainImportCommento)
 	api.DomainImportDisqusHandler = operations.DomainImportDisqusHandlerFunc(handlers.DomainImportDisqus)
+	api.DomainInvitationListHandler = operations.DomainInvitationListHandlerFunc(handlers.DomainInvitationList)
+	api.DomainInvitationRevokeHandler = operations.DomainInvitationRevokeHandlerFunc(handlers.DomainInvitationRevoke)
 	api.DomainListHandler = operations.DomainListHandlerFunc(handlers.DomainList)
 	api.DomainModeratorDeleteHandler = operations.DomainModeratorDeleteHandlerFunc(handlers.DomainModeratorDelete)
 	api.DomainModeratorNewHandler = operations.DomainModeratorNewHandlerFunc(handlers.DomainModeratorNew)
@@ -102,6 +140,14 @@ func configureAPI(api *operations.ComentarioAPI) http.Handler {
 	api.DomainSsoSecretNewHandler = operations.DomainSsoSecretNewHandlerFunc(handlers.DomainSsoSecretNew)
 	api.DomainStatisticsHandler = operations.DomainStatisticsHandlerFunc(handlers.DomainStatistics)
 	api.DomainUpdateHandler = operations.DomainUpdateHandlerFunc(handlers.DomainUpdate)
+	api.DomainUserDeleteHandler = operations.DomainUserDeleteHandlerFunc(handlers.DomainUserDelete)
+	api.DomainUserListHandler = operations.DomainUserListHandlerFunc(handlers.DomainUserList)
+	api.DomainUserNewHandler = operations.DomainUserNewHandlerFunc(handlers.DomainUserNew)
+	api.DomainVerifyHandler = operations.DomainVerifyHandlerFunc(handlers.DomainVerify)
+	api.DomainWebhookDeleteHandler = operations.DomainWebhookDeleteHandlerFunc(handlers.DomainWebhookDelete)
+	api.DomainWebhookDeliveriesHandler = operations.DomainWebhookDeliveriesHandlerFunc(handlers.DomainWebhookDeliveries)
+	api.DomainWebhookListHandler = operations.DomainWebhookListHandlerFunc(handlers.DomainWebhookList)
+	api.DomainWebhookNewHandler = operations.DomainWebhookNewHandlerFunc(handlers.DomainWebhookNew)
 	// Email
 	api.EmailGetHandler = operations.EmailGetHandlerFunc(handlers.EmailGet)
 	api.EmailModerateHandler = operations.EmailModerateHandlerFunc(handlers.EmailModerate)
@@ -112,11 +158,28 @@ func configureAPI(api *operations.ComentarioAPI) http.Handler {
 	api.OauthSsoCallbackHandler = operations.OauthSsoCallbackHandlerFunc(handlers.OauthSsoCallback)
 	api.OauthSsoInitHandler = operations.OauthSsoInitHandlerFunc(handlers.OauthSsoInit)
 	// Owner
+	api.OwnerAPITokenDeleteHandler = operations.OwnerAPITokenDeleteHandlerFunc(handlers.OwnerAPITokenDelete)
+	api.OwnerAPITokenNewHandler = operations.OwnerAPITokenNewHandlerFunc(handlers.OwnerAPITokenNew)
+	api.OwnerAPITokensHandler = operations.OwnerAPITokensHandlerFunc(handlers.OwnerAPITokens)
 	api.OwnerConfirmHexHandler = operations.OwnerConfirmHexHandlerFunc(handlers.OwnerConfirmHex)
 	api.OwnerDeleteHandler = operations.OwnerDeleteHandlerFunc(handlers.OwnerDelete)
+	api.OwnerInvitationAcceptHandler = operations.OwnerInvitationAcceptHandlerFunc(handlers.OwnerInvitationAccept)
 	api.OwnerLoginHandler = operations.OwnerLoginHandlerFunc(handlers.OwnerLogin)
+	api.OwnerLoginTotpHandler = operations.OwnerLoginTotpHandlerFunc(handlers.OwnerLoginTotp)
 	api.OwnerNewHandler = operations.OwnerNewHandlerFunc(handlers.OwnerNew)
 	api.OwnerSelfHandler = operations.OwnerSelfHandlerFunc(handlers.OwnerSelf)
+	api.OwnerSessionDeleteHandler = operations.OwnerSessionDeleteHandlerFunc(handlers.OwnerSessionDelete)
+	api.OwnerSessionsHandler = operations.OwnerSessionsHandlerFunc(handlers.OwnerSessions)
+	api.OwnerSessionsDeleteOthersHandler = operations.OwnerSessionsDeleteOthersHandlerFunc(handlers.OwnerSessionsDeleteOthers)
+	api.OwnerTotpDisableHandler = operations.OwnerTotpDisableHandlerFunc(handlers.OwnerTotpDisable)
+	api.OwnerTotpEnableHandler = operations.OwnerTotpEnableHandlerFunc(handlers.OwnerTotpEnable)
+	api.OwnerTotpSetupHandler = operations.OwnerTotpSetupHandlerFunc(handlers.OwnerTotpSetup)
+	api.OwnerWebauthnCredentialDeleteHandler = operations.OwnerWebauthnCredentialDeleteHandlerFunc(handlers.OwnerWebauthnCredentialDelete)
+	api.OwnerWebauthnCredentialsHandler = operations.OwnerWebauthnCredentialsHandlerFunc(handlers.OwnerWebauthnCredentials)
+	api.OwnerWebauthnLoginBeginHandler = operations.OwnerWebauthnLoginBeginHandlerFunc(handlers.OwnerWebauthnLoginBegin)
+	api.OwnerWebauthnLoginFinishHandler = operations.OwnerWebauthnLoginFinishHandlerFunc(handlers.OwnerWebauthnLoginFinish)
+	api.OwnerWebauthnRegisterBeginHandler = operations.OwnerWebauthnRegisterBeginHandlerFunc(handlers.OwnerWebauthnRegisterBegin)
+	api.OwnerWebauthnRegisterFinishHandler = operations.OwnerWebauthnRegisterFinishHandlerFunc(handlers.OwnerWebauthnRegisterFinish)
 	// Page
 	api.PageUpdateHandler = operations.PageUpdateHandlerFunc(handlers.PageUpdate)
 	// Auth
@@ -139,6 +202,7 @@ func configureAPI(api *operations.ComentarioAPI) http.Handler {
 		redirectToLangRootHandler,
 		corsHandler,
 		staticHandler,
+		rateLimitHandler,
 		makeAPIHandler(api.Serve(nil)),
 	)
 
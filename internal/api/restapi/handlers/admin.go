@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"github.com/go-openapi/runtime/middleware"
+	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/svc"
+	"gitlab.com/comentario/comentario/internal/util"
+	"strings"
+)
+
+func AdminDomainFreeze(params operations.AdminDomainFreezeParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Update the domain
+	if err := svc.TheAdminService.SetDomainFrozen(data.TrimmedString(params.Body.Domain), params.Body.Frozen); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminDomainFreezeNoContent()
+}
+
+func AdminDomainList(params operations.AdminDomainListParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Fetch the domains
+	domains, err := svc.TheAdminService.ListDomains(strings.TrimSpace(params.Body.Query), int(params.Body.Offset))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminDomainListOK().WithPayload(&operations.AdminDomainListOKBody{Domains: domains})
+}
+
+func AdminDomainOwnerReassign(params operations.AdminDomainOwnerReassignParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Find the new owner
+	user, err := svc.TheUserService.FindUserByEmail(data.EmailToString(params.Body.Email), false)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Reassign the domain
+	if err := svc.TheAdminService.ReassignDomainOwner(data.TrimmedString(params.Body.Domain), user); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminDomainOwnerReassignNoContent()
+}
+
+func AdminSignupDomainDelete(params operations.AdminSignupDomainDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Remove the email domain
+	if err := svc.TheAdminService.DeleteSignupDomain(normaliseEmailDomain(params.Body.EmailDomain)); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminSignupDomainDeleteNoContent()
+}
+
+func AdminSignupDomainList(_ operations.AdminSignupDomainListParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Fetch the email domains
+	emailDomains, err := svc.TheAdminService.ListSignupDomains()
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminSignupDomainListOK().
+		WithPayload(&operations.AdminSignupDomainListOKBody{EmailDomains: emailDomains})
+}
+
+func AdminSignupDomainNew(params operations.AdminSignupDomainNewParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Validate the email domain
+	emailDomain := normaliseEmailDomain(params.Body.EmailDomain)
+	if !util.IsValidHostname(emailDomain) {
+		return respBadRequest(util.ErrorInvalidEmailDomain)
+	}
+
+	// Add the email domain
+	if err := svc.TheAdminService.AddSignupDomain(emailDomain); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminSignupDomainNewNoContent()
+}
+
+func AdminStats(_ operations.AdminStatsParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Collect the stats
+	stats, err := svc.TheAdminService.Stats()
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminStatsOK().WithPayload(stats)
+}
+
+func AdminUserList(params operations.AdminUserListParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Fetch the users
+	users, err := svc.TheAdminService.ListUsers(strings.TrimSpace(params.Body.Query), params.Body.Owners, int(params.Body.Offset))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminUserListOK().WithPayload(&operations.AdminUserListOKBody{Users: users})
+}
+
+func AdminUserSuspend(params operations.AdminUserSuspendParams, principal data.Principal) middleware.Responder {
+	// Verify the user is a superuser
+	if r := Verifier.PrincipalIsSuperuser(principal); r != nil {
+		return r
+	}
+
+	// Superusers cannot lock themselves out
+	userHex := *params.Body.UserHex
+	if params.Body.Suspended && userHex == principal.GetHexID() {
+		return respBadRequest(util.ErrorSelfSuspend)
+	}
+
+	// Update the user
+	if err := svc.TheAdminService.SetUserSuspended(userHex, params.Body.Suspended); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewAdminUserSuspendNoContent()
+}
+
+// normaliseEmailDomain returns the given email domain trimmed, lowercased, and without a leading "@"
+func normaliseEmailDomain(s *string) string {
+	return strings.ToLower(strings.TrimPrefix(data.TrimmedString(s), "@"))
+}
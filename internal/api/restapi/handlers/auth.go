@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"github.com/go-openapi/runtime/middleware"
-	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
 	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
@@ -15,24 +14,11 @@ func ForgotPassword(params operations.ForgotPasswordParams) middleware.Responder
 	email := data.EmailToString(params.Body.Email)
 	entity := *params.Body.Entity
 
-	var user *data.User
-
-	switch entity {
-	// Resetting owner password
-	case models.EntityOwner:
-		if owner, err := svc.TheUserService.FindOwnerByEmail(email, false); err == nil {
-			user = &owner.User
-		} else if err != svc.ErrNotFound {
-			return respServiceError(err)
-		}
-
-	// Resetting commenter password: find the locally authenticated commenter
-	case models.EntityCommenter:
-		if commenter, err := svc.TheUserService.FindCommenterByIdPEmail("", email, false); err == nil {
-			user = &commenter.User
-		} else if err != svc.ErrNotFound {
-			return respServiceError(err)
-		}
+	// Find the user. Both kinds of entity share the same account, the entity only determines where the user gets
+	// redirected after the reset
+	user, err := svc.TheUserService.FindUserByEmail(email, false)
+	if err != nil && err != svc.ErrNotFound {
+		return respServiceError(err)
 	}
 
 	// If no user found, apply a random delay to discourage email polling
@@ -59,6 +45,12 @@ func ForgotPassword(params operations.ForgotPasswordParams) middleware.Responder
 }
 
 func ResetPassword(params operations.ResetPasswordParams) middleware.Responder {
+	// Verify the new password complies with the policy
+	if err := svc.ThePasswordService.CheckPolicy(*params.Body.Password); err != nil {
+		return respBadRequest(err)
+	}
+
+	// Reset the password
 	entity, err := svc.TheUserService.ResetUserPasswordByToken(*params.Body.ResetHex, *params.Body.Password)
 	if err != nil {
 		return respServiceError(err)
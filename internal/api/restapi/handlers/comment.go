@@ -1,15 +1,21 @@
 package handlers
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-openapi/runtime"
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/go-openapi/strfmt"
 	"github.com/go-openapi/swag"
 	"github.com/markbates/goth"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
+	"io"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -20,6 +26,11 @@ func CommentApprove(params operations.CommentApproveParams, principal data.Princ
 		return r
 	}
 
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
 	// Fetch the comment
 	comment, err := svc.TheCommentService.FindByHexID(*params.Body.CommentHex)
 	if err != nil {
@@ -27,7 +38,7 @@ func CommentApprove(params operations.CommentApproveParams, principal data.Princ
 	}
 
 	// Verify the user is a domain moderator
-	if r := Verifier.UserIsDomainModerator(principal.GetUser().Email, comment.Domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, comment.Domain, data.DomainPermissionModerate); r != nil {
 		return r
 	}
 
@@ -36,6 +47,19 @@ func CommentApprove(params operations.CommentApproveParams, principal data.Princ
 		return respServiceError(err)
 	}
 
+	// The moderator has reviewed the comment, so dismiss any reports on it
+	if err = svc.TheReportService.DeleteByComments([]models.HexID{comment.CommentHex}); err != nil {
+		return respServiceError(err)
+	}
+
+	// Use the approval to train the spam filter
+	go trainSpamFilter(comment.Domain, comment.Markdown, false)
+
+	// Notify the page subscribers and webhooks
+	comment.State = models.CommentStateApproved
+	publishCommentEvent(models.CommentEventKindApprove, comment, true)
+	svc.TheWebhookService.Trigger(models.WebhookEventApprove, comment)
+
 	// Succeeded
 	return operations.NewCommentApproveNoContent()
 }
@@ -57,6 +81,11 @@ func CommentDelete(params operations.CommentDeleteParams, principal data.Princip
 		return r
 	}
 
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
 	// Find the comment
 	comment, err := svc.TheCommentService.FindByHexID(*params.Body.CommentHex)
 	if err != nil {
@@ -64,8 +93,9 @@ func CommentDelete(params operations.CommentDeleteParams, principal data.Princip
 	}
 
 	// If not deleting their own comment, the user must be a domain moderator
-	if comment.CommenterHex != principal.GetHexID() {
-		if r := Verifier.UserIsDomainModerator(principal.GetUser().Email, comment.Domain); r != nil {
+	byModerator := comment.CommenterHex != principal.GetHexID()
+	if byModerator {
+		if r := Verifier.PrincipalHasDomainPermission(principal, comment.Domain, data.DomainPermissionModerate); r != nil {
 			return r
 		}
 	}
@@ -75,6 +105,18 @@ func CommentDelete(params operations.CommentDeleteParams, principal data.Princip
 		return respServiceError(err)
 	}
 
+	// Use the moderator's deletion to train the spam filter
+	if byModerator {
+		go trainSpamFilter(comment.Domain, comment.Markdown, true)
+	}
+
+	// Notify the page subscribers and webhooks
+	comment.Deleted = true
+	comment.Markdown = "[deleted]"
+	comment.HTML = "[deleted]"
+	publishCommentEvent(models.CommentEventKindDelete, comment, false)
+	svc.TheWebhookService.Trigger(models.WebhookEventDelete, comment)
+
 	// Succeeded
 	return operations.NewCommentDeleteNoContent()
 }
@@ -91,9 +133,21 @@ func CommentEdit(params operations.CommentEditParams, principal data.Principal)
 		return respServiceError(err)
 	}
 
-	// If not updating their own comment, the user must be a domain moderator
+	// Verify the domain isn't frozen
+	if r := domainNotFrozen(comment.Domain); r != nil {
+		return r
+	}
+
+	// If not updating their own comment, the user must be a domain moderator. Otherwise, verify they aren't banned. A
+	// shadow ban lets them edit, but nobody else gets notified
+	shadowed := false
 	if comment.CommenterHex != principal.GetHexID() {
-		if r := Verifier.UserIsDomainModerator(principal.GetUser().Email, comment.Domain); r != nil {
+		if r := Verifier.PrincipalHasDomainPermission(principal, comment.Domain, data.DomainPermissionModerate); r != nil {
+			return r
+		}
+	} else {
+		var r middleware.Responder
+		if shadowed, r = commenterBan(comment.Domain, principal.(*data.User), params.HTTPRequest); r != nil {
 			return r
 		}
 	}
@@ -102,17 +156,61 @@ func CommentEdit(params operations.CommentEditParams, principal data.Principal)
 	markdown := swag.StringValue(params.Body.Markdown)
 	html := util.MarkdownToHTML(markdown)
 
+	// Nothing to do if the text hasn't changed, as that would only produce an empty revision
+	if markdown == comment.Markdown {
+		return operations.NewCommentEditOK().WithPayload(&operations.CommentEditOKBody{HTML: html})
+	}
+
 	// Persist the edits in the database
-	if err := svc.TheCommentService.UpdateText(comment.CommentHex, markdown, html); err != nil {
+	if err := svc.TheCommentService.UpdateText(comment.CommentHex, principal.GetHexID(), markdown, html); err != nil {
 		return respServiceError(err)
 	}
 
+	// Notify the page subscribers and webhooks, unless the comment is only visible to its author
+	if !shadowed {
+		comment.Markdown = markdown
+		comment.HTML = html
+		comment.EditCount++
+		comment.Edited = true
+		publishCommentEvent(models.CommentEventKindEdit, comment, false)
+		svc.TheWebhookService.Trigger(models.WebhookEventEdit, comment)
+	}
+
 	// Succeeded
 	return operations.NewCommentEditOK().WithPayload(&operations.CommentEditOKBody{HTML: html})
 }
 
+func CommentHistory(params operations.CommentHistoryParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Find the comment
+	comment, err := svc.TheCommentService.FindByHexID(*params.Body.CommentHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// If it isn't their own comment, the user must be a domain moderator
+	if comment.CommenterHex != principal.GetHexID() {
+		if r := Verifier.PrincipalHasDomainPermission(principal, comment.Domain, data.DomainPermissionModerate); r != nil {
+			return r
+		}
+	}
+
+	// Fetch the revisions
+	revisions, err := svc.TheCommentService.ListRevisions(comment.CommentHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommentHistoryOK().WithPayload(&operations.CommentHistoryOKBody{Revisions: revisions})
+}
+
 func CommentList(params operations.CommentListParams, principal data.Principal) middleware.Responder {
-	commenter := principal.(*data.UserCommenter)
+	commenter := principal.(*data.User)
 
 	// Fetch the domain
 	domain, err := svc.TheDomainService.FindByName(*params.Body.Domain)
@@ -122,9 +220,10 @@ func CommentList(params operations.CommentListParams, principal data.Principal)
 
 	// Prepare a map of configured identity providers: federated ones should only be enabled when configured
 	idps := domain.Idps.Clone()
-	for idp, gothIdP := range util.FederatedIdProviders {
-		idps[idp] = idps[idp] && goth.GetProviders()[gothIdP] != nil
+	for idp, fidp := range util.FederatedIdProviders {
+		idps[idp] = idps[idp] && goth.GetProviders()[fidp.GothID] != nil
 	}
+	idps["mastodon"] = idps["mastodon"] && config.SecretsConfig.IdP.Mastodon.Enable
 
 	// Fetch the page
 	page, err := svc.ThePageService.FindByDomainPath(domain.Domain, params.Body.Path)
@@ -141,8 +240,38 @@ func CommentList(params operations.CommentListParams, principal data.Principal)
 		}
 	}
 
-	// Fetch comment list
-	comments, commenters, err := svc.TheCommentService.ListWithCommentersByDomainPath(commenter, domain.Domain, params.Body.Path)
+	// Fetch comment list: a single page if a limit is given, otherwise all comments on the page
+	var comments []*models.Comment
+	var commenters map[models.HexID]*models.Commenter
+	var nextCursor *data.CommentCursor
+	isFirstPage := true
+	if params.Body.Limit > 0 {
+		// Default to root comments and the domain's sort policy
+		parentHex := params.Body.ParentHex
+		if parentHex == "" {
+			parentHex = data.RootParentHexID
+		} else if parentHex != data.RootParentHexID {
+			isFirstPage = false
+		}
+		sortPolicy := params.Body.SortPolicy
+		if sortPolicy == "" {
+			sortPolicy = domain.DefaultSortPolicy
+		}
+
+		// Parse the cursor, if any. It must have been produced for the same sort policy
+		var after *data.CommentCursor
+		if params.Body.Cursor != "" {
+			if after, err = data.ParseCommentCursor(params.Body.Cursor, sortPolicy); err != nil {
+				return respBadRequest(util.ErrorInvalidCursor)
+			}
+			isFirstPage = false
+		}
+
+		comments, commenters, nextCursor, err = svc.TheCommentService.ListPageWithCommentersByDomainPath(
+			commenter, domain.Domain, params.Body.Path, parentHex, sortPolicy, after, int(params.Body.Limit))
+	} else {
+		comments, commenters, err = svc.TheCommentService.ListWithCommentersByDomainPath(commenter, domain.Domain, params.Body.Path)
+	}
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -158,8 +287,16 @@ func CommentList(params operations.CommentListParams, principal data.Principal)
 		cr.Email = ""
 	}
 
-	// Register a view in domain statistics, ignoring any error
-	_ = svc.TheDomainService.RegisterView(domain.Domain, commenter)
+	// Register a view in domain statistics (only once per page load), ignoring any error
+	if isFirstPage {
+		_ = svc.TheDomainService.RegisterView(domain.Domain, commenter)
+	}
+
+	// Provide a cursor to the next page, if any
+	next := ""
+	if nextCursor != nil {
+		next = nextCursor.String()
+	}
 
 	// Succeeded
 	return operations.NewCommentListOK().WithPayload(&operations.CommentListOKBody{
@@ -169,13 +306,167 @@ func CommentList(params operations.CommentListParams, principal data.Principal)
 		ConfiguredOauths:      idps,
 		DefaultSortPolicy:     domain.DefaultSortPolicy,
 		Domain:                domain.Domain,
-		IsFrozen:              domain.State == models.DomainStateFrozen,
+		FederatedIdps:         configuredFederatedIdps(),
+		IsFrozen:              domainFrozen(domain) || !domain.Verified,
 		IsModerator:           commenter.IsModerator,
+		NextCursor:            next,
 		RequireIdentification: domain.RequireIdentification,
 		RequireModeration:     domain.RequireModeration,
 	})
 }
 
+func CommentModerationBulk(params operations.CommentModerationBulkParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user is a domain moderator
+	domain := swag.StringValue(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Apply the action
+	var comments []*models.Comment
+	var err error
+	action := *params.Body.Action
+	switch action {
+	case models.ModerationActionApprove:
+		comments, err = svc.TheCommentService.ApproveBulk(domain, params.Body.CommentHexes)
+	case models.ModerationActionDelete:
+		comments, err = svc.TheCommentService.MarkDeletedBulk(domain, params.Body.CommentHexes, principal.GetHexID())
+	case models.ModerationActionSpam:
+		comments, err = svc.TheCommentService.MarkSpamBulk(domain, params.Body.CommentHexes)
+	default:
+		return respBadRequest(util.ErrorInvalidAction)
+	}
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Collect the affected comment hex IDs
+	hexes := make([]models.HexID, len(comments))
+	for i, c := range comments {
+		hexes[i] = c.CommentHex
+	}
+
+	// Approved comments have been reviewed by the moderator, so dismiss any reports on them
+	if action == models.ModerationActionApprove && len(hexes) > 0 {
+		if err := svc.TheReportService.DeleteByComments(hexes); err != nil {
+			return respServiceError(err)
+		}
+	}
+
+	// Use the moderator's decisions to train the spam filter
+	go func() {
+		for _, c := range comments {
+			trainSpamFilter(c.Domain, c.Markdown, action != models.ModerationActionApprove)
+		}
+	}()
+
+	// Notify the page subscribers and webhooks
+	for _, c := range comments {
+		switch action {
+		case models.ModerationActionApprove:
+			publishCommentEvent(models.CommentEventKindApprove, c, true)
+			svc.TheWebhookService.Trigger(models.WebhookEventApprove, c)
+		case models.ModerationActionDelete:
+			// Make a copy without the original text, which is still needed for training
+			dc := *c
+			dc.Markdown = "[deleted]"
+			dc.HTML = "[deleted]"
+			publishCommentEvent(models.CommentEventKindDelete, &dc, false)
+			svc.TheWebhookService.Trigger(models.WebhookEventDelete, &dc)
+		case models.ModerationActionSpam:
+			svc.TheWebhookService.Trigger(models.WebhookEventFlag, c)
+		}
+	}
+
+	// Succeeded
+	return operations.NewCommentModerationBulkOK().
+		WithPayload(&operations.CommentModerationBulkOKBody{CommentHexes: hexes})
+}
+
+func CommentModerationList(params operations.CommentModerationListParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user is a domain moderator
+	domain := swag.StringValue(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+	moderator := *principal.(*data.User)
+	moderator.IsModerator = true
+
+	// Default to comments awaiting moderation, the most recent first
+	filter := &svc.CommentFilter{
+		Domain:        domain,
+		States:        params.Body.States,
+		Path:          params.Body.Path,
+		CommenterHex:  params.Body.CommenterHex,
+		CreatedAfter:  time.Time(params.Body.CreatedAfter),
+		CreatedBefore: time.Time(params.Body.CreatedBefore),
+	}
+	if len(filter.States) == 0 {
+		filter.States = []models.CommentState{models.CommentStateUnapproved, models.CommentStateFlagged}
+	}
+	sortPolicy := params.Body.SortPolicy
+	if sortPolicy == "" {
+		sortPolicy = models.SortPolicyCreationdateDashDesc
+	}
+
+	// Parse the cursor, if any. It must have been produced for the same sort policy
+	var after *data.CommentCursor
+	if params.Body.Cursor != "" {
+		var err error
+		if after, err = data.ParseCommentCursor(params.Body.Cursor, sortPolicy); err != nil {
+			return respBadRequest(util.ErrorInvalidCursor)
+		}
+	}
+	limit := int(params.Body.Limit)
+	if limit <= 0 {
+		limit = util.ModerationQueuePageSize
+	}
+
+	// Fetch the comments
+	comments, commenters, nextCursor, err := svc.TheCommentService.ListForModeration(&moderator, filter, sortPolicy, after, limit)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Wipe out commenter emails (to omit them in the response)
+	for _, cr := range commenters {
+		cr.Email = ""
+	}
+
+	// Provide a cursor to the next page, if any
+	next := ""
+	if nextCursor != nil {
+		next = nextCursor.String()
+	}
+
+	// Succeeded
+	return operations.NewCommentModerationListOK().WithPayload(&operations.CommentModerationListOKBody{
+		Commenters: commenters,
+		Comments:   comments,
+		NextCursor: next,
+	})
+}
+
 func CommentNew(params operations.CommentNewParams, principal data.Principal) middleware.Responder {
 	// Fetch the domain
 	domain, err := svc.TheDomainService.FindByName(*params.Body.Domain)
@@ -191,10 +482,15 @@ func CommentNew(params operations.CommentNewParams, principal data.Principal) mi
 	}
 
 	// Verify the domain isn't frozen
-	if domain.State == models.DomainStateFrozen {
+	if domainFrozen(domain) {
 		return respBadRequest(util.ErrorDomainFrozen)
 	}
 
+	// Verify the domain's ownership has been proven
+	if !domain.Verified {
+		return respBadRequest(util.ErrorDomainUnverified)
+	}
+
 	// Verify the page isn't locked
 	path := strings.TrimSpace(params.Body.Path)
 	if page, err := svc.ThePageService.FindByDomainPath(domain.Domain, path); err != nil {
@@ -204,7 +500,7 @@ func CommentNew(params operations.CommentNewParams, principal data.Principal) mi
 	}
 
 	// If the commenter is authenticated, check if it's a domain moderator
-	commenter := principal.(*data.UserCommenter)
+	commenter := principal.(*data.User)
 	if !commenter.IsAnonymous() {
 		for _, mod := range domain.Moderators {
 			if string(mod.Email) == commenter.Email {
@@ -214,24 +510,35 @@ func CommentNew(params operations.CommentNewParams, principal data.Principal) mi
 		}
 	}
 
+	// Verify the commenter isn't banned. A shadow ban lets them comment, but nobody else sees it
+	shadowed, r := commenterBan(domain.Domain, commenter, params.HTTPRequest)
+	if r != nil {
+		return r
+	}
+
 	// Determine comment state
 	markdown := data.TrimmedString(params.Body.Markdown)
 	var state models.CommentState
 	if commenter.IsModerator {
 		state = models.CommentStateApproved
-	} else if domain.RequireModeration || commenter.IsAnonymous() && domain.ModerateAllAnonymous {
+	} else if domain.RequireModeration ||
+		commenter.IsAnonymous() && domain.ModerateAllAnonymous ||
+		commenter.IsUnconfirmedLocal() && domain.ModerateUnconfirmed {
 		state = models.CommentStateUnapproved
-	} else if domain.AutoSpamFilter &&
-		svc.TheAntispamService.CheckForSpam(
-			domain.Domain,
-			util.UserIP(params.HTTPRequest),
-			util.UserAgent(params.HTTPRequest),
-			commenter.Name,
-			commenter.Email,
-			commenter.WebsiteURL,
-			markdown,
-		) {
-		state = models.CommentStateFlagged
+	} else if domain.AutoSpamFilter {
+		// Map the spam score to a state using the domain's thresholds
+		state = svc.TheAntispamService.CheckForSpam(
+			domain,
+			&svc.SpamMessage{
+				CommenterHex: commenter.HexID,
+				UserIP:       util.UserIP(params.HTTPRequest),
+				UserAgent:    util.UserAgent(params.HTTPRequest),
+				Name:         commenter.Name,
+				Email:        commenter.Email,
+				URL:          commenter.WebsiteURL,
+				Markdown:     markdown,
+			}).
+			State(domain)
 	} else {
 		state = models.CommentStateApproved
 	}
@@ -244,13 +551,23 @@ func CommentNew(params operations.CommentNewParams, principal data.Principal) mi
 		markdown,
 		*params.Body.ParentHex,
 		state,
+		shadowed,
 		strfmt.DateTime(time.Now().UTC()))
 	if err != nil {
 		return respServiceError(err)
 	}
 
-	// Send out an email notification
-	go emailNotificationNew(domain, comment)
+	// Send out an email notification, unless the comment is only visible to its author
+	if !shadowed {
+		go emailNotificationNew(domain, comment)
+	}
+
+	// Notify the page subscribers and webhooks
+	svc.TheEventService.Publish(models.CommentEventKindNew, comment, commenter.ToCommenter())
+	svc.TheWebhookService.Trigger(models.WebhookEventNew, comment)
+	if state == models.CommentStateFlagged {
+		svc.TheWebhookService.Trigger(models.WebhookEventFlag, comment)
+	}
 
 	// Succeeded
 	return operations.NewCommentNewOK().WithPayload(&operations.CommentNewOKBody{
@@ -261,6 +578,227 @@ func CommentNew(params operations.CommentNewParams, principal data.Principal) mi
 	})
 }
 
+func CommentReport(params operations.CommentReportParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Find the comment
+	comment, err := svc.TheCommentService.FindByHexID(*params.Body.CommentHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Make sure the commenter is not reporting their own or a deleted comment
+	if comment.CommenterHex == principal.GetHexID() {
+		return respForbidden(util.ErrorSelfReport)
+	} else if comment.Deleted {
+		return respBadRequest(util.ErrorCommentDeleted)
+	}
+
+	// Verify the domain isn't frozen
+	if r := domainNotFrozen(comment.Domain); r != nil {
+		return r
+	}
+
+	// Verify the commenter isn't banned. A shadow-banned commenter's report is silently dropped
+	if shadowed, r := commenterBan(comment.Domain, principal.(*data.User), params.HTTPRequest); r != nil {
+		return r
+	} else if shadowed {
+		return operations.NewCommentReportNoContent()
+	}
+
+	// Persist the report
+	cnt, err := svc.TheReportService.Create(&models.CommentReport{
+		CommentHex:  comment.CommentHex,
+		Domain:      comment.Domain,
+		ReporterHex: principal.GetHexID(),
+		Category:    *params.Body.Category,
+		Details:     strings.TrimSpace(params.Body.Details),
+	})
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Flag an approved comment once it's been reported often enough
+	if comment.State == models.CommentStateApproved {
+		domain, err := svc.TheDomainService.FindByName(comment.Domain)
+		if err != nil {
+			return respServiceError(err)
+		}
+		if domain.ReportThreshold > 0 && int64(cnt) >= domain.ReportThreshold {
+			flagged, err := svc.TheCommentService.MarkSpamBulk(domain.Domain, []models.HexID{comment.CommentHex})
+			if err != nil {
+				return respServiceError(err)
+			}
+
+			// Notify the moderators and webhooks, unless the comment has concurrently been flagged already
+			for _, c := range flagged {
+				go emailNotificationReported(domain, c)
+				svc.TheWebhookService.Trigger(models.WebhookEventFlag, c)
+			}
+		}
+	}
+
+	// Succeeded
+	return operations.NewCommentReportNoContent()
+}
+
+func CommentReportList(params operations.CommentReportListParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user can moderate the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Fetch the reports
+	reports, err := svc.TheReportService.ListByDomain(domain, params.Body.CommentHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommentReportListOK().WithPayload(&operations.CommentReportListOKBody{Reports: reports})
+}
+
+func CommentRestore(params operations.CommentRestoreParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Find the comment
+	comment, err := svc.TheCommentService.FindByHexID(*params.Body.CommentHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Verify the user is a domain moderator
+	if r := Verifier.PrincipalHasDomainPermission(principal, comment.Domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Restore the comment
+	if err := svc.TheCommentService.Restore(comment.CommentHex); err == util.ErrorCommentNotRestorable {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Notify the page subscribers and webhooks, using the restored comment
+	if comment, err = svc.TheCommentService.FindByHexID(comment.CommentHex); err == nil {
+		publishCommentEvent(models.CommentEventKindRestore, comment, true)
+		svc.TheWebhookService.Trigger(models.WebhookEventRestore, comment)
+	}
+
+	// Succeeded
+	return operations.NewCommentRestoreNoContent()
+}
+
+func CommentStream(params operations.CommentStreamParams, principal data.Principal) middleware.Responder {
+	commenter := principal.(*data.User)
+
+	// Fetch the domain
+	domain, err := svc.TheDomainService.FindByName(params.Domain)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// If the commenter is authenticated, check if it's a domain moderator
+	if !commenter.IsAnonymous() {
+		for _, mod := range domain.Moderators {
+			if string(mod.Email) == commenter.Email {
+				commenter.IsModerator = true
+				break
+			}
+		}
+	}
+
+	// Verify the commenter isn't banned. A shadow ban still lets them follow the page
+	if _, r := commenterBan(domain.Domain, commenter, params.HTTPRequest); r != nil {
+		return r
+	}
+
+	// Subscribe to the page's events
+	events, unsubscribe := svc.TheEventService.Subscribe(commenter, domain.Domain, swag.StringValue(params.Path))
+
+	// Stream the events until the client disconnects
+	return middleware.ResponderFunc(func(w http.ResponseWriter, _ runtime.Producer) {
+		defer unsubscribe()
+
+		// The stream is long-lived, so disable any write deadline imposed by the server
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		// Send out the headers
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // Disable response buffering in nginx
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			logger.Errorf("CommentStream: Flush() failed: %v", err)
+			return
+		}
+
+		// Keep the connection alive by periodically sending a comment line
+		ticker := time.NewTicker(util.EventStreamKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-params.HTTPRequest.Context().Done():
+				return
+
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				var b []byte
+				if b, err = json.Marshal(e); err != nil {
+					logger.Errorf("CommentStream: json.Marshal() failed: %v", err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", *e.Kind, b)
+
+			case <-ticker.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+			}
+
+			// Flush the written data to the client
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				logger.Debugf("CommentStream: write failed, closing the stream: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func CommentStreamTicket(params operations.CommentStreamTicketParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated. Anonymous commenters need no ticket
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Issue a ticket for the current session
+	ticket, err := svc.TheUserService.CreateStreamTicket(
+		models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken)))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommentStreamTicketOK().WithPayload(&operations.CommentStreamTicketOKBody{Ticket: ticket})
+}
+
 func CommentVote(params operations.CommentVoteParams, principal data.Principal) middleware.Responder {
 	// Verify the commenter is authenticated
 	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
@@ -286,11 +824,98 @@ func CommentVote(params operations.CommentVoteParams, principal data.Principal)
 		return respForbidden(util.ErrorSelfVote)
 	}
 
+	// Verify the domain isn't frozen
+	if r := domainNotFrozen(comment.Domain); r != nil {
+		return r
+	}
+
+	// Verify the commenter isn't banned. A shadow-banned commenter's vote is silently dropped
+	if shadowed, r := commenterBan(comment.Domain, principal.(*data.User), params.HTTPRequest); r != nil {
+		return r
+	} else if shadowed {
+		return operations.NewCommentVoteNoContent()
+	}
+
 	// Update the vote in the database
 	if err := svc.TheVoteService.SetVote(comment.CommentHex, principal.GetHexID(), direction); err != nil {
 		return respServiceError(err)
 	}
 
+	// Reload the comment to get the updated score and notify the page subscribers and webhooks
+	if comment, err = svc.TheCommentService.FindByHexID(comment.CommentHex); err == nil {
+		publishCommentEvent(models.CommentEventKindVote, comment, false)
+		svc.TheWebhookService.Trigger(models.WebhookEventVote, comment)
+	}
+
 	// Succeeded
 	return operations.NewCommentVoteNoContent()
 }
+
+// commenterBan verifies the commenter isn't banned from the domain; moderators are exempt. Returns whether the
+// commenter is shadow-banned, or a responder rejecting the request if they are fully banned or the check fails
+func commenterBan(domain string, commenter *data.User, r *http.Request) (bool, middleware.Responder) {
+	// Moderators can't be banned
+	if commenter.IsModerator {
+		return false, nil
+	}
+
+	// Find the most severe ban applying to the commenter
+	ban, err := svc.TheBanService.FindActive(domain, commenter.HexID, commenter.Email, util.UserIP(r))
+	if err == svc.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, respServiceError(err)
+	}
+
+	// The commenter may still be a moderator not marked as such
+	if !commenter.IsAnonymous() {
+		if roles, _, err := svc.TheDomainService.FindUserRoles(commenter.HexID, domain); err == nil &&
+			data.DomainRolesAllow(roles, data.DomainPermissionModerate) {
+			return false, nil
+		}
+	}
+
+	// A shadow ban lets the request through
+	if ban.Shadow {
+		return true, nil
+	}
+	return false, respForbidden(util.ErrorBanned)
+}
+
+// domainFrozen returns whether the domain is frozen, either by its owner or by a superuser
+func domainFrozen(domain *models.Domain) bool {
+	return domain.State == models.DomainStateFrozen || domain.AdminFrozen
+}
+
+// domainNotFrozen verifies the domain with the given name isn't frozen, and returns a responder rejecting the request
+// otherwise
+func domainNotFrozen(domainName string) middleware.Responder {
+	if domain, err := svc.TheDomainService.FindByName(domainName); err != nil {
+		return respServiceError(err)
+	} else if domainFrozen(domain) {
+		return respBadRequest(util.ErrorDomainFrozen)
+	}
+	return nil
+}
+
+// publishCommentEvent notifies the subscribers of the comment's page of an event of the given kind. If withAuthor is
+// true, the event also carries the comment's author
+func publishCommentEvent(kind models.CommentEventKind, comment *models.Comment, withAuthor bool) {
+	var author *models.Commenter
+	if withAuthor {
+		if comment.CommenterHex == data.AnonymousCommenter.HexID {
+			author = data.AnonymousCommenter.ToCommenter()
+		} else if uc, err := svc.TheUserService.FindUserByID(comment.CommenterHex); err == nil {
+			author = uc.ToCommenter()
+		}
+	}
+	svc.TheEventService.Publish(kind, comment, author)
+}
+
+// trainSpamFilter feeds a moderator decision on the comment text into the domain's Bayesian spam classifier, if it's
+// enabled for the domain
+func trainSpamFilter(domainName, markdown string, spam bool) {
+	if domain, err := svc.TheDomainService.FindByName(domainName); err == nil && domain.SpamBayesFilter {
+		_ = svc.TheAntispamService.Train(domain.Domain, markdown, spam)
+	}
+}
@@ -2,39 +2,102 @@ package handlers
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/disintegration/imaging"
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/go-openapi/swag"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
-	"golang.org/x/crypto/bcrypt"
+	"html"
 	"image"
 	"image/color"
 	"image/draw"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
+func CommenterConfirmHex(params operations.CommenterConfirmHexParams) middleware.Responder {
+	// Update the commenter, if the token checks out
+	if err := svc.TheUserService.ConfirmUser(models.HexID(params.ConfirmHex)); err == svc.ErrNotFound {
+		return messagePageResponse(
+			http.StatusBadRequest,
+			"Confirmation failed",
+			"The confirmation link is invalid or has expired.")
+	} else if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Confirmation failed", util.ErrorInternal.Error())
+	}
+
+	// Succeeded
+	return messagePageResponse(
+		http.StatusOK,
+		"Email confirmed",
+		"Your email address has been confirmed. You can close this page now.")
+}
+
+func CommenterConfirmResend(_ operations.CommenterConfirmResendParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Verify there's anything to confirm
+	commenter := principal.GetUser()
+	if !commenter.IsUnconfirmedLocal() {
+		return respBadRequest(util.ErrorEmailAlreadyConfirmed)
+	} else if !config.SMTPConfigured {
+		return respBadRequest(util.ErrorSMTPNotConfigured)
+	}
+
+	// Mail a new confirmation link
+	if err := emailConfirmation(commenter, "commenter/confirm-hex"); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterConfirmResendNoContent()
+}
+
 func CommenterLogin(params operations.CommenterLoginParams) middleware.Responder {
-	// Try to find a local user with the given email
-	commenter, err := svc.TheUserService.FindCommenterByIdPEmail("", data.EmailToString(params.Body.Email), true)
+	// Try to find a local user with the given email, and verify the provided password
+	addr, password := data.EmailToString(params.Body.Email), swag.StringValue(params.Body.Password)
+	commenter, err := svc.TheUserService.FindUserByIdentity("", addr, true)
+	if err == nil && !svc.TheUserService.VerifyPassword(commenter, password) {
+		err = svc.ErrNotFound
+	}
+
+	// Users who had to give the email up when accounts were merged can still sign in with it and their own password
+	if err == svc.ErrNotFound {
+		commenter, err = svc.TheUserService.FindUserByFormerEmail(addr, password)
+	}
 	if err != nil {
 		time.Sleep(util.WrongAuthDelay)
 		return respUnauthorized(util.ErrorInvalidEmailPassword)
 	}
 
-	// Verify the provided password
-	if err := bcrypt.CompareHashAndPassword([]byte(commenter.PasswordHash), []byte(swag.StringValue(params.Body.Password))); err != nil {
-		time.Sleep(util.WrongAuthDelay)
-		return respUnauthorized(util.ErrorInvalidEmailPassword)
+	// Verify the commenter isn't suspended
+	if commenter.Suspended {
+		return respForbidden(util.ErrorUserSuspended)
+	}
+
+	// If the commenter has two-factor authentication enabled, issue a challenge to be completed with
+	// CommenterLoginTotp
+	if commenter.TOTPEnabled {
+		loginToken, err := svc.TheTOTPService.CreateChallenge(commenter.HexID, "")
+		if err != nil {
+			return respServiceError(err)
+		}
+		return operations.NewCommenterLoginOK().
+			WithPayload(&operations.CommenterLoginOKBody{TotpRequired: true, LoginToken: loginToken})
 	}
 
-	// Create a new commenter session
-	commenterToken, err := svc.TheUserService.CreateCommenterSession(commenter.HexID)
+	// Create a new session
+	commenterToken, err := svc.TheUserService.CreateSession(commenter.HexID, false, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -53,6 +116,45 @@ func CommenterLogin(params operations.CommenterLoginParams) middleware.Responder
 	})
 }
 
+func CommenterLoginTotp(params operations.CommenterLoginTotpParams) middleware.Responder {
+	// Verify the code against the sign-in challenge. Challenges issued for an existing session can only be completed
+	// with CommenterSessionTotp
+	userID, sessionHex, err := svc.TheTOTPService.TakeChallenge(*params.Body.LoginToken, swag.StringValue(params.Body.Code))
+	if err == util.ErrorInvalidTOTPCode || err == svc.ErrNotFound || (err == nil && sessionHex != "") {
+		time.Sleep(util.WrongAuthDelay)
+		return respUnauthorized(util.ErrorInvalidTOTPCode)
+	} else if err == util.ErrorTOTPLocked {
+		return respUnauthorized(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Fetch the commenter
+	commenter, err := svc.TheUserService.FindUserByID(userID)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Create a new session, signed in with the second factor
+	commenterToken, err := svc.TheUserService.CreateSession(userID, true, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Fetch the commenter's email
+	email, err := svc.TheEmailService.FindByEmail(commenter.Email)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterLoginTotpOK().WithPayload(&operations.CommenterLoginTotpOKBody{
+		Commenter:      commenter.ToCommenter(),
+		CommenterToken: commenterToken,
+		Email:          email,
+	})
+}
+
 func CommenterLogout(params operations.CommenterLogoutParams, principal data.Principal) middleware.Responder {
 	// Verify the commenter is authenticated
 	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
@@ -62,28 +164,183 @@ func CommenterLogout(params operations.CommenterLogoutParams, principal data.Pri
 	// Extract a commenter token from the corresponding header, if any
 	if token := models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken)); token.Validate(nil) == nil {
 		// Delete the commenter token, ignoring any error
-		_ = svc.TheUserService.DeleteCommenterSession(principal.GetHexID(), token)
+		_ = svc.TheUserService.DeleteSession(principal.GetHexID(), token)
 	}
 
 	// Regardless of whether the above was successful, return a success response
 	return operations.NewCommenterLogoutNoContent()
 }
 
+func CommenterMagicLinkBind(params operations.CommenterMagicLinkBindParams) middleware.Responder {
+	// Bind the link to this browser by a nonce
+	nonce, err := data.RandomHexID()
+	if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+	email, token, err := svc.TheMagicLinkService.Bind(models.HexID(params.Request), nonce)
+	if err == svc.ErrNotFound {
+		return messagePageResponse(
+			http.StatusBadRequest,
+			"Sign-in failed",
+			"The sign-in request is invalid, has expired, or has already been used. Please start over.")
+	} else if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Mail the link
+	err = svc.TheMailService.SendFromTemplate(
+		"",
+		email,
+		"Your sign-in link",
+		"magic-link.gohtml",
+		map[string]any{
+			"URL":          config.URLForAPI("commenter/magic-link/login", map[string]string{"token": string(token)}),
+			"ValidMinutes": int(util.MagicLinkTTL.Minutes()),
+		})
+	if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Succeeded: store the nonce in a cookie. This page is a first-party one, and so is the sign-in page the link leads
+	// to, hence no need to relax the SameSite restriction
+	return NewCookieResponder(
+		messagePageResponse(
+			http.StatusOK,
+			"Check your email",
+			fmt.Sprintf(
+				"A sign-in link has been sent to %s. Open it in this browser to sign in. You can close this page now.",
+				email))).
+		WithCookie(util.CookieNameMagicLink, string(nonce), "/", util.MagicLinkTTL, true, http.SameSiteLaxMode)
+}
+
+func CommenterMagicLinkLogin(params operations.CommenterMagicLinkLoginParams) middleware.Responder {
+	// Obtain the nonce from the cookie: the link only works in the browser it's been requested from, otherwise anyone
+	// could have a victim sign the requester's session in
+	var nonce models.HexID
+	if cookie, err := params.HTTPRequest.Cookie(util.CookieNameMagicLink); err == nil {
+		nonce = models.HexID(cookie.Value)
+	}
+	if nonce.Validate(nil) != nil {
+		return messagePageResponse(
+			http.StatusBadRequest,
+			"Sign-in failed",
+			"Please open the sign-in link in the same browser you requested it from.")
+	}
+
+	// Take the link, if it checks out
+	email, name, sessionHex, err := svc.TheMagicLinkService.Take(models.HexID(params.Token), nonce)
+	if err == svc.ErrNotFound {
+		return messagePageResponse(
+			http.StatusBadRequest,
+			"Sign-in failed",
+			"The sign-in link is invalid, has expired, or has been requested from a different browser.")
+	} else if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Sign a new user up, or find the existing one. Either way, following the link proves they own the email
+	user, err := svc.TheUserService.CreateUser(email, name, "", "", "", "", true)
+	if err == util.ErrorEmailAlreadyExists {
+		if user, err = svc.TheUserService.FindUserByEmail(email, false); err == nil && !user.EmailConfirmed {
+			err = svc.TheUserService.ConfirmUserByID(user.HexID)
+		}
+	}
+	if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Link the user to the session the link was requested for, or ask for the second factor first
+	r, err := signInCommenterSession(sessionHex, user, false)
+	if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	} else if r == nil {
+		r = commenterSignedInResponse(false)
+	}
+
+	// Succeeded: the nonce has served its purpose
+	return NewCookieResponder(r).WithoutCookie(util.CookieNameMagicLink, "/")
+}
+
+func CommenterMagicLinkLoginPage(params operations.CommenterMagicLinkLoginPageParams) middleware.Responder {
+	// Render a form submitting the token, rather than signing in right away: mail scanners following links would
+	// otherwise use the link up
+	return NewHTMLResponder(
+		http.StatusOK,
+		fmt.Sprintf(
+			`<html lang="en">
+			<head>
+				<title>Sign in</title>
+			</head>
+			<body>
+				<h1>Sign in</h1>
+				<form method="post" action="%s">
+					<input type="hidden" name="token" value="%s">
+					<button type="submit">Sign in to comments</button>
+				</form>
+			</body>
+			</html>`,
+			html.EscapeString(config.URLForAPI("commenter/magic-link/login", nil)),
+			html.EscapeString(params.Token)))
+}
+
+func CommenterMagicLinkNew(params operations.CommenterMagicLinkNewParams) middleware.Responder {
+	// Verify mailing is configured
+	if !config.SMTPConfigured {
+		return respBadRequest(util.ErrorSMTPNotConfigured)
+	}
+
+	// Extract the commenter token from the corresponding header: that's the session to sign in
+	sessionToken := models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken))
+	if sessionToken.Validate(nil) != nil || sessionToken == data.AnonymousCommenter.HexID {
+		return respBadRequest(util.ErrorInvalidCommenterToken)
+	}
+
+	// The name is only used for signing up, default to the email's local part
+	email := data.EmailToString(params.Body.Email)
+	name := strings.TrimSpace(params.Body.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+
+	// Create a new link request. The link only gets bound to the browser and mailed once the request token is passed to
+	// CommenterMagicLinkBind in a first-party window
+	requestToken, err := svc.TheMagicLinkService.Create(email, name, sessionToken)
+	if err == svc.ErrNotFound {
+		return respBadRequest(util.ErrorInvalidCommenterToken)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterMagicLinkNewOK().
+		WithPayload(&operations.CommenterMagicLinkNewOKBody{RequestToken: requestToken})
+}
+
 func CommenterNew(params operations.CommenterNewParams) middleware.Responder {
 	email := data.EmailToString(params.Body.Email)
 	name := data.TrimmedString(params.Body.Name)
 	website := string(params.Body.WebsiteURL)
 
-	// Since the local authentication is used, verify the email is unique
-	if r := Verifier.CommenterLocalEmaiUnique(email); r != nil {
-		return r
+	// Verify the password complies with the policy
+	if err := svc.ThePasswordService.CheckPolicy(*params.Body.Password); err != nil {
+		return respBadRequest(err)
 	}
 
-	// Create a commenter record in the database
-	if _, err := svc.TheUserService.CreateCommenter(email, name, website, "", "", *params.Body.Password); err != nil {
+	// Create a user record in the database. If no SMTP is configured, mark the user confirmed at once
+	commenter, err := svc.TheUserService.CreateUser(email, name, website, "", "", *params.Body.Password, !config.SMTPConfigured)
+	if err == util.ErrorEmailAlreadyExists {
+		return respBadRequest(err)
+	} else if err != nil {
 		return respServiceError(err)
 	}
 
+	// If mailing is configured, create and mail a confirmation token
+	if config.SMTPConfigured {
+		if err := emailConfirmation(commenter, "commenter/confirm-hex"); err != nil {
+			return respServiceError(err)
+		}
+	}
+
 	// Succeeded
 	return operations.NewCommenterNewNoContent()
 }
@@ -96,7 +353,7 @@ func CommenterPhoto(params operations.CommenterPhotoParams) middleware.Responder
 	}
 
 	// Find the commenter user
-	commenter, err := svc.TheUserService.FindCommenterByID(id)
+	commenter, err := svc.TheUserService.FindUserByID(id)
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -145,7 +402,7 @@ func CommenterSelf(params operations.CommenterSelfParams) middleware.Responder {
 	// Extract a commenter token from the corresponding header, if any
 	if token := models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken)); token.Validate(nil) == nil {
 		// Find the commenter
-		if commenter, err := svc.TheUserService.FindCommenterByToken(token); err != nil && err != svc.ErrNotFound {
+		if commenter, err := svc.TheUserService.FindUserBySession(token); err != nil && err != svc.ErrNotFound {
 			// Any error except "not found"
 			return respServiceError(err)
 
@@ -168,9 +425,87 @@ func CommenterSelf(params operations.CommenterSelfParams) middleware.Responder {
 	return operations.NewCommenterSelfNoContent()
 }
 
-func CommenterTokenNew(operations.CommenterTokenNewParams) middleware.Responder {
+func CommenterSessionDelete(params operations.CommenterSessionDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Delete the session
+	if err := svc.TheUserService.DeleteSessionByHex(principal.GetHexID(), *params.Body.SessionHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterSessionDeleteNoContent()
+}
+
+func CommenterSessionTotp(params operations.CommenterSessionTotpParams) middleware.Responder {
+	// Verify the code against the sign-in challenge. Challenges issued for a password sign-in can only be completed
+	// with CommenterLoginTotp
+	loginToken := models.HexID(params.LoginToken)
+	closeWindow := swag.BoolValue(params.Close)
+	userID, sessionHex, err := svc.TheTOTPService.TakeChallenge(loginToken, params.Code)
+	if err == util.ErrorInvalidTOTPCode {
+		// The challenge is still there: let the user try again
+		time.Sleep(util.WrongAuthDelay)
+		return commenterTOTPPage(http.StatusUnauthorized, loginToken, closeWindow, err.Error())
+	} else if err == svc.ErrNotFound || (err == nil && sessionHex == "") {
+		return messagePageResponse(
+			http.StatusBadRequest,
+			"Sign-in failed",
+			"The sign-in has expired or there were too many wrong codes. Please start over.")
+	} else if err == util.ErrorTOTPLocked {
+		return messagePageResponse(http.StatusBadRequest, "Sign-in failed", err.Error())
+	} else if err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Link the user to the session, signed in with the second factor
+	if err := svc.TheUserService.UpdateSessionByHex(sessionHex, userID, true); err != nil {
+		return messagePageResponse(http.StatusInternalServerError, "Sign-in failed", util.ErrorInternal.Error())
+	}
+
+	// Succeeded
+	return commenterSignedInResponse(closeWindow)
+}
+
+func CommenterSessions(params operations.CommenterSessionsParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Fetch the sessions, marking the one the request is made in
+	token := models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken))
+	sessions, err := svc.TheUserService.ListSessions(principal.GetHexID(), token)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterSessionsOK().WithPayload(&operations.CommenterSessionsOKBody{Sessions: sessions})
+}
+
+func CommenterSessionsDeleteOthers(params operations.CommenterSessionsDeleteOthersParams, principal data.Principal) middleware.Responder {
+	// Verify the commenter is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Delete all sessions but the one the request is made in
+	token := models.HexID(params.HTTPRequest.Header.Get(util.HeaderCommenterToken))
+	if err := svc.TheUserService.DeleteSessions(principal.GetHexID(), token); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewCommenterSessionsDeleteOthersNoContent()
+}
+
+func CommenterTokenNew(params operations.CommenterTokenNewParams) middleware.Responder {
 	// Create an "anonymous" session
-	token, err := svc.TheUserService.CreateCommenterSession("")
+	token, err := svc.TheUserService.CreateSession("", false, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -184,7 +519,7 @@ func CommenterUpdate(params operations.CommenterUpdateParams, principal data.Pri
 	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
 		return r
 	}
-	commenter := principal.(*data.UserCommenter)
+	commenter := principal.(*data.User)
 
 	// Only locally authenticated users can be updated
 	if commenter.Provider != "" {
@@ -192,13 +527,11 @@ func CommenterUpdate(params operations.CommenterUpdateParams, principal data.Pri
 	}
 
 	// Update the commenter in the database
-	err := svc.TheUserService.UpdateCommenter(
+	err := svc.TheUserService.UpdateUser(
 		commenter.HexID,
-		commenter.Email,
 		data.TrimmedString(params.Body.Name),
 		string(params.Body.WebsiteURL),
-		string(params.Body.AvatarURL),
-		commenter.Provider)
+		string(params.Body.AvatarURL))
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -206,3 +539,61 @@ func CommenterUpdate(params operations.CommenterUpdateParams, principal data.Pri
 	// Succeeded
 	return operations.NewCommenterUpdateNoContent()
 }
+
+// commenterSignedInResponse returns a responder to serve once a session is signed in from a separate window: one
+// closing the window if closeWindow is true, otherwise one rendering a message page
+func commenterSignedInResponse(closeWindow bool) middleware.Responder {
+	if closeWindow {
+		return closeParentWindowResponse()
+	}
+	return messagePageResponse(
+		http.StatusOK,
+		"Signed in",
+		"You are now signed in. You can close this page and return to the comments.")
+}
+
+// commenterTOTPPage returns a responder that renders a form asking for the second factor code to complete the sign-in
+// challenge with the given token. message, if any, is displayed above the form
+func commenterTOTPPage(code int, loginToken models.HexID, closeWindow bool, message string) middleware.Responder {
+	return NewHTMLResponder(
+		code,
+		fmt.Sprintf(
+			`<html lang="en">
+			<head>
+				<title>Two-factor authentication</title>
+			</head>
+			<body>
+				<h1>Two-factor authentication</h1>
+				<p>%s</p>
+				<form method="post" action="%s">
+					<input type="hidden" name="loginToken" value="%s">
+					<input type="hidden" name="close" value="%t">
+					<label>Code from your authenticator app, or a recovery code
+						<input name="code" autocomplete="one-time-code" minlength="6" maxlength="32" required autofocus>
+					</label>
+					<button type="submit">Sign in</button>
+				</form>
+			</body>
+			</html>`,
+			html.EscapeString(message),
+			html.EscapeString(config.URLForAPI("commenter/session/totp", nil)),
+			html.EscapeString(string(loginToken)),
+			closeWindow))
+}
+
+// signInCommenterSession links the user to the (existing) session with the given hex ID, and returns a nil responder.
+// If the user has two-factor authentication enabled, however, it issues a sign-in challenge for the session instead,
+// and returns a responder rendering a form for completing it with CommenterSessionTotp
+func signInCommenterSession(sessionHex models.HexID, user *data.User, closeWindow bool) (middleware.Responder, error) {
+	// If the user has two-factor authentication enabled, the session may only be signed in once they provide the code
+	if user.TOTPEnabled {
+		loginToken, err := svc.TheTOTPService.CreateChallenge(user.HexID, sessionHex)
+		if err != nil {
+			return nil, err
+		}
+		return commenterTOTPPage(http.StatusOK, loginToken, closeWindow, ""), nil
+	}
+
+	// Link the user to the session
+	return nil, svc.TheUserService.UpdateSessionByHex(sessionHex, user.HexID, false)
+}
@@ -4,28 +4,125 @@ import (
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/markbates/goth"
 	"gitlab.com/comentario/comentario/internal/api/exmodels"
+	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
+	"net"
 	"net/url"
 	"strings"
+	"time"
 )
 
-func DomainClear(params operations.DomainClearParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
+func DomainBanDelete(params operations.DomainBanDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user can moderate the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Delete the ban
+	if err := svc.TheBanService.Delete(domain, *params.Body.BanHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainBanDeleteNoContent()
+}
+
+func DomainBanList(params operations.DomainBanListParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user can moderate the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Fetch the bans
+	bans, err := svc.TheBanService.ListByDomain(domain)
 	if err != nil {
 		return respServiceError(err)
 	}
 
+	// Succeeded
+	return operations.NewDomainBanListOK().WithPayload(&operations.DomainBanListOKBody{Bans: bans})
+}
+
+func DomainBanNew(params operations.DomainBanNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows moderation
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeModeration); r != nil {
+		return r
+	}
+
+	// Verify the user can moderate the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
+	// Verify the ban targets somebody. The anonymous commenter stands for everyone not logged in, so it can't be banned
+	// as a whole
+	ban := &models.Ban{
+		Domain:       domain,
+		CommenterHex: params.Body.CommenterHex,
+		Email:        strings.TrimSpace(params.Body.Email),
+		IP:           strings.TrimSpace(params.Body.IP),
+		Shadow:       params.Body.Shadow,
+		Reason:       strings.TrimSpace(params.Body.Reason),
+		CreatorHex:   principal.GetHexID(),
+	}
+	if ban.CommenterHex == data.AnonymousCommenter.HexID {
+		return respBadRequest(util.ErrorInvalidAction)
+	} else if ban.CommenterHex == "" && ban.Email == "" && ban.IP == "" {
+		return respBadRequest(util.ErrorMissingField)
+	}
+
+	// Verify the IP is a valid address or range
+	if ban.IP != "" && net.ParseIP(ban.IP) == nil {
+		if _, _, err := net.ParseCIDR(ban.IP); err != nil {
+			return respBadRequest(util.ErrorInvalidIP)
+		}
+	}
+
+	// An expiry date is optional
+	if !time.Time(params.Body.ExpiryDate).IsZero() {
+		ban.ExpiryDate = &params.Body.ExpiryDate
+	}
+
+	// Persist the ban
+	if err := svc.TheBanService.Create(ban); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainBanNewOK().WithPayload(&operations.DomainBanNewOKBody{Ban: ban})
+}
+
+func DomainClear(params operations.DomainClearParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
 	// Verify the user owns the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionOwn); r != nil {
 		return r
 	}
 
 	// Clear all domain's pages/comments/votes
-	if err = svc.TheDomainService.Clear(domain); err != nil {
+	if err := svc.TheDomainService.Clear(domain); err != nil {
 		return respServiceError(err)
 	}
 
@@ -33,20 +130,20 @@ func DomainClear(params operations.DomainClearParams) middleware.Responder {
 	return operations.NewDomainClearNoContent()
 }
 
-func DomainDelete(params operations.DomainDeleteParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainDelete(params operations.DomainDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
 	// Verify the user owns the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionOwn); r != nil {
 		return r
 	}
 
 	// Delete the domain
-	if err = svc.TheDomainService.Delete(domain); err != nil {
+	if err := svc.TheDomainService.Delete(domain); err != nil {
 		return respServiceError(err)
 	}
 
@@ -54,40 +151,119 @@ func DomainDelete(params operations.DomainDeleteParams) middleware.Responder {
 	return operations.NewDomainDeleteNoContent()
 }
 
+func DomainDeletedPurge(params operations.DomainDeletedPurgeParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Purge all comments deleted so far
+	if err := svc.TheCommentService.PurgeDeleted(domain, time.Now().UTC()); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainDeletedPurgeNoContent()
+}
+
+func DomainInvitationList(params operations.DomainInvitationListParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Fetch the domain's invitations
+	invitations, err := svc.TheInvitationService.ListByDomain(domain)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainInvitationListOK().
+		WithPayload(&operations.DomainInvitationListOKBody{Invitations: invitations})
+}
+
+func DomainInvitationRevoke(params operations.DomainInvitationRevokeParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Revoke the invitation
+	if err := svc.TheInvitationService.Revoke(domain, *params.Body.InvitationHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainInvitationRevokeNoContent()
+}
+
 func DomainList(_ operations.DomainListParams, principal data.Principal) middleware.Responder {
-	// Fetch domains by the owner
-	domains, err := svc.TheDomainService.ListByOwner(principal.GetUser().HexID)
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeStats); r != nil {
+		return r
+	}
+
+	// Fetch domains the user has any role in
+	domains, err := svc.TheDomainService.ListByUser(principal.GetHexID())
 	if err != nil {
 		return respServiceError(err)
 	}
 
+	// Only those allowed to configure a domain may see its SSO secret and verification token
+	for _, d := range domains {
+		if !data.DomainRolesAllow(d.Roles, data.DomainPermissionConfigure) {
+			d.SsoSecret = ""
+			d.VerificationToken = ""
+		}
+	}
+
 	// Prepare an IdentityProviderMap
 	idps := exmodels.IdentityProviderMap{}
-	for idp, gothIdP := range util.FederatedIdProviders {
-		idps[idp] = goth.GetProviders()[gothIdP] != nil
+	for idp, fidp := range util.FederatedIdProviders {
+		idps[idp] = goth.GetProviders()[fidp.GothID] != nil
 	}
 
 	// Succeeded
 	return operations.NewDomainListOK().WithPayload(&operations.DomainListOKBody{
 		ConfiguredOauths: idps,
 		Domains:          domains,
+		FederatedIdps:    configuredFederatedIdps(),
 	})
 }
 
-func DomainModeratorDelete(params operations.DomainModeratorDeleteParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainModeratorDelete(params operations.DomainModeratorDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
 	// Delete the moderator from the database
-	if err = svc.TheDomainService.DeleteModerator(domain, data.EmailToString(params.Body.Email)); err != nil {
+	if err := svc.TheDomainService.RemoveUser(domain, data.EmailToString(params.Body.Email), models.DomainRoleModerator); err != nil {
 		return respServiceError(err)
 	}
 
@@ -95,20 +271,25 @@ func DomainModeratorDelete(params operations.DomainModeratorDeleteParams) middle
 	return operations.NewDomainModeratorDeleteNoContent()
 }
 
-func DomainModeratorNew(params operations.DomainModeratorNewParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainModeratorNew(params operations.DomainModeratorNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
-	// Register a new domain moderator
-	if _, err := svc.TheDomainService.CreateModerator(domain, data.EmailToString(params.Body.Email)); err != nil {
+	// Make sure SMTP is configured, since the invitation has to be emailed
+	if !config.SMTPConfigured {
+		return respBadRequest(util.ErrorSMTPNotConfigured)
+	}
+
+	// Invite a new domain moderator
+	if err := emailInvitation(principal.GetUser(), domain, data.EmailToString(params.Body.Email), models.DomainRoleModerator); err != nil {
 		return respServiceError(err)
 	}
 
@@ -116,10 +297,28 @@ func DomainModeratorNew(params operations.DomainModeratorNewParams) middleware.R
 	return operations.NewDomainModeratorNewNoContent()
 }
 
-func DomainNew(params operations.DomainNewParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainNew(params operations.DomainNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+	user := principal.GetUser()
+
+	// Any user can sign in to the admin UI, so a user adding their first domain becomes a new owner, which is subject
+	// to the owner signup rules. Superusers are exempt from those
+	if !user.Superuser {
+		if domains, err := svc.TheDomainService.ListByOwner(user.HexID); err != nil {
+			return respServiceError(err)
+		} else if len(domains) == 0 {
+			if !config.CLIFlags.AllowNewOwners {
+				return respForbidden(util.ErrorNewOwnerForbidden)
+			}
+			if ok, err := svc.TheAdminService.IsSignupAllowed(user.Email); err != nil {
+				return respServiceError(err)
+			} else if !ok {
+				return respForbidden(util.ErrorSignupNotAllowed)
+			}
+		}
 	}
 
 	// If the domain name contains a non-hostname char, parse the passed domain as a URL to only keep the host part
@@ -143,30 +342,30 @@ func DomainNew(params operations.DomainNewParams) middleware.Responder {
 		return respBadRequest(util.ErrorInvalidDomainHost)
 	}
 
-	// Persist a new domain record in the database
+	// Persist a new domain record in the database, or a claim of a domain pending someone else's verification
 	domain, err := svc.TheDomainService.Create(user.HexID, data.TrimmedString(params.Body.Name), domainName)
-	if err != nil {
-		return respServiceError(err)
-	}
-
-	// Register the current owner as a domain moderator
-	if _, err := svc.TheDomainService.CreateModerator(domain.Domain, user.Email); err != nil {
+	if err == util.ErrorDomainAlreadyExists {
+		return respBadRequest(err)
+	} else if err != nil {
 		return respServiceError(err)
 	}
 
 	// Succeeded
-	return operations.NewDomainNewOK().WithPayload(&operations.DomainNewOKBody{Domain: domain.Domain})
+	return operations.NewDomainNewOK().WithPayload(&operations.DomainNewOKBody{
+		Domain:            domain.Domain,
+		VerificationToken: models.HexID(domain.VerificationToken),
+	})
 }
 
-func DomainSsoSecretNew(params operations.DomainSsoSecretNewParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainSsoSecretNew(params operations.DomainSsoSecretNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
@@ -180,15 +379,15 @@ func DomainSsoSecretNew(params operations.DomainSsoSecretNewParams) middleware.R
 	return operations.NewDomainSsoSecretNewOK().WithPayload(&operations.DomainSsoSecretNewOKBody{SsoSecret: token})
 }
 
-func DomainStatistics(params operations.DomainStatisticsParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainStatistics(params operations.DomainStatisticsParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeStats); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can view the domain statistics
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionViewStats); r != nil {
 		return r
 	}
 
@@ -211,29 +410,242 @@ func DomainStatistics(params operations.DomainStatisticsParams) middleware.Respo
 	})
 }
 
-func DomainUpdate(params operations.DomainUpdateParams) middleware.Responder {
-	// Find the owner user
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
+func DomainUpdate(params operations.DomainUpdateParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	settings := params.Body.Domain
+	if r := Verifier.PrincipalHasDomainPermission(principal, settings.Domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Fetch the domain: settings not provided keep their current values
+	domain, err := svc.TheDomainService.FindByName(settings.Domain)
 	if err != nil {
 		return respServiceError(err)
 	}
 
-	// Verify the user owns the domain
-	domain := params.Body.Domain
-	if r := Verifier.UserOwnsDomain(user.HexID, domain.Domain); r != nil {
-		return r
+	// Only owners can freeze or unfreeze the domain
+	if settings.State != "" && settings.State != domain.State {
+		if r := Verifier.PrincipalHasDomainPermission(principal, domain.Domain, data.DomainPermissionOwn); r != nil {
+			return r
+		}
 	}
 
 	// Validate SSO provider
-	if domain.Idps["sso"] && domain.SsoURL == "" {
+	ssoEnabled, ssoURL := domain.Idps["sso"], domain.SsoURL
+	if settings.Idps != nil {
+		ssoEnabled = settings.Idps["sso"]
+	}
+	if settings.SsoURL != nil {
+		ssoURL = *settings.SsoURL
+	}
+	if ssoEnabled && ssoURL == "" {
 		return respBadRequest(util.ErrorSSOURLMissing)
 	}
 
 	// Update the domain record
-	if err := svc.TheDomainService.Update(domain); err != nil {
+	if err := svc.TheDomainService.Update(domain.Domain, settings); err != nil {
 		return respServiceError(err)
 	}
 
 	// Succeeded
 	return operations.NewDomainUpdateNoContent()
 }
+
+func DomainUserDelete(params operations.DomainUserDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user is allowed to manage the role in question
+	domain := data.TrimmedString(params.Body.Domain)
+	role := *params.Body.Role
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainRoleManagePermission(role)); r != nil {
+		return r
+	}
+
+	// Take the role away
+	if err := svc.TheDomainService.RemoveUser(domain, data.EmailToString(params.Body.Email), role); err == util.ErrorLastDomainOwner {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainUserDeleteNoContent()
+}
+
+func DomainUserList(params operations.DomainUserListParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Fetch the domain's users
+	users, err := svc.TheDomainService.ListUsers(domain)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainUserListOK().WithPayload(&operations.DomainUserListOKBody{Users: users})
+}
+
+func DomainUserNew(params operations.DomainUserNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user is allowed to manage the role in question
+	domain := data.TrimmedString(params.Body.Domain)
+	role := *params.Body.Role
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainRoleManagePermission(role)); r != nil {
+		return r
+	}
+
+	// Make sure SMTP is configured, since the invitation has to be emailed
+	if !config.SMTPConfigured {
+		return respBadRequest(util.ErrorSMTPNotConfigured)
+	}
+
+	// Invite the user to take the role
+	if err := emailInvitation(principal.GetUser(), domain, data.EmailToString(params.Body.Email), role); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainUserNewNoContent()
+}
+
+func DomainVerify(params operations.DomainVerifyParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain. Otherwise, they may have claimed it, and check their own proof
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		if principal.IsAnonymous() {
+			return r
+		}
+		verified, err := svc.TheDomainVerificationService.VerifyClaim(domain, principal.GetHexID())
+		if err == svc.ErrNotFound {
+			return r
+		} else if err != nil {
+			return respServiceError(err)
+		}
+		return operations.NewDomainVerifyOK().WithPayload(&operations.DomainVerifyOKBody{Verified: verified})
+	}
+
+	// Check the domain's ownership proof
+	verified, err := svc.TheDomainVerificationService.Verify(domain)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainVerifyOK().WithPayload(&operations.DomainVerifyOKBody{Verified: verified})
+}
+
+func DomainWebhookDelete(params operations.DomainWebhookDeleteParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Delete the webhook
+	if err := svc.TheWebhookService.Delete(domain, *params.Body.WebhookHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainWebhookDeleteNoContent()
+}
+
+func DomainWebhookDeliveries(params operations.DomainWebhookDeliveriesParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Fetch the webhook's deliveries
+	deliveries, err := svc.TheWebhookService.ListDeliveries(domain, *params.Body.WebhookHex)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainWebhookDeliveriesOK().
+		WithPayload(&operations.DomainWebhookDeliveriesOKBody{Deliveries: deliveries})
+}
+
+func DomainWebhookList(params operations.DomainWebhookListParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Fetch the domain's webhooks
+	webhooks, err := svc.TheWebhookService.ListByDomain(domain)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainWebhookListOK().WithPayload(&operations.DomainWebhookListOKBody{Webhooks: webhooks})
+}
+
+func DomainWebhookNew(params operations.DomainWebhookNewParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
+	}
+
+	// Verify the user can configure the domain
+	domain := data.TrimmedString(params.Body.Domain)
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
+		return r
+	}
+
+	// Register a new webhook
+	webhook, err := svc.TheWebhookService.Create(domain, data.URIToString(params.Body.URL), params.Body.Events)
+	if err == util.ErrorInvalidWebhookURL {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewDomainWebhookNewOK().WithPayload(&operations.DomainWebhookNewOKBody{Webhook: webhook})
+}
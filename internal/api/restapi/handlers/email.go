@@ -4,6 +4,7 @@ import (
 	"github.com/go-openapi/runtime/middleware"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
@@ -38,18 +39,17 @@ func EmailModerate(params operations.EmailModerateParams) middleware.Responder {
 		return respServiceError(err)
 	}
 
-	// Verify the user is a domain moderator
-	if r := Verifier.UserIsDomainModerator(string(email.Email), comment.Domain); r != nil {
-		return r
-	}
-
-	// TODO this must be changed to using hex ID or IdP
-	// Find (any) commenter with that email
-	commenter, err := svc.TheUserService.FindCommenterByEmail(string(email.Email))
+	// Find the user with that email
+	user, err := svc.TheUserService.FindUserByEmail(string(email.Email), false)
 	if err != nil {
 		return respServiceError(err)
 	}
 
+	// Verify the user is a domain moderator
+	if r := Verifier.PrincipalHasDomainPermission(user, comment.Domain, data.DomainPermissionModerate); r != nil {
+		return r
+	}
+
 	// Perform the appropriate action
 	switch params.Action {
 	case "approve":
@@ -57,7 +57,7 @@ func EmailModerate(params operations.EmailModerateParams) middleware.Responder {
 			return respServiceError(err)
 		}
 	case "delete":
-		if err := svc.TheCommentService.MarkDeleted(comment.CommentHex, commenter.HexID); err != nil {
+		if err := svc.TheCommentService.MarkDeleted(comment.CommentHex, user.HexID); err != nil {
 			return respServiceError(err)
 		}
 	default:
@@ -84,12 +84,57 @@ func EmailUpdate(params operations.EmailUpdateParams) middleware.Responder {
 	return operations.NewEmailUpdateNoContent()
 }
 
+// emailConfirmation creates a new confirmation token for the given user and mails them a link to the given API path,
+// passing the token as the confirmHex parameter
+func emailConfirmation(user *data.User, path string) error {
+	// Create a new confirmation token
+	token, err := svc.TheUserService.CreateConfirmationToken(user.HexID)
+	if err != nil {
+		return err
+	}
+
+	// Send a confirmation email
+	return svc.TheMailService.SendFromTemplate(
+		"",
+		user.Email,
+		"Please confirm your email address",
+		"confirm-hex.gohtml",
+		map[string]any{
+			"URL":        config.URLForAPI(path, map[string]string{"confirmHex": string(token)}),
+			"ValidHours": int(util.ConfirmationTokenTTL.Hours()),
+		})
+}
+
+// emailInvitation creates a new invitation of the given email to take the specified role in the domain, and mails the
+// invitee a link to accept it
+func emailInvitation(inviter *data.User, domain, email string, role models.DomainRole) error {
+	// Create a new invitation
+	token, err := svc.TheInvitationService.Create(domain, email, role, inviter.HexID)
+	if err != nil {
+		return err
+	}
+
+	// Send an invitation email
+	return svc.TheMailService.SendFromTemplate(
+		"",
+		email,
+		"You have been invited to "+domain,
+		"domain-invitation.gohtml",
+		map[string]any{
+			"Domain":      domain,
+			"InviterName": inviter.Name,
+			"Role":        role,
+			"URL":         config.URLFor("invitation", map[string]string{"token": string(token)}),
+			"ValidDays":   int(util.InvitationTTL / util.OneDay),
+		})
+}
+
 func emailNotificationModerator(d *models.Domain, path string, title string, commenterHex models.HexID, commentHex models.HexID, html string, state models.CommentState) {
 	// Find the related commenter
 	commenter := &data.AnonymousCommenter
 	if commenterHex != data.AnonymousCommenter.HexID {
 		var err error
-		if commenter, err = svc.TheUserService.FindCommenterByID(commenterHex); err != nil {
+		if commenter, err = svc.TheUserService.FindUserByID(commenterHex); err != nil {
 			// Failed to retrieve, give up
 			return
 		}
@@ -139,16 +184,16 @@ func emailNotificationReply(d *models.Domain, path string, title string, comment
 		return
 	}
 
-	// Find the parent commenter
-	parentCommenter, err := svc.TheUserService.FindCommenterByID(parentComment.CommenterHex)
-	if err != nil {
+	// Find the parent commenter. Unconfirmed emails may belong to someone else, so they get no notifications
+	parentCommenter, err := svc.TheUserService.FindUserByID(parentComment.CommenterHex)
+	if err != nil || parentCommenter.IsUnconfirmedLocal() {
 		return
 	}
 
 	// Find the commenter for the comment in question
 	commenter := &data.AnonymousCommenter
 	if commenterHex != data.AnonymousCommenter.HexID {
-		if commenter, err = svc.TheUserService.FindCommenterByID(commenterHex); err != nil {
+		if commenter, err = svc.TheUserService.FindUserByID(commenterHex); err != nil {
 			return
 		}
 	}
@@ -176,29 +221,57 @@ func emailNotificationReply(d *models.Domain, path string, title string, comment
 }
 
 func emailNotificationNew(d *models.Domain, c *models.Comment) {
-	// Fetch the page
-	page, err := svc.ThePageService.FindByDomainPath(d.Domain, c.Path)
+	// Fetch the page title
+	title, err := emailPageTitle(d, c.Path)
 	if err != nil {
 		logger.Errorf("cannot get page to send email notification: %v", err)
 		return
 	}
 
-	// If the page has no title, try to fetch it
-	if page.Title == "" {
-		if page.Title, err = svc.ThePageService.UpdateTitleByDomainPath(d.Domain, c.Path); err != nil {
-			// Failed, just use the domain name
-			page.Title = d.Domain
-		}
-	}
-
 	// Send an email notification to moderators, if we notify about every comment or comments pending moderation and
 	// the comment isn't approved yet
 	if d.EmailNotificationPolicy == models.EmailNotificationPolicyAll || d.EmailNotificationPolicy == models.EmailNotificationPolicyPendingDashModeration && c.State != models.CommentStateApproved {
-		emailNotificationModerator(d, c.Path, page.Title, c.CommenterHex, c.CommentHex, c.HTML, c.State)
+		emailNotificationModerator(d, c.Path, title, c.CommenterHex, c.CommentHex, c.HTML, c.State)
 	}
 
 	// If it's a reply and the comment is approved, send out a reply notifications
 	if c.ParentHex != data.RootParentHexID && c.State == models.CommentStateApproved {
-		emailNotificationReply(d, c.Path, page.Title, c.CommenterHex, c.CommentHex, models.HexID(c.ParentHex), c.HTML)
+		emailNotificationReply(d, c.Path, title, c.CommenterHex, c.CommentHex, models.HexID(c.ParentHex), c.HTML)
+	}
+}
+
+// emailNotificationReported notifies the domain moderators of a comment flagged by reader reports, unless email
+// notifications are disabled for the domain
+func emailNotificationReported(d *models.Domain, c *models.Comment) {
+	if d.EmailNotificationPolicy == models.EmailNotificationPolicyNone {
+		return
+	}
+
+	// Fetch the page title
+	title, err := emailPageTitle(d, c.Path)
+	if err != nil {
+		logger.Errorf("cannot get page to send email notification: %v", err)
+		return
+	}
+
+	// Send an email notification to moderators
+	emailNotificationModerator(d, c.Path, title, c.CommenterHex, c.CommentHex, c.HTML, models.CommentStateFlagged)
+}
+
+// emailPageTitle returns the title of the page with the given path on the given domain, for use in notification emails
+func emailPageTitle(d *models.Domain, path string) (string, error) {
+	// Fetch the page
+	page, err := svc.ThePageService.FindByDomainPath(d.Domain, path)
+	if err != nil {
+		return "", err
+	}
+
+	// If the page has no title, try to fetch it
+	if page.Title == "" {
+		if page.Title, err = svc.ThePageService.UpdateTitleByDomainPath(d.Domain, path); err != nil {
+			// Failed, just use the domain name
+			page.Title = d.Domain
+		}
 	}
+	return page.Title, nil
 }
@@ -13,21 +13,21 @@ import (
 	"io"
 )
 
-func DomainExportBegin(params operations.DomainExportBeginParams) middleware.Responder {
+func DomainExportBegin(params operations.DomainExportBeginParams, principal data.Principal) middleware.Responder {
 	// Make sure SMTP is configured
 	if !config.SMTPConfigured {
 		return respBadRequest(util.ErrorSMTPNotConfigured)
 	}
 
-	// Find the owner user
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
+	user := principal.GetUser()
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
@@ -51,15 +51,15 @@ func DomainExportDownload(params operations.DomainExportDownloadParams) middlewa
 		WithPayload(io.NopCloser(bytes.NewReader(binData)))
 }
 
-func DomainImportCommento(params operations.DomainImportCommentoParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainImportCommento(params operations.DomainImportCommentoParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
@@ -73,15 +73,15 @@ func DomainImportCommento(params operations.DomainImportCommentoParams) middlewa
 	return operations.NewDomainImportCommentoOK().WithPayload(&operations.DomainImportCommentoOKBody{NumImported: count})
 }
 
-func DomainImportDisqus(params operations.DomainImportDisqusParams) middleware.Responder {
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
-	if err != nil {
-		return respServiceError(err)
+func DomainImportDisqus(params operations.DomainImportDisqusParams, principal data.Principal) middleware.Responder {
+	// Verify the API token, if any, allows doing that
+	if r := Verifier.PrincipalHasAPIScope(principal, models.APITokenScopeAdmin); r != nil {
+		return r
 	}
 
-	// Verify the user owns the domain
+	// Verify the user can configure the domain
 	domain := data.TrimmedString(params.Body.Domain)
-	if r := Verifier.UserOwnsDomain(user.HexID, domain); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, domain, data.DomainPermissionConfigure); r != nil {
 		return r
 	}
 
@@ -8,14 +8,18 @@ import (
 	"fmt"
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/pkg/errors"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -37,20 +41,16 @@ var commenterTokens = &util.SafeStringMap[models.HexID]{}
 
 // OauthInit initiates a federated authentication process
 func OauthInit(params operations.OauthInitParams) middleware.Responder {
-	// Map the provider to a goth provider
-	gothIdP := util.FederatedIdProviders[params.Provider]
-	if gothIdP == "" {
+	// Get the provider instance by its ID (coming from the path parameter)
+	provider, err := oauthProvider(params.Provider)
+	if err == util.ErrorUnknownIdP {
 		return respBadRequest(fmt.Errorf("unknown provider: %s", params.Provider))
-	}
-
-	// Get the registered provider instance by its name (coming from the path parameter)
-	provider, err := goth.GetProvider(gothIdP)
-	if err != nil {
-		return respBadRequest(fmt.Errorf("%s (%s)", util.ErrorOAuthNotConfigured.Error(), params.Provider))
+	} else if err != nil {
+		return respBadRequest(fmt.Errorf("%s (%s)", err.Error(), params.Provider))
 	}
 
 	// Verify the provided commenter token
-	if _, err = svc.TheUserService.FindCommenterByToken(models.HexID(params.CommenterToken)); err != nil && err != svc.ErrNotFound {
+	if _, err = svc.TheUserService.FindUserBySession(models.HexID(params.CommenterToken)); err != nil && err != svc.ErrNotFound {
 		return oauthFailure(err)
 	}
 
@@ -92,15 +92,11 @@ func OauthInit(params operations.OauthInitParams) middleware.Responder {
 }
 
 func OauthCallback(params operations.OauthCallbackParams) middleware.Responder {
-	// Map the provider to a goth provider
-	gothIdP := util.FederatedIdProviders[params.Provider]
-	if gothIdP == "" {
-		return respBadRequest(util.ErrorUnknownIdP)
-	}
-
-	// Get the registered provider instance by its name (coming from the path parameter)
-	provider, err := goth.GetProvider(gothIdP)
-	if err != nil {
+	// Get the provider instance by its ID (coming from the path parameter)
+	provider, err := oauthProvider(params.Provider)
+	if err == util.ErrorUnknownIdP {
+		return respBadRequest(err)
+	} else if err != nil {
 		logger.Debugf("Failed to fetch provider '%s': %v", params.Provider, err)
 		return oauthFailure(fmt.Errorf("provider not configured: %s", params.Provider))
 	}
@@ -146,6 +142,12 @@ func OauthCallback(params operations.OauthCallbackParams) middleware.Responder {
 		return oauthFailure(errors.New("fetching user"))
 	}
 
+	// Mastodon doesn't disclose user emails, so make up a stable, undeliverable one from the account ID
+	isMastodon := strings.HasPrefix(params.Provider, util.MastodonIdPPrefix)
+	if isMastodon && fedUser.UserID != "" {
+		fedUser.Email = fedUser.UserID + "@" + strings.TrimPrefix(params.Provider, util.MastodonIdPPrefix) + ".invalid"
+	}
+
 	// Obtain the commenter token: if it isn't present in the state param (Twitter doesn't support state), try to find
 	// it in the token store
 	commenterToken := models.HexID(reqParams.Get("state"))
@@ -173,42 +175,24 @@ func OauthCallback(params operations.OauthCallbackParams) middleware.Responder {
 	}
 
 	// Try to find the corresponding commenter by their token
-	if _, err := svc.TheUserService.FindCommenterByToken(commenterToken); err != nil && err != svc.ErrNotFound {
-		return oauthFailure(err)
-	}
-
-	// Now try to find an existing commenter by their email
-	var commenterHex models.HexID
-	if commenter, err := svc.TheUserService.FindCommenterByIdPEmail(params.Provider, fedUser.Email, false); err == nil {
-		// Commenter found
-		commenterHex = commenter.HexID
-
-	} else if err != svc.ErrNotFound {
-		// Any other error than "not found"
+	if _, err := svc.TheUserService.FindUserBySession(commenterToken); err != nil && err != svc.ErrNotFound {
 		return oauthFailure(err)
 	}
 
-	// No such commenter yet: it's a signup
-	if commenterHex == "" {
-		// Create a new commenter
-		if c, err := svc.TheUserService.CreateCommenter(fedUser.Email, fedUser.Name, "", fedUser.AvatarURL, params.Provider, ""); err != nil {
-			return oauthFailure(err)
-		} else {
-			commenterHex = c.HexID
-		}
-
-		// Commenter already exists: it's a login. Update commenter's details
-	} else if err := svc.TheUserService.UpdateCommenter(commenterHex, fedUser.Email, fedUser.Name, "", fedUser.AvatarURL, params.Provider); err != nil {
-		return oauthFailure(err)
-	}
-
-	// Link the commenter to the session token
-	if err := svc.TheUserService.UpdateCommenterSession(commenterToken, commenterHex); err != nil {
+	// Log the user in, signing them up if necessary. OAuth providers verify user emails, so the identity can be linked
+	// to an existing user with that email. Generic OpenID Connect providers, however, must explicitly say so, and
+	// Mastodon emails are made up
+	canLink := !isMastodon &&
+		(!strings.HasPrefix(params.Provider, util.OIDCIdPPrefix) || oidcEmailVerified(fedUser.RawData))
+	r, err := oauthLoginUser(commenterToken, params.Provider, fedUser.Email, fedUser.Name, "", fedUser.AvatarURL, canLink)
+	if err != nil {
 		return oauthFailure(err)
+	} else if r == nil {
+		r = closeParentWindowResponse()
 	}
 
-	// Succeeded: close the parent window, removing the auth session cookie
-	return NewCookieResponder(closeParentWindowResponse()).WithoutCookie(util.CookieNameAuthSession, "/")
+	// Succeeded: close the parent window (or ask for the second factor), removing the auth session cookie
+	return NewCookieResponder(r).WithoutCookie(util.CookieNameAuthSession, "/")
 }
 
 func OauthSsoInit(params operations.OauthSsoInitParams) middleware.Responder {
@@ -219,7 +203,7 @@ func OauthSsoInit(params operations.OauthSsoInitParams) middleware.Responder {
 
 	// Try to find the commenter by token
 	commenterToken := models.HexID(params.CommenterToken)
-	if _, err = svc.TheUserService.FindCommenterByToken(commenterToken); err != nil && err != svc.ErrNotFound {
+	if _, err = svc.TheUserService.FindUserBySession(commenterToken); err != nil && err != svc.ErrNotFound {
 		return oauthFailure(err)
 	}
 
@@ -332,43 +316,37 @@ func OauthSsoCallback(params operations.OauthSsoCallbackParams) middleware.Respo
 	}
 
 	// Try to find the corresponding commenter by their token
-	if _, err := svc.TheUserService.FindCommenterByToken(commenterToken); err != nil && err != svc.ErrNotFound {
+	if _, err := svc.TheUserService.FindUserBySession(commenterToken); err != nil && err != svc.ErrNotFound {
 		return oauthFailure(err)
 	}
 
-	// Now try to find an existing commenter by their email
-	var commenterHex models.HexID
+	// Log the user in, signing them up if necessary. Any SSO can claim an arbitrary email, so its identity must never
+	// get linked to an existing user
 	idp := "sso:" + domain.Domain
-	if commenter, err := svc.TheUserService.FindCommenterByIdPEmail(idp, payload.Email, false); err == nil {
-		// Commenter found
-		commenterHex = commenter.HexID
-
-	} else if err != svc.ErrNotFound {
-		// Any other error than "not found"
+	r, err := oauthLoginUser(commenterToken, idp, payload.Email, payload.Name, payload.Link, payload.Photo, false)
+	if err != nil {
 		return oauthFailure(err)
+	} else if r == nil {
+		r = closeParentWindowResponse()
 	}
 
-	// No such commenter yet: it's a signup
-	if commenterHex == "" {
-		// Create a new commenter
-		if c, err := svc.TheUserService.CreateCommenter(payload.Email, payload.Name, payload.Link, payload.Photo, idp, ""); err != nil {
-			return oauthFailure(err)
-		} else {
-			commenterHex = c.HexID
-		}
+	// Succeeded: close the parent window (or ask for the second factor)
+	return r
+}
 
-		// Commenter already exists: it's a login. Update commenter's details
-	} else if err := svc.TheUserService.UpdateCommenter(commenterHex, payload.Email, payload.Name, payload.Link, payload.Photo, idp); err != nil {
-		return oauthFailure(err)
+// configuredFederatedIdps returns a list of federated identity providers configured on the server, ordered by ID
+func configuredFederatedIdps() []*models.FederatedIdp {
+	var res []*models.FederatedIdp
+	for id, fidp := range util.FederatedIdProviders {
+		if goth.GetProviders()[fidp.GothID] != nil {
+			res = append(res, &models.FederatedIdp{ID: id, Name: fidp.Name, Icon: fidp.Icon})
+		}
 	}
-
-	// Link the commenter to the session token
-	if err := svc.TheUserService.UpdateCommenterSession(commenterToken, commenterHex); err != nil {
-		return oauthFailure(err)
+	if config.SecretsConfig.IdP.Mastodon.Enable {
+		res = append(res, &models.FederatedIdp{ID: "mastodon", Name: "Mastodon"})
 	}
-
-	// Succeeded: close the parent window
-	return closeParentWindowResponse()
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
 }
 
 // getSessionState extracts the state parameter from the given session's URL
@@ -408,6 +386,86 @@ func oauthFailure(err error) middleware.Responder {
 		WithoutCookie(util.CookieNameAuthSession, "/")
 }
 
+// oauthLoginUser finds the user having the given identity, or signs a new one up, and binds the session token to them.
+// If canLink is true, an identity not known yet gets linked to the existing user with the same email, if any, provided
+// that user has confirmed their email. Returns util.ErrorEmailAlreadyExists if the email belongs to another user. If
+// the user has two-factor authentication enabled, the session isn't bound yet, and the returned responder asks for
+// the code instead; otherwise the responder is nil
+func oauthLoginUser(token models.HexID, idp, email, name, websiteURL, photoURL string, canLink bool) (middleware.Responder, error) {
+	// Try to find the user by their identity
+	user, err := svc.TheUserService.FindUserByIdentity(idp, email, true)
+	if err == svc.ErrNotFound {
+		// Not found: link the identity to the user with that email, if allowed
+		if canLink {
+			if user, err = svc.TheUserService.FindUserByEmail(email, false); err == nil {
+				// An account with an unconfirmed email could have been registered by anyone, so don't hand it over
+				if !user.EmailConfirmed {
+					return nil, util.ErrorEmailAlreadyExists
+				}
+				err = svc.TheUserService.LinkIdentity(user.HexID, idp, email)
+			}
+		}
+
+		// No such user yet: it's a signup
+		if user == nil && (err == nil || err == svc.ErrNotFound) {
+			user, err = svc.TheUserService.CreateUser(email, name, websiteURL, photoURL, idp, "", false)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// User already exists: it's a login. Update their details, unless they manage their profile themselves
+	} else if err != nil {
+		return nil, err
+	} else if user.PasswordHash == "" {
+		if err := svc.TheUserService.UpdateUser(user.HexID, name, websiteURL, photoURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// Link the user to the session token, or ask for the second factor first
+	sessionHex, err := svc.TheUserService.FindSessionHex(token)
+	if err != nil {
+		return nil, err
+	}
+	return signInCommenterSession(sessionHex, user, true)
+}
+
+// oauthProvider returns a goth provider for the given federated identity provider ID. Returns util.ErrorUnknownIdP if
+// there's no such provider, and util.ErrorOAuthNotConfigured if it isn't configured
+func oauthProvider(id string) (goth.Provider, error) {
+	// Mastodon providers are set up on the fly, one per instance
+	if strings.HasPrefix(id, util.MastodonIdPPrefix) {
+		if !config.SecretsConfig.IdP.Mastodon.Enable {
+			return nil, util.ErrorOAuthNotConfigured
+		}
+		return svc.TheMastodonService.Provider(strings.TrimPrefix(id, util.MastodonIdPPrefix))
+	}
+
+	// Any other provider must be registered on configuration
+	fidp, ok := util.FederatedIdProviders[id]
+	if !ok {
+		return nil, util.ErrorUnknownIdP
+	}
+	provider, err := goth.GetProvider(fidp.GothID)
+	if err != nil {
+		return nil, util.ErrorOAuthNotConfigured
+	}
+	return provider, nil
+}
+
+// oidcEmailVerified returns whether the given OpenID Connect claims state the user's email has been verified
+func oidcEmailVerified(claims map[string]any) bool {
+	switch v := claims[openidConnect.EmailVerifiedClaim].(type) {
+	case bool:
+		return v
+	case string:
+		// Some providers return the claim as a string
+		return v == "true"
+	}
+	return false
+}
+
 // validateAuthSessionState verifies the session token initially submitted, if any, is matching the one returned with
 // the given callback request
 func validateAuthSessionState(sess goth.Session, req *http.Request) error {
@@ -9,14 +9,75 @@ import (
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
-	"golang.org/x/crypto/bcrypt"
 	"time"
 )
 
+func OwnerAPITokenDelete(params operations.OwnerAPITokenDeleteParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Delete the token
+	if err := svc.TheUserService.DeleteAPIToken(user.HexID, *params.Body.TokenHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerAPITokenDeleteNoContent()
+}
+
+func OwnerAPITokenNew(params operations.OwnerAPITokenNewParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Validate the expiry, regardless of what the spec allows, as a huge value would overflow the date
+	days := swag.Int64Value(params.Body.ExpiresInDays)
+	if days < util.APITokenMinDays || days > util.APITokenMaxDays {
+		return respBadRequest(util.ErrorInvalidTokenExpiry)
+	}
+
+	// Create a new token. It's only returned once, as only its hash gets stored
+	expiry := time.Now().UTC().AddDate(0, 0, int(days))
+	token, apiToken, err := svc.TheUserService.CreateAPIToken(
+		user.HexID,
+		data.TrimmedString(params.Body.Name),
+		*params.Body.Scope,
+		expiry)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerAPITokenNewOK().
+		WithPayload(&operations.OwnerAPITokenNewOKBody{APIToken: apiToken, Token: token})
+}
+
+func OwnerAPITokens(params operations.OwnerAPITokensParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Fetch the user's tokens
+	tokens, err := svc.TheUserService.ListAPITokens(user.HexID)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerAPITokensOK().WithPayload(&operations.OwnerAPITokensOKBody{APITokens: tokens})
+}
+
 func OwnerConfirmHex(params operations.OwnerConfirmHexParams) middleware.Responder {
 	// Update the owner, if the token checks out
 	conf := "true"
-	if err := svc.TheUserService.ConfirmOwner(models.HexID(params.ConfirmHex)); err != nil {
+	if err := svc.TheUserService.ConfirmUser(models.HexID(params.ConfirmHex)); err != nil {
 		conf = "false"
 	}
 
@@ -27,7 +88,7 @@ func OwnerConfirmHex(params operations.OwnerConfirmHexParams) middleware.Respond
 
 func OwnerDelete(params operations.OwnerDeleteParams) middleware.Responder {
 	// Find the owner user
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -41,8 +102,8 @@ func OwnerDelete(params operations.OwnerDeleteParams) middleware.Responder {
 		return respBadRequest(util.ErrorCannotDeleteOwner)
 	}
 
-	// Remove the owner user
-	if err := svc.TheUserService.DeleteOwnerByID(user.HexID); err != nil {
+	// Remove the user
+	if err := svc.TheUserService.DeleteUserByID(user.HexID); err != nil {
 		return respServiceError(err)
 	}
 
@@ -50,10 +111,29 @@ func OwnerDelete(params operations.OwnerDeleteParams) middleware.Responder {
 	return operations.NewOwnerDeleteNoContent()
 }
 
+func OwnerInvitationAccept(params operations.OwnerInvitationAcceptParams, principal data.Principal) middleware.Responder {
+	// Verify the user is authenticated
+	if r := Verifier.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Accept the invitation on behalf of the current user
+	domain, role, err := svc.TheInvitationService.Accept(*params.Body.Token, principal.GetUser())
+	if err == util.ErrorInvitationEmail {
+		return respForbidden(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerInvitationAcceptOK().
+		WithPayload(&operations.OwnerInvitationAcceptOKBody{Domain: domain, Role: role})
+}
+
 func OwnerLogin(params operations.OwnerLoginParams) middleware.Responder {
-	// Find the owner
-	owner, err := svc.TheUserService.FindOwnerByEmail(data.EmailToString(params.Body.Email), true)
-	if err == svc.ErrNotFound {
+	// Find the user
+	owner, err := svc.TheUserService.FindUserByEmail(data.EmailToString(params.Body.Email), true)
+	if err == svc.ErrNotFound || err == nil && owner.PasswordHash == "" {
 		time.Sleep(util.WrongAuthDelay)
 		return respUnauthorized(util.ErrorInvalidEmailPassword)
 	} else if err != nil {
@@ -66,13 +146,28 @@ func OwnerLogin(params operations.OwnerLoginParams) middleware.Responder {
 	}
 
 	// Verify the provided password
-	if err := bcrypt.CompareHashAndPassword([]byte(owner.PasswordHash), []byte(swag.StringValue(params.Body.Password))); err != nil {
+	if !svc.TheUserService.VerifyPassword(owner, swag.StringValue(params.Body.Password)) {
 		time.Sleep(util.WrongAuthDelay)
 		return respUnauthorized(util.ErrorInvalidEmailPassword)
 	}
 
-	// Create a new owner session
-	ownerToken, err := svc.TheUserService.CreateOwnerSession(owner.HexID)
+	// Verify the owner isn't suspended
+	if owner.Suspended {
+		return respForbidden(util.ErrorUserSuspended)
+	}
+
+	// If the owner has two-factor authentication enabled, issue a challenge to be completed with OwnerLoginTotp
+	if owner.TOTPEnabled {
+		loginToken, err := svc.TheTOTPService.CreateChallenge(owner.HexID, "")
+		if err != nil {
+			return respServiceError(err)
+		}
+		return operations.NewOwnerLoginOK().
+			WithPayload(&operations.OwnerLoginOKBody{TotpRequired: true, LoginToken: loginToken})
+	}
+
+	// Create a new session
+	ownerToken, err := svc.TheUserService.CreateSession(owner.HexID, false, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
 	if err != nil {
 		return respServiceError(err)
 	}
@@ -81,54 +176,61 @@ func OwnerLogin(params operations.OwnerLoginParams) middleware.Responder {
 	return operations.NewOwnerLoginOK().WithPayload(&operations.OwnerLoginOKBody{OwnerToken: ownerToken})
 }
 
+func OwnerLoginTotp(params operations.OwnerLoginTotpParams) middleware.Responder {
+	// Verify the code against the sign-in challenge. Challenges issued for an existing commenter session haven't seen
+	// a password, so they don't count
+	userID, sessionHex, err := svc.TheTOTPService.TakeChallenge(*params.Body.LoginToken, swag.StringValue(params.Body.Code))
+	if err == util.ErrorInvalidTOTPCode || err == svc.ErrNotFound || (err == nil && sessionHex != "") {
+		time.Sleep(util.WrongAuthDelay)
+		return respUnauthorized(util.ErrorInvalidTOTPCode)
+	} else if err == util.ErrorTOTPLocked {
+		return respUnauthorized(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Create a new session, signed in with the second factor
+	ownerToken, err := svc.TheUserService.CreateSession(userID, true, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerLoginTotpOK().WithPayload(&operations.OwnerLoginTotpOKBody{OwnerToken: ownerToken})
+}
+
 func OwnerNew(params operations.OwnerNewParams) middleware.Responder {
 	// Verify new owners are allowed
 	if !config.CLIFlags.AllowNewOwners {
 		return respForbidden(util.ErrorNewOwnerForbidden)
 	}
 
-	// Verify no owner with that email exists yet
+	// Verify the email domain is allowed to sign up
 	email := data.EmailToString(params.Body.Email)
-	if r := Verifier.OwnerEmaiUnique(email); r != nil {
-		return r
+	if ok, err := svc.TheAdminService.IsSignupAllowed(email); err != nil {
+		return respServiceError(err)
+	} else if !ok {
+		return respForbidden(util.ErrorSignupNotAllowed)
 	}
 
-	// Create a new email record
-	if _, err := svc.TheEmailService.Create(email); err != nil {
-		return respServiceError(err)
+	// Verify the password complies with the policy
+	pwd := swag.StringValue(params.Body.Password)
+	if err := svc.ThePasswordService.CheckPolicy(pwd); err != nil {
+		return respBadRequest(err)
 	}
 
-	// Create a new owner record
+	// Create a new user record. If no SMTP is configured, mark the user confirmed at once
 	name := data.TrimmedString(params.Body.Name)
-	pwd := swag.StringValue(params.Body.Password)
-	owner, err := svc.TheUserService.CreateOwner(email, name, pwd)
-	if err != nil {
+	owner, err := svc.TheUserService.CreateUser(email, name, "", "", "", pwd, !config.SMTPConfigured)
+	if err == util.ErrorEmailAlreadyExists {
+		return respBadRequest(err)
+	} else if err != nil {
 		return respServiceError(err)
 	}
 
 	// If mailing is configured, create and mail a confirmation token
 	if config.SMTPConfigured {
-		// Create a new confirmation token
-		token, err := svc.TheUserService.CreateOwnerConfirmationToken(owner.HexID)
-		if err != nil {
-			return respServiceError(err)
-		}
-
-		// Send a confirmation email
-		err = svc.TheMailService.SendFromTemplate(
-			"",
-			email,
-			"Please confirm your email address",
-			"confirm-hex.gohtml",
-			map[string]any{"URL": config.URLForAPI("owner/confirm-hex", map[string]string{"confirmHex": string(token)})})
-		if err != nil {
-			return respServiceError(err)
-		}
-	}
-
-	// If no commenter with that email exists yet, register the owner also as a commenter, with the same password
-	if _, err := svc.TheUserService.FindCommenterByIdPEmail("", email, false); err == svc.ErrNotFound {
-		if _, err := svc.TheUserService.CreateCommenter(email, name, "", "", "", pwd); err != nil {
+		if err := emailConfirmation(owner, "owner/confirm-hex"); err != nil {
 			return respServiceError(err)
 		}
 	}
@@ -139,7 +241,7 @@ func OwnerNew(params operations.OwnerNewParams) middleware.Responder {
 
 func OwnerSelf(params operations.OwnerSelfParams) middleware.Responder {
 	// Try to find the owner
-	user, err := svc.TheUserService.FindOwnerByToken(*params.Body.OwnerToken)
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
 	if err == svc.ErrNotFound {
 		// Owner isn't logged id
 		return operations.NewOwnerSelfNoContent()
@@ -151,3 +253,121 @@ func OwnerSelf(params operations.OwnerSelfParams) middleware.Responder {
 	// Succeeded: owner's logged in
 	return operations.NewOwnerSelfOK().WithPayload(&operations.OwnerSelfOKBody{Owner: user.ToOwner()})
 }
+
+func OwnerSessionDelete(params operations.OwnerSessionDeleteParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Delete the session
+	if err := svc.TheUserService.DeleteSessionByHex(user.HexID, *params.Body.SessionHex); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerSessionDeleteNoContent()
+}
+
+func OwnerSessions(params operations.OwnerSessionsParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Fetch the sessions, marking the one the request is made in
+	sessions, err := svc.TheUserService.ListSessions(user.HexID, *params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerSessionsOK().WithPayload(&operations.OwnerSessionsOKBody{Sessions: sessions})
+}
+
+func OwnerSessionsDeleteOthers(params operations.OwnerSessionsDeleteOthersParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Delete all sessions but the one the request is made in
+	if err := svc.TheUserService.DeleteSessions(user.HexID, *params.Body.OwnerToken); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerSessionsDeleteOthersNoContent()
+}
+
+func OwnerTotpDisable(params operations.OwnerTotpDisableParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Verify the code, which proves the owner still possesses the second factor
+	if err := svc.TheTOTPService.Verify(user.HexID, swag.StringValue(params.Body.Code)); err == util.ErrorInvalidTOTPCode {
+		time.Sleep(util.WrongAuthDelay)
+		return respUnauthorized(err)
+	} else if err == util.ErrorTOTPLocked {
+		return respUnauthorized(err)
+	} else if err == util.ErrorTOTPNotEnabled {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Turn two-factor authentication off
+	if err := svc.TheTOTPService.Disable(user.HexID); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerTotpDisableNoContent()
+}
+
+func OwnerTotpEnable(params operations.OwnerTotpEnableParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Verify the code and enable two-factor authentication
+	codes, err := svc.TheTOTPService.Enable(user.HexID, swag.StringValue(params.Body.Code))
+	if err == util.ErrorInvalidTOTPCode || err == util.ErrorTOTPAlreadyEnabled || err == util.ErrorTOTPNotSetUp {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerTotpEnableOK().WithPayload(&operations.OwnerTotpEnableOKBody{RecoveryCodes: codes})
+}
+
+func OwnerTotpSetup(params operations.OwnerTotpSetupParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Generate a new secret
+	secret, err := svc.TheTOTPService.Setup(user.HexID)
+	if err == util.ErrorTOTPAlreadyEnabled {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerTotpSetupOK().WithPayload(&operations.OwnerTotpSetupOKBody{
+		ProvisioningURI: util.TOTPProvisioningURI("Comentario", user.Email, secret),
+		Secret:          secret,
+	})
+}
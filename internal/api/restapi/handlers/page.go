@@ -16,7 +16,7 @@ func PageUpdate(params operations.PageUpdateParams, principal data.Principal) mi
 
 	// Verify the user is a domain moderator
 	page := params.Body.Page
-	if r := Verifier.UserIsDomainModerator(principal.GetUser().Email, swag.StringValue(page.Domain)); r != nil {
+	if r := Verifier.PrincipalHasDomainPermission(principal, swag.StringValue(page.Domain), data.DomainPermissionModerate); r != nil {
 		return r
 	}
 
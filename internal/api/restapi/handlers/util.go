@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"github.com/go-openapi/runtime"
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/op/go-logging"
@@ -9,6 +10,7 @@ import (
 	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
+	"html"
 	"net/http"
 	"time"
 )
@@ -34,6 +36,25 @@ func closeParentWindowResponse() middleware.Responder {
 	return NewHTMLResponder(http.StatusOK, "<html><script>window.parent.close()</script></html>")
 }
 
+// messagePageResponse returns a responder that renders a simple HTML page with the given status code, title, and
+// message
+func messagePageResponse(code int, title, message string) middleware.Responder {
+	return NewHTMLResponder(
+		code,
+		fmt.Sprintf(
+			`<html lang="en">
+			<head>
+				<title>%[1]s</title>
+			</head>
+			<body>
+				<h1>%[1]s</h1>
+				<p>%[2]s</p>
+			</body>
+			</html>`,
+			html.EscapeString(title),
+			html.EscapeString(message)))
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 
 // HTMLResponder is an implementation of middleware.Responder that serves out a static piece of HTML
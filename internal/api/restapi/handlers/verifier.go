@@ -13,39 +13,47 @@ var Verifier VerifierService = &verifier{}
 
 // VerifierService is an API service interface for data and permission verification
 type VerifierService interface {
-	// CommenterLocalEmaiUnique verifies there's no existing commenter  user using the password authentication with the
-	// given email
-	CommenterLocalEmaiUnique(email string) middleware.Responder
-	// OwnerEmaiUnique verifies there's no existing owner user with the given email
-	OwnerEmaiUnique(email string) middleware.Responder
+	// PrincipalHasAPIScope verifies the given principal, if authenticated with an API token, is allowed to do what the
+	// specified scope allows
+	PrincipalHasAPIScope(principal data.Principal, scope models.APITokenScope) middleware.Responder
+	// PrincipalHasDomainPermission verifies the given principal is authenticated and has a role in the specified domain
+	// that grants the given permission. Moderating also requires a sign-in with a second factor if the domain requires so
+	PrincipalHasDomainPermission(principal data.Principal, domainName string, perm data.DomainPermission) middleware.Responder
 	// PrincipalIsAuthenticated verifies the given principal is an authenticated one
 	PrincipalIsAuthenticated(principal data.Principal) middleware.Responder
-	// UserIsDomainModerator verifies the owner with the given email is a moderator in the specified domain
-	UserIsDomainModerator(email, domainName string) middleware.Responder
-	// UserOwnsDomain verifies the owner with the given hex ID owns the specified domain
-	UserOwnsDomain(id models.HexID, domainName string) middleware.Responder
+	// PrincipalIsSuperuser verifies the given principal is an authenticated instance superuser
+	PrincipalIsSuperuser(principal data.Principal) middleware.Responder
 }
 
 // ----------------------------------------------------------------------------------------------------------------------
 // verifier is a blueprint VerifierService implementation
 type verifier struct{}
 
-func (v *verifier) CommenterLocalEmaiUnique(email string) middleware.Responder {
-	// Verify no such email is registered yet
-	if _, err := svc.TheUserService.FindCommenterByIdPEmail("", email, false); err == nil {
-		return respBadRequest(util.ErrorEmailAlreadyExists)
-	} else if err != svc.ErrNotFound {
-		return respServiceError(err)
+func (v *verifier) PrincipalHasAPIScope(principal data.Principal, scope models.APITokenScope) middleware.Responder {
+	if !principal.GetUser().HasAPIScope(scope) {
+		return respForbidden(util.ErrorAPITokenScope)
 	}
 	return nil
 }
 
-func (v *verifier) OwnerEmaiUnique(email string) middleware.Responder {
-	// Verify no such email is registered yet
-	if _, err := svc.TheUserService.FindOwnerByEmail(email, false); err == nil {
-		return respBadRequest(util.ErrorEmailAlreadyExists)
-	} else if err != svc.ErrNotFound {
+func (v *verifier) PrincipalHasDomainPermission(principal data.Principal, domainName string, perm data.DomainPermission) middleware.Responder {
+	if r := v.PrincipalIsAuthenticated(principal); r != nil {
+		return r
+	}
+
+	// Users having two-factor authentication enabled must have signed in with the second factor
+	user := principal.GetUser()
+	if user.TOTPEnabled && !user.TOTPVerified {
+		return respForbidden(util.ErrorTOTPRequired)
+	}
+
+	// Check the user's roles against the domain policy
+	if roles, require2FA, err := svc.TheDomainService.FindUserRoles(user.HexID, domainName); err != nil {
 		return respServiceError(err)
+	} else if !data.DomainRolesAllow(roles, perm) {
+		return respForbidden(util.ErrorNoDomainPermission)
+	} else if perm == data.DomainPermissionModerate && require2FA && !user.TOTPVerified {
+		return respForbidden(util.ErrorModerator2FARequired)
 	}
 	return nil
 }
@@ -57,20 +65,12 @@ func (v *verifier) PrincipalIsAuthenticated(principal data.Principal) middleware
 	return nil
 }
 
-func (v *verifier) UserIsDomainModerator(email, domainName string) middleware.Responder {
-	if b, err := svc.TheDomainService.IsDomainModerator(email, domainName); err != nil {
-		return respServiceError(err)
-	} else if !b {
-		return respForbidden(util.ErrorNotModerator)
+func (v *verifier) PrincipalIsSuperuser(principal data.Principal) middleware.Responder {
+	if r := v.PrincipalIsAuthenticated(principal); r != nil {
+		return r
 	}
-	return nil
-}
-
-func (v *verifier) UserOwnsDomain(id models.HexID, domainName string) middleware.Responder {
-	if b, err := svc.TheDomainService.IsDomainOwner(id, domainName); err != nil {
-		return respServiceError(err)
-	} else if !b {
-		return respForbidden(util.ErrorNotDomainOwner)
+	if !principal.GetUser().Superuser {
+		return respForbidden(util.ErrorNotSuperuser)
 	}
 	return nil
 }
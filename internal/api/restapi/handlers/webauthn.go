@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"github.com/go-openapi/runtime/middleware"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/svc"
+	"gitlab.com/comentario/comentario/internal/util"
+	"time"
+)
+
+func OwnerWebauthnCredentialDelete(params operations.OwnerWebauthnCredentialDeleteParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Remove the credential
+	if err := svc.TheWebAuthnService.DeleteCredential(user.HexID, *params.Body.CredentialID); err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnCredentialDeleteNoContent()
+}
+
+func OwnerWebauthnCredentials(params operations.OwnerWebauthnCredentialsParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Fetch the credentials
+	creds, err := svc.TheWebAuthnService.ListCredentials(user.HexID)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnCredentialsOK().
+		WithPayload(&operations.OwnerWebauthnCredentialsOKBody{Credentials: creds})
+}
+
+func OwnerWebauthnLoginBegin(operations.OwnerWebauthnLoginBeginParams) middleware.Responder {
+	// Start a sign-in ceremony
+	opts, err := svc.TheWebAuthnService.BeginLogin()
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnLoginBeginOK().WithPayload(opts)
+}
+
+func OwnerWebauthnLoginFinish(params operations.OwnerWebauthnLoginFinishParams) middleware.Responder {
+	// Verify the response and find the user
+	owner, r := webAuthnLoginUser(params.Body)
+	if r != nil {
+		return r
+	}
+
+	// Verify the owner is confirmed
+	if !owner.EmailConfirmed {
+		return respUnauthorized(util.ErrorUnconfirmedEmail)
+	}
+
+	// Create a new session. Passkeys verify the user, so the session counts as signed in with a second factor
+	ownerToken, err := svc.TheUserService.CreateSession(owner.HexID, true, util.UserAgent(params.HTTPRequest), util.UserIP(params.HTTPRequest))
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnLoginFinishOK().
+		WithPayload(&operations.OwnerWebauthnLoginFinishOKBody{OwnerToken: ownerToken})
+}
+
+func OwnerWebauthnRegisterBegin(params operations.OwnerWebauthnRegisterBeginParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Start a registration ceremony
+	opts, err := svc.TheWebAuthnService.BeginRegistration(user)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnRegisterBeginOK().WithPayload(opts)
+}
+
+func OwnerWebauthnRegisterFinish(params operations.OwnerWebauthnRegisterFinishParams) middleware.Responder {
+	// Find the owner user
+	user, err := svc.TheUserService.FindOwnerBySession(*params.Body.OwnerToken)
+	if err != nil {
+		return respServiceError(err)
+	}
+
+	// Verify the response and register the credential
+	cred, err := svc.TheWebAuthnService.FinishRegistration(user.HexID, params.Body.Attestation)
+	if err == util.ErrorWebAuthnFailed {
+		return respBadRequest(err)
+	} else if err != nil {
+		return respServiceError(err)
+	}
+
+	// Succeeded
+	return operations.NewOwnerWebauthnRegisterFinishOK().WithPayload(cred)
+}
+
+// webAuthnLoginUser verifies the given response of a sign-in ceremony and returns the user it's been performed by, or
+// an error responder if it failed
+func webAuthnLoginUser(assertion *models.WebauthnAssertion) (*data.User, middleware.Responder) {
+	// Verify the response
+	userID, err := svc.TheWebAuthnService.FinishLogin(assertion)
+	if err == util.ErrorWebAuthnFailed {
+		time.Sleep(util.WrongAuthDelay)
+		return nil, respUnauthorized(err)
+	} else if err != nil {
+		return nil, respServiceError(err)
+	}
+
+	// Fetch the user
+	user, err := svc.TheUserService.FindUserByID(userID)
+	if err != nil {
+		return nil, respServiceError(err)
+	}
+	return user, nil
+}
@@ -1,18 +1,26 @@
 package restapi
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/go-openapi/errors"
+	"github.com/go-openapi/runtime"
 	"github.com/gorilla/handlers"
 	"github.com/justinas/alice"
+	"gitlab.com/comentario/comentario/internal/api/restapi/operations"
 	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/svc"
 	"gitlab.com/comentario/comentario/internal/util"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -48,9 +56,9 @@ func (w *notFoundBypassWriter) Write(p []byte) (int, error) {
 
 // corsHandler returns a middleware that adds CORS headers to responses
 func corsHandler(next http.Handler) http.Handler {
-	return handlers.CORS(
-		handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With", util.HeaderCommenterToken}),
-	)(next)
+	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "X-Requested-With", util.HeaderCommenterToken})
+	exposedHeaders := handlers.ExposedHeaders([]string{"Retry-After"})
+	return handlers.CORS(allowedHeaders, exposedHeaders)(next)
 }
 
 // fallbackHandler returns a middleware that is called in case all other handlers failed
@@ -91,6 +99,103 @@ func makeAPIHandler(apiHandler http.Handler) alice.Constructor {
 	}
 }
 
+// rateLimitHandler returns a middleware that throttles API requests according to the configured rate limits
+func rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only API calls can be limited
+		if ok, p := config.PathOfBaseURL(r.URL.Path); ok && strings.HasPrefix(p, util.APIPath) && r.Method != http.MethodOptions {
+			op := strings.TrimPrefix(p, util.APIPath)
+			if limits, ok := config.RateLimits[op]; ok {
+				if allowed, wait := rateLimitAllow(op, limits, r); !allowed {
+					logger.Warningf("Rate limit exceeded for %s from %s", op, util.UserIP(r))
+					operations.NewGenericTooManyRequests().
+						WithRetryAfter(int64(math.Ceil(wait.Seconds()))).
+						WithPayload(&operations.GenericTooManyRequestsBody{Details: util.ErrorTooManyRequests.Error()}).
+						WriteResponse(w, runtime.JSONProducer())
+					return
+				}
+			}
+		}
+
+		// Pass on to the next handler
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitAllow checks the request to the given API operation against each of the operation's limits. Returns whether
+// the request is allowed and, if it isn't, how long to wait before retrying
+func rateLimitAllow(op string, limits *config.OperationRateLimits, r *http.Request) (bool, time.Duration) {
+	// Collect bucket keys the request is attributed to
+	type bucket struct {
+		key   string
+		limit *config.RateLimit
+	}
+	var buckets []bucket
+	if limits.IP.Usable() {
+		buckets = append(buckets, bucket{op + "|ip|" + util.UserIP(r), limits.IP})
+	}
+
+	// Only registered commenters can be told apart
+	if limits.Commenter.Usable() {
+		if p, err := AuthCommenterByTokenHeader(r.Header.Get(util.HeaderCommenterToken)); err == nil && !p.IsAnonymous() {
+			buckets = append(buckets, bucket{op + "|commenter|" + string(p.GetHexID()), limits.Commenter})
+		}
+	}
+
+	// The domain is to be peeked from the request body
+	if limits.Domain.Usable() {
+		if domain := peekRequestDomain(r); domain != "" {
+			buckets = append(buckets, bucket{op + "|domain|" + domain, limits.Domain})
+		}
+	}
+
+	// Take a request from every bucket. Errors don't block the request to avoid locking everyone out on a DB failure
+	allowed, wait := true, time.Duration(0)
+	for _, b := range buckets {
+		if ok, w, err := svc.TheRateLimitService.Allow(b.key, b.limit); err != nil {
+			logger.Warningf("Rate limit check for %s failed: %v", b.key, err)
+		} else if !ok {
+			allowed = false
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	return allowed, wait
+}
+
+// peekMaxBodySize is the max number of request body bytes buffered by peekRequestDomain(). It's well above the size of
+// any valid payload the domain is peeked from
+const peekMaxBodySize = 256 * 1024
+
+// peekRequestDomain returns the domain specified in the request's JSON body, if any, leaving the body intact for
+// subsequent handlers
+func peekRequestDomain(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	// Read in the beginning of the body, and put it back in front of the rest
+	body := r.Body
+	b, err := io.ReadAll(io.LimitReader(body, peekMaxBodySize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}
+	if err != nil || len(b) > peekMaxBodySize {
+		return ""
+	}
+
+	// Only extract the domain; a malformed body is rejected later by the API
+	var payload struct {
+		Domain string `json:"domain"`
+	}
+	if json.Unmarshal(b, &payload) != nil {
+		return ""
+	}
+	return strings.TrimSpace(payload.Domain)
+}
+
 // redirectToLangRootHandler returns a middleware that redirects the user from the site root or an "incomplete" language
 // root (such as "/en") to the complete/appropriate language root (such as "/en/")
 func redirectToLangRootHandler(next http.Handler) http.Handler {
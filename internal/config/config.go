@@ -1,15 +1,18 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"gitlab.com/comentario/comentario/internal/util"
 	"golang.org/x/text/language"
 	"gopkg.in/yaml.v3"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 // KeySecret is a record containing a key and a secret
@@ -24,6 +27,45 @@ func (c *KeySecret) Usable() bool {
 	return !c.Disable && c.Key != "" && c.Secret != ""
 }
 
+// OIDCProvider is a generic OpenID Connect identity provider configuration
+type OIDCProvider struct {
+	KeySecret    `yaml:",inline"`
+	ID           string   `yaml:"id"`           // Provider ID, consisting of lowercase letters, digits, '-', and '_'
+	Name         string   `yaml:"name"`         // Display name
+	Icon         string   `yaml:"icon"`         // Icon URL
+	DiscoveryURL string   `yaml:"discoveryUrl"` // URL of the provider's configuration (.well-known/openid-configuration)
+	Scopes       []string `yaml:"scopes"`       // Scopes to request, defaults to openid, email, and profile
+	Claims       struct {
+		Name   []string `yaml:"name"`   // Claims holding the user's name, the first one present is used
+		Email  []string `yaml:"email"`  // Claims holding the user's email, the first one present is used
+		Avatar []string `yaml:"avatar"` // Claims holding the user's avatar URL, the first one present is used
+	} `yaml:"claims"`
+}
+
+// Usable returns whether the provider isn't disabled and its ID, discovery URL, key, and secret are filled in
+func (c *OIDCProvider) Usable() bool {
+	return c.KeySecret.Usable() && c.ID != "" && c.DiscoveryURL != ""
+}
+
+// RateLimit describes a token bucket quota
+type RateLimit struct {
+	Burst  int           `yaml:"burst"`  // Max number of requests that can be made in a row
+	Period time.Duration `yaml:"period"` // Time it takes to replenish a single request
+}
+
+// Usable returns whether the limit is set and has a non-zero quota
+func (l *RateLimit) Usable() bool {
+	return l != nil && l.Burst > 0 && l.Period > 0
+}
+
+// OperationRateLimits describes rate limits applied to an API operation, per key the requests are attributed to. A nil
+// limit means no limitation by that key
+type OperationRateLimits struct {
+	IP        *RateLimit `yaml:"ip"`        // Limit per user IP
+	Commenter *RateLimit `yaml:"commenter"` // Limit per authenticated commenter
+	Domain    *RateLimit `yaml:"domain"`    // Limit per domain the request refers to
+}
+
 var (
 	AppVersion string // Application version set during bootstrapping
 	BuildDate  string // Application build date set during bootstrapping
@@ -52,15 +94,21 @@ var (
 		} `yaml:"smtpServer"`
 
 		IdP struct {
-			GitHub  KeySecret `yaml:"github"`  // GitHub auth config
-			GitLab  KeySecret `yaml:"gitlab"`  // GitLab auth config
-			Google  KeySecret `yaml:"google"`  // Google auth config
-			Twitter KeySecret `yaml:"twitter"` // Twitter auth config
+			GitHub   KeySecret      `yaml:"github"`  // GitHub auth config
+			GitLab   KeySecret      `yaml:"gitlab"`  // GitLab auth config
+			Google   KeySecret      `yaml:"google"`  // Google auth config
+			Twitter  KeySecret      `yaml:"twitter"` // Twitter auth config
+			OIDC     []OIDCProvider `yaml:"oidc"`    // Generic OpenID Connect providers
+			Mastodon struct {
+				Enable bool `yaml:"enable"` // Whether to allow signing in via any Mastodon-compatible instance
+			} `yaml:"mastodon"`
 		} `yaml:"idp"`
 
 		Akismet struct {
 			Key string `yaml:"key"` // Akismet key
 		} `yaml:"akismet"`
+
+		TokenKey string `yaml:"tokenKey"` // Key for hashing tokens stored in the database. Changing it invalidates them
 	}{}
 
 	// CLIFlags stores command-line flags
@@ -78,8 +126,53 @@ var (
 		AllowNewOwners  bool   `long:"allow-new-owners"  description:"Allow new owner signups"                                                     env:"ALLOW_NEW_OWNERS"`
 		GitLabURL       string `long:"gitlab-url"        description:"Custom GitLab URL for authentication"       default:""                       env:"GITLAB_URL"`
 		E2e             bool   `long:"e2e"               description:"End-2-end testing mode"`
+		RateLimitsFile  string `long:"rate-limits"       description:"Path to YAML file with rate limit quotas"   default:""                       env:"RATE_LIMITS_FILE"`
+		RateLimitStore  string `long:"rate-limit-store"  description:"Where to keep rate limit counters"           default:"memory"                 env:"RATE_LIMIT_STORE" choice:"memory" choice:"postgres"`
+		RetentionDays   int    `long:"deleted-retention" description:"Days deleted comments can be restored for"   default:"30"                     env:"DELETED_RETENTION"`
+		SessionIdleDays int    `long:"session-idle"      description:"Days an unused session stays valid for"      default:"30"                     env:"SESSION_IDLE"`
+		SessionMaxDays  int    `long:"session-max"       description:"Days a session stays valid for at most"      default:"90"                     env:"SESSION_MAX"`
+		PwdMinLength    int    `long:"password-min"      description:"Min. length of user passwords"               default:"8"                      env:"PASSWORD_MIN"`
+		BreachedPwdFile string `long:"breached-list"     description:"File with breached passwords, one per line"  default:""                       env:"BREACHED_LIST"`
+		Argon2Memory    uint32 `long:"argon2-memory"     description:"Memory cost of password hashing, KiB"        default:"19456"                  env:"ARGON2_MEMORY"`
+		Argon2Time      uint32 `long:"argon2-time"       description:"Time cost (passes) of password hashing"      default:"2"                      env:"ARGON2_TIME"`
+		Argon2Threads   uint8  `long:"argon2-threads"    description:"Parallelism of password hashing"             default:"1"                      env:"ARGON2_THREADS"`
+		Superuser       string `long:"superuser"         description:"Email of a user to make instance superuser"  default:""                       env:"SUPERUSER"`
+		TrustedProxies  string `long:"trusted-proxies"   description:"Reverse proxy IPs/CIDRs, comma-separated"    default:""                       env:"TRUSTED_PROXIES"`
 	}{}
 
+	// RateLimits stores rate limit quotas, keyed by the API operation path (relative to the API root). Defaults can be
+	// overridden per operation with the rate limits file
+	RateLimits = map[string]*OperationRateLimits{
+		"comment/new": {
+			IP:        &RateLimit{Burst: 10, Period: time.Minute},
+			Commenter: &RateLimit{Burst: 5, Period: time.Minute},
+			Domain:    &RateLimit{Burst: 100, Period: time.Second},
+		},
+		"comment/report": {
+			IP:        &RateLimit{Burst: 10, Period: time.Minute},
+			Commenter: &RateLimit{Burst: 10, Period: time.Minute},
+		},
+		"comment/stream/ticket": {
+			IP:        &RateLimit{Burst: 10, Period: time.Minute},
+			Commenter: &RateLimit{Burst: 10, Period: time.Minute},
+		},
+		"comment/vote": {
+			IP:        &RateLimit{Burst: 30, Period: 2 * time.Second},
+			Commenter: &RateLimit{Burst: 30, Period: 2 * time.Second},
+		},
+		"commenter/confirm-resend":   {Commenter: &RateLimit{Burst: 3, Period: 10 * time.Minute}},
+		"commenter/login":            {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+		"commenter/login/totp":       {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+		"commenter/magic-link/bind":  {IP: &RateLimit{Burst: 5, Period: 10 * time.Minute}},
+		"commenter/magic-link/new":   {IP: &RateLimit{Burst: 5, Period: 10 * time.Minute}},
+		"commenter/new":              {IP: &RateLimit{Burst: 5, Period: 10 * time.Minute}},
+		"commenter/session/totp":     {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+		"forgot":                     {IP: &RateLimit{Burst: 3, Period: 10 * time.Minute}},
+		"owner/login":                {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+		"owner/login/totp":           {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+		"owner/webauthn/login/begin": {IP: &RateLimit{Burst: 10, Period: time.Minute}},
+	}
+
 	// Derived values
 
 	BaseURL        *url.URL // The parsed base URL
@@ -105,11 +198,28 @@ func CLIParsed() error {
 		return fmt.Errorf("invalid CDN URL: %v", err)
 	}
 
+	// Parse the trusted proxy list
+	if util.TrustedProxies, err = parseIPNets(CLIFlags.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
 	// Load secrets
 	if err := UnmarshalConfigFile(CLIFlags.SecretsFile, SecretsConfig); err != nil {
 		return err
 	}
 
+	// Verify the token key is set and isn't trivially guessable
+	if len(SecretsConfig.TokenKey) < 32 {
+		return errors.New("tokenKey in the secrets file must be at least 32 characters long")
+	}
+
+	// Load rate limit quotas, if any
+	if CLIFlags.RateLimitsFile != "" {
+		if err := UnmarshalConfigFile(CLIFlags.RateLimitsFile, &RateLimits); err != nil {
+			return fmt.Errorf("failed to load rate limits: %v", err)
+		}
+	}
+
 	// Configure OAuth providers
 	oauthConfigure()
 
@@ -190,3 +300,35 @@ func URLFor(path string, queryParams map[string]string) string {
 func URLForAPI(path string, queryParams map[string]string) string {
 	return URLFor(util.APIPath+strings.TrimPrefix(path, "/"), queryParams)
 }
+
+// parseIPNets parses a comma-separated list of IP addresses and CIDR networks. A single address is a network of its own
+func parseIPNets(s string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		// Turn a single address into a network containing only it
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		// Parse a network
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
@@ -5,15 +5,22 @@ import (
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/gitlab"
 	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/markbates/goth/providers/twitter"
+	"gitlab.com/comentario/comentario/internal/util"
+	"regexp"
 	"strings"
 )
 
+// oidcIDRegex is a regular expression a generic OpenID Connect provider ID must match
+var oidcIDRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 // oauthConfigure configures federated (OAuth) authentication
 func oauthConfigure() {
 	githubOauthConfigure()
 	gitlabOauthConfigure()
 	googleOauthConfigure()
+	oidcOauthConfigure()
 	twitterOauthConfigure()
 }
 
@@ -82,6 +89,59 @@ func googleOauthConfigure() {
 	)
 }
 
+// oidcOauthConfigure configures federated authentication via generic OpenID Connect providers
+func oidcOauthConfigure() {
+	for i := range SecretsConfig.IdP.OIDC {
+		c := &SecretsConfig.IdP.OIDC[i]
+		if !c.Usable() {
+			logger.Debugf("OpenID Connect provider '%s' isn't configured or enabled", c.ID)
+			continue
+		}
+
+		// Validate the ID
+		id := util.OIDCIdPPrefix + c.ID
+		if !oidcIDRegex.MatchString(c.ID) {
+			logger.Errorf("Invalid OpenID Connect provider ID '%s', skipping the provider", c.ID)
+			continue
+		} else if _, ok := util.FederatedIdProviders[id]; ok {
+			logger.Errorf("Duplicate OpenID Connect provider ID '%s', skipping the provider", c.ID)
+			continue
+		}
+
+		// Fetch the provider's configuration
+		logger.Infof("Registering OpenID Connect provider %s for client %s", id, c.Key)
+		scopes := c.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		p, err := openidConnect.New(c.Key, c.Secret, URLForAPI("oauth/"+id+"/callback", nil), c.DiscoveryURL, scopes...)
+		if err != nil {
+			logger.Errorf("Failed to register OpenID Connect provider %s: %v", id, err)
+			continue
+		}
+
+		// Apply the claim mapping, if any
+		p.SetName(id)
+		if len(c.Claims.Name) > 0 {
+			p.NameClaims = c.Claims.Name
+		}
+		if len(c.Claims.Email) > 0 {
+			p.EmailClaims = c.Claims.Email
+		}
+		if len(c.Claims.Avatar) > 0 {
+			p.AvatarURLClaims = c.Claims.Avatar
+		}
+		goth.UseProviders(p)
+
+		// Make the provider known
+		name := c.Name
+		if name == "" {
+			name = c.ID
+		}
+		util.FederatedIdProviders[id] = util.FederatedIdProvider{GothID: id, Name: name, Icon: c.Icon}
+	}
+}
+
 // twitterOauthConfigure configures federated authentication via Twitter
 func twitterOauthConfigure() {
 	if !SecretsConfig.IdP.Twitter.Usable() {
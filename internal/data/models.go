@@ -1,6 +1,8 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"github.com/go-openapi/strfmt"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"time"
@@ -10,11 +12,9 @@ const RootParentHexID = models.ParentHexID("root") // The "root" parent hex
 
 // AnonymousCommenter is a fake, anonymous, commenter instance, which doesn't exist in the database, but is nonetheless
 // referenced by comments ¯\_(ツ)_/¯
-var AnonymousCommenter = UserCommenter{
-	User: User{
-		HexID: "0000000000000000000000000000000000000000000000000000000000000000",
-		Name:  "Anonymous",
-	},
+var AnonymousCommenter = User{
+	HexID: "0000000000000000000000000000000000000000000000000000000000000000",
+	Name:  "Anonymous",
 }
 
 // Principal represents user's identity for the API
@@ -27,13 +27,30 @@ type Principal interface {
 	IsAnonymous() bool
 }
 
-// User is a base user type
+// User represents a user, who can own and moderate domains as well as comment on them
 type User struct {
-	HexID        models.HexID // User hex ID
-	Email        string       // User's email
-	Created      time.Time    // Timestamp when user was created, in UTC
-	Name         string       // User's full name
-	PasswordHash string       // User's hashed password
+	HexID          models.HexID         // User hex ID
+	Email          string               // User's email
+	Created        time.Time            // Timestamp when user was created, in UTC
+	Name           string               // User's full name
+	PasswordHash   string               // User's hashed password
+	EmailConfirmed bool                 // Whether the user's email is confirmed
+	WebsiteURL     string               // User's website link
+	PhotoURL       string               // URL of the user's avatar image
+	Provider       string               // Federated identity provider of a user without a password, empty otherwise
+	TOTPEnabled    bool                 // Whether the user signs in with a second factor (TOTP)
+	Superuser      bool                 // Whether the user administers the whole instance
+	Suspended      bool                 // Whether the user is barred from signing in
+	TOTPVerified   bool                 // Whether the user's current session has been signed in with a second factor. Not persisted
+	IsModerator    bool                 // Whether the user is a moderator of the domain in question. Not persisted
+	APIScope       models.APITokenScope // Scope of the API token the user is authenticated with, if any. Not persisted
+}
+
+// apiScopeLevels ranks API token scopes, each wider scope including all narrower ones
+var apiScopeLevels = map[models.APITokenScope]int{
+	models.APITokenScopeStats:      1,
+	models.APITokenScopeModeration: 2,
+	models.APITokenScopeAdmin:      3,
 }
 
 func (u *User) GetHexID() models.HexID {
@@ -44,50 +61,105 @@ func (u *User) GetUser() *User {
 	return u
 }
 
+// HasAPIScope returns whether the user is allowed to do what the given API token scope allows. Users not authenticated
+// with an API token are unrestricted
+func (u *User) HasAPIScope(scope models.APITokenScope) bool {
+	return u.APIScope == "" || apiScopeLevels[u.APIScope] >= apiScopeLevels[scope]
+}
+
 func (u *User) IsAnonymous() bool {
 	return u.HexID == AnonymousCommenter.HexID
 }
 
-// ---------------------------------------------------------------------------------------------------------------------
+// IsUnconfirmedLocal returns whether the user has signed up with a password, but hasn't confirmed their email yet
+func (u *User) IsUnconfirmedLocal() bool {
+	return !u.IsAnonymous() && u.Provider == "" && !u.EmailConfirmed
+}
 
-// UserOwner represents a user that is a domain owner
-type UserOwner struct {
-	User
-	EmailConfirmed bool // Whether the user's email is confirmed
+// ToCommenter converts this user into models.Commenter model
+func (u *User) ToCommenter() *models.Commenter {
+	return &models.Commenter{
+		CommenterHex: u.HexID,
+		Email:        strfmt.Email(u.Email),
+		IsModerator:  u.IsModerator,
+		JoinDate:     strfmt.DateTime(u.Created),
+		WebsiteURL:   strfmt.URI(u.WebsiteURL),
+		Name:         u.Name,
+		AvatarURL:    strfmt.URI(u.PhotoURL),
+		Provider:     u.Provider,
+	}
 }
 
 // ToOwner converts this user into models.Owner model
-func (u *UserOwner) ToOwner() *models.Owner {
+func (u *User) ToOwner() *models.Owner {
 	return &models.Owner{
 		ConfirmedEmail: u.EmailConfirmed,
 		Email:          strfmt.Email(u.Email),
 		JoinDate:       strfmt.DateTime(u.Created),
 		Name:           u.Name,
 		OwnerHex:       u.HexID,
+		Superuser:      u.Superuser,
+		TotpEnabled:    u.TOTPEnabled,
 	}
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// UserCommenter represents a commenter user
-type UserCommenter struct {
-	User
-	IsModerator bool   // Whether the user is a moderator
-	WebsiteURL  string // User's website link
-	PhotoURL    string // URL of the user's avatar image
-	Provider    string // User's federated provider ID
+// DomainPermission is a kind of action on a domain, which users are allowed to take depending on their domain roles
+type DomainPermission string
+
+const (
+	DomainPermissionOwn       DomainPermission = "own"       // Delete, clear, or freeze the domain, manage owners and administrators
+	DomainPermissionConfigure DomainPermission = "configure" // Change settings, webhooks, import data, manage moderators and analysts
+	DomainPermissionModerate  DomainPermission = "moderate"  // Moderate comments, manage bans and reports
+	DomainPermissionViewStats DomainPermission = "viewStats" // View domain statistics
+)
+
+// DomainPolicy is the policy table granting permissions to domain roles
+var DomainPolicy = map[models.DomainRole][]DomainPermission{
+	models.DomainRoleOwner: {
+		DomainPermissionOwn, DomainPermissionConfigure, DomainPermissionModerate, DomainPermissionViewStats,
+	},
+	models.DomainRoleAdministrator: {DomainPermissionConfigure, DomainPermissionModerate, DomainPermissionViewStats},
+	models.DomainRoleModerator:     {DomainPermissionModerate},
+	models.DomainRoleAnalyst:       {DomainPermissionViewStats},
 }
 
-// ToCommenter converts this user into models.Commenter model
-func (u *UserCommenter) ToCommenter() *models.Commenter {
-	return &models.Commenter{
-		CommenterHex: u.HexID,
-		Email:        strfmt.Email(u.Email),
-		IsModerator:  u.IsModerator,
-		JoinDate:     strfmt.DateTime(u.Created),
-		WebsiteURL:   strfmt.URI(u.WebsiteURL),
-		Name:         u.Name,
-		AvatarURL:    strfmt.URI(u.PhotoURL),
-		Provider:     u.Provider,
+// DomainRolesAllow returns whether any of the given domain roles grants the specified permission
+func DomainRolesAllow(roles []models.DomainRole, perm DomainPermission) bool {
+	for _, r := range roles {
+		for _, p := range DomainPolicy[r] {
+			if p == perm {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// DomainRoleManagePermission returns the permission required to grant the given domain role to, or take it away from,
+// a user
+func DomainRoleManagePermission(role models.DomainRole) DomainPermission {
+	if role == models.DomainRoleOwner || role == models.DomainRoleAdministrator {
+		return DomainPermissionOwn
+	}
+	return DomainPermissionConfigure
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// CommentCursor represents a position in a paginated comment list, i.e. the sort key of the last comment on a page.
+// Since it refers to a comment's sort key rather than its offset, it stays valid when new comments get added. The sort
+// key only makes sense in the sort order it's been produced for, hence the sort policy is part of the cursor
+type CommentCursor struct {
+	SortPolicy models.SortPolicy `json:"p"` // Sort policy of the list
+	Score      int64             `json:"s"` // Score of the comment
+	Created    time.Time         `json:"c"` // Creation timestamp of the comment
+	HexID      models.HexID      `json:"h"` // Comment hex ID, used as a tie-breaker
+}
+
+// String encodes the cursor into an opaque string, suitable for passing to the client
+func (c *CommentCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
 }
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"testing"
+)
+
+func TestDomainRolesAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []models.DomainRole
+		perm  DomainPermission
+		want  bool
+	}{
+		{"no roles", nil, DomainPermissionViewStats, false},
+		{"owner owns", []models.DomainRole{models.DomainRoleOwner}, DomainPermissionOwn, true},
+		{"owner moderates", []models.DomainRole{models.DomainRoleOwner}, DomainPermissionModerate, true},
+		{"administrator configures", []models.DomainRole{models.DomainRoleAdministrator}, DomainPermissionConfigure, true},
+		{"administrator doesn't own", []models.DomainRole{models.DomainRoleAdministrator}, DomainPermissionOwn, false},
+		{"moderator moderates", []models.DomainRole{models.DomainRoleModerator}, DomainPermissionModerate, true},
+		{"moderator doesn't configure", []models.DomainRole{models.DomainRoleModerator}, DomainPermissionConfigure, false},
+		{"analyst views stats", []models.DomainRole{models.DomainRoleAnalyst}, DomainPermissionViewStats, true},
+		{"analyst doesn't moderate", []models.DomainRole{models.DomainRoleAnalyst}, DomainPermissionModerate, false},
+		{"roles combine", []models.DomainRole{models.DomainRoleAnalyst, models.DomainRoleModerator}, DomainPermissionModerate, true},
+		{"unknown role", []models.DomainRole{"superhero"}, DomainPermissionViewStats, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DomainRolesAllow(tt.roles, tt.perm); got != tt.want {
+				t.Errorf("DomainRolesAllow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package data
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/go-openapi/strfmt"
 	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/util"
 	"strings"
 )
 
@@ -13,6 +17,30 @@ func EmailToString(email *strfmt.Email) string {
 	return TrimmedString((*string)(email))
 }
 
+// ParseCommentCursor decodes a comment cursor from a string, previously produced by CommentCursor.String() for a list
+// sorted according to the given sort policy
+func ParseCommentCursor(s string, sortPolicy models.SortPolicy) (*CommentCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c CommentCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	// Validate the comment hex ID
+	if !util.IsValidHexID(string(c.HexID)) {
+		return nil, errors.New("invalid cursor comment ID")
+	}
+
+	// A cursor produced for a different order can't point to a position in this one
+	if c.SortPolicy != sortPolicy {
+		return nil, errors.New("cursor sort policy mismatch")
+	}
+	return &c, nil
+}
+
 // RandomHexID creates and returns a new, random hex ID
 func RandomHexID() (models.HexID, error) {
 	b := make([]byte, 32)
@@ -37,3 +65,9 @@ func URIToString(v *strfmt.URI) string {
 	}
 	return string(*v)
 }
+
+// UnsubscribeToken returns the token for unsubscribing the given email from notifications. It's derived from the email
+// with the given key rather than random, so it can be reproduced for every notification without storing it in plain
+func UnsubscribeToken(key, email string) models.HexID {
+	return models.HexID(util.HMACHex(key, "unsubscribe:"+email))
+}
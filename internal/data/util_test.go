@@ -2,7 +2,10 @@ package data
 
 import (
 	"github.com/go-openapi/strfmt"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestEmailToString(t *testing.T) {
@@ -26,6 +29,43 @@ func TestEmailToString(t *testing.T) {
 	}
 }
 
+func TestParseCommentCursor(t *testing.T) {
+	hex := models.HexID("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	c := &CommentCursor{
+		SortPolicy: models.SortPolicyScoreDashDesc,
+		Score:      -3,
+		Created:    time.Date(2023, 2, 14, 10, 20, 30, 0, time.UTC),
+		HexID:      hex,
+	}
+	tests := []struct {
+		name       string
+		s          string
+		sortPolicy models.SortPolicy
+		want       *CommentCursor
+		wantErr    bool
+	}{
+		{"empty          ", "", models.SortPolicyScoreDashDesc, nil, true},
+		{"not base64     ", "!!!", models.SortPolicyScoreDashDesc, nil, true},
+		{"not JSON       ", "Zm9vYmFy", models.SortPolicyScoreDashDesc, nil, true},
+		{"bad hex ID     ", (&CommentCursor{SortPolicy: models.SortPolicyScoreDashDesc, HexID: "xyz"}).String(), models.SortPolicyScoreDashDesc, nil, true},
+		{"no sort policy ", (&CommentCursor{HexID: hex}).String(), models.SortPolicyScoreDashDesc, nil, true},
+		{"other policy   ", c.String(), models.SortPolicyCreationdateDashAsc, nil, true},
+		{"valid cursor   ", c.String(), models.SortPolicyScoreDashDesc, c, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCommentCursor(tt.s, tt.sortPolicy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCommentCursor() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCommentCursor() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestRandomHexID(t *testing.T) {
 	t.Run("randomness test", func(t *testing.T) {
 		// Generate first ID
@@ -21,6 +21,7 @@ var logger = logging.MustGetLogger("persistence")
 
 var goMigrations = map[string]func(db *Database) error{
 	"20190213033530-email-notifications.sql": migrateEmails,
+	"20261017120000-hashed-tokens.sql":       migrateHashedTokens,
 }
 
 // Database is an opaque structure providing database operations
@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+)
+
+func migrateHashedTokens(db *Database) error {
+	key := config.SecretsConfig.TokenKey
+
+	// Replace session tokens with their hashes, so that nobody gets signed out
+	tokens, err := queryStrings(db, "select token from usersessions;")
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := db.Exec("update usersessions set token=$1 where token=$2;", util.HMACHex(key, token), token); err != nil {
+			logger.Errorf("cannot rehash session token during migration: %v", err)
+			return util.ErrorDatabaseMigration
+		}
+	}
+
+	// Unsubscribe tokens are derived from the email now, which invalidates the random ones sent out before
+	emails, err := queryStrings(db, "select email from emails;")
+	if err != nil {
+		return err
+	}
+	for _, email := range emails {
+		hash := util.HMACHex(key, string(data.UnsubscribeToken(key, email)))
+		if err := db.Exec("update emails set unsubscribesecrethex=$1 where email=$2;", hash, email); err != nil {
+			logger.Errorf("cannot update unsubscribe token during migration: %v", err)
+			return util.ErrorDatabaseMigration
+		}
+	}
+
+	return nil
+}
+
+// queryStrings runs the given query, which must select a single text column, and returns all the values it yields
+func queryStrings(db *Database, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		logger.Errorf("cannot query values during migration: %v", err)
+		return nil, util.ErrorDatabaseMigration
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			logger.Errorf("cannot fetch value during migration: %v", err)
+			return nil, util.ErrorDatabaseMigration
+		}
+		res = append(res, s)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("cannot fetch values during migration: %v", err)
+		return nil, util.ErrorDatabaseMigration
+	}
+	return res, nil
+}
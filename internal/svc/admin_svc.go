@@ -0,0 +1,353 @@
+package svc
+
+import (
+	"github.com/go-openapi/strfmt"
+	"github.com/lib/pq"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"strings"
+	"time"
+)
+
+// TheAdminService is a global AdminService implementation
+var TheAdminService AdminService = &adminService{}
+
+// AdminService is a service interface for administering the whole instance
+type AdminService interface {
+	// AddSignupDomain adds the given (lowercase) email domain to the owner signup allow-list
+	AddSignupDomain(emailDomain string) error
+	// BootstrapSuperuser makes the user with the given email an instance superuser, provided they've confirmed that
+	// email. Returns ErrNotFound if there's no such confirmed user
+	BootstrapSuperuser(email string) error
+	// DeleteSignupDomain removes the given email domain from the owner signup allow-list. Returns ErrNotFound if
+	// there's no such email domain in the list
+	DeleteSignupDomain(emailDomain string) error
+	// IsSignupAllowed returns whether the owner signup allow-list permits the given email. An empty list permits any
+	// email
+	IsSignupAllowed(email string) (bool, error)
+	// ListDomains returns a page of all domains whose host, name, or owner email contains the given query string,
+	// ordered by host
+	ListDomains(query string, offset int) ([]*models.AdminDomain, error)
+	// ListSignupDomains returns the owner signup allow-list, ordered alphabetically
+	ListSignupDomains() ([]string, error)
+	// ListUsers returns a page of all users whose email or name contains the given query string, ordered by email. If
+	// ownersOnly is true, only users owning at least one domain are returned
+	ListUsers(query string, ownersOnly bool, offset int) ([]*models.AdminUser, error)
+	// ReassignDomainOwner makes the given user the only owner of the specified domain, removing all roles of the
+	// previous owners. Returns ErrNotFound if there's no such domain
+	ReassignDomainOwner(domain string, user *data.User) error
+	// SetDomainFrozen freezes or unfreezes the specified domain, independently of the state set by its owners. Returns
+	// ErrNotFound if there's no such domain
+	SetDomainFrozen(domain string, frozen bool) error
+	// SetUserSuspended suspends or reinstates the user with the given hex ID. Suspending also removes all the user's
+	// sessions and API tokens. Returns ErrNotFound if there's no such user
+	SetUserSuspended(id models.HexID, suspended bool) error
+	// Stats collects and returns instance-wide statistics
+	Stats() (*models.AdminStats, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// adminListLimit is the maximum number of items returned by a single admin list query
+const adminListLimit = 100
+
+// adminService is a blueprint AdminService implementation
+type adminService struct{}
+
+func (svc *adminService) AddSignupDomain(emailDomain string) error {
+	logger.Debugf("adminService.AddSignupDomain(%s)", emailDomain)
+
+	// Insert a new record, unless the email domain's already there
+	err := db.Exec(
+		"insert into signupdomains(emaildomain, adddate) values($1, $2) on conflict do nothing;",
+		emailDomain, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("adminService.AddSignupDomain: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *adminService) BootstrapSuperuser(email string) error {
+	logger.Debugf("adminService.BootstrapSuperuser(%s)", email)
+
+	// Update the user's record. An unconfirmed account could have been registered by anyone with that email
+	res, err := db.ExecRes("update users set superuser=true where email=$1 and confirmedemail;", email)
+	if err != nil {
+		logger.Errorf("adminService.BootstrapSuperuser: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+func (svc *adminService) DeleteSignupDomain(emailDomain string) error {
+	logger.Debugf("adminService.DeleteSignupDomain(%s)", emailDomain)
+
+	// Delete the record
+	res, err := db.ExecRes("delete from signupdomains where emaildomain=$1;", emailDomain)
+	if err != nil {
+		logger.Errorf("adminService.DeleteSignupDomain: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+func (svc *adminService) IsSignupAllowed(email string) (bool, error) {
+	logger.Debugf("adminService.IsSignupAllowed(%s)", email)
+
+	// Extract the email's domain
+	emailDomain := ""
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		emailDomain = strings.ToLower(email[i+1:])
+	}
+
+	// Allow the email if the list is empty or has its domain
+	var allowed bool
+	err := db.QueryRow(
+		"select not exists(select 1 from signupdomains) or exists(select 1 from signupdomains where emaildomain=$1);",
+		emailDomain).
+		Scan(&allowed)
+	if err != nil {
+		logger.Errorf("adminService.IsSignupAllowed: QueryRow() failed: %v", err)
+		return false, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return allowed, nil
+}
+
+func (svc *adminService) ListDomains(query string, offset int) ([]*models.AdminDomain, error) {
+	logger.Debugf("adminService.ListDomains(%s, %d)", query, offset)
+
+	// Query the domains along with their owners
+	rows, err := db.Query(
+		"select d.domain, d.name, d.creationdate, d.state, d.adminfrozen, "+
+			"coalesce(array_agg(u.email order by u.email) filter (where u.email is not null), '{}'), "+
+			"(select count(*) from comments c where c.domain=d.domain and not c.deleted) "+
+			"from domains d "+
+			"left join domainusers du on du.domain=d.domain and du.role=$1 "+
+			"left join users u on u.userhex=du.userhex "+
+			"group by d.domain "+
+			"having strpos(lower(d.domain), lower($2))>0 or strpos(lower(d.name), lower($2))>0 or "+
+			"coalesce(bool_or(strpos(lower(u.email), lower($2))>0), false) "+
+			"order by d.domain "+
+			"limit $3 offset $4;",
+		models.DomainRoleOwner, query, adminListLimit, offset)
+	if err != nil {
+		logger.Errorf("adminService.ListDomains: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the domains
+	res := []*models.AdminDomain{}
+	for rows.Next() {
+		d := models.AdminDomain{}
+		var created time.Time
+		var owners []string
+		if err := rows.Scan(&d.Domain, &d.Name, &created, &d.State, &d.AdminFrozen, pq.Array(&owners), &d.CountComments); err != nil {
+			logger.Errorf("adminService.ListDomains: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		d.CreationDate = strfmt.DateTime(created)
+		for _, email := range owners {
+			d.Owners = append(d.Owners, strfmt.Email(email))
+		}
+		res = append(res, &d)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("adminService.ListDomains: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *adminService) ListSignupDomains() ([]string, error) {
+	logger.Debug("adminService.ListSignupDomains()")
+
+	// Query the email domains
+	rows, err := db.Query("select emaildomain from signupdomains order by emaildomain;")
+	if err != nil {
+		logger.Errorf("adminService.ListSignupDomains: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the email domains
+	res := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			logger.Errorf("adminService.ListSignupDomains: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, s)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("adminService.ListSignupDomains: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *adminService) ListUsers(query string, ownersOnly bool, offset int) ([]*models.AdminUser, error) {
+	logger.Debugf("adminService.ListUsers(%s, %v, %d)", query, ownersOnly, offset)
+
+	// Query the users along with the number of domains they own
+	rows, err := db.Query(
+		"select u.userhex, u.email, u.name, "+userProviderColumn("u")+", u.confirmedemail, u.joindate, u.superuser, "+
+			"u.suspended, (select count(*) from domainusers du where du.userhex=u.userhex and du.role=$1) as cnt "+
+			"from users u "+
+			"where u.userhex<>$2 and (strpos(lower(u.email), lower($3))>0 or strpos(lower(u.name), lower($3))>0) "+
+			"and (not $4 or exists(select 1 from domainusers du where du.userhex=u.userhex and du.role=$1)) "+
+			"order by u.email "+
+			"limit $5 offset $6;",
+		models.DomainRoleOwner, data.AnonymousCommenter.HexID, query, ownersOnly, adminListLimit, offset)
+	if err != nil {
+		logger.Errorf("adminService.ListUsers: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the users
+	res := []*models.AdminUser{}
+	for rows.Next() {
+		u := models.AdminUser{}
+		var joined time.Time
+		var provider string
+		err := rows.Scan(&u.UserHex, &u.Email, &u.Name, &provider, &u.ConfirmedEmail, &joined, &u.Superuser, &u.Suspended, &u.CountOwnedDomains)
+		if err != nil {
+			logger.Errorf("adminService.ListUsers: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		u.JoinDate = strfmt.DateTime(joined)
+		u.Provider = unfixIdP(provider)
+		res = append(res, &u)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("adminService.ListUsers: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *adminService) ReassignDomainOwner(domain string, user *data.User) error {
+	logger.Debugf("adminService.ReassignDomainOwner(%s, [%s])", domain, user.HexID)
+
+	// Make sure the domain exists
+	if _, err := TheDomainService.FindByName(domain); err != nil {
+		return err
+	}
+
+	// Replace the domain's owners with the user in a single statement, so that the domain never ends up without one.
+	// The previous owners lose any other role on the domain, too
+	err := db.Exec(
+		"with d as (delete from domainusers where domain=$1 and userhex<>$3 and userhex in "+
+			"(select userhex from domainusers where domain=$1 and role=$2)) "+
+			"insert into domainusers(domain, userhex, role, adddate) values($1, $3, $2, $4) on conflict do nothing;",
+		domain, models.DomainRoleOwner, user.HexID, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("adminService.ReassignDomainOwner: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Create an email record for the new owner, needed for notifications
+	if _, err := TheEmailService.Create(user.Email); err != nil {
+		return err
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *adminService) SetDomainFrozen(domain string, frozen bool) error {
+	logger.Debugf("adminService.SetDomainFrozen(%s, %v)", domain, frozen)
+
+	// Update the domain's record. The flag is separate from the domain's state, which its owners are free to change
+	res, err := db.ExecRes("update domains set adminfrozen=$1 where domain=$2;", frozen, domain)
+	if err != nil {
+		logger.Errorf("adminService.SetDomainFrozen: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+func (svc *adminService) SetUserSuspended(id models.HexID, suspended bool) error {
+	logger.Debugf("adminService.SetUserSuspended(%s, %v)", id, suspended)
+
+	// Update the user's record
+	res, err := db.ExecRes("update users set suspended=$1 where userhex=$2;", suspended, id)
+	if err != nil {
+		logger.Errorf("adminService.SetUserSuspended: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err != nil {
+		return err
+	}
+
+	// Sign a suspended user out everywhere and revoke their API tokens
+	if suspended {
+		if err := TheUserService.DeleteSessions(id, ""); err != nil {
+			return err
+		}
+		if err := db.Exec("delete from apitokens where userhex=$1;", id); err != nil {
+			logger.Errorf("adminService.SetUserSuspended: Exec() failed: %v", err)
+			return translateDBErrors(err)
+		}
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *adminService) Stats() (*models.AdminStats, error) {
+	logger.Debug("adminService.Stats()")
+
+	// Query all the counts at once
+	s := models.AdminStats{}
+	since := time.Now().UTC().AddDate(0, 0, -30)
+	err := db.QueryRow(
+		"select "+
+			"(select count(*) from users where userhex<>$1), "+
+			"(select count(*) from users where suspended), "+
+			"(select count(*) from domains), "+
+			"(select count(*) from domains where state=$2 or adminfrozen), "+
+			"(select count(*) from comments where not deleted), "+
+			"(select count(*) from comments where not deleted and creationdate>=$3), "+
+			"(select count(*) from views where viewdate>=$3);",
+		data.AnonymousCommenter.HexID, models.DomainStateFrozen, since).
+		Scan(
+			&s.CountUsers,
+			&s.CountSuspendedUsers,
+			&s.CountDomains,
+			&s.CountFrozenDomains,
+			&s.CountComments,
+			&s.CountCommentsLast30Days,
+			&s.CountViewsLast30Days)
+	if err != nil {
+		logger.Errorf("adminService.Stats: QueryRow() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return &s, nil
+}
@@ -0,0 +1,142 @@
+package svc
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Local Bayesian spam classifier, trained on moderator decisions
+
+const (
+	bayesMinTrainedMessages = 10  // Minimum number of trained spam and ham messages each before the classifier kicks in
+	bayesMinTokenLength     = 3   // Minimum length of a token to be considered
+	bayesMaxTokenLength     = 32  // Maximum length of a token to be considered
+	bayesMaxTokens          = 200 // Maximum number of distinct tokens taken from a single message
+)
+
+// bayesSpamChecker is a SpamChecker that uses the domain's Bayesian classifier, if it's enabled for the domain
+type bayesSpamChecker struct{}
+
+func (c *bayesSpamChecker) ID() string {
+	return "bayes"
+}
+
+func (c *bayesSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	// Skip if the classifier isn't enabled
+	if !domain.SpamBayesFilter {
+		return nil, nil
+	}
+
+	// Fetch the number of trained messages. Not having trained anything yet isn't an error
+	var spamDocs, hamDocs int
+	err := db.QueryRow("select spamcount, hamcount from spamcorpora where domain=$1;", domain.Domain).Scan(&spamDocs, &hamDocs)
+	if err = translateDBErrors(err); err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Skip until the classifier is sufficiently trained
+	if spamDocs < bayesMinTrainedMessages || hamDocs < bayesMinTrainedMessages {
+		return nil, nil
+	}
+
+	// Fetch the statistics for the message's tokens
+	tokens := bayesTokenize(msg.Markdown)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	rows, err := db.Query(
+		"select spamcount, hamcount from spamtokens where domain=$1 and token=any($2);",
+		domain.Domain, pq.Array(tokens))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts [][2]int
+	for rows.Next() {
+		var c [2]int
+		if err := rows.Scan(&c[0], &c[1]); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only a probability above 0.5 contributes to the score
+	p := bayesSpamProbability(spamDocs, hamDocs, counts)
+	if p <= 0.5 {
+		return nil, nil
+	}
+	return &SpamCheckResult{Score: 2 * (p - 0.5), Reasons: []string{fmt.Sprintf("spam probability %.2f", p)}}, nil
+}
+
+// bayesSpamProbability calculates the probability of a message being spam, given the number of trained spam and ham
+// messages, and spam/ham counts for each known token of the message
+func bayesSpamProbability(spamDocs, hamDocs int, tokenCounts [][2]int) float64 {
+	// Sum up log-odds, applying Laplace smoothing to token probabilities
+	logOdds := math.Log(float64(spamDocs) / float64(hamDocs))
+	for _, c := range tokenCounts {
+		pSpam := float64(c[0]+1) / float64(spamDocs+2)
+		pHam := float64(c[1]+1) / float64(hamDocs+2)
+		logOdds += math.Log(pSpam / pHam)
+	}
+	return 1 / (1 + math.Exp(-logOdds))
+}
+
+// bayesTokenize splits the text into a list of distinct lowercase tokens
+func bayesTokenize(text string) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, t := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if l := len([]rune(t)); l >= bayesMinTokenLength && l <= bayesMaxTokenLength && !seen[t] {
+			seen[t] = true
+			res = append(res, t)
+			if len(res) >= bayesMaxTokens {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// bayesTrain updates the domain's classifier statistics with the given message, which is considered either spam or ham
+func bayesTrain(domain, markdown string, spam bool) error {
+	spamInc, hamInc := 0, 1
+	if spam {
+		spamInc, hamInc = 1, 0
+	}
+
+	// Update the message counts
+	err := db.Exec(
+		"insert into spamcorpora(domain, spamcount, hamcount) values($1, $2, $3) "+
+			"on conflict (domain) do update set spamcount=spamcorpora.spamcount+$2, hamcount=spamcorpora.hamcount+$3;",
+		domain, spamInc, hamInc)
+	if err != nil {
+		logger.Errorf("bayesTrain: Exec() failed for corpus: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Update the token counts
+	if tokens := bayesTokenize(markdown); len(tokens) > 0 {
+		err = db.Exec(
+			"insert into spamtokens(domain, token, spamcount, hamcount) select $1, unnest($2::text[]), $3, $4 "+
+				"on conflict (domain, token) do update set spamcount=spamtokens.spamcount+$3, hamcount=spamtokens.hamcount+$4;",
+			domain, pq.Array(tokens), spamInc, hamInc)
+		if err != nil {
+			logger.Errorf("bayesTrain: Exec() failed for tokens: %v", err)
+			return translateDBErrors(err)
+		}
+	}
+
+	// Succeeded
+	return nil
+}
@@ -0,0 +1,224 @@
+package svc
+
+import (
+	"fmt"
+	"github.com/adtac/go-akismet/akismet"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/config"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Built-in spam checkers
+
+// reLink matches a link in a comment's markdown: either an absolute URL or a bare "www." host
+var reLink = regexp.MustCompile(`(?i)\b(https?://|www\.)[^\s)\]]+`)
+
+const (
+	duplicateSpamMinLength = 20             // Minimum message length for it to be checked for duplicates
+	duplicateSpamWindow    = 24 * time.Hour // How far back to look for duplicates
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// akismetSpamChecker is a SpamChecker that consults the Akismet API, if it's configured
+type akismetSpamChecker struct{}
+
+func (c *akismetSpamChecker) ID() string {
+	return "akismet"
+}
+
+func (c *akismetSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	// Ignore if Akismet isn't configured
+	if config.SecretsConfig.Akismet.Key == "" {
+		return nil, nil
+	}
+
+	// Run the message with Akismet API
+	spam, err := akismet.Check(
+		&akismet.Comment{
+			Blog:               domain.Domain,
+			UserIP:             msg.UserIP,
+			UserAgent:          msg.UserAgent,
+			CommentType:        "comment",
+			CommentAuthor:      msg.Name,
+			CommentAuthorEmail: msg.Email,
+			CommentAuthorURL:   msg.URL,
+			CommentContent:     msg.Markdown,
+		},
+		config.SecretsConfig.Akismet.Key)
+	if err != nil {
+		return nil, err
+	} else if !spam {
+		return nil, nil
+	}
+	return &SpamCheckResult{Score: 1, Reasons: []string{"Akismet considers the message spam"}}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// blocklistSpamChecker is a SpamChecker that looks for words, phrases, and regular expressions listed in the domain's
+// blocklist
+type blocklistSpamChecker struct{}
+
+func (c *blocklistSpamChecker) ID() string {
+	return "blocklist"
+}
+
+func (c *blocklistSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	text := strings.ToLower(msg.Markdown)
+	var reasons []string
+	for _, entry := range splitSpamList(domain.SpamBlocklist) {
+		// An entry enclosed in slashes is a regular expression
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			re, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+			if err != nil {
+				logger.Warningf("blocklistSpamChecker: invalid regular expression %s in domain %s: %v", entry, domain.Domain, err)
+				continue
+			}
+			if re.MatchString(msg.Markdown) {
+				reasons = append(reasons, fmt.Sprintf("matches %s", entry))
+			}
+
+			// Any other entry is a word or a phrase
+		} else if strings.Contains(text, strings.ToLower(entry)) {
+			reasons = append(reasons, fmt.Sprintf("contains '%s'", entry))
+		}
+	}
+	if len(reasons) == 0 {
+		return nil, nil
+	}
+	return &SpamCheckResult{Score: 1, Reasons: reasons}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// denylistSpamChecker is a SpamChecker that matches the author's IP address and email against the domain's denylist
+type denylistSpamChecker struct{}
+
+func (c *denylistSpamChecker) ID() string {
+	return "denylist"
+}
+
+func (c *denylistSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	ip := parseUserIP(msg.UserIP)
+	email := strings.ToLower(msg.Email)
+	for _, entry := range splitSpamList(domain.SpamDenylist) {
+		entry = strings.ToLower(entry)
+		var matches bool
+		switch {
+		// Email domain
+		case strings.HasPrefix(entry, "@"):
+			matches = email != "" && strings.HasSuffix(email, entry)
+
+		// Email address
+		case strings.Contains(entry, "@"):
+			matches = email == entry
+
+		// CIDR range
+		case strings.Contains(entry, "/"):
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+				matches = ip != nil && ipNet.Contains(ip)
+			}
+
+		// IP address
+		default:
+			matches = ip != nil && ip.Equal(net.ParseIP(entry))
+		}
+		if matches {
+			return &SpamCheckResult{Score: 1, Reasons: []string{fmt.Sprintf("author matches %s", entry)}}, nil
+		}
+	}
+	return nil, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// duplicateSpamChecker is a SpamChecker that looks for recent comments with identical text on the domain
+type duplicateSpamChecker struct{}
+
+func (c *duplicateSpamChecker) ID() string {
+	return "duplicate"
+}
+
+func (c *duplicateSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	// Short messages ("Thanks!") are legitimately repeated
+	text := strings.TrimSpace(msg.Markdown)
+	if len(text) < duplicateSpamMinLength {
+		return nil, nil
+	}
+
+	// Count recent comments with the same text, in total and by the same author
+	var total, own int
+	err := db.QueryRow(
+		"select count(*), count(*) filter (where commenterhex=$3) "+
+			"from comments "+
+			"where domain=$1 and markdown=$2 and creationdate>$4 and deleted=false;",
+		domain.Domain, text, fixCommenterHex(msg.CommenterHex), time.Now().UTC().Add(-duplicateSpamWindow)).
+		Scan(&total, &own)
+	if err != nil {
+		return nil, err
+	}
+
+	// The anonymous commenter isn't a single person, so anonymous duplicates don't count as own
+	switch {
+	case own > 0 && fixCommenterHex(msg.CommenterHex) != "anonymous":
+		return &SpamCheckResult{Score: 1, Reasons: []string{fmt.Sprintf("author posted the same text %d time(s) recently", own)}}, nil
+	case total > 0:
+		return &SpamCheckResult{Score: 0.5, Reasons: []string{fmt.Sprintf("the same text was posted %d time(s) recently", total)}}, nil
+	}
+	return nil, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// linkCountSpamChecker is a SpamChecker that limits the number of links in a message
+type linkCountSpamChecker struct{}
+
+func (c *linkCountSpamChecker) ID() string {
+	return "links"
+}
+
+func (c *linkCountSpamChecker) Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error) {
+	// Skip if there's no limit
+	if domain.SpamLinkLimit <= 0 {
+		return nil, nil
+	}
+
+	// Count the links
+	if n := int64(len(reLink.FindAllStringIndex(msg.Markdown, -1))); n > domain.SpamLinkLimit {
+		return &SpamCheckResult{Score: 1, Reasons: []string{fmt.Sprintf("%d link(s), only %d allowed", n, domain.SpamLinkLimit)}}, nil
+	}
+	return nil, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// parseUserIP parses a user IP address. Addresses recorded before util.UserIP() started resolving forwarded lists and
+// stripping ports may still contain those
+func parseUserIP(s string) net.IP {
+	// Only use the first (originating) address of a forwarded list
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+
+	// Strip off the port, if any
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s)
+}
+
+// splitSpamList splits a newline-separated list into non-empty, trimmed entries
+func splitSpamList(s string) []string {
+	var res []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
@@ -1,48 +1,135 @@
 package svc
 
 import (
-	"github.com/adtac/go-akismet/akismet"
-	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"strings"
+	"sync"
 )
 
 // TheAntispamService is a global AntispamService implementation
-var TheAntispamService AntispamService = &antispamService{}
+var TheAntispamService AntispamService = &antispamService{
+	checkers: []SpamChecker{
+		&denylistSpamChecker{},
+		&blocklistSpamChecker{},
+		&linkCountSpamChecker{},
+		&duplicateSpamChecker{},
+		&bayesSpamChecker{},
+		&akismetSpamChecker{},
+	},
+}
 
 // AntispamService is a service interface for spam checks
 type AntispamService interface {
-	// CheckForSpam verifies the provided message details for spam and returns whether it's a spam message
-	CheckForSpam(domain, userIP, userAgent, name, email, url, markdown string) bool
+	// CheckForSpam runs the message posted to the given domain through all registered spam checkers and returns the
+	// combined verdict. Checkers that fail are skipped
+	CheckForSpam(domain *models.Domain, msg *SpamMessage) *SpamVerdict
+	// Register appends a new checker to the spam check pipeline
+	Register(checker SpamChecker)
+	// Train feeds a moderator decision on the given message text into the domain's Bayesian classifier
+	Train(domain, markdown string, spam bool) error
+}
+
+// SpamChecker is a single step in the spam check pipeline
+type SpamChecker interface {
+	// ID returns the checker's unique identifier
+	ID() string
+	// Check examines the message posted to the given domain. It returns nil if the checker has nothing to report
+	Check(domain *models.Domain, msg *SpamMessage) (*SpamCheckResult, error)
+}
+
+// SpamMessage describes a message to be checked for spam
+type SpamMessage struct {
+	CommenterHex models.HexID // Hex ID of the message author
+	UserIP       string       // IP address of the author
+	UserAgent    string       // User agent of the author
+	Name         string       // Name of the author
+	Email        string       // Email of the author
+	URL          string       // Website URL of the author
+	Markdown     string       // Message text
+}
+
+// SpamCheckResult is the outcome of a single spam check
+type SpamCheckResult struct {
+	Score   float64  // Spam score: 0 means no spam signal, 1 and over is a strong one
+	Reasons []string // Human-readable explanation of the score
+}
+
+// SpamVerdict is the combined outcome of all spam checks
+type SpamVerdict struct {
+	Score   float64  // Total spam score
+	Reasons []string // Reasons reported by individual checkers, prefixed with the checker ID
+}
+
+// Default domain spam score thresholds, used when the domain has none configured
+const (
+	DefaultSpamThresholdUnapproved = 0.5
+	DefaultSpamThresholdFlagged    = 1.0
+)
+
+// State maps the verdict's score to a comment state, using the given domain's thresholds
+func (v *SpamVerdict) State(domain *models.Domain) models.CommentState {
+	unapproved, flagged := domain.SpamThresholdUnapproved, domain.SpamThresholdFlagged
+	if unapproved <= 0 {
+		unapproved = DefaultSpamThresholdUnapproved
+	}
+	if flagged <= 0 {
+		flagged = DefaultSpamThresholdFlagged
+	}
+	switch {
+	case v.Score >= flagged:
+		return models.CommentStateFlagged
+	case v.Score >= unapproved:
+		return models.CommentStateUnapproved
+	}
+	return models.CommentStateApproved
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
 // antispamService is a blueprint AntispamService implementation
-type antispamService struct{}
+type antispamService struct {
+	checkers []SpamChecker
+	mu       sync.RWMutex
+}
+
+func (svc *antispamService) CheckForSpam(domain *models.Domain, msg *SpamMessage) *SpamVerdict {
+	logger.Debugf("antispamService.CheckForSpam(%s, %s, %s, %s, %s, %s, ...)", domain.Domain, msg.UserIP, msg.UserAgent, msg.Name, msg.Email, msg.URL)
 
-func (svc *antispamService) CheckForSpam(domain, userIP, userAgent, name, email, url, markdown string) bool {
-	logger.Debugf("antispamService.CheckForSpam(%s, %s, %s, %s, %s, ...)", domain, userIP, userAgent, name, email, url)
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
 
-	// Ignore if Akismet isn't configured (consider it not spam)
-	if config.SecretsConfig.Akismet.Key == "" {
-		return false
+	// Run the message through every checker
+	v := &SpamVerdict{}
+	for _, c := range svc.checkers {
+		res, err := c.Check(domain, msg)
+		if err != nil {
+			logger.Warningf("antispamService.CheckForSpam: %s checker failed, skipping: %v", c.ID(), err)
+			continue
+		}
+
+		// Accumulate the score and the reasons
+		if res != nil && res.Score > 0 {
+			v.Score += res.Score
+			for _, r := range res.Reasons {
+				v.Reasons = append(v.Reasons, c.ID()+": "+r)
+			}
+		}
 	}
 
-	// Run the message with Akismet API
-	res, err := akismet.Check(
-		&akismet.Comment{
-			Blog:               domain,
-			UserIP:             userIP,
-			UserAgent:          userAgent,
-			CommentType:        "comment",
-			CommentAuthor:      name,
-			CommentAuthorEmail: email,
-			CommentAuthorURL:   url,
-			CommentContent:     markdown,
-		},
-		config.SecretsConfig.Akismet.Key)
-	if err != nil {
-		logger.Errorf("antispamService.CheckForSpam: akismet.Check() failed: %v", err)
-		return true
+	if v.Score > 0 {
+		logger.Infof("antispamService.CheckForSpam: message on %s scored %.2f (%s)", domain.Domain, v.Score, strings.Join(v.Reasons, "; "))
 	}
-	return res
+	return v
+}
+
+func (svc *antispamService) Register(checker SpamChecker) {
+	logger.Debugf("antispamService.Register(%s)", checker.ID())
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.checkers = append(svc.checkers, checker)
+}
+
+func (svc *antispamService) Train(domain, markdown string, spam bool) error {
+	logger.Debugf("antispamService.Train(%s, ..., %v)", domain, spam)
+	return bayesTrain(domain, markdown, spam)
 }
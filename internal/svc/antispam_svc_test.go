@@ -0,0 +1,179 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"reflect"
+	"testing"
+)
+
+func TestSpamVerdict_State(t *testing.T) {
+	custom := &models.Domain{SpamThresholdUnapproved: 2, SpamThresholdFlagged: 3}
+	tests := []struct {
+		name   string
+		domain *models.Domain
+		score  float64
+		want   models.CommentState
+	}{
+		{"defaults, no spam   ", &models.Domain{}, 0, models.CommentStateApproved},
+		{"defaults, suspicious", &models.Domain{}, 0.5, models.CommentStateUnapproved},
+		{"defaults, spam      ", &models.Domain{}, 1.5, models.CommentStateFlagged},
+		{"custom, no spam     ", custom, 1.5, models.CommentStateApproved},
+		{"custom, suspicious  ", custom, 2, models.CommentStateUnapproved},
+		{"custom, spam        ", custom, 3, models.CommentStateFlagged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &SpamVerdict{Score: tt.score}
+			if got := v.State(tt.domain); got != tt.want {
+				t.Errorf("State() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_antispamService_CheckForSpam(t *testing.T) {
+	t.Run("combines checkers", func(t *testing.T) {
+		svc := &antispamService{}
+		svc.Register(&blocklistSpamChecker{})
+		svc.Register(&linkCountSpamChecker{})
+		domain := &models.Domain{Domain: "example.com", SpamBlocklist: "casino", SpamLinkLimit: 1}
+		v := svc.CheckForSpam(domain, &SpamMessage{Markdown: "Best casino: https://a.com https://b.com"})
+		if v.Score != 2 {
+			t.Errorf("CheckForSpam() score = %v, want 2", v.Score)
+		}
+		want := []string{"blocklist: contains 'casino'", "links: 2 link(s), only 1 allowed"}
+		if !reflect.DeepEqual(v.Reasons, want) {
+			t.Errorf("CheckForSpam() reasons = %v, want %v", v.Reasons, want)
+		}
+	})
+}
+
+func Test_blocklistSpamChecker_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		blocklist string
+		markdown  string
+		wantScore float64
+	}{
+		{"empty list     ", "", "Buy cheap pills", 0},
+		{"no match       ", "casino\npills", "Nice article", 0},
+		{"word match     ", "casino\npills", "Buy cheap PILLS", 1},
+		{"regex match    ", "/ch[e3]+ap/", "Buy CH33AP stuff", 1},
+		{"invalid regex  ", "/(/", "Anything (really)", 0},
+		{"blank lines    ", "\n  \n", "Anything", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := (&blocklistSpamChecker{}).Check(&models.Domain{SpamBlocklist: tt.blocklist}, &SpamMessage{Markdown: tt.markdown})
+			if err != nil {
+				t.Errorf("Check() error = %v", err)
+			}
+			if got := spamCheckScore(res); got != tt.wantScore {
+				t.Errorf("Check() score = %v, want %v", got, tt.wantScore)
+			}
+		})
+	}
+}
+
+func Test_denylistSpamChecker_Check(t *testing.T) {
+	const denylist = "10.0.0.1\n192.168.0.0/16\nspammer@example.com\n@spam.org"
+	tests := []struct {
+		name      string
+		ip        string
+		email     string
+		wantScore float64
+	}{
+		{"clean            ", "10.0.0.2", "user@example.com", 0},
+		{"IP               ", "10.0.0.1", "", 1},
+		{"IP with port     ", "10.0.0.1:4321", "", 1},
+		{"forwarded IP     ", "10.0.0.1, 172.16.0.1", "", 1},
+		{"CIDR             ", "192.168.12.34", "", 1},
+		{"email            ", "", "Spammer@Example.com", 1},
+		{"email domain     ", "", "anyone@spam.org", 1},
+		{"email subdomain  ", "", "anyone@notspam.org", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := (&denylistSpamChecker{}).Check(&models.Domain{SpamDenylist: denylist}, &SpamMessage{UserIP: tt.ip, Email: tt.email})
+			if err != nil {
+				t.Errorf("Check() error = %v", err)
+			}
+			if got := spamCheckScore(res); got != tt.wantScore {
+				t.Errorf("Check() score = %v, want %v", got, tt.wantScore)
+			}
+		})
+	}
+}
+
+func Test_linkCountSpamChecker_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int64
+		markdown  string
+		wantScore float64
+	}{
+		{"no limit      ", 0, "http://a.com http://b.com http://c.com", 0},
+		{"within limit  ", 2, "See [this](https://a.com) and www.b.com", 0},
+		{"over limit    ", 2, "http://a.com https://b.com www.c.com", 1},
+		{"no links      ", 1, "Plain text", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := (&linkCountSpamChecker{}).Check(&models.Domain{SpamLinkLimit: tt.limit}, &SpamMessage{Markdown: tt.markdown})
+			if err != nil {
+				t.Errorf("Check() error = %v", err)
+			}
+			if got := spamCheckScore(res); got != tt.wantScore {
+				t.Errorf("Check() score = %v, want %v", got, tt.wantScore)
+			}
+		})
+	}
+}
+
+func Test_bayesSpamProbability(t *testing.T) {
+	tests := []struct {
+		name     string
+		spam     int
+		ham      int
+		counts   [][2]int
+		wantSpam bool
+	}{
+		{"no known tokens", 10, 10, nil, false},
+		{"spammy tokens  ", 10, 10, [][2]int{{9, 0}, {8, 1}}, true},
+		{"hammy tokens   ", 10, 10, [][2]int{{0, 9}, {1, 8}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bayesSpamProbability(tt.spam, tt.ham, tt.counts); (got > 0.5) != tt.wantSpam {
+				t.Errorf("bayesSpamProbability() = %v, want spam %v", got, tt.wantSpam)
+			}
+		})
+	}
+}
+
+func Test_bayesTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"empty       ", "", nil},
+		{"short words ", "a an is", nil},
+		{"mixed       ", "Buy CHEAP pills, buy now: cheap!", []string{"buy", "cheap", "pills", "now"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bayesTokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bayesTokenize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// spamCheckScore returns the score of the given check result, which can be nil
+func spamCheckScore(res *SpamCheckResult) float64 {
+	if res == nil {
+		return 0
+	}
+	return res.Score
+}
@@ -0,0 +1,200 @@
+package svc
+
+import (
+	"database/sql"
+	"github.com/go-openapi/strfmt"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"net"
+	"strings"
+	"time"
+)
+
+// TheBanService is a global BanService implementation
+var TheBanService BanService = &banService{}
+
+// BanService is a service interface for dealing with per-domain commenter bans
+type BanService interface {
+	// Create persists a new ban, filling in its hex ID and creation date
+	Create(ban *models.Ban) error
+	// Delete deletes the ban with the given hex ID, belonging to the given domain
+	Delete(domain string, banHex models.HexID) error
+	// DeleteByDomain deletes all bans of the given domain
+	DeleteByDomain(domain string) error
+	// FindActive returns an active ban on the given domain matching any of the commenter hex, email, or IP, preferring
+	// a full ban to a shadow one. Returns ErrNotFound if there's no such ban
+	FindActive(domain string, commenterHex models.HexID, email, ip string) (*models.Ban, error)
+	// ListByDomain returns a list of all bans of the given domain, including expired ones
+	ListByDomain(domain string) ([]*models.Ban, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// banColumns is the list of ban columns scanned by scanBan()
+const banColumns = "banhex, domain, commenterhex, email, ip, shadow, reason, creatorhex, creationdate, expirydate"
+
+// banService is a blueprint BanService implementation
+type banService struct{}
+
+func (svc *banService) Create(ban *models.Ban) error {
+	logger.Debugf("banService.Create(%#v)", ban)
+
+	// Generate a new ban hex ID
+	var err error
+	if ban.BanHex, err = data.RandomHexID(); err != nil {
+		return err
+	}
+	ban.CreationDate = strfmt.DateTime(time.Now().UTC())
+
+	// Persist a new record
+	err = db.Exec(
+		"insert into bans("+banColumns+") values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);",
+		ban.BanHex,
+		ban.Domain,
+		ban.CommenterHex,
+		strings.ToLower(ban.Email),
+		ban.IP,
+		ban.Shadow,
+		ban.Reason,
+		ban.CreatorHex,
+		ban.CreationDate,
+		ban.ExpiryDate)
+	if err != nil {
+		logger.Errorf("banService.Create: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *banService) Delete(domain string, banHex models.HexID) error {
+	logger.Debugf("banService.Delete(%s, %s)", domain, banHex)
+
+	// Delete the record, making sure it belongs to the domain
+	res, err := db.ExecRes("delete from bans where banhex=$1 and domain=$2;", banHex, domain)
+	if err != nil {
+		logger.Errorf("banService.Delete: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+	return checkRowsAffected(res)
+}
+
+func (svc *banService) DeleteByDomain(domain string) error {
+	logger.Debugf("banService.DeleteByDomain(%s)", domain)
+
+	// Delete the records
+	if err := db.Exec("delete from bans where domain=$1;", domain); err != nil {
+		logger.Errorf("banService.DeleteByDomain: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *banService) FindActive(domain string, commenterHex models.HexID, email, ip string) (*models.Ban, error) {
+	logger.Debugf("banService.FindActive(%s, %s, %s, %s)", domain, commenterHex, email, ip)
+
+	// Query active bans that possibly match. IP entries are matched below, since they can be CIDR ranges
+	rows, err := db.Query(
+		"select "+banColumns+" from bans "+
+			"where domain=$1 and (expirydate is null or expirydate>$2) and "+
+			"(commenterhex<>'' and commenterhex=$3 or email<>'' and email=$4 or ip<>'');",
+		domain, time.Now().UTC(), commenterHex, strings.ToLower(email))
+	if err != nil {
+		logger.Errorf("banService.FindActive: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Pick the most severe matching ban
+	var res *models.Ban
+	userIP := parseUserIP(ip)
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			logger.Errorf("banService.FindActive: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		if banMatches(b, commenterHex, email, userIP) && (res == nil || res.Shadow && !b.Shadow) {
+			res = b
+		}
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("banService.FindActive: Next() failed: %v", err)
+		return nil, err
+	}
+
+	if res == nil {
+		return nil, ErrNotFound
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *banService) ListByDomain(domain string) ([]*models.Ban, error) {
+	logger.Debugf("banService.ListByDomain(%s)", domain)
+
+	// Query the domain's bans
+	rows, err := db.Query("select "+banColumns+" from bans where domain=$1 order by creationdate desc;", domain)
+	if err != nil {
+		logger.Errorf("banService.ListByDomain: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the bans
+	var res []*models.Ban
+	for rows.Next() {
+		b, err := scanBan(rows)
+		if err != nil {
+			logger.Errorf("banService.ListByDomain: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, b)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("banService.ListByDomain: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+// banMatches returns whether the given ban applies to a commenter with the given hex ID, email, and IP
+func banMatches(ban *models.Ban, commenterHex models.HexID, email string, ip net.IP) bool {
+	switch {
+	case ban.CommenterHex != "" && ban.CommenterHex == commenterHex:
+		return true
+	case ban.Email != "" && strings.EqualFold(ban.Email, email):
+		return true
+	case ban.IP == "" || ip == nil:
+		return false
+	case strings.Contains(ban.IP, "/"):
+		_, ipNet, err := net.ParseCIDR(ban.IP)
+		return err == nil && ipNet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(ban.IP))
+}
+
+// scanBan fetches a ban from the given row, containing banColumns
+func scanBan(row interface{ Scan(...any) error }) (*models.Ban, error) {
+	var b models.Ban
+	var expiry sql.NullTime
+	err := row.Scan(&b.BanHex, &b.Domain, &b.CommenterHex, &b.Email, &b.IP, &b.Shadow, &b.Reason, &b.CreatorHex, &b.CreationDate, &expiry)
+	if err != nil {
+		return nil, err
+	}
+	if expiry.Valid {
+		d := strfmt.DateTime(expiry.Time)
+		b.ExpiryDate = &d
+	}
+	return &b, nil
+}
@@ -0,0 +1,34 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"testing"
+)
+
+func Test_banMatches(t *testing.T) {
+	const hex = models.HexID("0000000000000000000000000000000000000000000000000000000000000001")
+	tests := []struct {
+		name  string
+		ban   models.Ban
+		hex   models.HexID
+		email string
+		ip    string
+		want  bool
+	}{
+		{"commenter hex   ", models.Ban{CommenterHex: hex}, hex, "", "", true},
+		{"other commenter ", models.Ban{CommenterHex: hex}, "other", "", "10.0.0.1", false},
+		{"email           ", models.Ban{Email: "spammer@example.com"}, "", "Spammer@Example.com", "", true},
+		{"IP              ", models.Ban{IP: "10.0.0.1"}, "", "", "10.0.0.1:1234", true},
+		{"other IP        ", models.Ban{IP: "10.0.0.1"}, "", "", "10.0.0.2", false},
+		{"CIDR            ", models.Ban{IP: "192.168.0.0/16"}, "", "", "192.168.1.1, 10.0.0.1", true},
+		{"no IP known     ", models.Ban{IP: "192.168.0.0/16"}, "", "", "", false},
+		{"empty ban       ", models.Ban{}, "", "", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := banMatches(&tt.ban, tt.hex, tt.email, parseUserIP(tt.ip)); got != tt.want {
+				t.Errorf("banMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
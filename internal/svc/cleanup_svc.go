@@ -1,6 +1,11 @@
 package svc
 
-import "time"
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/util"
+	"time"
+)
 
 var TheCleanupService CleanupService = &cleanupService{}
 
@@ -12,15 +17,87 @@ type cleanupService struct{}
 
 func (s *cleanupService) Init() error {
 	logger.Debugf("cleanupService: initialising")
+	if err := s.apiTokenCleanupBegin(); err != nil {
+		return err
+	}
+	if err := s.confirmationTokenCleanupBegin(); err != nil {
+		return err
+	}
+	if err := s.deletedCommentsCleanupBegin(); err != nil {
+		return err
+	}
 	if err := s.domainExportCleanupBegin(); err != nil {
 		return err
 	}
+	if err := s.magicLinkCleanupBegin(); err != nil {
+		return err
+	}
+	if err := s.rateLimitsCleanupBegin(); err != nil {
+		return err
+	}
+	if err := s.sessionCleanupBegin(); err != nil {
+		return err
+	}
 	if err := s.ssoTokenCleanupBegin(); err != nil {
 		return err
 	}
+	if err := s.totpChallengeCleanupBegin(); err != nil {
+		return err
+	}
 	if err := s.viewsCleanupBegin(); err != nil {
 		return err
 	}
+	if err := s.webAuthnChallengeCleanupBegin(); err != nil {
+		return err
+	}
+	if err := s.webhookDeliveriesCleanupBegin(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *cleanupService) apiTokenCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising API token cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from apitokens where expirydate<$1;", time.Now().UTC()); err != nil {
+				logger.Errorf("cleanupService: error cleaning up API tokens: %v", err)
+				return
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	return nil
+}
+
+func (s *cleanupService) confirmationTokenCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising confirmation token cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from ownerconfirmhexes where senddate<$1;", time.Now().UTC().Add(-util.ConfirmationTokenTTL)); err != nil {
+				logger.Errorf("cleanupService: error cleaning up confirmation tokens: %v", err)
+				return
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	return nil
+}
+
+func (s *cleanupService) deletedCommentsCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising deleted comment cleanup")
+	go func() {
+		for {
+			if err := TheCommentService.PurgeDeleted("", time.Now().UTC().AddDate(0, 0, -config.CLIFlags.RetentionDays)); err != nil {
+				logger.Errorf("cleanupService: error purging deleted comments: %v", err)
+				return
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
 	return nil
 }
 
@@ -39,6 +116,53 @@ func (s *cleanupService) domainExportCleanupBegin() error {
 	return nil
 }
 
+func (s *cleanupService) magicLinkCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising magic link cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from magiclinks where creationdate<$1;", time.Now().UTC().Add(-util.MagicLinkTTL)); err != nil {
+				logger.Errorf("cleanupService: error cleaning up magic links: %v", err)
+				return
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (s *cleanupService) rateLimitsCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising rate limit cleanup")
+	go func() {
+		for {
+			// Buckets idle for that long are full again, so they can be safely discarded
+			if err := db.Exec("delete from ratelimits where updated<$1;", time.Now().UTC().AddDate(0, 0, -1)); err != nil {
+				logger.Errorf("cleanupService: error cleaning up rate limits: %v", err)
+				return
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	return nil
+}
+
+func (s *cleanupService) sessionCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising session cleanup")
+	go func() {
+		for {
+			idleCutoff, maxCutoff := sessionCutoffs()
+			if err := db.Exec("delete from usersessions where lastseendate<$1 or creationdate<$2;", idleCutoff, maxCutoff); err != nil {
+				logger.Errorf("cleanupService: error cleaning up expired sessions: %v", err)
+				return
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	return nil
+}
+
 func (s *cleanupService) ssoTokenCleanupBegin() error {
 	logger.Debugf("cleanupService: initialising SSO token cleanup")
 	go func() {
@@ -54,6 +178,21 @@ func (s *cleanupService) ssoTokenCleanupBegin() error {
 	return nil
 }
 
+func (s *cleanupService) totpChallengeCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising TOTP challenge cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from totpchallenges where creationdate<$1;", time.Now().UTC().Add(-10*time.Minute)); err != nil {
+				logger.Errorf("cleanupService: error cleaning up TOTP challenges: %v", err)
+				return
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
 func (s *cleanupService) viewsCleanupBegin() error {
 	logger.Debugf("cleanupService: initialising view stats cleanup")
 	go func() {
@@ -68,3 +207,33 @@ func (s *cleanupService) viewsCleanupBegin() error {
 
 	return nil
 }
+
+func (s *cleanupService) webAuthnChallengeCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising WebAuthn challenge cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from webauthnchallenges where creationdate<$1;", time.Now().UTC().Add(-10*time.Minute)); err != nil {
+				logger.Errorf("cleanupService: error cleaning up WebAuthn challenges: %v", err)
+				return
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (s *cleanupService) webhookDeliveriesCleanupBegin() error {
+	logger.Debugf("cleanupService: initialising webhook delivery log cleanup")
+	go func() {
+		for {
+			if err := db.Exec("delete from webhookdeliveries where creationdate<$1 and status<>$2;", time.Now().UTC().AddDate(0, 0, -30), models.WebhookDeliveryStatusPending); err != nil {
+				logger.Errorf("cleanupService: error cleaning up webhook deliveries: %v", err)
+				return
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+
+	return nil
+}
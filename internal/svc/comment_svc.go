@@ -1,7 +1,10 @@
 package svc
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/go-openapi/strfmt"
+	"github.com/lib/pq"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/util"
@@ -15,21 +18,62 @@ var TheCommentService CommentService = &commentService{}
 type CommentService interface {
 	// Approve sets the status of a comment with the given hex ID to 'approved'
 	Approve(commentHex models.HexID) error
-	// Create creates, persists, and returns a new comment
-	Create(commenterHex models.HexID, domain, path, markdown string, parentHex models.ParentHexID, state models.CommentState, creationDate strfmt.DateTime) (*models.Comment, error)
+	// ApproveBulk sets the status of comments with the given hex IDs on the given domain to 'approved', returning the
+	// comments that weren't approved before
+	ApproveBulk(domain string, commentHexes []models.HexID) ([]*models.Comment, error)
+	// Create creates, persists, and returns a new comment. A shadowed comment is only visible to its author and
+	// moderators
+	Create(commenterHex models.HexID, domain, path, markdown string, parentHex models.ParentHexID, state models.CommentState, shadowed bool, creationDate strfmt.DateTime) (*models.Comment, error)
 	// DeleteByDomain deletes all comments for the specified domain
 	DeleteByDomain(domain string) error
 	// FindByHexID finds and returns a comment with the given hex ID
 	FindByHexID(commentHex models.HexID) (*models.Comment, error)
 	// ListByDomain returns a list of all comments for the given domain
 	ListByDomain(domain string) ([]models.Comment, error)
+	// ListForModeration returns a single page (up to limit items) of comments on all pages of a domain matching the given
+	// filter, and related commenters, sorted according to sortPolicy. moderator is the current user, after is an
+	// optional cursor pointing to the last comment of the previous page. Also returns a cursor to the next page, or nil
+	// if there are no more comments
+	ListForModeration(moderator *data.User, filter *CommentFilter, sortPolicy models.SortPolicy, after *data.CommentCursor, limit int) ([]*models.Comment, map[models.HexID]*models.Commenter, *data.CommentCursor, error)
+	// ListRevisions returns the edit history of a comment with the given hex ID, the most recent revision first
+	ListRevisions(commentHex models.HexID) ([]*models.CommentRevision, error)
+	// ListPageWithCommentersByDomainPath returns a single page (up to limit items) of comments having the given parent,
+	// and related commenters for the given domain and path combination, sorted according to sortPolicy. commenter is the
+	// current (un)authenticated user, after is an optional cursor pointing to the last comment of the previous page.
+	// Also returns a cursor to the next page, or nil if there are no more comments
+	ListPageWithCommentersByDomainPath(commenter *data.User, domain, path string, parentHex models.ParentHexID, sortPolicy models.SortPolicy, after *data.CommentCursor, limit int) ([]*models.Comment, map[models.HexID]*models.Commenter, *data.CommentCursor, error)
 	// ListWithCommentersByDomainPath returns a list of comments and related commenters for the given domain and path
 	// combination. commenter is the current (un)authenticated user
-	ListWithCommentersByDomainPath(commenter *data.UserCommenter, domain, path string) ([]*models.Comment, map[models.HexID]*models.Commenter, error)
-	// MarkDeleted mark a comment with the given hex ID deleted in the database
+	ListWithCommentersByDomainPath(commenter *data.User, domain, path string) ([]*models.Comment, map[models.HexID]*models.Commenter, error)
+	// MarkDeleted mark a comment with the given hex ID deleted in the database. Unless the comment is deleted by its
+	// author, its text is retained so that it can be restored until purged
 	MarkDeleted(commentHex models.HexID, deleterHex models.HexID) error
-	// UpdateText updates the markdown and the HTML of a comment with the given hex ID in the database
-	UpdateText(commentHex models.HexID, markdown, html string) error
+	// MarkDeletedBulk marks comments with the given hex IDs on the given domain deleted, returning the comments that
+	// weren't deleted before. The returned comments carry their original text, unless deleted by their author
+	MarkDeletedBulk(domain string, commentHexes []models.HexID, deleterHex models.HexID) ([]*models.Comment, error)
+	// MarkSpamBulk sets the status of comments with the given hex IDs on the given domain to 'flagged', returning the
+	// comments that weren't flagged before
+	MarkSpamBulk(domain string, commentHexes []models.HexID) ([]*models.Comment, error)
+	// PurgeDeleted permanently removes comments deleted before the given time, along with their votes, revisions, and
+	// reports, for the given domain or, if it's empty, all domains. Deleted comments that still have replies are kept to
+	// preserve the thread structure, but their text is discarded
+	PurgeDeleted(domain string, deletedBefore time.Time) error
+	// Restore undeletes a deleted comment with the given hex ID, bringing back its text. Returns
+	// util.ErrorCommentNotRestorable if the text hasn't been retained
+	Restore(commentHex models.HexID) error
+	// UpdateText updates the markdown and the HTML of a comment with the given hex ID in the database, preserving the
+	// previous text as a revision made by the given editor
+	UpdateText(commentHex, editorHex models.HexID, markdown, html string) error
+}
+
+// CommentFilter describes criteria for selecting comments across a domain
+type CommentFilter struct {
+	Domain        string                // Domain the comments belong to
+	States        []models.CommentState // Comment states to include; empty means any state
+	Path          string                // Page path; empty means any page
+	CommenterHex  models.HexID          // Author of the comments; empty means any author
+	CreatedAfter  time.Time             // Lower (exclusive) bound of the creation date; zero means unbounded
+	CreatedBefore time.Time             // Upper (exclusive) bound of the creation date; zero means unbounded
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -50,8 +94,17 @@ func (svc *commentService) Approve(commentHex models.HexID) error {
 	return nil
 }
 
-func (svc *commentService) Create(commenterHex models.HexID, domain, path, markdown string, parentHex models.ParentHexID, state models.CommentState, creationDate strfmt.DateTime) (*models.Comment, error) {
-	logger.Debugf("commentService.Create(%s, %s, %s, ..., %s, %s, ...)", commenterHex, domain, path, parentHex, state)
+func (svc *commentService) ApproveBulk(domain string, commentHexes []models.HexID) ([]*models.Comment, error) {
+	logger.Debugf("commentService.ApproveBulk(%s, %v)", domain, commentHexes)
+	return svc.updateBulk(
+		"ApproveBulk",
+		"update comments set state=$3 where domain=$1 and commenthex=any($2) and deleted=false and state<>$3 "+
+			"returning "+commentColumns+";",
+		domain, pq.Array(commentHexes), models.CommentStateApproved)
+}
+
+func (svc *commentService) Create(commenterHex models.HexID, domain, path, markdown string, parentHex models.ParentHexID, state models.CommentState, shadowed bool, creationDate strfmt.DateTime) (*models.Comment, error) {
+	logger.Debugf("commentService.Create(%s, %s, %s, ..., %s, %s, %v, ...)", commenterHex, domain, path, parentHex, state, shadowed)
 
 	// Generate a new comment hex ID
 	commentHex, err := data.RandomHexID()
@@ -78,11 +131,12 @@ func (svc *commentService) Create(commenterHex models.HexID, domain, path, markd
 		ParentHex:    parentHex,
 		State:        state,
 		Path:         path,
+		Shadowed:     shadowed,
 	}
 	err = db.Exec(
-		"insert into comments(commentHex, domain, path, commenterHex, parentHex, markdown, html, creationDate, state) "+
-			"values($1, $2, $3, $4, $5, $6, $7, $8, $9);",
-		c.CommentHex, c.Domain, c.Path, fixCommenterHex(c.CommenterHex), c.ParentHex, c.Markdown, c.HTML, c.CreationDate, c.State)
+		"insert into comments(commentHex, domain, path, commenterHex, parentHex, markdown, html, creationDate, state, shadowed) "+
+			"values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);",
+		c.CommentHex, c.Domain, c.Path, fixCommenterHex(c.CommenterHex), c.ParentHex, c.Markdown, c.HTML, c.CreationDate, c.State, c.Shadowed)
 	if err != nil {
 		logger.Errorf("commentService.Create: Exec() failed: %v", err)
 		return nil, translateDBErrors(err)
@@ -94,6 +148,15 @@ func (svc *commentService) Create(commenterHex models.HexID, domain, path, markd
 func (svc *commentService) DeleteByDomain(domain string) error {
 	logger.Debugf("commentService.DeleteByDomain(%s)", domain)
 
+	// Delete comment revisions and reports
+	err := checkErrors(
+		db.Exec("delete from commentrevisions where commenthex in (select commenthex from comments where domain=$1);", domain),
+		db.Exec("delete from commentreports where domain=$1;", domain))
+	if err != nil {
+		logger.Errorf("commentService.DeleteByDomain: Exec() failed for revisions or reports: %v", err)
+		return translateDBErrors(err)
+	}
+
 	// Delete records from the database
 	if err := db.Exec("delete from comments where domain=$1;", domain); err != nil {
 		logger.Errorf("commentService.DeleteByDomain: Exec() failed: %v", err)
@@ -108,25 +171,16 @@ func (svc *commentService) FindByHexID(commentHex models.HexID) (*models.Comment
 	logger.Debugf("commentService.FindByHexID(%s)", commentHex)
 
 	// Query the database
-	row := db.QueryRow(
-		"select commenthex, commenterhex, markdown, html, parenthex, score, state, deleted, creationdate "+
-			"from comments "+
-			"where commenthex=$1;",
-		commentHex)
+	row := db.QueryRow("select "+commentColumns+" from comments where commenthex=$1;", commentHex)
 
 	// Fetch the comment
-	var c models.Comment
-	var crHex string
-	err := row.Scan(&c.CommentHex, &crHex, &c.Markdown, &c.HTML, &c.ParentHex, &c.Score, &c.State, &c.Deleted, &c.CreationDate)
+	c, err := scanComment(row)
 	if err != nil {
 		return nil, translateDBErrors(err)
 	}
 
-	// Apply necessary conversions
-	c.CommenterHex = unfixCommenterHex(crHex)
-
 	// Succeeded
-	return &c, nil
+	return c, nil
 }
 
 func (svc *commentService) ListByDomain(domain string) ([]models.Comment, error) {
@@ -169,38 +223,135 @@ func (svc *commentService) ListByDomain(domain string) ([]models.Comment, error)
 	return res, nil
 }
 
-func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCommenter, domain, path string) ([]*models.Comment, map[models.HexID]*models.Commenter, error) {
-	logger.Debugf("commentService.ListWithCommentersByDomainPath([%s], %s, %s)", commenter.HexID, domain, path)
+func (svc *commentService) ListForModeration(moderator *data.User, filter *CommentFilter, sortPolicy models.SortPolicy, after *data.CommentCursor, limit int) ([]*models.Comment, map[models.HexID]*models.Commenter, *data.CommentCursor, error) {
+	logger.Debugf("commentService.ListForModeration([%s], %#v, %s, %v, %d)", moderator.HexID, filter, sortPolicy, after, limit)
 
 	// Prepare a query
-	statement :=
-		"select " +
-			"c.commenthex, c.commenterhex, c.markdown, c.html, c.parenthex, c.score, c.state, c.deleted, c.creationdate, " +
-			"coalesce(v.direction, 0), " +
-			"coalesce(r.commenterhex, ''), " +
-			"coalesce(r.email, ''), " +
-			"coalesce(r.name, ''), " +
-			"coalesce(r.link, ''), " +
-			"coalesce(r.photo, ''), " +
-			"coalesce(r.provider, ''), " +
-			"coalesce(r.joindate, CURRENT_TIMESTAMP) " +
-			"from comments c " +
-			"left join votes v on v.commenthex=c.commenthex and v.commenterhex=$1 " +
-			"left join commenters r on r.commenterhex=c.commenterhex " +
-			"where c.domain=$2 and c.path=$3 and c.deleted=false"
-	params := []any{commenter.HexID, domain, path}
+	params := []any{moderator.HexID, filter.Domain}
+	statement := commentListSelect + " " + commentListFrom + "where c.domain=$2 and c.deleted=false"
+	if len(filter.States) > 0 {
+		params = append(params, pq.Array(filter.States))
+		statement += fmt.Sprintf(" and c.state=any($%d)", len(params))
+	}
+	if filter.Path != "" {
+		params = append(params, filter.Path)
+		statement += fmt.Sprintf(" and c.path=$%d", len(params))
+	}
+	if filter.CommenterHex != "" {
+		params = append(params, filter.CommenterHex)
+		statement += fmt.Sprintf(" and c.commenterhex=$%d", len(params))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		params = append(params, filter.CreatedAfter)
+		statement += fmt.Sprintf(" and c.creationdate>$%d", len(params))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		params = append(params, filter.CreatedBefore)
+		statement += fmt.Sprintf(" and c.creationdate<$%d", len(params))
+	}
 
-	// Anonymous commenter: only include approved
-	if commenter.IsAnonymous() {
-		statement += " and c.state=$4"
-		params = append(params, models.CommentStateApproved)
+	// Apply the sort policy, continuing after the cursor, if any. Fetch one extra comment to find out whether there's a
+	// next page
+	keyset, order := commentPageKeyset(sortPolicy, after, &params)
+	statement += keyset + fmt.Sprintf(" order by %s limit %d;", order, limit+1)
 
-	} else if !commenter.IsModerator {
-		// Authenticated, non-moderator commenter: show only approved and all own comments
-		statement += " and (c.state=$4 or c.commenterHex=$1)"
-		params = append(params, models.CommentStateApproved)
+	// Fetch the comments
+	rs, err := db.Query(statement, params...)
+	if err != nil {
+		logger.Errorf("commentService.ListForModeration: Query() failed: %v", err)
+		return nil, nil, nil, util.ErrorInternal
+	}
+	defer rs.Close()
+	comments, commenters, err := svc.fetchCommentsWithCommenters(rs, moderator, false)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	statement += ";"
+
+	// Succeeded
+	comments, next := commentPageNext(comments, limit, sortPolicy)
+	return comments, commenters, next, nil
+}
+
+func (svc *commentService) ListRevisions(commentHex models.HexID) ([]*models.CommentRevision, error) {
+	logger.Debugf("commentService.ListRevisions(%s)", commentHex)
+
+	// Query the comment's revisions
+	rows, err := db.Query(
+		"select revisionhex, commenthex, editorhex, markdown, editdate "+
+			"from commentrevisions "+
+			"where commenthex=$1 "+
+			"order by editdate desc;",
+		commentHex)
+	if err != nil {
+		logger.Errorf("commentService.ListRevisions: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the revisions
+	var res []*models.CommentRevision
+	for rows.Next() {
+		r := models.CommentRevision{}
+		if err = rows.Scan(&r.RevisionHex, &r.CommentHex, &r.EditorHex, &r.Markdown, &r.EditDate); err != nil {
+			logger.Errorf("commentService.ListRevisions: rows.Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, &r)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("commentService.ListRevisions: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *commentService) ListPageWithCommentersByDomainPath(commenter *data.User, domain, path string, parentHex models.ParentHexID, sortPolicy models.SortPolicy, after *data.CommentCursor, limit int) ([]*models.Comment, map[models.HexID]*models.Commenter, *data.CommentCursor, error) {
+	logger.Debugf("commentService.ListPageWithCommentersByDomainPath([%s], %s, %s, %s, %s, %v, %d)", commenter.HexID, domain, path, parentHex, sortPolicy, after, limit)
+
+	// Prepare a query. Also count visible replies of each comment so that the client knows whether to request them
+	params := []any{commenter.HexID, domain, path, parentHex}
+	replyFilter := commentVisibilityFilter("rc", commenter, &params)
+	statement := commentListSelect +
+		", (select count(*) from comments rc where rc.parenthex=c.commenthex and rc.deleted=false" + replyFilter + ") " +
+		commentListFrom +
+		"where c.domain=$2 and c.path=$3 and c.deleted=false and c.parenthex=$4" +
+		commentVisibilityFilter("c", commenter, &params)
+
+	// Apply the sort policy, continuing after the cursor, if any. Fetch one extra comment to find out whether there's a
+	// next page
+	keyset, order := commentPageKeyset(sortPolicy, after, &params)
+	statement += keyset + fmt.Sprintf(" order by %s limit %d;", order, limit+1)
+
+	// Fetch the comments
+	rs, err := db.Query(statement, params...)
+	if err != nil {
+		logger.Errorf("commentService.ListPageWithCommentersByDomainPath: Query() failed: %v", err)
+		return nil, nil, nil, util.ErrorInternal
+	}
+	defer rs.Close()
+	comments, commenters, err := svc.fetchCommentsWithCommenters(rs, commenter, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Succeeded
+	comments, next := commentPageNext(comments, limit, sortPolicy)
+	return comments, commenters, next, nil
+}
+
+func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.User, domain, path string) ([]*models.Comment, map[models.HexID]*models.Commenter, error) {
+	logger.Debugf("commentService.ListWithCommentersByDomainPath([%s], %s, %s)", commenter.HexID, domain, path)
+
+	// Prepare a query
+	params := []any{commenter.HexID, domain, path}
+	statement := commentListSelect + " " + commentListFrom +
+		"where c.domain=$2 and c.path=$3 and c.deleted=false" +
+		commentVisibilityFilter("c", commenter, &params) +
+		";"
 
 	// Fetch the comments
 	rs, err := db.Query(statement, params...)
@@ -209,7 +360,13 @@ func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCo
 		return nil, nil, util.ErrorInternal
 	}
 	defer rs.Close()
+	return svc.fetchCommentsWithCommenters(rs, commenter, false)
+}
 
+// fetchCommentsWithCommenters fetches comments and related commenters from the given result rows, produced by a query
+// based on commentListSelect. commenter is the current (un)authenticated user. withReplyCount indicates whether the rows
+// also include the reply count column
+func (svc *commentService) fetchCommentsWithCommenters(rs *sql.Rows, commenter *data.User, withReplyCount bool) ([]*models.Comment, map[models.HexID]*models.Commenter, error) {
 	// Prepare commenter map: begin with only the "anonymous" one
 	commenters := map[models.HexID]*models.Commenter{
 		data.AnonymousCommenter.HexID: data.AnonymousCommenter.ToCommenter(),
@@ -220,11 +377,12 @@ func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCo
 	for rs.Next() {
 		// Fetch the comment and the related commenter
 		comment := models.Comment{}
-		uc := data.UserCommenter{}
-		var crHex, ucWebsiteURL, ucPhotoURL, ucProvider string
-		err := rs.Scan(
+		uc := data.User{}
+		var crHex, ucProvider string
+		dest := []any{
 			&comment.CommentHex,
 			&crHex,
+			&comment.Path,
 			&comment.Markdown,
 			&comment.HTML,
 			&comment.ParentHex,
@@ -233,23 +391,28 @@ func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCo
 			&comment.Deleted,
 			&comment.CreationDate,
 			&comment.Direction,
+			&comment.EditCount,
+			&comment.Shadowed,
 			&uc.HexID,
 			&uc.Email,
 			&uc.Name,
-			&ucWebsiteURL,
-			&ucPhotoURL,
+			&uc.WebsiteURL,
+			&uc.PhotoURL,
 			&ucProvider,
-			&uc.Created)
-		if err != nil {
-			logger.Errorf("commentService.ListWithCommentersByDomainPath: Scan() failed: %v", err)
+			&uc.Created,
+		}
+		if withReplyCount {
+			dest = append(dest, &comment.ReplyCount)
+		}
+		if err := rs.Scan(dest...); err != nil {
+			logger.Errorf("commentService.fetchCommentsWithCommenters: Scan() failed: %v", err)
 			return nil, nil, translateDBErrors(err)
 		}
 
 		// Apply necessary conversions
 		comment.CommenterHex = unfixCommenterHex(crHex)
+		comment.Edited = comment.EditCount > 0
 		if uc.HexID != "" {
-			uc.WebsiteURL = unfixUndefined(ucWebsiteURL)
-			uc.PhotoURL = unfixUndefined(ucPhotoURL)
 			uc.Provider = unfixIdP(ucProvider)
 
 			// Add the commenter to the map
@@ -263,9 +426,10 @@ func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCo
 			comment.Markdown = ""
 		}
 
-		// Also, do not report comment state for non-moderators
+		// Also, do not report comment state and shadowing for non-moderators
 		if !commenter.IsModerator {
 			comment.State = ""
+			comment.Shadowed = false
 		}
 
 		// Append the comment to the list
@@ -284,11 +448,16 @@ func (svc *commentService) ListWithCommentersByDomainPath(commenter *data.UserCo
 func (svc *commentService) MarkDeleted(commentHex models.HexID, deleterHex models.HexID) error {
 	logger.Debugf("commentService.MarkDeleted(%s, %s)", commentHex, deleterHex)
 
-	// Update the record in the database
+	// Update the record in the database. The text of a comment deleted by its author isn't retained, and neither are
+	// its earlier revisions: it's the author's choice to remove it
 	err := db.Exec(
-		"update comments "+
-			"set deleted=true, markdown='[deleted]', html='[deleted]', deleterhex=$1, deletiondate=$2 "+
-			"where commenthex=$3;",
+		"with d as ("+
+			"update comments "+
+			"set deleted=true, deletedmarkdown=case when commenterhex=$1 then null else markdown end, "+
+			"markdown='[deleted]', html='[deleted]', deleterhex=$1, deletiondate=$2 "+
+			"where commenthex=$3 and deleted=false "+
+			"returning commenthex, commenterhex) "+
+			"delete from commentrevisions r using d where r.commenthex=d.commenthex and d.commenterhex=$1;",
 		deleterHex,
 		time.Now().UTC(),
 		commentHex)
@@ -301,11 +470,130 @@ func (svc *commentService) MarkDeleted(commentHex models.HexID, deleterHex model
 	return nil
 }
 
-func (svc *commentService) UpdateText(commentHex models.HexID, markdown, html string) error {
-	logger.Debugf("commentService.UpdateText(%s, ...)", commentHex)
+func (svc *commentService) MarkDeletedBulk(domain string, commentHexes []models.HexID, deleterHex models.HexID) ([]*models.Comment, error) {
+	logger.Debugf("commentService.MarkDeletedBulk(%s, %v, %s)", domain, commentHexes, deleterHex)
+
+	// The returned columns are those of commentColumns, but with the original text in place of the markdown. As in
+	// MarkDeleted(), neither the text nor the revisions of the deleter's own comments are retained
+	return svc.updateBulk(
+		"MarkDeletedBulk",
+		"with d as ("+
+			"update comments "+
+			"set deleted=true, deletedmarkdown=case when commenterhex=$3 then null else markdown end, "+
+			"markdown='[deleted]', html='[deleted]', deleterhex=$3, deletiondate=$4 "+
+			"where domain=$1 and commenthex=any($2) and deleted=false "+
+			"returning commenthex, domain, path, commenterhex, coalesce(deletedmarkdown, '') as markdown, html, "+
+			"parenthex, score, state, deleted, creationdate, editcount, shadowed), "+
+			"r as (delete from commentrevisions where commenthex in (select commenthex from d where commenterhex=$3)) "+
+			"select "+commentColumns+" from d;",
+		domain, pq.Array(commentHexes), deleterHex, time.Now().UTC())
+}
+
+func (svc *commentService) MarkSpamBulk(domain string, commentHexes []models.HexID) ([]*models.Comment, error) {
+	logger.Debugf("commentService.MarkSpamBulk(%s, %v)", domain, commentHexes)
+	return svc.updateBulk(
+		"MarkSpamBulk",
+		"update comments set state=$3 where domain=$1 and commenthex=any($2) and deleted=false and state<>$3 "+
+			"returning "+commentColumns+";",
+		domain, pq.Array(commentHexes), models.CommentStateFlagged)
+}
+
+func (svc *commentService) PurgeDeleted(domain string, deletedBefore time.Time) error {
+	logger.Debugf("commentService.PurgeDeleted(%s, %v)", domain, deletedBefore)
 
-	// Update the row in the database
-	if err := db.Exec("update comments set markdown=$1, html=$2 where commentHex=$3;", markdown, html, commentHex); err != nil {
+	// Prepare a filter for the comments to purge
+	params := []any{deletedBefore}
+	filter := "c.deleted=true and coalesce(c.deletiondate, c.creationdate)<$1"
+	if domain != "" {
+		params = append(params, domain)
+		filter += " and c.domain=$2"
+	}
+
+	// Remove childless comments along with their votes, revisions, and reports. Removing replies can leave their parents
+	// childless, so repeat until there's nothing left to remove
+	for {
+		res, err := db.ExecRes(
+			"with p as ("+
+				"select c.commenthex from comments c "+
+				"where "+filter+" and not exists (select 1 from comments r where r.parenthex=c.commenthex)"+
+				"), "+
+				"v as (delete from votes where commenthex in (select commenthex from p)), "+
+				"r as (delete from commentrevisions where commenthex in (select commenthex from p)), "+
+				"rp as (delete from commentreports where commenthex in (select commenthex from p)) "+
+				"delete from comments where commenthex in (select commenthex from p);",
+			params...)
+		if err != nil {
+			logger.Errorf("commentService.PurgeDeleted: ExecRes() failed: %v", err)
+			return translateDBErrors(err)
+		}
+		if cnt, err := res.RowsAffected(); err != nil {
+			logger.Errorf("commentService.PurgeDeleted: RowsAffected() failed: %v", err)
+			return translateDBErrors(err)
+		} else if cnt == 0 {
+			break
+		}
+	}
+
+	// Discard the text of the remaining comments, which makes them unrecoverable
+	err := db.Exec(
+		"with r as (delete from commentrevisions where commenthex in (select c.commenthex from comments c where "+filter+")) "+
+			"update comments c set deletedmarkdown=null where deletedmarkdown is not null and "+filter+";",
+		params...)
+	if err != nil {
+		logger.Errorf("commentService.PurgeDeleted: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *commentService) Restore(commentHex models.HexID) error {
+	logger.Debugf("commentService.Restore(%s)", commentHex)
+
+	// Fetch the original text of the comment
+	var markdown sql.NullString
+	err := db.QueryRow("select deletedmarkdown from comments where commenthex=$1 and deleted=true;", commentHex).Scan(&markdown)
+	if err != nil {
+		return translateDBErrors(err)
+	} else if !markdown.Valid {
+		// The text has been purged, the comment was deleted by its author, or before the text was retained
+		return util.ErrorCommentNotRestorable
+	}
+
+	// Update the record in the database
+	err = db.Exec(
+		"update comments "+
+			"set deleted=false, markdown=$1, html=$2, deletedmarkdown=null, deleterhex=null, deletiondate=null "+
+			"where commenthex=$3 and deleted=true;",
+		markdown.String, util.MarkdownToHTML(markdown.String), commentHex)
+	if err != nil {
+		logger.Errorf("commentService.Restore: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *commentService) UpdateText(commentHex, editorHex models.HexID, markdown, html string) error {
+	logger.Debugf("commentService.UpdateText(%s, %s, ...)", commentHex, editorHex)
+
+	// Generate a new revision hex ID
+	revisionHex, err := data.RandomHexID()
+	if err != nil {
+		return err
+	}
+
+	// Save the current text as a revision and update the row in the database, in a single statement
+	err = db.Exec(
+		"with r as ("+
+			"insert into commentrevisions(revisionhex, commenthex, editorhex, markdown, editdate) "+
+			"select $4, commenthex, $5, markdown, $6 from comments where commenthex=$3"+
+			") "+
+			"update comments set markdown=$1, html=$2, editcount=editcount+1 where commenthex=$3;",
+		markdown, html, commentHex, revisionHex, editorHex, time.Now().UTC())
+	if err != nil {
 		logger.Errorf("commentService.UpdateText: Exec() failed: %v", err)
 		return translateDBErrors(err)
 	}
@@ -313,3 +601,157 @@ func (svc *commentService) UpdateText(commentHex models.HexID, markdown, html st
 	// Succeeded
 	return nil
 }
+
+// updateBulk runs the given update statement, whose returning clause lists commentColumns, and returns the updated
+// comments. name is the name of the calling method, used for logging
+func (svc *commentService) updateBulk(name, statement string, params ...any) ([]*models.Comment, error) {
+	rows, err := db.Query(statement, params...)
+	if err != nil {
+		logger.Errorf("commentService.%s: Query() failed: %v", name, err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the updated comments
+	var res []*models.Comment
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			logger.Errorf("commentService.%s: Scan() failed: %v", name, err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, c)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("commentService.%s: Next() failed: %v", name, err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+// commentColumns is the list of comment columns scanned by scanComment()
+const commentColumns = "commenthex, domain, path, commenterhex, markdown, html, parenthex, score, state, deleted, creationdate, editcount, shadowed"
+
+// scanComment fetches a comment from the given row, containing commentColumns
+func scanComment(row interface{ Scan(...any) error }) (*models.Comment, error) {
+	var c models.Comment
+	var crHex string
+	err := row.Scan(&c.CommentHex, &c.Domain, &c.Path, &crHex, &c.Markdown, &c.HTML, &c.ParentHex, &c.Score, &c.State, &c.Deleted, &c.CreationDate, &c.EditCount, &c.Shadowed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply necessary conversions
+	c.CommenterHex = unfixCommenterHex(crHex)
+	c.Edited = c.EditCount > 0
+	return &c, nil
+}
+
+// commentListSelect is the select list of a comment list query. The query must reference the current commenter's hex
+// as $1
+var commentListSelect = "select " +
+	"c.commenthex, c.commenterhex, c.path, c.markdown, c.html, c.parenthex, c.score, c.state, c.deleted, c.creationdate, " +
+	"coalesce(v.direction, 0), " +
+	"c.editcount, " +
+	"c.shadowed, " +
+	"coalesce(r.userhex, ''), " +
+	"coalesce(r.email, ''), " +
+	"coalesce(r.name, ''), " +
+	"coalesce(r.websiteurl, ''), " +
+	"coalesce(r.avatarurl, ''), " +
+	"coalesce(" + userProviderColumn("r") + ", ''), " +
+	"coalesce(r.joindate, CURRENT_TIMESTAMP)"
+
+// commentListFrom is the from clause of a comment list query, which includes the current commenter's votes (whose hex
+// must be passed as $1) and comment authors
+const commentListFrom = "from comments c " +
+	"left join votes v on v.commenthex=c.commenthex and v.commenterhex=$1 " +
+	"left join users r on r.userhex=c.commenterhex "
+
+// commentPageKeyset returns a condition (starting with " and", if any) selecting comments, referenced by the "c" alias,
+// that follow the given cursor, and an order clause for the given sort policy, appending the necessary query parameters
+// to params. The comment hex is used as a tie-breaker to make the order stable
+func commentPageKeyset(sortPolicy models.SortPolicy, after *data.CommentCursor, params *[]any) (string, string) {
+	var keyset, order string
+	n := len(*params)
+	switch sortPolicy {
+	case models.SortPolicyCreationdateDashAsc:
+		keyset = fmt.Sprintf(" and (c.creationdate, c.commenthex) > ($%d, $%d)", n+1, n+2)
+		order = "c.creationdate, c.commenthex"
+	case models.SortPolicyCreationdateDashDesc:
+		keyset = fmt.Sprintf(" and (c.creationdate, c.commenthex) < ($%d, $%d)", n+1, n+2)
+		order = "c.creationdate desc, c.commenthex desc"
+	default:
+		keyset = fmt.Sprintf(" and (c.score, c.creationdate, c.commenthex) < ($%d, $%d, $%d)", n+1, n+2, n+3)
+		order = "c.score desc, c.creationdate desc, c.commenthex desc"
+	}
+
+	// No cursor means the first page
+	if after == nil {
+		return "", order
+	}
+	if sortPolicy == models.SortPolicyCreationdateDashAsc || sortPolicy == models.SortPolicyCreationdateDashDesc {
+		*params = append(*params, after.Created, after.HexID)
+	} else {
+		*params = append(*params, after.Score, after.Created, after.HexID)
+	}
+	return keyset, order
+}
+
+// commentPageNext cuts the given comments, fetched with one extra item, down to limit. If there were more than
+// requested, also returns a cursor pointing to the last returned comment in the given sort policy
+func commentPageNext(comments []*models.Comment, limit int, sortPolicy models.SortPolicy) ([]*models.Comment, *data.CommentCursor) {
+	if len(comments) <= limit {
+		return comments, nil
+	}
+	comments = comments[:limit]
+	last := comments[limit-1]
+	return comments, &data.CommentCursor{
+		SortPolicy: sortPolicy,
+		Score:      last.Score,
+		Created:    time.Time(last.CreationDate),
+		HexID:      last.CommentHex,
+	}
+}
+
+// commentVisibilityFilter returns a condition (starting with " and", if any) limiting comments, referenced by the
+// given alias, to those visible to the given commenter, appending the necessary query parameters to params. The
+// query must reference the commenter's hex as $1
+func commentVisibilityFilter(alias string, commenter *data.User, params *[]any) string {
+	switch {
+	// Anonymous commenter: only include approved, non-shadowed, not by a shadow-banned author
+	case commenter.IsAnonymous():
+		*params = append(*params, models.CommentStateApproved)
+		return fmt.Sprintf(" and %s.state=$%d and %[1]s.shadowed=false", alias, len(*params)) +
+			commentShadowBanFilter(alias, params)
+
+	// Authenticated, non-moderator commenter: show only approved, non-shadowed, not by a shadow-banned author, and all
+	// own comments
+	case !commenter.IsModerator:
+		*params = append(*params, models.CommentStateApproved)
+		return fmt.Sprintf(" and (%s.state=$%d and %[1]s.shadowed=false", alias, len(*params)) +
+			commentShadowBanFilter(alias, params) +
+			fmt.Sprintf(" or %s.commenterhex=$1)", alias)
+	}
+
+	// Moderators see everything
+	return ""
+}
+
+// commentShadowBanFilter returns a condition (starting with " and") excluding comments, referenced by the given alias,
+// whose author is under an active shadow ban, appending the necessary query parameters to params. This also hides
+// comments written before the ban. IP bans can't be matched, since comments don't record the author's IP
+func commentShadowBanFilter(alias string, params *[]any) string {
+	*params = append(*params, time.Now().UTC())
+	return fmt.Sprintf(
+		" and not exists (select 1 from bans b "+
+			"where b.domain=%[1]s.domain and b.shadow and (b.expirydate is null or b.expirydate>$%[2]d) and "+
+			"(b.commenterhex<>'' and b.commenterhex=%[1]s.commenterhex or "+
+			"b.email<>'' and b.email=(select lower(u.email) from users u where u.userhex=%[1]s.commenterhex)))",
+		alias,
+		len(*params))
+}
@@ -0,0 +1,68 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"testing"
+	"time"
+)
+
+func Test_commentPageKeyset(t *testing.T) {
+	cursor := &data.CommentCursor{Score: 3, Created: time.Unix(1700000000, 0).UTC(), HexID: "abc"}
+	tests := []struct {
+		name       string
+		sortPolicy models.SortPolicy
+		after      *data.CommentCursor
+		wantKeyset string
+		wantOrder  string
+		wantParams int
+	}{
+		{"first page, score     ", models.SortPolicyScoreDashDesc, nil, "", "c.score desc, c.creationdate desc, c.commenthex desc", 1},
+		{"next page, score      ", models.SortPolicyScoreDashDesc, cursor, " and (c.score, c.creationdate, c.commenthex) < ($2, $3, $4)", "c.score desc, c.creationdate desc, c.commenthex desc", 4},
+		{"next page, oldest     ", models.SortPolicyCreationdateDashAsc, cursor, " and (c.creationdate, c.commenthex) > ($2, $3)", "c.creationdate, c.commenthex", 3},
+		{"next page, most recent", models.SortPolicyCreationdateDashDesc, cursor, " and (c.creationdate, c.commenthex) < ($2, $3)", "c.creationdate desc, c.commenthex desc", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := []any{"x"}
+			keyset, order := commentPageKeyset(tt.sortPolicy, tt.after, &params)
+			if keyset != tt.wantKeyset {
+				t.Errorf("commentPageKeyset() keyset = %v, want %v", keyset, tt.wantKeyset)
+			}
+			if order != tt.wantOrder {
+				t.Errorf("commentPageKeyset() order = %v, want %v", order, tt.wantOrder)
+			}
+			if len(params) != tt.wantParams {
+				t.Errorf("commentPageKeyset() got %d params, want %d", len(params), tt.wantParams)
+			}
+		})
+	}
+}
+
+func Test_commentPageNext(t *testing.T) {
+	comments := []*models.Comment{{CommentHex: "a"}, {CommentHex: "b"}, {CommentHex: "c"}}
+	tests := []struct {
+		name     string
+		limit    int
+		wantLen  int
+		wantNext models.HexID
+	}{
+		{"fewer than limit", 5, 3, ""},
+		{"exactly limit   ", 3, 3, ""},
+		{"more than limit ", 2, 2, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next := commentPageNext(comments, tt.limit, models.SortPolicyScoreDashDesc)
+			if len(got) != tt.wantLen {
+				t.Errorf("commentPageNext() got %d comments, want %d", len(got), tt.wantLen)
+			}
+			if next == nil && tt.wantNext != "" || next != nil && next.HexID != tt.wantNext {
+				t.Errorf("commentPageNext() next = %v, want %v", next, tt.wantNext)
+			}
+			if next != nil && next.SortPolicy != models.SortPolicyScoreDashDesc {
+				t.Errorf("commentPageNext() next sort policy = %v, want %v", next.SortPolicy, models.SortPolicyScoreDashDesc)
+			}
+		})
+	}
+}
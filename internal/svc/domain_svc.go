@@ -3,9 +3,13 @@ package svc
 import (
 	"database/sql"
 	"github.com/go-openapi/strfmt"
+	"github.com/lib/pq"
 	"gitlab.com/comentario/comentario/internal/api/exmodels"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -14,39 +18,49 @@ var TheDomainService DomainService = &domainService{}
 
 // DomainService is a service interface for dealing with domains
 type DomainService interface {
+	// AddUser grants the given user the specified role in the domain
+	AddUser(domain string, user *data.User, role models.DomainRole) error
 	// Clear removes all pages, comments, and comment votes for the specified domain
 	Clear(domain string) error
-	// Create creates and persists a new domain record
+	// Create creates and persists a new domain record, pending ownership verification, making the given user its owner
+	// and moderator. A domain with the same name that has been pending verification for too long is removed beforehand.
+	// If a domain with that name is still pending someone else's verification, a claim is recorded instead, and
+	// whoever proves the ownership first gets the domain. Returns util.ErrorDomainAlreadyExists if the domain has been
+	// verified already, or the user owns it
 	Create(ownerHex models.HexID, name, domain string) (*models.Domain, error)
-	// CreateModerator creates and persists a new domain moderator record
-	CreateModerator(domain, email string) (*models.DomainModerator, error)
 	// CreateSSOSecret generates a new SSO secret token for the given domain and saves that in the domain properties
 	CreateSSOSecret(domain string) (models.HexID, error)
 	// CreateSSOToken generates, persists, and returns a new SSO token for the given domain and commenter token
 	CreateSSOToken(domain string, commenterToken models.HexID) (models.HexID, error)
 	// Delete deletes the specified domain
 	Delete(domain string) error
-	// DeleteModerator deletes the specified domain moderator
-	DeleteModerator(domain, email string) error
 	// FindByName fetches and returns a domain with the specified name
 	FindByName(domainName string) (*models.Domain, error)
-	// IsDomainModerator returns whether the given email is a moderator in the given domain
-	IsDomainModerator(email, domain string) (bool, error)
-	// IsDomainOwner returns whether the given owner hex ID is an owner of the given domain
-	IsDomainOwner(id models.HexID, domain string) (bool, error)
+	// FindUserRoles returns the roles the user with the given hex ID has in the given domain, and whether the domain
+	// requires its moderators to sign in with a second factor
+	FindUserRoles(id models.HexID, domain string) ([]models.DomainRole, bool, error)
 	// ListByOwner fetches and returns a list of domains for the specified owner
 	ListByOwner(ownerHex models.HexID) ([]*models.Domain, error)
+	// ListByUser fetches and returns a list of domains the specified user has any role in, reporting the user's roles
+	// in each of them
+	ListByUser(id models.HexID) ([]*models.Domain, error)
+	// ListUsers fetches and returns a list of users having a role in the given domain
+	ListUsers(domain string) ([]*models.DomainUser, error)
 	// RegisterView records a domain view in the database. commenterHex should be "anonymous" for an unauthenticated
 	// viewer
-	RegisterView(domain string, commenter *data.UserCommenter) error
+	RegisterView(domain string, commenter *data.User) error
+	// RemoveUser takes the specified role in the domain away from the user with the given email. Returns
+	// util.ErrorLastDomainOwner if that would leave the domain without an owner
+	RemoveUser(domain, email string, role models.DomainRole) error
 	// StatsForComments collects and returns comment statistics for the given domain
 	StatsForComments(domain string) ([]int64, error)
 	// StatsForViews collects and returns view statistics for the given domain
 	StatsForViews(domain string) ([]int64, error)
 	// TakeSSOToken queries and removes the provided token from the database, returning its domain and commenter token
 	TakeSSOToken(token models.HexID) (string, models.HexID, error)
-	// Update updates the domain record in the database
-	Update(domain *models.Domain) error
+	// Update updates the settings of the given domain in the database. Only the settings provided (i.e. non-nil or
+	// non-empty) are updated
+	Update(domain string, settings *models.DomainSettings) error
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -54,6 +68,27 @@ type DomainService interface {
 // domainService is a blueprint DomainService implementation
 type domainService struct{}
 
+func (svc *domainService) AddUser(domain string, user *data.User, role models.DomainRole) error {
+	logger.Debugf("domainService.AddUser(%s, [%s], %s)", domain, user.HexID, role)
+
+	// Create a new email record, needed for notifications
+	if _, err := TheEmailService.Create(user.Email); err != nil {
+		return err
+	}
+
+	// Create a new domain user record
+	err := db.Exec(
+		"insert into domainusers(domain, userhex, role, adddate) values($1, $2, $3, $4) on conflict do nothing;",
+		domain, user.HexID, role, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("domainService.AddUser: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
 func (svc *domainService) Clear(domain string) error {
 	logger.Debugf("domainService.Clear(%s)", domain)
 
@@ -79,47 +114,72 @@ func (svc *domainService) Clear(domain string) error {
 func (svc *domainService) Create(ownerHex models.HexID, name, domain string) (*models.Domain, error) {
 	logger.Debugf("domainService.Create(%s, %s, %s)", ownerHex, name, domain)
 
-	// Insert a new record
-	d := models.Domain{
-		CreationDate: strfmt.DateTime(time.Now().UTC()),
-		Domain:       domain,
-		Name:         name,
-		OwnerHex:     ownerHex,
-	}
-	err := db.Exec(
-		"insert into domains(ownerhex, name, domain, creationdate) values($1, $2, $3, $4);",
-		d.OwnerHex, d.Name, d.Domain, d.CreationDate)
+	// Generate a token to prove the domain ownership with
+	token, err := data.RandomHexID()
 	if err != nil {
-		logger.Errorf("domainService.Create: Exec() failed: %v", err)
-		return nil, translateDBErrors(err)
+		logger.Errorf("domainService.Create: RandomHexID() failed: %v", err)
+		return nil, err
 	}
 
-	// Succeeded
-	return &d, nil
-}
-
-func (svc *domainService) CreateModerator(domain, email string) (*models.DomainModerator, error) {
-	logger.Debugf("domainService.CreateModerator(%s, %s)", domain, email)
-
-	// Create a new email record
-	if _, err := TheEmailService.Create(email); err != nil {
+	// A domain someone else has failed to verify in time mustn't block its name
+	if err := TheDomainVerificationService.ReleaseExpired(domain); err != nil {
 		return nil, err
 	}
 
-	// Create a new domain moderator record
-	dm := models.DomainModerator{
-		AddDate: strfmt.DateTime(time.Now().UTC()),
-		Domain:  domain,
-		Email:   strfmt.Email(email),
+	// Find the user, to create an email record for them, needed for notifications
+	if user, err := TheUserService.FindUserByID(ownerHex); err != nil {
+		return nil, err
+	} else if _, err := TheEmailService.Create(user.Email); err != nil {
+		return nil, err
 	}
-	err := db.Exec("insert into moderators(domain, email, adddate) values($1, $2, $3);", dm.Domain, dm.Email, dm.AddDate)
+
+	// Insert a new record, pending verification, unless there's one already
+	d := models.Domain{
+		CreationDate:      strfmt.DateTime(time.Now().UTC()),
+		Domain:            domain,
+		Name:              name,
+		OwnerHex:          ownerHex,
+		VerificationToken: string(token),
+	}
+	res, err := db.ExecRes(
+		"with d as ("+
+			"insert into domains(name, domain, creationdate, verificationtoken, verified) values($1, $2, $3, $4, false) "+
+			"on conflict do nothing returning domain) "+
+			"insert into domainusers(domain, userhex, role, adddate) "+
+			"select domain, $5, $6, $3 from d union all select domain, $5, $7, $3 from d;",
+		d.Name, d.Domain, d.CreationDate, d.VerificationToken, d.OwnerHex, models.DomainRoleOwner, models.DomainRoleModerator)
 	if err != nil {
-		logger.Errorf("domainService.CreateModerator: Exec() failed: %v", err)
+		logger.Errorf("domainService.Create: ExecRes() failed: %v", err)
+		return nil, translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == nil {
+		// Succeeded
+		return &d, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	// The domain exists already: claim it if it's pending someone else's verification. A repeated claim keeps its
+	// token, which may have already been published
+	var created time.Time
+	err = db.QueryRow(
+		"insert into domainclaims(domain, ownerhex, name, verificationtoken, creationdate) "+
+			"select domain, $2, $3, $4, $5 from domains "+
+			"where domain=$1 and verifieddate is null and verificationtoken<>'' and "+
+			"not exists (select 1 from domainusers where domain=$1 and userhex=$2 and role=$6) "+
+			"on conflict (domain, ownerhex) do update set name=excluded.name "+
+			"returning verificationtoken, creationdate;",
+		d.Domain, d.OwnerHex, d.Name, d.VerificationToken, d.CreationDate, models.DomainRoleOwner).
+		Scan(&d.VerificationToken, &created)
+	if err == sql.ErrNoRows {
+		return nil, util.ErrorDomainAlreadyExists
+	} else if err != nil {
+		logger.Errorf("domainService.Create: Scan() failed: %v", err)
 		return nil, translateDBErrors(err)
 	}
+	d.CreationDate = strfmt.DateTime(created)
 
 	// Succeeded
-	return &dm, nil
+	return &d, nil
 }
 
 func (svc *domainService) CreateSSOSecret(domain string) (models.HexID, error) {
@@ -168,11 +228,20 @@ func (svc *domainService) CreateSSOToken(domain string, commenterToken models.He
 func (svc *domainService) Delete(domain string) error {
 	logger.Debugf("domainService.Delete(%s)", domain)
 
-	// Remove the domain's view stats, moderators, ssotokens
+	// Remove the domain's webhooks and bans
+	if err := TheWebhookService.DeleteByDomain(domain); err != nil {
+		return err
+	}
+	if err := TheBanService.DeleteByDomain(domain); err != nil {
+		return err
+	}
+
+	// Remove the domain's view stats, user roles, invitations, ssotokens
 	err := checkErrors(
 		db.Exec(
 			"delete from views where domain=$1;"+
-				"delete from moderators where domain=$1;"+
+				"delete from domainusers where domain=$1;"+
+				"delete from domaininvitations where domain=$1;"+
 				"delete from ssotokens where domain=$1;",
 			domain))
 	if err != nil {
@@ -190,31 +259,14 @@ func (svc *domainService) Delete(domain string) error {
 	return nil
 }
 
-func (svc *domainService) DeleteModerator(domain, email string) error {
-	logger.Debugf("domainService.DeleteModerator(%s, %s)", domain, email)
-
-	// Remove the row from the database
-	if err := db.Exec("delete from moderators where domain=$1 and email=$2;", domain, email); err != nil {
-		logger.Errorf("domainService.DeleteModerator: Exec() failed: %v", err)
-		return translateDBErrors(err)
-	}
-
-	// Succeeded
-	return nil
-}
-
 func (svc *domainService) FindByName(domainName string) (*models.Domain, error) {
 	logger.Debugf("domainService.Find(%s)", domainName)
 
 	// Query the row
 	rows, err := db.Query(
-		"select "+
-			"d.domain, d.ownerhex, d.name, d.creationdate, d.state, d.importedcomments, d.autospamfilter, "+
-			"d.requiremoderation, d.requireidentification, d.moderateallanonymous, d.emailnotificationpolicy, "+
-			"d.commentoprovider, d.googleprovider, d.githubprovider, d.gitlabprovider, d.twitterprovider, "+
-			"d.ssoprovider, d.ssosecret, d.ssourl, d.defaultsortpolicy, m.email, m.adddate "+
+		domainSelect+
 			"from domains d "+
-			"left join moderators m on m.domain=d.domain "+
+			domainModeratorsJoin+
 			"where d.domain=$1;",
 		domainName)
 	if err != nil {
@@ -234,44 +286,42 @@ func (svc *domainService) FindByName(domainName string) (*models.Domain, error)
 	}
 }
 
-func (svc *domainService) IsDomainModerator(email, domain string) (bool, error) {
-	logger.Debugf("domainService.IsDomainModerator(%s, %s)", email, domain)
-
-	// Query the row
-	row := db.QueryRow("select 1 from moderators where domain=$1 and email=$2;", domain, email)
-	var b byte
-	if err := row.Scan(&b); err == sql.ErrNoRows {
-		// No rows means it isn't a moderator
-		return false, nil
+func (svc *domainService) FindUserRoles(id models.HexID, domain string) ([]models.DomainRole, bool, error) {
+	logger.Debugf("domainService.FindUserRoles(%s, %s)", id, domain)
 
-	} else if err != nil {
-		// Any other database error
-		logger.Errorf("domainService.IsDomainModerator: QueryRow() failed: %v", err)
-		return false, translateDBErrors(err)
+	// Query the roles along with the domain's 2FA requirement
+	rows, err := db.Query(
+		"select du.role, d.requiremoderator2fa "+
+			"from domainusers du "+
+			"join domains d on d.domain=du.domain "+
+			"where du.domain=$1 and du.userhex=$2;",
+		domain, id)
+	if err != nil {
+		logger.Errorf("domainService.FindUserRoles: Query() failed: %v", err)
+		return nil, false, translateDBErrors(err)
 	}
+	defer rows.Close()
 
-	// Succeeded: the email belongs to a domain moderator
-	return true, nil
-}
-
-func (svc *domainService) IsDomainOwner(id models.HexID, domain string) (bool, error) {
-	logger.Debugf("domainService.IsDomainOwner(%s, %s)", id, domain)
-
-	// Query the row
-	row := db.QueryRow("select 1 from domains where ownerhex=$1 and domain=$2", id, domain)
-	var b byte
-	if err := row.Scan(&b); err == sql.ErrNoRows {
-		// No rows means it isn't an owner
-		return false, nil
+	// Fetch the roles. No rows means the user has no role in the domain
+	var roles []models.DomainRole
+	var require2FA bool
+	for rows.Next() {
+		var r models.DomainRole
+		if err := rows.Scan(&r, &require2FA); err != nil {
+			logger.Errorf("domainService.FindUserRoles: Scan() failed: %v", err)
+			return nil, false, translateDBErrors(err)
+		}
+		roles = append(roles, r)
+	}
 
-	} else if err != nil {
-		// Any other database error
-		logger.Errorf("domainService.IsDomainOwner: QueryRow() failed: %v", err)
-		return false, translateDBErrors(err)
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainService.FindUserRoles: Next() failed: %v", err)
+		return nil, false, translateDBErrors(err)
 	}
 
-	// Succeeded: the ID belongs to a domain owner
-	return true, nil
+	// Succeeded
+	return roles, require2FA, nil
 }
 
 func (svc *domainService) ListByOwner(ownerHex models.HexID) ([]*models.Domain, error) {
@@ -279,15 +329,11 @@ func (svc *domainService) ListByOwner(ownerHex models.HexID) ([]*models.Domain,
 
 	// Query domains and moderators
 	rows, err := db.Query(
-		"select "+
-			"d.domain, d.ownerhex, d.name, d.creationdate, d.state, d.importedcomments, d.autospamfilter, "+
-			"d.requiremoderation, d.requireidentification, d.moderateallanonymous, d.emailnotificationpolicy, "+
-			"d.commentoprovider, d.googleprovider, d.githubprovider, d.gitlabprovider, d.twitterprovider, "+
-			"d.ssoprovider, d.ssosecret, d.ssourl, d.defaultsortpolicy, m.email, m.adddate "+
+		domainSelect+
 			"from domains d "+
-			"left join moderators m on m.domain=d.domain "+
-			"where d.ownerhex=$1;",
-		ownerHex)
+			domainModeratorsJoin+
+			"where d.domain in (select o.domain from domainusers o where o.userhex=$1 and o.role=$2);",
+		ownerHex, models.DomainRoleOwner)
 	if err != nil {
 		logger.Errorf("domainService.ListByOwner: Query() failed: %v", err)
 		return nil, translateDBErrors(err)
@@ -302,7 +348,102 @@ func (svc *domainService) ListByOwner(ownerHex models.HexID) ([]*models.Domain,
 	}
 }
 
-func (svc *domainService) RegisterView(domain string, commenter *data.UserCommenter) error {
+func (svc *domainService) ListByUser(id models.HexID) ([]*models.Domain, error) {
+	logger.Debugf("domainService.ListByUser(%s)", id)
+
+	// Query domains and moderators
+	rows, err := db.Query(
+		domainSelect+
+			"from domains d "+
+			domainModeratorsJoin+
+			"where d.domain in (select r.domain from domainusers r where r.userhex=$1);",
+		id)
+	if err != nil {
+		logger.Errorf("domainService.ListByUser: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the domains
+	domains, err := svc.fetchDomainsAndModerators(rows)
+	if err != nil {
+		return nil, translateDBErrors(err)
+	}
+
+	// Query the user's roles
+	rows, err = db.Query("select domain, role from domainusers where userhex=$1;", id)
+	if err != nil {
+		logger.Errorf("domainService.ListByUser: Query() failed for roles: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Add the roles to the respective domains
+	dn := map[string]*models.Domain{}
+	for _, d := range domains {
+		dn[d.Domain] = d
+	}
+	for rows.Next() {
+		var domain string
+		var role models.DomainRole
+		if err := rows.Scan(&domain, &role); err != nil {
+			logger.Errorf("domainService.ListByUser: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		if d, ok := dn[domain]; ok {
+			d.Roles = append(d.Roles, role)
+		}
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainService.ListByUser: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return domains, nil
+}
+
+func (svc *domainService) ListUsers(domain string) ([]*models.DomainUser, error) {
+	logger.Debugf("domainService.ListUsers(%s)", domain)
+
+	// Query the domain's users
+	rows, err := db.Query(
+		"select u.email, u.name, du.role, du.adddate "+
+			"from domainusers du "+
+			"join users u on u.userhex=du.userhex "+
+			"where du.domain=$1 "+
+			"order by du.adddate, u.email;",
+		domain)
+	if err != nil {
+		logger.Errorf("domainService.ListUsers: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the users
+	res := []*models.DomainUser{}
+	for rows.Next() {
+		du := models.DomainUser{}
+		if err := rows.Scan(&du.Email, &du.Name, &du.Role, &du.AddDate); err != nil {
+			logger.Errorf("domainService.ListUsers: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, &du)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainService.ListUsers: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *domainService) RegisterView(domain string, commenter *data.User) error {
 	logger.Debugf("domainService.RegisterView(%s, [%s])", domain, commenter.HexID)
 
 	// Insert a new view record
@@ -318,6 +459,37 @@ func (svc *domainService) RegisterView(domain string, commenter *data.UserCommen
 	return nil
 }
 
+func (svc *domainService) RemoveUser(domain, email string, role models.DomainRole) error {
+	logger.Debugf("domainService.RemoveUser(%s, %s, %s)", domain, email, role)
+
+	// A domain must keep at least one owner
+	if role == models.DomainRoleOwner {
+		var cnt int
+		if err := db.QueryRow("select count(*) from domainusers where domain=$1 and role=$2;", domain, role).Scan(&cnt); err != nil {
+			logger.Errorf("domainService.RemoveUser: QueryRow() failed: %v", err)
+			return translateDBErrors(err)
+		} else if cnt <= 1 {
+			return util.ErrorLastDomainOwner
+		}
+	}
+
+	// Remove the row from the database, repeating the owner check in case another owner is being removed concurrently.
+	// The owner rows are locked, so that concurrent removals are counted one after another, not against the same rows
+	res, err := db.ExecRes(
+		"with owners as (select o.userhex from domainusers o where o.domain=$1 and o.role=$4 for update) "+
+			"delete from domainusers "+
+			"where domain=$1 and role=$2 and userhex in (select userhex from users where email=$3) and "+
+			"($2<>$4 or (select count(*) from owners)>1);",
+		domain, role, email, models.DomainRoleOwner)
+	if err != nil {
+		logger.Errorf("domainService.RemoveUser: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
 func (svc *domainService) StatsForComments(domain string) ([]int64, error) {
 	logger.Debugf("domainService.StatsForComments(%s)", domain)
 
@@ -386,40 +558,98 @@ func (svc *domainService) TakeSSOToken(token models.HexID) (string, models.HexID
 	return domain, commenterToken, nil
 }
 
-func (svc *domainService) Update(domain *models.Domain) error {
-	logger.Debug("domainService.Update(...)")
+func (svc *domainService) Update(domain string, settings *models.DomainSettings) error {
+	logger.Debugf("domainService.Update(%s, ...)", domain)
 
-	// Update the domain
-	err := db.Exec(
+	// Identity providers are only updated if the map is provided at all
+	idp := func(id string) *bool { return nil }
+	var oidcProviders any
+	if settings.Idps != nil {
+		idp = func(id string) *bool { v := settings.Idps[id]; return &v }
+		oidcProviders = pq.Array(svc.enabledOIDCProviders(settings.Idps))
+	}
+
+	// Update the domain, keeping the current value of each setting not provided
+	res, err := db.ExecRes(
 		"update domains "+
-			"set name=$1, state=$2, autospamfilter=$3, requiremoderation=$4, requireidentification=$5, "+
-			"moderateallanonymous=$6, emailnotificationpolicy=$7, commentoprovider=$8, googleprovider=$9, "+
-			"githubprovider=$10, gitlabprovider=$11, twitterprovider=$12, ssoprovider=$13, ssourl=$14, "+
-			"defaultsortpolicy=$15 "+
-			"where domain=$16;",
-		domain.Name,
-		domain.State,
-		domain.AutoSpamFilter,
-		domain.RequireModeration,
-		domain.RequireIdentification,
-		domain.ModerateAllAnonymous,
-		domain.EmailNotificationPolicy,
-		domain.Idps["commento"],
-		domain.Idps["google"],
-		domain.Idps["github"],
-		domain.Idps["gitlab"],
-		domain.Idps["twitter"],
-		domain.Idps["sso"],
-		domain.SsoURL,
-		domain.DefaultSortPolicy,
-		domain.Domain)
+			"set name=coalesce($1, name), state=coalesce($2, state), autospamfilter=coalesce($3, autospamfilter), "+
+			"requiremoderation=coalesce($4, requiremoderation), "+
+			"requireidentification=coalesce($5, requireidentification), "+
+			"moderateallanonymous=coalesce($6, moderateallanonymous), "+
+			"emailnotificationpolicy=coalesce($7, emailnotificationpolicy), "+
+			"commentoprovider=coalesce($8, commentoprovider), googleprovider=coalesce($9, googleprovider), "+
+			"githubprovider=coalesce($10, githubprovider), gitlabprovider=coalesce($11, gitlabprovider), "+
+			"twitterprovider=coalesce($12, twitterprovider), ssoprovider=coalesce($13, ssoprovider), "+
+			"ssourl=coalesce($14, ssourl), defaultsortpolicy=coalesce($15, defaultsortpolicy), "+
+			"spamthresholdunapproved=coalesce($16, spamthresholdunapproved), "+
+			"spamthresholdflagged=coalesce($17, spamthresholdflagged), spamlinklimit=coalesce($18, spamlinklimit), "+
+			"spamblocklist=coalesce($19, spamblocklist), spamdenylist=coalesce($20, spamdenylist), "+
+			"spambayesfilter=coalesce($21, spambayesfilter), reportthreshold=coalesce($22, reportthreshold), "+
+			"requiremoderator2fa=coalesce($23, requiremoderator2fa), oidcproviders=coalesce($24, oidcproviders), "+
+			"mastodonprovider=coalesce($25, mastodonprovider), moderateunconfirmed=coalesce($26, moderateunconfirmed) "+
+			"where domain=$27;",
+		settings.Name,
+		nullIfEmpty(string(settings.State)),
+		settings.AutoSpamFilter,
+		settings.RequireModeration,
+		settings.RequireIdentification,
+		settings.ModerateAllAnonymous,
+		nullIfEmpty(string(settings.EmailNotificationPolicy)),
+		idp("commento"),
+		idp("google"),
+		idp("github"),
+		idp("gitlab"),
+		idp("twitter"),
+		idp("sso"),
+		(*string)(settings.SsoURL),
+		nullIfEmpty(string(settings.DefaultSortPolicy)),
+		settings.SpamThresholdUnapproved,
+		settings.SpamThresholdFlagged,
+		settings.SpamLinkLimit,
+		settings.SpamBlocklist,
+		settings.SpamDenylist,
+		settings.SpamBayesFilter,
+		settings.ReportThreshold,
+		settings.RequireModerator2fa,
+		oidcProviders,
+		idp("mastodon"),
+		settings.ModerateUnconfirmed,
+		domain)
 	if err != nil {
-		logger.Errorf("domainService.Update: Exec() failed: %v", err)
+		logger.Errorf("domainService.Update: ExecRes() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
 	// Succeeded
-	return nil
+	return checkRowsAffected(res)
+}
+
+// domainSelect is the select list of a domain query, which is to be processed with fetchDomainsAndModerators(). The
+// query must alias domains as "d", and include domainModeratorsJoin
+const domainSelect = "select " +
+	"d.domain, " +
+	"coalesce((select o.userhex from domainusers o where o.domain=d.domain and o.role='owner' order by o.adddate limit 1), ''), " +
+	"d.name, d.creationdate, d.state, d.adminfrozen, d.importedcomments, d.autospamfilter, " +
+	"d.requiremoderation, d.requireidentification, d.moderateallanonymous, d.emailnotificationpolicy, " +
+	"d.commentoprovider, d.googleprovider, d.githubprovider, d.gitlabprovider, d.twitterprovider, " +
+	"d.ssoprovider, d.ssosecret, d.ssourl, d.defaultsortpolicy, d.spamthresholdunapproved, d.spamthresholdflagged, " +
+	"d.spamlinklimit, d.spamblocklist, d.spamdenylist, d.spambayesfilter, d.reportthreshold, d.requiremoderator2fa, d.oidcproviders, " +
+	"d.mastodonprovider, d.moderateunconfirmed, d.verified, d.verificationtoken, coalesce(mu.email, ''), m.adddate "
+
+// domainModeratorsJoin is the join clause adding domain moderators to a domainSelect query
+const domainModeratorsJoin = "left join domainusers m on m.domain=d.domain and m.role='moderator' " +
+	"left join users mu on mu.userhex=m.userhex "
+
+// enabledOIDCProviders returns the IDs of generic OpenID Connect providers enabled in the given map
+func (svc *domainService) enabledOIDCProviders(idps exmodels.IdentityProviderMap) []string {
+	res := []string{}
+	for idp, enabled := range idps {
+		if enabled && strings.HasPrefix(idp, util.OIDCIdPPrefix) {
+			res = append(res, idp)
+		}
+	}
+	sort.Strings(res)
+	return res
 }
 
 // fetchDomainsAndModerators returns a list of domain instances from the provided database rows
@@ -433,13 +663,15 @@ func (svc *domainService) fetchDomainsAndModerators(rs *sql.Rows) ([]*models.Dom
 		// Fetch a domain and a moderator
 		d := models.Domain{}
 		m := models.DomainModerator{}
-		var commento, google, github, gitlab, twitter, sso bool
+		var commento, google, github, gitlab, twitter, sso, mastodon bool
+		var oidc []string
 		err := rs.Scan(
 			&d.Domain,
 			&d.OwnerHex,
 			&d.Name,
 			&d.CreationDate,
 			&d.State,
+			&d.AdminFrozen,
 			&d.ImportedComments,
 			&d.AutoSpamFilter,
 			&d.RequireModeration,
@@ -455,6 +687,19 @@ func (svc *domainService) fetchDomainsAndModerators(rs *sql.Rows) ([]*models.Dom
 			&d.SsoSecret,
 			&d.SsoURL,
 			&d.DefaultSortPolicy,
+			&d.SpamThresholdUnapproved,
+			&d.SpamThresholdFlagged,
+			&d.SpamLinkLimit,
+			&d.SpamBlocklist,
+			&d.SpamDenylist,
+			&d.SpamBayesFilter,
+			&d.ReportThreshold,
+			&d.RequireModerator2fa,
+			pq.Array(&oidc),
+			&mastodon,
+			&d.ModerateUnconfirmed,
+			&d.Verified,
+			&d.VerificationToken,
 			&m.Email,
 			&m.AddDate)
 		if err != nil {
@@ -476,6 +721,10 @@ func (svc *domainService) fetchDomainsAndModerators(rs *sql.Rows) ([]*models.Dom
 				"gitlab":   gitlab,
 				"twitter":  twitter,
 				"sso":      sso,
+				"mastodon": mastodon,
+			}
+			for _, idp := range oidc {
+				d.Idps[idp] = true
 			}
 
 			// Add the domain to the result list and the name map
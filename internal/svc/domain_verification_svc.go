@@ -0,0 +1,463 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/util"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TheDomainVerificationService is a global DomainVerificationService implementation
+var TheDomainVerificationService = NewDomainVerificationService(
+	net.DefaultResolver,
+	util.NewPublicHTTPClient(domainVerifyTimeout))
+
+// DomainVerificationService is a service interface for verifying the ownership of domains
+type DomainVerificationService interface {
+	// Init starts the periodic rechecks of domain ownership proofs, and the removal of domains pending verification for
+	// too long
+	Init()
+	// ReleaseExpired removes the given domain if it's been pending verification for too long, so that its name can be
+	// registered by someone else. Does nothing otherwise
+	ReleaseExpired(domain string) error
+	// Verify checks the ownership proof of the given domain right away, records the outcome, and returns whether the
+	// domain is verified. A proof that cannot be checked at the moment leaves the domain's state unchanged
+	Verify(domain string) (bool, error)
+	// VerifyClaim checks the ownership proof of the given user's claim of the given domain right away, and returns
+	// whether the user has got the domain. Returns ErrNotFound if there's no such claim
+	VerifyClaim(domain string, ownerHex models.HexID) (bool, error)
+}
+
+// NewDomainVerificationService returns a new DomainVerificationService looking up DNS records with the given resolver
+// and downloading well-known files with the given fetcher
+func NewDomainVerificationService(resolver TXTResolver, fetcher HTTPFetcher) DomainVerificationService {
+	return &domainVerificationService{resolver: resolver, fetcher: fetcher}
+}
+
+// TXTResolver looks up DNS TXT records. Implemented by net.Resolver
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// HTTPFetcher performs HTTP requests. Implemented by http.Client
+type HTTPFetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	domainVerifyTXTPrefix       = "comentario-verification="             // Prefix of the DNS TXT record value carrying the token
+	domainVerifyWellKnownPath   = "/.well-known/comentario-verification" // Path of the file carrying the token on the site
+	domainVerifyMaxFileSize     = 1024                                   // Max number of bytes read from the well-known file
+	domainVerifyTimeout         = 10 * time.Second                       // Timeout of a single proof check
+	domainVerifyPollInterval    = 10 * time.Minute                       // Interval between checks for due domains
+	domainVerifyPendingInterval = time.Hour                              // Interval between rechecks of a pending domain
+	domainVerifyRecheckInterval = 24 * time.Hour                         // Interval between rechecks of a verified domain
+	domainVerifyPendingTTL      = 3 * util.OneDay                        // Time a domain may stay pending verification for
+	domainVerifyBatchSize       = 50                                     // Max number of domains rechecked in one go
+)
+
+// domainVerificationService is a blueprint DomainVerificationService implementation
+type domainVerificationService struct {
+	resolver TXTResolver // Resolver used to look up DNS TXT records
+	fetcher  HTTPFetcher // Fetcher used to download well-known files
+}
+
+// domainProof is a domain's ownership proof due for a check
+type domainProof struct {
+	domain   string
+	token    string
+	verified bool
+	pending  bool // Whether the domain has never been verified, and can therefore be claimed by someone else
+}
+
+// domainClaim is a user's claim of a domain pending someone else's verification
+type domainClaim struct {
+	domain   string
+	ownerHex models.HexID
+	token    string
+}
+
+func (svc *domainVerificationService) Init() {
+	logger.Debug("domainVerificationService: initialising")
+	go func() {
+		for {
+			svc.releaseDue()
+			svc.recheckDue()
+			time.Sleep(domainVerifyPollInterval)
+		}
+	}()
+}
+
+func (svc *domainVerificationService) ReleaseExpired(domain string) error {
+	logger.Debugf("domainVerificationService.ReleaseExpired(%s)", domain)
+	return svc.releaseIfExpired(domain, time.Now().UTC().Add(-domainVerifyPendingTTL))
+}
+
+func (svc *domainVerificationService) Verify(domain string) (bool, error) {
+	logger.Debugf("domainVerificationService.Verify(%s)", domain)
+
+	// Fetch the domain's token
+	p := domainProof{domain: domain}
+	err := db.QueryRow("select verificationtoken, verified, verifieddate is null from domains where domain=$1;", domain).
+		Scan(&p.token, &p.verified, &p.pending)
+	if err != nil {
+		return false, translateDBErrors(err)
+	}
+
+	// Domains without a token predate ownership verification and are exempt
+	if p.token == "" {
+		return p.verified, nil
+	}
+
+	// Check the proof
+	return svc.checkAndRecord(&p)
+}
+
+func (svc *domainVerificationService) VerifyClaim(domain string, ownerHex models.HexID) (bool, error) {
+	logger.Debugf("domainVerificationService.VerifyClaim(%s, %s)", domain, ownerHex)
+
+	// Fetch the claim's token
+	c := domainClaim{domain: domain, ownerHex: ownerHex}
+	err := db.QueryRow("select verificationtoken from domainclaims where domain=$1 and ownerhex=$2;", domain, ownerHex).
+		Scan(&c.token)
+	if err != nil {
+		return false, translateDBErrors(err)
+	}
+
+	// Check the proof. A proof that cannot be checked is as good as a missing one
+	if ok, err := svc.check(domain, c.token); err != nil {
+		logger.Warningf("domainVerificationService: failed to check claim of domain %s: %v", domain, err)
+		return false, nil
+	} else if !ok {
+		return false, nil
+	}
+
+	// Hand the domain over
+	return svc.handOver(&c)
+}
+
+// check returns whether the given token is published for the given host either in a DNS TXT record or in the
+// well-known file on the site. Returns an error if the proof is missing, but that could not be established for sure
+func (svc *domainVerificationService) check(host, token string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), domainVerifyTimeout)
+	defer cancel()
+
+	// Look for a DNS record first. The record belongs to the host name, whatever the port
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	ok, txtErr := svc.checkTXT(ctx, hostname, token)
+	if ok {
+		return true, nil
+	}
+
+	// Try to download the file then, via HTTPS first. The file check only fails if neither scheme gives an answer
+	var fileErrs []error
+	for _, scheme := range []string{"https", "http"} {
+		if ok, err := svc.checkFile(ctx, scheme+"://"+host+domainVerifyWellKnownPath, token); ok {
+			return true, nil
+		} else if err != nil {
+			fileErrs = append(fileErrs, err)
+		}
+	}
+	if len(fileErrs) < 2 {
+		fileErrs = nil
+	}
+
+	// No proof found
+	return false, errors.Join(append(fileErrs, txtErr)...)
+}
+
+// checkAndRecord checks the given domain's ownership proof, and persists and returns the resulting verification state
+func (svc *domainVerificationService) checkAndRecord(p *domainProof) (bool, error) {
+	// Check the proof. If that fails, keep the domain's current state
+	verified, err := svc.check(p.domain, p.token)
+	if err != nil {
+		logger.Warningf("domainVerificationService: failed to check ownership of domain %s: %v", p.domain, err)
+		verified = p.verified
+	}
+
+	// Record the outcome, remembering when the domain has first been verified
+	err = db.Exec(
+		"update domains "+
+			"set verified=$1, verificationcheckdate=$2, verifieddate=case when $1 then coalesce(verifieddate, $2) else verifieddate end "+
+			"where domain=$3;",
+		verified, time.Now().UTC(), p.domain)
+	if err != nil {
+		logger.Errorf("domainVerificationService.checkAndRecord: Exec() failed: %v", err)
+		return false, translateDBErrors(err)
+	}
+
+	// Once verified, the domain can't be claimed anymore
+	if verified && p.pending {
+		if err := db.Exec("delete from domainclaims where domain=$1;", p.domain); err != nil {
+			logger.Errorf("domainVerificationService.checkAndRecord: Exec() failed: %v", err)
+			return false, translateDBErrors(err)
+		}
+	}
+
+	// Report state changes
+	if verified && !p.verified {
+		logger.Infof("Domain %s has been verified", p.domain)
+	} else if !verified && p.verified {
+		logger.Warningf("Domain %s has lost its ownership proof and is pending verification again", p.domain)
+	}
+	return verified, nil
+}
+
+// checkClaims checks the ownership proofs of the claims of the given pending domain, oldest first, and hands the
+// domain over to the first claimant whose proof is found
+func (svc *domainVerificationService) checkClaims(domain string) {
+	// Query the domain's claims
+	rows, err := db.Query(
+		"select ownerhex, verificationtoken from domainclaims where domain=$1 order by creationdate;",
+		domain)
+	if err != nil {
+		logger.Errorf("domainVerificationService.checkClaims: Query() failed: %v", err)
+		return
+	}
+
+	// Collect the claims before checking, so that the database connection isn't held during the checks
+	var claims []*domainClaim
+	for rows.Next() {
+		c := domainClaim{domain: domain}
+		if err := rows.Scan(&c.ownerHex, &c.token); err != nil {
+			logger.Errorf("domainVerificationService.checkClaims: Scan() failed: %v", err)
+			_ = rows.Close()
+			return
+		}
+		claims = append(claims, &c)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainVerificationService.checkClaims: Next() failed: %v", err)
+	}
+	_ = rows.Close()
+
+	// Check the claims, one by one, until one is proven
+	for _, c := range claims {
+		if ok, err := svc.check(domain, c.token); err != nil {
+			logger.Warningf("domainVerificationService: failed to check claim of domain %s: %v", domain, err)
+		} else if ok {
+			if _, err := svc.handOver(c); err != nil {
+				logger.Warningf("domainVerificationService: failed to hand domain %s over: %v", domain, err)
+			}
+			return
+		}
+	}
+}
+
+// checkFile returns whether the file at the given URL contains the given token
+func (svc *domainVerificationService) checkFile(ctx context.Context, url, token string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := svc.fetcher.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// A server failure says nothing about the file, whereas any other status means it's missing
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("fetching %s failed with HTTP status %d", url, resp.StatusCode)
+	} else if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	// Compare the file's content with the token
+	b, err := io.ReadAll(io.LimitReader(resp.Body, domainVerifyMaxFileSize))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == token, nil
+}
+
+// checkTXT returns whether there's a DNS TXT record for the given host name carrying the given token
+func (svc *domainVerificationService) checkTXT(ctx context.Context, hostname, token string) (bool, error) {
+	records, err := svc.resolver.LookupTXT(ctx, hostname)
+	if err != nil {
+		// A missing record is a definitive answer
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("TXT lookup failed: %w", err)
+	}
+	for _, r := range records {
+		if strings.TrimSpace(r) == domainVerifyTXTPrefix+token {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// releaseDue removes domains that have been pending verification for too long, without ever getting verified
+func (svc *domainVerificationService) releaseDue() {
+	// Query expired domains
+	cutoff := time.Now().UTC().Add(-domainVerifyPendingTTL)
+	rows, err := db.Query(
+		"select domain from domains where verifieddate is null and verificationtoken<>'' and creationdate<$1 limit $2;",
+		cutoff, domainVerifyBatchSize)
+	if err != nil {
+		logger.Errorf("domainVerificationService.releaseDue: Query() failed: %v", err)
+		return
+	}
+
+	// Collect the domains before removing them, so that the database connection isn't held meanwhile
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			logger.Errorf("domainVerificationService.releaseDue: Scan() failed: %v", err)
+			_ = rows.Close()
+			return
+		}
+		domains = append(domains, domain)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainVerificationService.releaseDue: Next() failed: %v", err)
+	}
+	_ = rows.Close()
+
+	// Remove the domains, one by one
+	for _, domain := range domains {
+		if err := svc.releaseIfExpired(domain, cutoff); err != nil {
+			logger.Warningf("domainVerificationService: failed to release domain %s: %v", domain, err)
+		}
+	}
+
+	// Remove expired claims
+	if err := db.Exec("delete from domainclaims where creationdate<$1;", cutoff); err != nil {
+		logger.Errorf("domainVerificationService.releaseDue: Exec() failed: %v", err)
+	}
+}
+
+// releaseIfExpired removes the given domain along with everything belonging to it, provided the domain has never been
+// verified and has been created before the given cutoff time. A domain that has lost its proof is kept
+func (svc *domainVerificationService) releaseIfExpired(domain string, cutoff time.Time) error {
+	// Remove the domain record first, so that a domain verified in the meantime is left alone
+	res, err := db.ExecRes(
+		"delete from domains where domain=$1 and verifieddate is null and verificationtoken<>'' and creationdate<$2;",
+		domain, cutoff)
+	if err != nil {
+		logger.Errorf("domainVerificationService.releaseIfExpired: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	logger.Infof("Domain %s hasn't been verified in time and has been released", domain)
+
+	// Remove the domain's content and dependent objects, so that nothing is passed on to whoever registers it next
+	if err := TheDomainService.Clear(domain); err != nil {
+		return err
+	}
+	return TheDomainService.Delete(domain)
+}
+
+// handOver removes the given claim's domain along with everything belonging to it, provided the domain has never been
+// verified, and registers it anew to the claimant, verified. Returns whether the claimant has got the domain
+func (svc *domainVerificationService) handOver(c *domainClaim) (bool, error) {
+	// Remove the domain record first, so that a domain verified in the meantime is left alone
+	res, err := db.ExecRes(
+		"delete from domains where domain=$1 and verifieddate is null and verificationtoken<>'';",
+		c.domain)
+	if err != nil {
+		logger.Errorf("domainVerificationService.handOver: ExecRes() failed: %v", err)
+		return false, translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// Remove the domain's content and dependent objects, so that nothing is passed on to the claimant
+	if err := TheDomainService.Clear(c.domain); err != nil {
+		return false, err
+	}
+	if err := TheDomainService.Delete(c.domain); err != nil {
+		return false, err
+	}
+
+	// Create an email record for the claimant, needed for notifications
+	if user, err := TheUserService.FindUserByID(c.ownerHex); err != nil {
+		return false, err
+	} else if _, err := TheEmailService.Create(user.Email); err != nil {
+		return false, err
+	}
+
+	// Register the domain to the claimant, dropping all claims of it. If someone has registered the domain in the
+	// meantime, the claim stays, to be checked against their registration later
+	now := time.Now().UTC()
+	res, err = db.ExecRes(
+		"with c as (select name, verificationtoken from domainclaims where domain=$1 and ownerhex=$2), "+
+			"d as ("+
+			"insert into domains(name, domain, creationdate, verificationtoken, verified, verificationcheckdate, verifieddate) "+
+			"select name, $1, $3, verificationtoken, true, $3, $3 from c on conflict do nothing returning domain), "+
+			"x as (delete from domainclaims where domain in (select domain from d)) "+
+			"insert into domainusers(domain, userhex, role, adddate) "+
+			"select domain, $2, $4, $3 from d union all select domain, $2, $5, $3 from d;",
+		c.domain, c.ownerHex, now, models.DomainRoleOwner, models.DomainRoleModerator)
+	if err != nil {
+		logger.Errorf("domainVerificationService.handOver: ExecRes() failed: %v", err)
+		return false, translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	logger.Infof("Domain %s has been verified and handed over to user %s, who claimed it", c.domain, c.ownerHex)
+	return true, nil
+}
+
+// recheckDue checks the ownership proofs of domains that haven't been checked for a while
+func (svc *domainVerificationService) recheckDue() {
+	// Query due domains. Pending ones are rechecked more often, so that they get verified soon after the proof appears
+	now := time.Now().UTC()
+	rows, err := db.Query(
+		"select domain, verificationtoken, verified, verifieddate is null from domains "+
+			"where verificationtoken<>'' and (verificationcheckdate is null or "+
+			"(verified and verificationcheckdate<$1) or (not verified and verificationcheckdate<$2)) "+
+			"order by verificationcheckdate nulls first "+
+			"limit $3;",
+		now.Add(-domainVerifyRecheckInterval), now.Add(-domainVerifyPendingInterval), domainVerifyBatchSize)
+	if err != nil {
+		logger.Errorf("domainVerificationService.recheckDue: Query() failed: %v", err)
+		return
+	}
+
+	// Collect the domains before checking, so that the database connection isn't held during the checks
+	var proofs []*domainProof
+	for rows.Next() {
+		p := domainProof{}
+		if err := rows.Scan(&p.domain, &p.token, &p.verified, &p.pending); err != nil {
+			logger.Errorf("domainVerificationService.recheckDue: Scan() failed: %v", err)
+			_ = rows.Close()
+			return
+		}
+		proofs = append(proofs, &p)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("domainVerificationService.recheckDue: Next() failed: %v", err)
+	}
+	_ = rows.Close()
+
+	// Check the domains, one by one. Errors are already logged. If a pending domain's proof is missing, someone
+	// claiming the domain may have published theirs
+	for _, p := range proofs {
+		if verified, err := svc.checkAndRecord(p); err == nil && !verified && p.pending {
+			svc.checkClaims(p.domain)
+		}
+	}
+}
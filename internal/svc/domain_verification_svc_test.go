@@ -0,0 +1,92 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeTXTResolver is a TXTResolver serving records from a map, or failing every lookup if told to
+type fakeTXTResolver struct {
+	records map[string][]string
+	fail    bool
+}
+
+func (r *fakeTXTResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if r.fail {
+		return nil, errors.New("server misbehaving")
+	}
+	if rs, ok := r.records[name]; ok {
+		return rs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func Test_domainVerificationService_check(t *testing.T) {
+	const token = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	// Start a site serving the well-known file, unless it's told not to or to fail
+	fileContent := ""
+	siteFailing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if siteFailing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != domainVerifyWellKnownPath || fileContent == "" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(fileContent))
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	// Get an address nobody listens on
+	down := httptest.NewServer(http.NotFoundHandler())
+	downHost := down.Listener.Addr().String()
+	down.Close()
+
+	tests := []struct {
+		name    string
+		host    string
+		records []string
+		dnsFail bool
+		file    string
+		failing bool
+		want    bool
+		wantErr bool
+	}{
+		{"TXT record", host, []string{"v=spf1 -all", domainVerifyTXTPrefix + token}, false, "", false, true, false},
+		{"file", host, nil, false, token + "\n", false, true, false},
+		{"no proof", host, []string{"v=spf1 -all"}, false, "", false, false, false},
+		{"wrong TXT record", host, []string{domainVerifyTXTPrefix + "x"}, false, "", false, false, false},
+		{"wrong file", host, nil, false, "x", false, false, false},
+		{"file despite DNS failure", host, nil, true, token, false, true, false},
+		{"DNS failure", host, nil, true, "", false, false, true},
+		{"TXT record on a site down", downHost, []string{domainVerifyTXTPrefix + token}, false, "", false, true, false},
+		{"site down", downHost, nil, false, "", false, false, true},
+		{"TXT record on a site failing", host, []string{domainVerifyTXTPrefix + token}, false, "", true, true, false},
+		{"site failing", host, nil, false, token, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileContent = tt.file
+			siteFailing = tt.failing
+			hostname, _, _ := net.SplitHostPort(tt.host)
+			svc := NewDomainVerificationService(
+				&fakeTXTResolver{records: map[string][]string{hostname: tt.records}, fail: tt.dnsFail},
+				srv.Client()).(*domainVerificationService)
+			got, err := svc.check(tt.host, token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("check() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
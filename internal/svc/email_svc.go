@@ -3,6 +3,7 @@ package svc
 import (
 	"github.com/go-openapi/strfmt"
 	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/util"
 	"time"
@@ -11,7 +12,8 @@ import (
 // TheEmailService is a global EmailService implementation
 var TheEmailService EmailService = &emailService{}
 
-// EmailService is a service interface for dealing with email objects
+// EmailService is a service interface for dealing with email objects. Unsubscribe tokens are derived from the email
+// address, and only their keyed hashes are persisted
 type EmailService interface {
 	// Create creates and persists a new email instance
 	Create(email string) (*models.Email, error)
@@ -34,21 +36,15 @@ func (svc *emailService) Create(email string) (*models.Email, error) {
 	// Create a new Email instance
 	e := models.Email{
 		Email:                     strfmt.Email(email),
+		UnsubscribeSecretHex:      svc.unsubscribeToken(email),
 		LastEmailNotificationDate: strfmt.DateTime(time.Now().UTC()),
 	}
 
-	// Generate a random unsubscribe token
-	if token, err := data.RandomHexID(); err != nil {
-		return nil, err
-	} else {
-		e.UnsubscribeSecretHex = token
-	}
-
-	// Insert a new row
+	// Insert a new row, storing only the unsubscribe token's hash
 	err := db.Exec(
 		"insert into emails(email, unsubscribesecrethex, lastemailnotificationdate) values ($1, $2, $3) "+
 			"on conflict do nothing;",
-		e.Email, e.UnsubscribeSecretHex, e.LastEmailNotificationDate)
+		e.Email, hashToken(e.UnsubscribeSecretHex), e.LastEmailNotificationDate)
 	if err != nil {
 		logger.Errorf("emailService.Create: Exec() failed: %v", err)
 		return nil, translateDBErrors(err)
@@ -62,7 +58,7 @@ func (svc *emailService) FindByEmail(email string) (*models.Email, error) {
 
 	// Query the database row
 	row := db.QueryRow(
-		"select email, unsubscribesecrethex, lastemailnotificationdate, sendreplynotifications, sendmoderatornotifications "+
+		"select email, lastemailnotificationdate, sendreplynotifications, sendmoderatornotifications "+
 			"from emails "+
 			"where email=$1;",
 		email)
@@ -80,10 +76,10 @@ func (svc *emailService) FindByUnsubscribeToken(token models.HexID) (*models.Ema
 
 	// Query the database row
 	row := db.QueryRow(
-		"select email, unsubscribesecrethex, lastemailnotificationdate, sendreplynotifications, sendmoderatornotifications "+
+		"select email, lastemailnotificationdate, sendreplynotifications, sendmoderatornotifications "+
 			"from emails "+
 			"where unsubscribesecrethex=$1;",
-		token)
+		hashToken(token))
 
 	// Fetch the email
 	if e, err := svc.fetchEmail(row); err != nil {
@@ -102,7 +98,7 @@ func (svc *emailService) UpdateByEmailToken(email string, token models.HexID, se
 		sendReply,
 		sendModerator,
 		email,
-		token)
+		hashToken(token))
 	if err != nil {
 		logger.Errorf("emailService.UpdateByEmailToken: Exec() failed: %v", err)
 		return translateDBErrors(err)
@@ -115,9 +111,17 @@ func (svc *emailService) UpdateByEmailToken(email string, token models.HexID, se
 // fetchEmail returns a new Email instance from the provided database row
 func (svc *emailService) fetchEmail(s util.Scanner) (*models.Email, error) {
 	e := models.Email{}
-	if err := s.Scan(&e.Email, &e.UnsubscribeSecretHex, &e.LastEmailNotificationDate, &e.SendReplyNotifications, &e.SendModeratorNotifications); err != nil {
+	if err := s.Scan(&e.Email, &e.LastEmailNotificationDate, &e.SendReplyNotifications, &e.SendModeratorNotifications); err != nil {
 		logger.Errorf("emailService.fetchEmail: Scan() failed: %v", err)
 		return nil, err
 	}
+
+	// Only the hash of the unsubscribe token is stored, so reproduce the token itself
+	e.UnsubscribeSecretHex = svc.unsubscribeToken(string(e.Email))
 	return &e, nil
 }
+
+// unsubscribeToken returns the unsubscribe token for the given email address
+func (svc *emailService) unsubscribeToken(email string) models.HexID {
+	return data.UnsubscribeToken(config.SecretsConfig.TokenKey, email)
+}
@@ -0,0 +1,145 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"sync"
+)
+
+// TheEventService is a global EventService implementation
+var TheEventService EventService = &eventService{}
+
+// EventService is a service interface for publishing and subscribing to real-time comment events
+type EventService interface {
+	// Publish delivers an event of the given kind to all subscribers of the comment's domain and path, who are allowed to
+	// see the comment. commenter is the author of the comment, only required for the "new" and "approve" events
+	Publish(kind models.CommentEventKind, comment *models.Comment, commenter *models.Commenter)
+	// Subscribe subscribes the given (un)authenticated user to events on the given domain and path. Returns a channel
+	// delivering the events and a function that cancels the subscription and closes the channel
+	Subscribe(user *data.User, domain, path string) (<-chan *models.CommentEvent, func())
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// eventBufferSize is the number of events buffered per subscriber. Events that don't fit the buffer of a lagging
+// subscriber are dropped
+const eventBufferSize = 32
+
+// eventTopic identifies a page subscribers can subscribe to
+type eventTopic struct {
+	domain string
+	path   string
+}
+
+// eventSubscriber represents a single subscription to a topic
+type eventSubscriber struct {
+	user *data.User
+	ch   chan *models.CommentEvent
+}
+
+// eventService is a blueprint EventService implementation
+type eventService struct {
+	subs map[eventTopic]map[*eventSubscriber]bool
+	mu   sync.RWMutex
+}
+
+func (svc *eventService) Publish(kind models.CommentEventKind, comment *models.Comment, commenter *models.Commenter) {
+	logger.Debugf("eventService.Publish(%s, %s, ...)", kind, comment.CommentHex)
+
+	// Never leak the author's email
+	if commenter != nil {
+		cr := *commenter
+		cr.Email = ""
+		commenter = &cr
+	}
+
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	// Iterate the page's subscribers
+	for sub := range svc.subs[eventTopic{domain: comment.Domain, path: comment.Path}] {
+		// Skip subscribers who aren't supposed to see the comment
+		if !commentVisibleTo(comment, sub.user) {
+			continue
+		}
+
+		// Try to deliver the event without blocking
+		e := &models.CommentEvent{Kind: &kind, Comment: commentFor(comment, sub.user), Commenter: commenter}
+		select {
+		case sub.ch <- e:
+		default:
+			logger.Warningf("eventService.Publish: dropping %s event for a lagging subscriber [%s]", kind, sub.user.HexID)
+		}
+	}
+}
+
+func (svc *eventService) Subscribe(user *data.User, domain, path string) (<-chan *models.CommentEvent, func()) {
+	logger.Debugf("eventService.Subscribe([%s], %s, %s)", user.HexID, domain, path)
+
+	// Register a new subscriber
+	topic := eventTopic{domain: domain, path: path}
+	sub := &eventSubscriber{user: user, ch: make(chan *models.CommentEvent, eventBufferSize)}
+	svc.mu.Lock()
+	if svc.subs == nil {
+		svc.subs = make(map[eventTopic]map[*eventSubscriber]bool)
+	}
+	if svc.subs[topic] == nil {
+		svc.subs[topic] = make(map[*eventSubscriber]bool)
+	}
+	svc.subs[topic][sub] = true
+	svc.mu.Unlock()
+
+	// Make an unsubscribe function, which is safe to call multiple times
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			logger.Debugf("eventService: unsubscribing [%s] from %s, %s", user.HexID, domain, path)
+			svc.mu.Lock()
+			defer svc.mu.Unlock()
+			delete(svc.subs[topic], sub)
+			if len(svc.subs[topic]) == 0 {
+				delete(svc.subs, topic)
+			}
+			close(sub.ch)
+		})
+	}
+	return sub.ch, unsubscribe
+}
+
+// commentFor returns a copy of the comment, stripped of the properties the given user isn't supposed to see, following
+// the same rules as a comment list
+func commentFor(comment *models.Comment, user *data.User) *models.Comment {
+	c := *comment
+
+	// Direction is specific to each user, so it's never reported
+	c.Direction = 0
+
+	// Do not include the original markdown for anonymous and other commenters, unless it's a moderator
+	if user.IsAnonymous() || !user.IsModerator && user.HexID != c.CommenterHex {
+		c.Markdown = ""
+	}
+
+	// Also, do not report comment state and shadowing for non-moderators
+	if !user.IsModerator {
+		c.State = ""
+		c.Shadowed = false
+	}
+	return &c
+}
+
+// commentVisibleTo returns whether the given comment is visible to the given user. This is an in-memory counterpart of
+// commentVisibilityFilter()
+func commentVisibleTo(comment *models.Comment, user *data.User) bool {
+	switch {
+	// Moderators see everything
+	case user.IsModerator:
+		return true
+
+	// Anonymous commenter: only include approved, non-shadowed
+	case user.IsAnonymous():
+		return comment.State == models.CommentStateApproved && !comment.Shadowed
+	}
+
+	// Authenticated, non-moderator commenter: show only approved, non-shadowed, and all own comments
+	return comment.State == models.CommentStateApproved && !comment.Shadowed || comment.CommenterHex == user.HexID
+}
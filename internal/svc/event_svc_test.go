@@ -0,0 +1,118 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"testing"
+)
+
+func Test_eventService_Publish(t *testing.T) {
+	author := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000001"}
+	other := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000002"}
+	moderator := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000003", IsModerator: true}
+	tests := []struct {
+		name         string
+		user         *data.User
+		path         string
+		state        models.CommentState
+		wantEvent    bool
+		wantMarkdown bool
+		wantState    bool
+	}{
+		{"anonymous, approved   ", &data.AnonymousCommenter, "/", models.CommentStateApproved, true, false, false},
+		{"anonymous, unapproved ", &data.AnonymousCommenter, "/", models.CommentStateUnapproved, false, false, false},
+		{"author, unapproved    ", author, "/", models.CommentStateUnapproved, true, true, false},
+		{"other, approved       ", other, "/", models.CommentStateApproved, true, false, false},
+		{"other, flagged        ", other, "/", models.CommentStateFlagged, false, false, false},
+		{"moderator, flagged    ", moderator, "/", models.CommentStateFlagged, true, true, true},
+		{"moderator, other page ", moderator, "/other", models.CommentStateApproved, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &eventService{}
+			events, unsubscribe := svc.Subscribe(tt.user, "example.com", tt.path)
+			defer unsubscribe()
+
+			// Publish an event
+			svc.Publish(
+				models.CommentEventKindNew,
+				&models.Comment{
+					CommentHex:   "00000000000000000000000000000000000000000000000000000000000000aa",
+					CommenterHex: author.HexID,
+					Domain:       "example.com",
+					Path:         "/",
+					Markdown:     "Hi",
+					State:        tt.state,
+				},
+				&models.Commenter{CommenterHex: author.HexID, Email: "author@example.com"})
+
+			// Check the outcome
+			select {
+			case e := <-events:
+				if !tt.wantEvent {
+					t.Errorf("Publish() delivered an unexpected event")
+				} else if (e.Comment.Markdown != "") != tt.wantMarkdown {
+					t.Errorf("Publish() markdown = %q, want markdown %v", e.Comment.Markdown, tt.wantMarkdown)
+				} else if (e.Comment.State != "") != tt.wantState {
+					t.Errorf("Publish() state = %q, want state %v", e.Comment.State, tt.wantState)
+				} else if e.Commenter.Email != "" {
+					t.Errorf("Publish() leaked commenter email %q", e.Commenter.Email)
+				}
+			default:
+				if tt.wantEvent {
+					t.Errorf("Publish() didn't deliver an event")
+				}
+			}
+		})
+	}
+}
+
+func Test_eventService_Subscribe(t *testing.T) {
+	t.Run("unsubscribe", func(t *testing.T) {
+		svc := &eventService{}
+		events, unsubscribe := svc.Subscribe(&data.AnonymousCommenter, "example.com", "/")
+
+		// Unsubscribing twice must not panic
+		unsubscribe()
+		unsubscribe()
+
+		// The channel must be closed
+		if _, ok := <-events; ok {
+			t.Errorf("Subscribe() channel isn't closed after unsubscribe")
+		}
+
+		// The topic must be gone
+		if len(svc.subs) != 0 {
+			t.Errorf("Subscribe() left %d topic(s) after unsubscribe", len(svc.subs))
+		}
+	})
+}
+
+func Test_commentVisibleTo(t *testing.T) {
+	author := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000001"}
+	other := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000002"}
+	moderator := &data.User{HexID: "0000000000000000000000000000000000000000000000000000000000000003", IsModerator: true}
+	tests := []struct {
+		name     string
+		user     *data.User
+		state    models.CommentState
+		shadowed bool
+		want     bool
+	}{
+		{"anonymous, approved          ", &data.AnonymousCommenter, models.CommentStateApproved, false, true},
+		{"anonymous, approved, shadowed", &data.AnonymousCommenter, models.CommentStateApproved, true, false},
+		{"author, approved, shadowed   ", author, models.CommentStateApproved, true, true},
+		{"author, unapproved           ", author, models.CommentStateUnapproved, false, true},
+		{"other, approved, shadowed    ", other, models.CommentStateApproved, true, false},
+		{"other, unapproved            ", other, models.CommentStateUnapproved, false, false},
+		{"moderator, flagged, shadowed ", moderator, models.CommentStateFlagged, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &models.Comment{CommenterHex: author.HexID, State: tt.state, Shadowed: tt.shadowed}
+			if got := commentVisibleTo(c, tt.user); got != tt.want {
+				t.Errorf("commentVisibleTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
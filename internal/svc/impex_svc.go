@@ -184,9 +184,9 @@ func (svc *importExportService) ImportCommento(domain, dataURL string) (int64, e
 	// Check if imported commentedHex or email exists, creating a map of commenterHex (old hex, new hex)
 	commenterHex := map[models.HexID]models.HexID{data.AnonymousCommenter.HexID: data.AnonymousCommenter.HexID}
 	for _, commenter := range exp.Commenters {
-		// Try to find an existing commenter with the same email
-		if c, err := TheUserService.FindCommenterByIdPEmail("", string(commenter.Email), false); err == nil {
-			// Commenter already exists. Add its hex ID to the map and proceed to the next record
+		// Try to find an existing user with the same email
+		if c, err := TheUserService.FindUserByEmail(string(commenter.Email), false); err == nil {
+			// User already exists. Add its hex ID to the map and proceed to the next record
 			commenterHex[commenter.CommenterHex] = c.HexID
 			continue
 
@@ -202,11 +202,11 @@ func (svc *importExportService) ImportCommento(domain, dataURL string) (int64, e
 			return 0, util.ErrorInternal
 		}
 
-		// Persist a new commenter instance
-		if c, err := TheUserService.CreateCommenter(string(commenter.Email), commenter.Name, string(commenter.WebsiteURL), string(commenter.AvatarURL), "", string(randomPassword)); err != nil {
+		// Persist a new user instance
+		if c, err := TheUserService.CreateUser(string(commenter.Email), commenter.Name, string(commenter.WebsiteURL), string(commenter.AvatarURL), "", string(randomPassword), false); err != nil {
 			return 0, err
 		} else {
-			// Save the new commenter's hex ID in the map
+			// Save the new user's hex ID in the map
 			commenterHex[commenter.CommenterHex] = c.HexID
 		}
 	}
@@ -238,7 +238,7 @@ func (svc *importExportService) ImportCommento(domain, dataURL string) (int64, e
 			}
 
 			// Add a new comment record
-			newComment, err := TheCommentService.Create(cHex, domain, comment.Path, comment.Markdown, parentHex, comment.State, comment.CreationDate)
+			newComment, err := TheCommentService.Create(cHex, domain, comment.Path, comment.Markdown, parentHex, comment.State, false, comment.CreationDate)
 			if err != nil {
 				return count, err
 			}
@@ -301,9 +301,9 @@ func (svc *importExportService) ImportDisqus(domain, dataURL string) (int64, err
 			continue
 		}
 
-		// Try to find an existing commenter with this email
-		if c, err := TheUserService.FindCommenterByIdPEmail("", email, false); err == nil {
-			// Commenter already exists. Add its hex ID to the map and proceed to the next record
+		// Try to find an existing user with this email
+		if c, err := TheUserService.FindUserByEmail(email, false); err == nil {
+			// User already exists. Add its hex ID to the map and proceed to the next record
 			commenterHex[email] = c.HexID
 			continue
 		} else if err != ErrNotFound {
@@ -318,11 +318,11 @@ func (svc *importExportService) ImportDisqus(domain, dataURL string) (int64, err
 			return 0, util.ErrorInternal
 		}
 
-		// Persist a new commenter instance
-		if c, err := TheUserService.CreateCommenter(email, post.Author.Name, "", "", "", string(randomPassword)); err != nil {
+		// Persist a new user instance
+		if c, err := TheUserService.CreateUser(email, post.Author.Name, "", "", "", string(randomPassword), false); err != nil {
 			return 0, err
 		} else {
-			// Save the new commenter's hex ID in the map
+			// Save the new user's hex ID in the map
 			commenterHex[email] = c.HexID
 		}
 	}
@@ -364,6 +364,7 @@ func (svc *importExportService) ImportDisqus(domain, dataURL string) (int64, err
 			html2md.Convert(post.Message),
 			parentHex,
 			models.CommentStateApproved,
+			false,
 			strfmt.DateTime(post.CreationDate))
 		if err != nil {
 			return count, err
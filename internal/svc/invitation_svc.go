@@ -0,0 +1,205 @@
+package svc
+
+import (
+	"database/sql"
+	"github.com/go-openapi/strfmt"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"strings"
+	"time"
+)
+
+// TheInvitationService is a global InvitationService implementation
+var TheInvitationService InvitationService = &invitationService{}
+
+// InvitationService is a service interface for dealing with emailed invitations to take a role in a domain
+type InvitationService interface {
+	// Accept accepts the pending invitation with the given token on behalf of the given user, granting them the role
+	// in the domain. Returns the domain and the role. Returns ErrNotFound if there's no such pending invitation or it's
+	// expired, and util.ErrorInvitationEmail if the invitation was sent to a different email
+	Accept(token models.HexID, user *data.User) (string, models.DomainRole, error)
+	// Create creates and persists a new pending invitation of the given email to take the specified role in the
+	// domain. Returns the invitation's token
+	Create(domain, email string, role models.DomainRole, inviterID models.HexID) (models.HexID, error)
+	// ListByDomain returns a list of all invitations in the given domain, the most recent first
+	ListByDomain(domain string) ([]*models.DomainInvitation, error)
+	// Revoke revokes the pending invitation with the given hex ID in the given domain. Returns ErrNotFound if there's
+	// no such pending invitation
+	Revoke(domain string, invitationHex models.HexID) error
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// invitationService is a blueprint InvitationService implementation
+type invitationService struct{}
+
+func (svc *invitationService) Accept(token models.HexID, user *data.User) (string, models.DomainRole, error) {
+	logger.Debugf("invitationService.Accept(%s, [%s])", token, user.HexID)
+
+	// Create an email record for the user, needed for notifications
+	if _, err := TheEmailService.Create(user.Email); err != nil {
+		return "", "", err
+	}
+
+	// Mark the invitation accepted and grant the role in a single statement, so that a concurrent revocation either
+	// prevents both or neither. Only the invited person can accept the invitation
+	now := time.Now().UTC()
+	var domain string
+	var role models.DomainRole
+	err := db.QueryRow(
+		"with i as ("+
+			"update domaininvitations set status=$1, statusdate=$2 "+
+			"where tokenhash=$3 and status=$4 and creationdate>=$5 and lower(email)=lower($6) "+
+			"returning domain, role), "+
+			"u as (insert into domainusers(domain, userhex, role, adddate) select domain, $7, role, $2 from i "+
+			"on conflict do nothing) "+
+			"select domain, role from i;",
+		models.InvitationStatusAccepted, now, hashToken(token), models.InvitationStatusPending,
+		now.Add(-util.InvitationTTL), user.Email, user.HexID).
+		Scan(&domain, &role)
+	if err == sql.ErrNoRows {
+		// Find out why the invitation couldn't be accepted
+		return "", "", svc.acceptError(token, user, now)
+	} else if err != nil {
+		logger.Errorf("invitationService.Accept: Scan() failed: %v", err)
+		return "", "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return domain, role, nil
+}
+
+func (svc *invitationService) Create(domain, email string, role models.DomainRole, inviterID models.HexID) (models.HexID, error) {
+	logger.Debugf("invitationService.Create(%s, %s, %s, %s)", domain, email, role, inviterID)
+
+	// Generate a new random token and invitation hex ID
+	token, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("invitationService.Create: RandomHexID() failed: %v", err)
+		return "", err
+	}
+	invitationHex, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("invitationService.Create: RandomHexID() failed: %v", err)
+		return "", err
+	}
+
+	// Insert a new record, storing only the token's hash
+	err = db.Exec(
+		"insert into domaininvitations(invitationhex, tokenhash, domain, email, role, inviterhex, creationdate, status) "+
+			"values($1, $2, $3, $4, $5, $6, $7, $8);",
+		invitationHex, hashToken(token), domain, email, role, inviterID, time.Now().UTC(), models.InvitationStatusPending)
+	if err != nil {
+		logger.Errorf("invitationService.Create: Exec() failed: %v", err)
+		return "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return token, nil
+}
+
+func (svc *invitationService) ListByDomain(domain string) ([]*models.DomainInvitation, error) {
+	logger.Debugf("invitationService.ListByDomain(%s)", domain)
+
+	// Query the domain's invitations
+	rows, err := db.Query(
+		"select invitationhex, email, role, status, creationdate, statusdate "+
+			"from domaininvitations "+
+			"where domain=$1 "+
+			"order by creationdate desc;",
+		domain)
+	if err != nil {
+		logger.Errorf("invitationService.ListByDomain: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the invitations
+	res := []*models.DomainInvitation{}
+	now := time.Now().UTC()
+	for rows.Next() {
+		i := models.DomainInvitation{}
+		var created time.Time
+		var statusDate sql.NullTime
+		if err := rows.Scan(&i.InvitationHex, &i.Email, &i.Role, &i.Status, &created, &statusDate); err != nil {
+			logger.Errorf("invitationService.ListByDomain: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		expires := created.Add(util.InvitationTTL)
+		i.CreationDate = strfmt.DateTime(created)
+		i.ExpiryDate = strfmt.DateTime(expires)
+		if statusDate.Valid {
+			i.StatusDate = strfmt.DateTime(statusDate.Time)
+		}
+
+		// A pending invitation that's no longer valid is reported as expired
+		if i.Status == models.InvitationStatusPending && now.After(expires) {
+			i.Status = models.InvitationStatusExpired
+		}
+		res = append(res, &i)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("invitationService.ListByDomain: Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *invitationService) Revoke(domain string, invitationHex models.HexID) error {
+	logger.Debugf("invitationService.Revoke(%s, %s)", domain, invitationHex)
+
+	// Update the record
+	res, err := db.ExecRes(
+		"update domaininvitations set status=$1, statusdate=$2 where domain=$3 and invitationhex=$4 and status=$5;",
+		models.InvitationStatusRevoked, time.Now().UTC(), domain, invitationHex, models.InvitationStatusPending)
+	if err != nil {
+		logger.Errorf("invitationService.Revoke: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+// acceptError returns the error explaining why the invitation with the given token couldn't be accepted by the user
+func (svc *invitationService) acceptError(token models.HexID, user *data.User, now time.Time) error {
+	var email string
+	var status models.InvitationStatus
+	var created time.Time
+	err := db.QueryRow(
+		"select email, status, creationdate from domaininvitations where tokenhash=$1;",
+		hashToken(token)).
+		Scan(&email, &status, &created)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		logger.Errorf("invitationService.acceptError: Scan() failed: %v", err)
+		return translateDBErrors(err)
+	}
+	if err := invitationAcceptError(email, status, created, user.Email, now); err != nil {
+		return err
+	}
+
+	// The invitation has been concurrently accepted or revoked
+	return ErrNotFound
+}
+
+// invitationAcceptError returns the error explaining why an invitation with the given email, status, and creation date
+// can't be accepted by the user with the given email at the given moment, or nil if it can
+func invitationAcceptError(email string, status models.InvitationStatus, created time.Time, userEmail string, now time.Time) error {
+	switch {
+	// A revoked, already accepted, or expired invitation is as good as none
+	case status != models.InvitationStatusPending, now.After(created.Add(util.InvitationTTL)):
+		return ErrNotFound
+
+	// Only the invited person can accept the invitation
+	case !strings.EqualFold(email, userEmail):
+		return util.ErrorInvitationEmail
+	}
+	return nil
+}
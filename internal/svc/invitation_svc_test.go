@@ -0,0 +1,39 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/util"
+	"testing"
+	"time"
+)
+
+func Test_invitationAcceptError(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	fresh := now.Add(-time.Hour)
+	expired := now.Add(-util.InvitationTTL - time.Second)
+	tests := []struct {
+		name      string
+		email     string
+		status    models.InvitationStatus
+		created   time.Time
+		userEmail string
+		want      error
+	}{
+		{"pending        ", "mod@example.com", models.InvitationStatusPending, fresh, "mod@example.com", nil},
+		{"email case     ", "Mod@Example.com", models.InvitationStatusPending, fresh, "mod@example.com", nil},
+		{"last moment    ", "mod@example.com", models.InvitationStatusPending, now.Add(-util.InvitationTTL), "mod@example.com", nil},
+		{"expired        ", "mod@example.com", models.InvitationStatusPending, expired, "mod@example.com", ErrNotFound},
+		{"email mismatch ", "mod@example.com", models.InvitationStatusPending, fresh, "other@example.com", util.ErrorInvitationEmail},
+		{"expired, other ", "mod@example.com", models.InvitationStatusPending, expired, "other@example.com", ErrNotFound},
+		{"revoked        ", "mod@example.com", models.InvitationStatusRevoked, fresh, "mod@example.com", ErrNotFound},
+		{"revoked, other ", "mod@example.com", models.InvitationStatusRevoked, fresh, "other@example.com", ErrNotFound},
+		{"accepted       ", "mod@example.com", models.InvitationStatusAccepted, fresh, "mod@example.com", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := invitationAcceptError(tt.email, tt.status, tt.created, tt.userEmail, now); got != tt.want {
+				t.Errorf("invitationAcceptError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package svc
+
+import (
+	"database/sql"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"time"
+)
+
+// TheMagicLinkService is a global MagicLinkService implementation
+var TheMagicLinkService MagicLinkService = &magicLinkService{}
+
+// MagicLinkService is a service interface for dealing with emailed one-time sign-in links
+type MagicLinkService interface {
+	// Bind binds the sign-in link requested with the given request token to the browser holding the given nonce, and
+	// returns the email to send the link to and the link's token. A request token can only be used once. Returns
+	// ErrNotFound if there's no such unbound request, or it's expired
+	Bind(requestToken, nonce models.HexID) (string, models.HexID, error)
+	// Create creates and persists a new sign-in link request for the given email and name, which signs the session
+	// with the given token in once bound with Bind() and used in the same browser. Returns the request token, or
+	// ErrNotFound if there's no such session
+	Create(email, name string, sessionToken models.HexID) (models.HexID, error)
+	// Take removes the sign-in link with the given token and nonce, and returns the email, the name, and the hex ID of
+	// the session it was created for. Returns ErrNotFound if there's no such link, it's expired, or its nonce is
+	// different
+	Take(token, nonce models.HexID) (string, string, models.HexID, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// magicLinkService is a blueprint MagicLinkService implementation
+type magicLinkService struct{}
+
+func (svc *magicLinkService) Bind(requestToken, nonce models.HexID) (string, models.HexID, error) {
+	logger.Debugf("magicLinkService.Bind(%s, %s)", requestToken, nonce)
+
+	// Generate a new random token for the link itself
+	token, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("magicLinkService.Bind: RandomHexID() failed: %v", err)
+		return "", "", err
+	}
+
+	// Replace the request token with the link's one, so that the request token can't be used again
+	var email string
+	err = db.QueryRow(
+		"update magiclinks set token=$1, nonce=$2 where token=$3 and nonce='' and creationdate>=$4 returning email;",
+		hashToken(token), hashToken(nonce), hashToken(requestToken), time.Now().UTC().Add(-util.MagicLinkTTL)).
+		Scan(&email)
+	if err != nil {
+		// Do not log "not found" errors
+		if err != sql.ErrNoRows {
+			logger.Errorf("magicLinkService.Bind: Scan() failed: %v", err)
+		}
+		return "", "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return email, token, nil
+}
+
+func (svc *magicLinkService) Create(email, name string, sessionToken models.HexID) (models.HexID, error) {
+	logger.Debugf("magicLinkService.Create(%s, %s, %s)", email, name, sessionToken)
+
+	// Generate a new random request token
+	requestToken, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("magicLinkService.Create: RandomHexID() failed: %v", err)
+		return "", err
+	}
+
+	// Insert a new record, storing only hashes of the secrets. The session is referred to by its public ID. The link
+	// isn't bound to any browser yet
+	res, err := db.ExecRes(
+		"insert into magiclinks(token, email, name, sessionhex, nonce, creationdate) "+
+			"select $1, $2, $3, sessionhex, '', $4 from usersessions where token=$5;",
+		hashToken(requestToken), email, name, time.Now().UTC(), hashToken(sessionToken))
+	if err != nil {
+		logger.Errorf("magicLinkService.Create: ExecRes() failed: %v", err)
+		return "", translateDBErrors(err)
+	}
+	if err := checkRowsAffected(res); err != nil {
+		return "", err
+	}
+
+	// Succeeded
+	return requestToken, nil
+}
+
+func (svc *magicLinkService) Take(token, nonce models.HexID) (string, string, models.HexID, error) {
+	logger.Debugf("magicLinkService.Take(%s, %s)", token, nonce)
+
+	// Remove the link, which can only be used once
+	var email, name string
+	var sessionHex models.HexID
+	err := db.QueryRow(
+		"delete from magiclinks where token=$1 and nonce=$2 and nonce<>'' and creationdate>=$3 "+
+			"returning email, name, sessionhex;",
+		hashToken(token), hashToken(nonce), time.Now().UTC().Add(-util.MagicLinkTTL)).
+		Scan(&email, &name, &sessionHex)
+	if err != nil {
+		// Do not log "not found" errors
+		if err != sql.ErrNoRows {
+			logger.Errorf("magicLinkService.Take: Scan() failed: %v", err)
+		}
+		return "", "", "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return email, name, sessionHex, nil
+}
@@ -1,6 +1,7 @@
 package svc
 
 import (
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/persistence"
 )
 
@@ -68,6 +69,25 @@ func (m *manager) Initialise() {
 		logger.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Keep rate limits in the database, if configured
+	if config.CLIFlags.RateLimitStore == "postgres" {
+		TheRateLimitService = &dbRateLimitService{}
+	}
+
+	// Make the configured user an instance superuser, if any
+	if email := config.CLIFlags.Superuser; email != "" {
+		if err = TheAdminService.BootstrapSuperuser(email); err == ErrNotFound {
+			logger.Warningf("Cannot make %s a superuser: no user with that email confirmed", email)
+		} else if err != nil {
+			logger.Fatalf("Failed to bootstrap superuser: %v", err)
+		}
+	}
+
+	// Load the password policy
+	if err = ThePasswordService.Init(); err != nil {
+		logger.Fatalf("Failed to initialise password service: %v", err)
+	}
+
 	// Start the cleanup service
 	if err = TheCleanupService.Init(); err != nil {
 		logger.Fatalf("Failed to initialise cleanup service: %v", err)
@@ -75,6 +95,12 @@ func (m *manager) Initialise() {
 
 	// Start the version service
 	TheVersionCheckService.Init()
+
+	// Start the webhook delivery
+	TheWebhookService.Init()
+
+	// Start the domain ownership rechecks
+	TheDomainVerificationService.Init()
 }
 
 func (m *manager) Shutdown() {
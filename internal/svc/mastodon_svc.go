@@ -0,0 +1,170 @@
+package svc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/mastodon"
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/util"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TheMastodonService is a global MastodonService implementation
+var TheMastodonService MastodonService = &mastodonService{failures: map[string]time.Time{}}
+
+// MastodonService is a service interface for dealing with Mastodon-compatible identity providers
+type MastodonService interface {
+	// Provider returns a provider for signing in via the Mastodon-compatible instance with the given host name. A
+	// client app gets registered with the instance on first use, and its credentials are reused afterwards. Returns
+	// util.ErrorInvalidMastodonInstance if the host name isn't valid. A failed registration isn't retried for a while
+	Provider(instance string) (goth.Provider, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	mastodonScope        = "read:accounts" // Scope requested from instances, sufficient to fetch the user's account
+	mastodonMaxRespBytes = 64 * 1024       // Max size of an app registration response
+	mastodonFailureTTL   = 5 * time.Minute // How long a failed app registration is remembered, and not retried for
+	mastodonMaxFailures  = 1000            // Max number of failed registrations remembered at a time
+)
+
+// mastodonClient is an HTTP client used to talk to Mastodon instances. Instances are entered by users, so the client
+// refuses to connect to internal addresses
+var mastodonClient = util.NewPublicHTTPClient(10 * time.Second)
+
+// mastodonService is a blueprint MastodonService implementation
+type mastodonService struct {
+	failures   map[string]time.Time // Times of recent failed app registrations, by instance
+	failuresMu sync.Mutex           // Mutex guarding failures
+}
+
+func (svc *mastodonService) Provider(instance string) (goth.Provider, error) {
+	logger.Debugf("mastodonService.Provider(%s)", instance)
+
+	// Validate the instance: it must be a fully qualified host name, not an IP address
+	if !util.IsValidHostname(instance) || !strings.Contains(instance, ".") || net.ParseIP(instance) != nil {
+		return nil, util.ErrorInvalidMastodonInstance
+	}
+
+	// Find the app registered with the instance, registering one if there's none yet
+	callbackURL := config.URLForAPI("oauth/"+util.MastodonIdPPrefix+instance+"/callback", nil)
+	clientID, clientSecret, err := svc.findApp(instance)
+	if err == ErrNotFound {
+		// Don't bother an instance that has recently failed to register an app, or doesn't exist at all
+		if svc.failedRecently(instance, time.Now()) {
+			return nil, fmt.Errorf("failed to register with %s", instance)
+		}
+		if clientID, clientSecret, err = svc.registerApp(instance, callbackURL); err != nil {
+			svc.recordFailure(instance, time.Now())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Succeeded
+	p := mastodon.NewCustomisedURL(clientID, clientSecret, callbackURL, "https://"+instance+"/", mastodonScope)
+	p.SetName(util.MastodonIdPPrefix + instance)
+	p.HTTPClient = mastodonClient
+	return p, nil
+}
+
+// failedRecently returns whether an app registration with the given instance has failed less than mastodonFailureTTL
+// before the given time
+func (svc *mastodonService) failedRecently(instance string, now time.Time) bool {
+	svc.failuresMu.Lock()
+	defer svc.failuresMu.Unlock()
+	t, ok := svc.failures[instance]
+	return ok && now.Sub(t) < mastodonFailureTTL
+}
+
+// findApp returns the client ID and secret of the app registered with the given instance
+func (svc *mastodonService) findApp(instance string) (string, string, error) {
+	var clientID, clientSecret string
+	err := db.QueryRow("select clientid, clientsecret from mastodonapps where instance=$1;", instance).
+		Scan(&clientID, &clientSecret)
+	if err != nil {
+		// Do not log "not found" errors
+		if err != sql.ErrNoRows {
+			logger.Errorf("mastodonService.findApp: Scan() failed: %v", err)
+		}
+		return "", "", translateDBErrors(err)
+	}
+	return clientID, clientSecret, nil
+}
+
+// recordFailure remembers that an app registration with the given instance has failed at the given time. Expired
+// failures are forgotten along the way, and so is everything else once there are too many of them
+func (svc *mastodonService) recordFailure(instance string, now time.Time) {
+	svc.failuresMu.Lock()
+	defer svc.failuresMu.Unlock()
+	for i, t := range svc.failures {
+		if now.Sub(t) >= mastodonFailureTTL {
+			delete(svc.failures, i)
+		}
+	}
+	if len(svc.failures) >= mastodonMaxFailures {
+		svc.failures = map[string]time.Time{}
+	}
+	svc.failures[instance] = now
+}
+
+// registerApp registers a new client app with the given instance, persists its credentials, and returns the client ID
+// and secret
+func (svc *mastodonService) registerApp(instance, callbackURL string) (string, string, error) {
+	logger.Infof("Registering a client app with Mastodon instance %s", instance)
+
+	// Submit a registration request
+	resp, err := mastodonClient.PostForm(
+		"https://"+instance+"/api/v1/apps",
+		url.Values{
+			"client_name":   {"Comentario"},
+			"redirect_uris": {callbackURL},
+			"scopes":        {mastodonScope},
+			"website":       {config.BaseURL.String()},
+		})
+	if err != nil {
+		logger.Warningf("mastodonService.registerApp: PostForm() failed: %v", err)
+		return "", "", fmt.Errorf("failed to register with %s", instance)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Warningf("mastodonService.registerApp: %s responded with status %d", instance, resp.StatusCode)
+		return "", "", fmt.Errorf("failed to register with %s", instance)
+	}
+
+	// Parse the response
+	var app struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, mastodonMaxRespBytes)).Decode(&app); err != nil {
+		logger.Warningf("mastodonService.registerApp: Decode() failed: %v", err)
+		return "", "", fmt.Errorf("failed to register with %s", instance)
+	} else if app.ClientID == "" || app.ClientSecret == "" {
+		logger.Warningf("mastodonService.registerApp: %s returned no client credentials", instance)
+		return "", "", fmt.Errorf("failed to register with %s", instance)
+	}
+
+	// Persist the app. If another app got registered concurrently, the first one wins
+	err = db.Exec(
+		"insert into mastodonapps(instance, clientid, clientsecret, creationdate) values($1, $2, $3, $4) "+
+			"on conflict (instance) do nothing;",
+		instance, app.ClientID, app.ClientSecret, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("mastodonService.registerApp: Exec() failed: %v", err)
+		return "", "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return svc.findApp(instance)
+}
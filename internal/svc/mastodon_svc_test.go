@@ -0,0 +1,38 @@
+package svc
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_mastodonService_failedRecently(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	svc := &mastodonService{failures: map[string]time.Time{}}
+	svc.recordFailure("failed.example.com", now)
+	svc.recordFailure("expired.example.com", now.Add(-mastodonFailureTTL))
+	tests := []struct {
+		name     string
+		instance string
+		at       time.Time
+		want     bool
+	}{
+		{"never failed      ", "mastodon.social", now, false},
+		{"just failed       ", "failed.example.com", now, true},
+		{"failed a while ago", "failed.example.com", now.Add(mastodonFailureTTL - time.Second), true},
+		{"failure expired   ", "failed.example.com", now.Add(mastodonFailureTTL), false},
+		{"expired earlier   ", "expired.example.com", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := svc.failedRecently(tt.instance, tt.at); got != tt.want {
+				t.Errorf("failedRecently() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Expired failures are forgotten when recording a new one
+	svc.recordFailure("other.example.com", now)
+	if _, ok := svc.failures["expired.example.com"]; ok {
+		t.Errorf("recordFailure() kept an expired failure")
+	}
+}
@@ -0,0 +1,175 @@
+package svc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// ThePasswordService is a global PasswordService implementation
+var ThePasswordService PasswordService = &passwordService{}
+
+// PasswordService is a service interface for hashing passwords and enforcing the password policy
+type PasswordService interface {
+	// CheckPolicy verifies the given password complies with the password policy. Returns util.ErrorPasswordTooShort or
+	// util.ErrorPasswordBreached if it doesn't
+	CheckPolicy(password string) error
+	// Hash returns an argon2id hash of the given password, computed with the configured cost
+	Hash(password string) (string, error)
+	// Init loads the breached password list, if one is configured
+	Init() error
+	// Verify returns whether the given password matches the given (argon2id or legacy bcrypt) hash, and if so, whether
+	// the hash is outdated and should be replaced with a fresh one
+	Verify(hash, password string) (bool, bool)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	argon2SaltLen   = 16      // Length of the random salt, in bytes
+	argon2KeyLen    = 32      // Length of the derived key, in bytes
+	argon2MaxKeyLen = 64      // Max length of the derived key in a hash to verify, in bytes
+	argon2MaxMemory = 1 << 20 // Max memory cost, in KiB (1 GiB)
+	argon2MaxTime   = 16      // Max time cost (passes)
+)
+
+// passwordService is a blueprint PasswordService implementation
+type passwordService struct {
+	breached map[string]struct{} // Set of known breached passwords
+}
+
+func (svc *passwordService) CheckPolicy(password string) error {
+	// Check the length, in characters
+	if utf8.RuneCountInString(password) < config.CLIFlags.PwdMinLength {
+		return util.ErrorPasswordTooShort
+	}
+
+	// Check against the breached password list
+	if _, ok := svc.breached[password]; ok {
+		return util.ErrorPasswordBreached
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *passwordService) Hash(password string) (string, error) {
+	// Generate a random salt
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		logger.Errorf("passwordService.Hash: rand.Read() failed: %v", err)
+		return "", err
+	}
+
+	// Hash the password and encode the result in the PHC string format
+	m, t, p := svc.argon2Params()
+	key := argon2.IDKey([]byte(password), salt, t, m, p, argon2KeyLen)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, m, t, p, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func (svc *passwordService) Init() error {
+	logger.Debug("passwordService.Init()")
+
+	// Skip if there's no breached password list
+	fileName := config.CLIFlags.BreachedPwdFile
+	if fileName == "" {
+		return nil
+	}
+
+	// Read in the list, one password per line
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to open breached password list: %v", err)
+	}
+	defer f.Close()
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if s := strings.TrimRight(scanner.Text(), "\r"); s != "" {
+			breached[s] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read breached password list: %v", err)
+	}
+
+	// Succeeded
+	svc.breached = breached
+	logger.Infof("Loaded %d breached passwords from %s", len(breached), fileName)
+	return nil
+}
+
+func (svc *passwordService) Verify(hash, password string) (bool, bool) {
+	// Hashes not in the argon2id format are legacy bcrypt ones, which always need an upgrade
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, true
+	}
+
+	// Parse the hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	var version int
+	var m, t uint32
+	var p uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil || !argon2ParamsValid(m, t, p) {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > argon2MaxKeyLen {
+		return false, false
+	}
+
+	// Hash the password with the same parameters and compare the results
+	if subtle.ConstantTimeCompare(argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key))), key) != 1 {
+		return false, false
+	}
+
+	// The password matches. The hash is outdated if the cost has been reconfigured since
+	cm, ct, cp := svc.argon2Params()
+	return true, m != cm || t != ct || p != cp || len(key) != argon2KeyLen
+}
+
+// argon2Params returns the configured argon2id memory (in KiB), time, and parallelism cost parameters, forcing them
+// into a valid range
+func (svc *passwordService) argon2Params() (uint32, uint32, uint8) {
+	m, t, p := config.CLIFlags.Argon2Memory, config.CLIFlags.Argon2Time, config.CLIFlags.Argon2Threads
+	if t < 1 {
+		t = 1
+	} else if t > argon2MaxTime {
+		t = argon2MaxTime
+	}
+	if p < 1 {
+		p = 1
+	}
+	if m < 8*uint32(p) {
+		m = 8 * uint32(p)
+	} else if m > argon2MaxMemory {
+		m = argon2MaxMemory
+	}
+	return m, t, p
+}
+
+// argon2ParamsValid returns whether the given argon2id memory (in KiB), time, and parallelism cost parameters are in
+// the range argon2Params() produces. Hashes with others are either malformed or made to exhaust the server
+func argon2ParamsValid(m, t uint32, p uint8) bool {
+	return t >= 1 && t <= argon2MaxTime && p >= 1 && m >= 8*uint32(p) && m <= argon2MaxMemory
+}
@@ -0,0 +1,80 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/util"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func Test_passwordService_CheckPolicy(t *testing.T) {
+	config.CLIFlags.PwdMinLength = 8
+	svc := &passwordService{breached: map[string]struct{}{"password123": {}}}
+	tests := []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"empty", "", util.ErrorPasswordTooShort},
+		{"too short", "1234567", util.ErrorPasswordTooShort},
+		{"multibyte short", "пароль!", util.ErrorPasswordTooShort},
+		{"breached", "password123", util.ErrorPasswordBreached},
+		{"min length", "12345678", nil},
+		{"multibyte OK", "пароль!!", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := svc.CheckPolicy(tt.password); err != tt.wantErr {
+				t.Errorf("CheckPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_passwordService_Verify(t *testing.T) {
+	config.CLIFlags.Argon2Memory, config.CLIFlags.Argon2Time, config.CLIFlags.Argon2Threads = 64, 1, 1
+	svc := &passwordService{}
+
+	// Produce hashes to verify against
+	argonHash, err := svc.Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash() failed: %v", err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		hash         string
+		password     string
+		memory       uint32
+		wantOK       bool
+		wantOutdated bool
+	}{
+		{"argon2id match", argonHash, "secret", 64, true, false},
+		{"argon2id mismatch", argonHash, "Secret", 64, false, false},
+		{"argon2id cost changed", argonHash, "secret", 128, true, true},
+		{"bcrypt match", string(bcryptHash), "secret", 64, true, true},
+		{"bcrypt mismatch", string(bcryptHash), "Secret", 64, false, true},
+		{"empty hash", "", "secret", 64, false, true},
+		{"malformed argon2id params", "$argon2id$v=19$m=x$c2FsdA$a2V5", "secret", 64, false, false},
+		{"zero argon2id time", "$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5", "secret", 64, false, false},
+		{"excessive argon2id time", "$argon2id$v=19$m=64,t=1000000,p=1$c2FsdA$a2V5", "secret", 64, false, false},
+		{"too little argon2id memory", "$argon2id$v=19$m=1,t=1,p=1$c2FsdA$a2V5", "secret", 64, false, false},
+		{"excessive argon2id memory", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5", "secret", 64, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.CLIFlags.Argon2Memory = tt.memory
+			gotOK, gotOutdated := svc.Verify(tt.hash, tt.password)
+			if gotOK != tt.wantOK {
+				t.Errorf("Verify() got ok = %v, want %v", gotOK, tt.wantOK)
+			}
+			if gotOK && gotOutdated != tt.wantOutdated {
+				t.Errorf("Verify() got outdated = %v, want %v", gotOutdated, tt.wantOutdated)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/config"
+	"math"
+	"sync"
+	"time"
+)
+
+// TheRateLimitService is a global RateLimitService implementation. It keeps the counters in memory unless replaced with
+// a Postgres-backed one on initialisation
+var TheRateLimitService RateLimitService = &memoryRateLimitService{buckets: map[string]*rateLimitBucket{}}
+
+// RateLimitService is a service interface for request rate limiting
+type RateLimitService interface {
+	// Allow takes a request from the token bucket identified by the given key and having the given quota. Returns
+	// whether the request is allowed and, if it isn't, how long to wait before retrying
+	Allow(key string, limit *config.RateLimit) (bool, time.Duration, error)
+}
+
+// rateLimitSweepInterval is how often idle buckets are discarded by the in-memory service
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitBucket is a token bucket
+type rateLimitBucket struct {
+	tokens  float64   // Number of requests left
+	updated time.Time // When the bucket was last updated
+	full    time.Time // When the bucket will be full again, if nothing is taken from it
+}
+
+// take refills the bucket according to the time elapsed since its last update and tries to take a single request from
+// it. Returns whether the request is allowed and, if it isn't, how long to wait before retrying
+func (b *rateLimitBucket) take(limit *config.RateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = rateLimitRefill(b.tokens, now.Sub(b.updated), limit)
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) * float64(limit.Period)))
+	return allowed, rateLimitWait(allowed, b.tokens, limit)
+}
+
+// rateLimitRefill returns the number of tokens in a bucket after the given time has elapsed
+func rateLimitRefill(tokens float64, elapsed time.Duration, limit *config.RateLimit) float64 {
+	if elapsed > 0 && limit.Period > 0 {
+		tokens += float64(elapsed) / float64(limit.Period)
+	}
+	return math.Min(tokens, float64(limit.Burst))
+}
+
+// rateLimitWait returns how long it takes for a denied request to be allowed again, given the number of tokens left in
+// the bucket
+func rateLimitWait(allowed bool, tokens float64, limit *config.RateLimit) time.Duration {
+	if allowed {
+		return 0
+	}
+	return time.Duration((1 - tokens) * float64(limit.Period))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// memoryRateLimitService is a RateLimitService implementation that keeps buckets in memory, hence is only suitable for
+// a single instance of the server
+type memoryRateLimitService struct {
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func (svc *memoryRateLimitService) Allow(key string, limit *config.RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	// Periodically discard buckets that have been refilled, as they're no different from new ones
+	if now.Sub(svc.lastSweep) > rateLimitSweepInterval {
+		for k, b := range svc.buckets {
+			if !now.Before(b.full) {
+				delete(svc.buckets, k)
+			}
+		}
+		svc.lastSweep = now
+	}
+
+	// Find or create a bucket and take a request from it
+	b, ok := svc.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{tokens: float64(limit.Burst), updated: now}
+		svc.buckets[key] = b
+	}
+	allowed, wait := b.take(limit, now)
+	return allowed, wait, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// dbRateLimitService is a RateLimitService implementation that keeps buckets in the database, which makes it suitable
+// for multiple server instances sharing the same database
+type dbRateLimitService struct{}
+
+func (svc *dbRateLimitService) Allow(key string, limit *config.RateLimit) (bool, time.Duration, error) {
+	// Refill the bucket and take a request from it in a single atomic statement
+	var allowed bool
+	var tokens float64
+	err := db.QueryRow(
+		"insert into ratelimits(key, tokens, allowed, updated) values($1, $2-1, $2>=1, $3) "+
+			"on conflict (key) do update set "+
+			"tokens=least($2, ratelimits.tokens+greatest(extract(epoch from $3-ratelimits.updated), 0)/$4) - "+
+			"case when least($2, ratelimits.tokens+greatest(extract(epoch from $3-ratelimits.updated), 0)/$4)>=1 then 1 else 0 end, "+
+			"allowed=least($2, ratelimits.tokens+greatest(extract(epoch from $3-ratelimits.updated), 0)/$4)>=1, "+
+			"updated=greatest(ratelimits.updated, $3) "+
+			"returning allowed, tokens;",
+		key, float64(limit.Burst), time.Now().UTC(), limit.Period.Seconds()).
+		Scan(&allowed, &tokens)
+	if err != nil {
+		logger.Errorf("dbRateLimitService.Allow: QueryRow() failed: %v", err)
+		return false, 0, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return allowed, rateLimitWait(allowed, tokens, limit), nil
+}
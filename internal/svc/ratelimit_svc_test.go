@@ -0,0 +1,70 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/config"
+	"testing"
+	"time"
+)
+
+func Test_memoryRateLimitService_Allow(t *testing.T) {
+	limit := &config.RateLimit{Burst: 2, Period: time.Hour}
+	svc := &memoryRateLimitService{buckets: map[string]*rateLimitBucket{}}
+	tests := []struct {
+		name        string
+		key         string
+		wantAllowed bool
+	}{
+		{"first request  ", "a", true},
+		{"second request ", "a", true},
+		{"burst exceeded ", "a", false},
+		{"another key    ", "b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, wait, err := svc.Allow(tt.key, limit)
+			if err != nil {
+				t.Errorf("Allow() error = %v", err)
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("Allow() allowed = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if allowed && wait != 0 || !allowed && (wait <= 0 || wait > limit.Period) {
+				t.Errorf("Allow() wait = %v", wait)
+			}
+		})
+	}
+}
+
+func Test_rateLimitBucket_take(t *testing.T) {
+	limit := &config.RateLimit{Burst: 3, Period: 10 * time.Second}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		tokens      float64
+		elapsed     time.Duration
+		wantAllowed bool
+		wantWait    time.Duration
+		wantTokens  float64
+	}{
+		{"full bucket     ", 3, 0, true, 0, 2},
+		{"empty bucket    ", 0, 0, false, 10 * time.Second, 0},
+		{"partially filled", 0, 4 * time.Second, false, 6 * time.Second, 0.4},
+		{"refilled        ", 0, 10 * time.Second, true, 0, 0},
+		{"refill capped   ", 1, time.Hour, true, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &rateLimitBucket{tokens: tt.tokens, updated: start}
+			allowed, wait := b.take(limit, start.Add(tt.elapsed))
+			if allowed != tt.wantAllowed {
+				t.Errorf("take() allowed = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if wait != tt.wantWait {
+				t.Errorf("take() wait = %v, want %v", wait, tt.wantWait)
+			}
+			if b.tokens != tt.wantTokens {
+				t.Errorf("take() tokens = %v, want %v", b.tokens, tt.wantTokens)
+			}
+		})
+	}
+}
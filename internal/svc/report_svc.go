@@ -0,0 +1,116 @@
+package svc
+
+import (
+	"github.com/go-openapi/strfmt"
+	"github.com/lib/pq"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"time"
+)
+
+// TheReportService is a global ReportService implementation
+var TheReportService ReportService = &reportService{}
+
+// ReportService is a service interface for dealing with comment reports submitted by readers
+type ReportService interface {
+	// Create persists a new report, filling in its hex ID and creation date. If the reporter has already reported the
+	// comment, the existing report is updated instead. Returns the total number of reports on the comment
+	Create(report *models.CommentReport) (int, error)
+	// DeleteByComments deletes all reports on comments with the given hex IDs
+	DeleteByComments(commentHexes []models.HexID) error
+	// ListByDomain returns a list of reports on the given domain, the most recent first. If commentHex isn't empty,
+	// only reports on that comment are returned
+	ListByDomain(domain string, commentHex models.HexID) ([]*models.CommentReport, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// reportService is a blueprint ReportService implementation
+type reportService struct{}
+
+func (svc *reportService) Create(report *models.CommentReport) (int, error) {
+	logger.Debugf("reportService.Create(%#v)", report)
+
+	// Generate a new report hex ID
+	var err error
+	if report.ReportHex, err = data.RandomHexID(); err != nil {
+		return 0, err
+	}
+	report.CreationDate = strfmt.DateTime(time.Now().UTC())
+
+	// Persist the report, replacing the reporter's previous one
+	err = db.Exec(
+		"insert into commentreports(reporthex, commenthex, domain, reporterhex, category, details, creationdate) "+
+			"values($1, $2, $3, $4, $5, $6, $7) "+
+			"on conflict (commenthex, reporterhex) do update set category=$5, details=$6, creationdate=$7;",
+		report.ReportHex,
+		report.CommentHex,
+		report.Domain,
+		report.ReporterHex,
+		report.Category,
+		report.Details,
+		report.CreationDate)
+	if err != nil {
+		logger.Errorf("reportService.Create: Exec() failed: %v", err)
+		return 0, translateDBErrors(err)
+	}
+
+	// Count the reports on the comment
+	var cnt int
+	if err := db.QueryRow("select count(*) from commentreports where commenthex=$1;", report.CommentHex).Scan(&cnt); err != nil {
+		logger.Errorf("reportService.Create: QueryRow() failed: %v", err)
+		return 0, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return cnt, nil
+}
+
+func (svc *reportService) DeleteByComments(commentHexes []models.HexID) error {
+	logger.Debugf("reportService.DeleteByComments(%v)", commentHexes)
+
+	// Delete the records
+	if err := db.Exec("delete from commentreports where commenthex=any($1);", pq.Array(commentHexes)); err != nil {
+		logger.Errorf("reportService.DeleteByComments: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *reportService) ListByDomain(domain string, commentHex models.HexID) ([]*models.CommentReport, error) {
+	logger.Debugf("reportService.ListByDomain(%s, %s)", domain, commentHex)
+
+	// Query the domain's reports
+	rows, err := db.Query(
+		"select reporthex, commenthex, domain, reporterhex, category, details, creationdate from commentreports "+
+			"where domain=$1 and ($2='' or commenthex=$2) "+
+			"order by creationdate desc;",
+		domain, commentHex)
+	if err != nil {
+		logger.Errorf("reportService.ListByDomain: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the reports
+	var res []*models.CommentReport
+	for rows.Next() {
+		var r models.CommentReport
+		if err := rows.Scan(&r.ReportHex, &r.CommentHex, &r.Domain, &r.ReporterHex, &r.Category, &r.Details, &r.CreationDate); err != nil {
+			logger.Errorf("reportService.ListByDomain: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, &r)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("reportService.ListByDomain: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
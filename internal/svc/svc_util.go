@@ -5,7 +5,9 @@ import (
 	"errors"
 	"github.com/op/go-logging"
 	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
 )
 
 // logger represents a package-wide logger instance
@@ -27,6 +29,18 @@ func checkErrors(errs ...error) error {
 	return nil
 }
 
+// checkRowsAffected verifies the statement that produced the given result has affected at least one row, and returns
+// ErrNotFound otherwise
+func checkRowsAffected(res sql.Result) error {
+	if count, err := res.RowsAffected(); err != nil {
+		logger.Errorf("checkRowsAffected: RowsAffected() failed: %v", err)
+		return translateDBErrors(err)
+	} else if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // fixCommenterHex handles the anonymous commenter hex ID when persisting a database record.
 func fixCommenterHex(id models.HexID) string {
 	if id == data.AnonymousCommenter.HexID {
@@ -60,6 +74,21 @@ func fixUndefined(s string) string {
 	return s
 }
 
+// hashToken returns a keyed hash of the given token, which is what gets persisted in the database instead of the token
+// itself
+func hashToken(token models.HexID) string {
+	return util.HMACHex(config.SecretsConfig.TokenKey, string(token))
+}
+
+// nullIfEmpty returns nil if s is empty, otherwise a pointer to it; meant for updating a database column only if a value
+// is provided.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
 // translateDBErrors "translates" database errors into a service error, picking the first non-nil error
 func translateDBErrors(errs ...error) error {
 	switch checkErrors(errs...) {
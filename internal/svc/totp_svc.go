@@ -0,0 +1,324 @@
+package svc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"strings"
+	"time"
+)
+
+// TheTOTPService is a global TOTPService implementation
+var TheTOTPService TOTPService = &totpService{}
+
+// TOTPService is a service interface for dealing with TOTP two-factor authentication
+type TOTPService interface {
+	// CreateChallenge creates and persists a new sign-in challenge for the given user, who has already passed the first
+	// step of signing in, returning its token. sessionHex is the hex ID of the existing session to sign in once the
+	// challenge is passed, if any
+	CreateChallenge(userID, sessionHex models.HexID) (models.HexID, error)
+	// Disable turns off two-factor authentication for the given user, removing their secret and recovery codes
+	Disable(userID models.HexID) error
+	// Enable verifies the code against the user's pending secret and, if it matches, turns on two-factor
+	// authentication, returning a new set of recovery codes
+	Enable(userID models.HexID, code string) ([]string, error)
+	// Setup generates and stores a new pending secret for the given user, which only takes effect once enabled with
+	// Enable(). Returns the secret
+	Setup(userID models.HexID) (string, error)
+	// TakeChallenge verifies the code for the sign-in challenge with the given token, and returns the hex ID of the
+	// challenged user and of the session the challenge has been created for, if any. The challenge is removed once the
+	// code matches, after too many wrong codes, or when it expires. Returns ErrNotFound if there's no such (valid)
+	// challenge, and util.ErrorTOTPLocked if the user is locked out
+	TakeChallenge(token models.HexID, code string) (models.HexID, models.HexID, error)
+	// Verify checks the given code, which is either a TOTP code or one of the recovery codes, for the given user. A
+	// matching recovery code is consumed. Returns util.ErrorInvalidTOTPCode if the code doesn't match, and
+	// util.ErrorTOTPLocked if the user is locked out for submitting too many wrong codes in a row
+	Verify(userID models.HexID, code string) error
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	totpChallengeAttempts = 5                // Max number of codes that can be submitted for a sign-in challenge
+	totpChallengeTTL      = 5 * time.Minute  // Time a sign-in challenge stays valid for
+	totpLockoutFailures   = 5                // Number of wrong codes in a row after which the user gets locked out
+	totpLockoutPeriod     = 15 * time.Minute // Time a user stays locked out for
+	totpRecoveryCodeCount = 10               // Number of recovery codes issued to a user
+)
+
+// totpService is a blueprint TOTPService implementation
+type totpService struct{}
+
+func (svc *totpService) CreateChallenge(userID, sessionHex models.HexID) (models.HexID, error) {
+	logger.Debugf("totpService.CreateChallenge(%s, %s)", userID, sessionHex)
+
+	// Generate a new random token
+	token, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("totpService.CreateChallenge: RandomHexID() failed: %v", err)
+		return "", err
+	}
+
+	// Insert a new record
+	err = db.Exec(
+		"insert into totpchallenges(token, userhex, sessionhex, creationdate) values($1, $2, $3, $4);",
+		token, userID, sessionHex, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("totpService.CreateChallenge: Exec() failed: %v", err)
+		return "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return token, nil
+}
+
+func (svc *totpService) Disable(userID models.HexID) error {
+	logger.Debugf("totpService.Disable(%s)", userID)
+
+	// Reset the user's TOTP settings and remove their recovery codes
+	err := checkErrors(
+		db.Exec("update users set totpsecret='', totpenabled=false, totplaststep=0, totpfailures=0, totplockeduntil=null where userhex=$1;", userID),
+		db.Exec("delete from userrecoverycodes where userhex=$1;", userID))
+	if err != nil {
+		logger.Errorf("totpService.Disable: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *totpService) Enable(userID models.HexID, code string) ([]string, error) {
+	logger.Debugf("totpService.Enable(%s, ...)", userID)
+
+	// Fetch the pending secret
+	var secret string
+	var enabled bool
+	if err := db.QueryRow("select totpsecret, totpenabled from users where userhex=$1;", userID).Scan(&secret, &enabled); err != nil {
+		logger.Errorf("totpService.Enable: Scan() failed: %v", err)
+		return nil, translateDBErrors(err)
+	} else if enabled {
+		return nil, util.ErrorTOTPAlreadyEnabled
+	} else if secret == "" {
+		return nil, util.ErrorTOTPNotSetUp
+	}
+
+	// Verify the code
+	step := util.TOTPVerify(secret, code, time.Now(), 0)
+	if step == 0 {
+		return nil, util.ErrorInvalidTOTPCode
+	}
+
+	// Generate recovery codes
+	codes := make([]string, totpRecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+	}
+
+	// Enable TOTP for the user and replace their recovery codes
+	res, err := db.ExecRes(
+		"update users set totpenabled=true, totplaststep=$1 where userhex=$2 and totpsecret=$3 and not totpenabled;",
+		step, userID, secret)
+	if err != nil {
+		logger.Errorf("totpService.Enable: ExecRes() failed: %v", err)
+		return nil, translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err != nil {
+		// The secret has been replaced or enabled in the meantime
+		return nil, util.ErrorInvalidTOTPCode
+	}
+	if err := db.Exec("delete from userrecoverycodes where userhex=$1;", userID); err != nil {
+		logger.Errorf("totpService.Enable: Exec() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	for _, c := range codes {
+		if err := db.Exec("insert into userrecoverycodes(userhex, codehash) values($1, $2);", userID, totpRecoveryCodeHash(c)); err != nil {
+			logger.Errorf("totpService.Enable: Exec() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+	}
+
+	// Succeeded
+	return codes, nil
+}
+
+func (svc *totpService) Setup(userID models.HexID) (string, error) {
+	logger.Debugf("totpService.Setup(%s)", userID)
+
+	// Generate a new secret
+	secret, err := util.TOTPNewSecret()
+	if err != nil {
+		logger.Errorf("totpService.Setup: TOTPNewSecret() failed: %v", err)
+		return "", err
+	}
+
+	// Store the secret, unless TOTP is already enabled
+	res, err := db.ExecRes("update users set totpsecret=$1 where userhex=$2 and not totpenabled;", secret, userID)
+	if err != nil {
+		logger.Errorf("totpService.Setup: ExecRes() failed: %v", err)
+		return "", translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return "", util.ErrorTOTPAlreadyEnabled
+	} else if err != nil {
+		return "", err
+	}
+
+	// Succeeded
+	return secret, nil
+}
+
+func (svc *totpService) TakeChallenge(token models.HexID, code string) (models.HexID, models.HexID, error) {
+	logger.Debugf("totpService.TakeChallenge(%s, ...)", token)
+
+	// Find the challenge
+	var userID, sessionHex models.HexID
+	var created time.Time
+	err := db.QueryRow("select userhex, sessionhex, creationdate from totpchallenges where token=$1;", token).
+		Scan(&userID, &sessionHex, &created)
+	if err != nil {
+		// Do not log "not found" errors
+		if err != sql.ErrNoRows {
+			logger.Errorf("totpService.TakeChallenge: Scan() failed: %v", err)
+		}
+		return "", "", translateDBErrors(err)
+	}
+
+	// Expired challenges are as good as missing
+	if time.Since(created) > totpChallengeTTL {
+		svc.deleteChallenge(token)
+		return "", "", ErrNotFound
+	}
+
+	// Verify the code. On failure, count the attempt and drop the challenge once there are too many
+	if err := svc.Verify(userID, code); err == util.ErrorInvalidTOTPCode {
+		var attempts int
+		err := db.QueryRow("update totpchallenges set attempts=attempts+1 where token=$1 returning attempts;", token).Scan(&attempts)
+		if err != nil {
+			logger.Errorf("totpService.TakeChallenge: Scan() failed: %v", err)
+			return "", "", translateDBErrors(err)
+		}
+		if attempts >= totpChallengeAttempts {
+			svc.deleteChallenge(token)
+		}
+		return "", "", util.ErrorInvalidTOTPCode
+	} else if err != nil {
+		return "", "", err
+	}
+
+	// The challenge is used up
+	svc.deleteChallenge(token)
+
+	// Succeeded
+	return userID, sessionHex, nil
+}
+
+func (svc *totpService) Verify(userID models.HexID, code string) error {
+	logger.Debugf("totpService.Verify(%s, ...)", userID)
+
+	// Fetch the user's TOTP settings
+	var secret string
+	var enabled bool
+	var lastStep int64
+	var failures int
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(
+		"select totpsecret, totpenabled, totplaststep, totpfailures, totplockeduntil from users where userhex=$1;",
+		userID).
+		Scan(&secret, &enabled, &lastStep, &failures, &lockedUntil)
+	if err != nil {
+		logger.Errorf("totpService.Verify: Scan() failed: %v", err)
+		return translateDBErrors(err)
+	} else if !enabled {
+		return util.ErrorTOTPNotEnabled
+	} else if lockedUntil.Valid && lockedUntil.Time.After(time.Now().UTC()) {
+		return util.ErrorTOTPLocked
+	}
+
+	// Check the code. Wrong codes are counted per user, regardless of the challenge they're submitted for, and lock
+	// the user out once there are too many in a row
+	if err := svc.verifyCode(userID, secret, lastStep, code); err == util.ErrorInvalidTOTPCode {
+		err := db.Exec(
+			"update users set totpfailures=totpfailures+1, "+
+				"totplockeduntil=case when (totpfailures+1)%$1=0 then $2 else totplockeduntil end "+
+				"where userhex=$3;",
+			totpLockoutFailures, time.Now().UTC().Add(totpLockoutPeriod), userID)
+		if err != nil {
+			logger.Errorf("totpService.Verify: Exec() failed: %v", err)
+			return translateDBErrors(err)
+		}
+		return util.ErrorInvalidTOTPCode
+	} else if err != nil {
+		return err
+	}
+
+	// Reset the failure count
+	if failures > 0 {
+		if err := db.Exec("update users set totpfailures=0 where userhex=$1;", userID); err != nil {
+			logger.Errorf("totpService.Verify: Exec() failed: %v", err)
+			return translateDBErrors(err)
+		}
+	}
+
+	// Succeeded
+	return nil
+}
+
+// deleteChallenge removes the sign-in challenge with the given token, ignoring any error
+func (svc *totpService) deleteChallenge(token models.HexID) {
+	if err := db.Exec("delete from totpchallenges where token=$1;", token); err != nil {
+		logger.Warningf("totpService.deleteChallenge: Exec() failed: %v", err)
+	}
+}
+
+// verifyCode checks the given code, which is either a TOTP code or one of the recovery codes, against the given user's
+// secret and last used time step. A matching recovery code is consumed. Returns util.ErrorInvalidTOTPCode if the code
+// doesn't match
+func (svc *totpService) verifyCode(userID models.HexID, secret string, lastStep int64, code string) error {
+	// Try the code as a TOTP one. Record the step it's valid for, so that it can't be used again
+	if len(code) == util.TOTPDigits {
+		step := util.TOTPVerify(secret, code, time.Now(), lastStep)
+		if step == 0 {
+			return util.ErrorInvalidTOTPCode
+		}
+		res, err := db.ExecRes("update users set totplaststep=$1 where userhex=$2 and totplaststep<$1;", step, userID)
+		if err != nil {
+			logger.Errorf("totpService.verifyCode: ExecRes() failed: %v", err)
+			return translateDBErrors(err)
+		} else if err := checkRowsAffected(res); err == ErrNotFound {
+			// A concurrent request has used the code already
+			return util.ErrorInvalidTOTPCode
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Otherwise, try it as a recovery code, consuming it
+	res, err := db.ExecRes("delete from userrecoverycodes where userhex=$1 and codehash=$2;", userID, totpRecoveryCodeHash(code))
+	if err != nil {
+		logger.Errorf("totpService.verifyCode: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return util.ErrorInvalidTOTPCode
+	} else if err != nil {
+		return err
+	}
+
+	// Succeeded
+	return nil
+}
+
+// totpRecoveryCodeHash returns a hash of the given recovery code, ignoring case, dashes, and spaces
+func totpRecoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
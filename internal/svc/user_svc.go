@@ -2,175 +2,222 @@ package svc
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/go-openapi/strfmt"
 	"github.com/op/go-logging"
 	"gitlab.com/comentario/comentario/internal/api/models"
 	"gitlab.com/comentario/comentario/internal/config"
 	"gitlab.com/comentario/comentario/internal/data"
 	"gitlab.com/comentario/comentario/internal/util"
-	"golang.org/x/crypto/bcrypt"
+	"strings"
 	"time"
 )
 
 // TheUserService is a global UserService implementation
 var TheUserService UserService = &userService{}
 
-// UserService is a service interface for dealing with users
+// UserService is a service interface for dealing with users. Session, confirmation, and password reset tokens are only
+// persisted as keyed hashes
 type UserService interface {
-	// ConfirmOwner confirms the owner's email using the specified token
-	ConfirmOwner(confirmToken models.HexID) error
-	// CreateCommenter creates and persists a new commenter. If no idp is provided, the local auth provider is assumed
-	CreateCommenter(email, name, websiteURL, photoURL, idp, password string) (*data.UserCommenter, error)
-	// CreateCommenterSession creates and persists a new commenter session record, returning session token
-	CreateCommenterSession(id models.HexID) (models.HexID, error)
-	// CreateOwner creates and persists a new owner user
-	CreateOwner(email, name, password string) (*data.UserOwner, error)
-	// CreateOwnerConfirmationToken creates, persists, and returns a new owner confirmation token
-	CreateOwnerConfirmationToken(userID models.HexID) (models.HexID, error)
-	// CreateOwnerSession creates and persists a new owner session record, returning session token
-	CreateOwnerSession(id models.HexID) (models.HexID, error)
+	// ConfirmUser confirms the user's email using the specified token. Returns ErrNotFound if there's no such token or
+	// it's expired
+	ConfirmUser(confirmToken models.HexID) error
+	// ConfirmUserByID marks the email of the user with the given hex ID confirmed, for when they have proven to own it
+	// otherwise
+	ConfirmUserByID(id models.HexID) error
+	// CreateAPIToken creates and persists a new API token for the given user, returning the token itself along with its
+	// details
+	CreateAPIToken(userID models.HexID, name string, scope models.APITokenScope, expiry time.Time) (models.HexID, *models.APIToken, error)
+	// CreateConfirmationToken creates, persists, and returns a new email confirmation token for the given user
+	CreateConfirmationToken(userID models.HexID) (models.HexID, error)
 	// CreateResetToken creates and persists a new password reset token for the user of given kind ('entity') and hex ID
 	CreateResetToken(userID models.HexID, entity models.Entity) (models.HexID, error)
-	// DeleteCommenterSession removes a commenter session by hex ID and token from the database
-	DeleteCommenterSession(id, token models.HexID) error
-	// DeleteOwnerByID removes an owner user by their hex ID
-	DeleteOwnerByID(id models.HexID) error
+	// CreateSession creates and persists a new session record, returning session token. An empty id creates a session
+	// not (yet) bound to any user. totpVerified indicates whether the user has signed in with a second factor,
+	// userAgent and ip describe the client the session is created for
+	CreateSession(id models.HexID, totpVerified bool, userAgent, ip string) (models.HexID, error)
+	// CreateStreamTicket creates and persists a new single-use ticket for opening a comment event stream on behalf of
+	// the session with the given token, and returns it. Returns ErrNotFound if there's no such session
+	CreateStreamTicket(sessionToken models.HexID) (models.HexID, error)
+	// CreateUser creates and persists a new user along with their identity. If no idp is provided, the local auth
+	// provider is assumed. Returns util.ErrorEmailAlreadyExists if the email is already taken
+	CreateUser(email, name, websiteURL, photoURL, idp, password string, confirmed bool) (*data.User, error)
+	// DeleteAPIToken removes an API token by user hex ID and token hex ID (as opposed to the token itself). Returns
+	// ErrNotFound if there's no such token
+	DeleteAPIToken(userID, tokenHex models.HexID) error
 	// DeleteResetTokens removes all password reset tokens for the given user
 	DeleteResetTokens(userID models.HexID) error
-	// FindCommenterByEmail finds and returns the first commenter having the specified email only, ignoring the identity
-	// provider (this is a shortcoming of the inherited implementation)
-	FindCommenterByEmail(email string) (*data.UserCommenter, error)
-	// FindCommenterByID finds and returns a commenter user by their hex ID
-	FindCommenterByID(id models.HexID) (*data.UserCommenter, error)
-	// FindCommenterByIdPEmail finds and returns a commenter user by their email and identity provider. If no idp is
-	// provided, the local auth provider (Comentario) is assumed
-	FindCommenterByIdPEmail(idp, email string, readPwdHash bool) (*data.UserCommenter, error)
-	// FindCommenterByToken finds and returns a commenter user by their token
-	FindCommenterByToken(token models.HexID) (*data.UserCommenter, error)
-	// FindOwnerByEmail finds and returns an owner user by their email
-	FindOwnerByEmail(email string, readPwdHash bool) (*data.UserOwner, error)
-	// FindOwnerByID finds and returns an owner user by their hex ID
-	FindOwnerByID(id models.HexID) (*data.UserOwner, error)
-	// FindOwnerByToken finds and returns an owner user by their token
-	FindOwnerByToken(token models.HexID) (*data.UserOwner, error)
+	// DeleteSession removes a session by user hex ID and token from the database
+	DeleteSession(id, token models.HexID) error
+	// DeleteSessionByHex removes a session by user hex ID and session hex ID (as opposed to its token) from the
+	// database. Returns ErrNotFound if there's no such session
+	DeleteSessionByHex(id, sessionHex models.HexID) error
+	// DeleteSessions removes all sessions of the given user, except the one with the given token, if any
+	DeleteSessions(id, exceptToken models.HexID) error
+	// DeleteUserByID removes a user by their hex ID, along with their identities, sessions, and roles. The user's
+	// comments are kept, but turn anonymous
+	DeleteUserByID(id models.HexID) error
+	// FindOwnerBySession finds and returns a user by their admin UI session token. Unlike FindUserBySession(), it
+	// rejects sessions of users having two-factor authentication enabled, unless signed in with the second factor
+	FindOwnerBySession(token models.HexID) (*data.User, error)
+	// FindSessionHex returns the hex ID of the unexpired session with the given token, which may or may not be linked
+	// to a user
+	FindSessionHex(token models.HexID) (models.HexID, error)
+	// FindUserByAPIToken finds and returns a user by their unexpired API token, also filling in the token's scope.
+	// Tokens of suspended users are as good as missing. Also updates the token's last used date
+	FindUserByAPIToken(token models.HexID) (*data.User, error)
+	// FindUserByEmail finds and returns a user by their email
+	FindUserByEmail(email string, readPwdHash bool) (*data.User, error)
+	// FindUserByID finds and returns a user by their hex ID
+	FindUserByID(id models.HexID) (*data.User, error)
+	// FindUserByFormerEmail finds and returns a user who had to give up the given email to another user when accounts
+	// were merged, and whose password matches the given one. Returns ErrNotFound if there's no such user
+	FindUserByFormerEmail(email, password string) (*data.User, error)
+	// FindUserByIdentity finds and returns a user by their identity provider and the email reported by it. If no idp
+	// is provided, the local auth provider (Comentario) is assumed
+	FindUserByIdentity(idp, email string, readPwdHash bool) (*data.User, error)
+	// FindUserBySession finds and returns a user by their session token, also filling in whether the session has been
+	// signed in with a second factor. Expired sessions and sessions of suspended users are as good as missing. Also
+	// updates the session's last seen date
+	FindUserBySession(token models.HexID) (*data.User, error)
+	// FindUserByStreamTicket finds and returns a user by a ticket issued by CreateStreamTicket(), also filling in
+	// whether the session has been signed in with a second factor. The ticket is used up. Expired tickets, and tickets
+	// of expired sessions or suspended users are as good as missing
+	FindUserByStreamTicket(ticket models.HexID) (*data.User, error)
+	// LinkIdentity adds an identity with the given provider and email to the specified user. If no idp is provided,
+	// the local auth provider is assumed
+	LinkIdentity(id models.HexID, idp, email string) error
+	// ListAPITokens returns a list of the given user's API tokens, including expired ones, newest first
+	ListAPITokens(userID models.HexID) ([]*models.APIToken, error)
 	// ListCommentersByDomain returns a list of all commenters for the (comments of) given domain
 	ListCommentersByDomain(domain string) ([]models.Commenter, error)
+	// ListSessions returns a list of the given user's unexpired sessions, most recently seen first. The session with the
+	// given token is marked current
+	ListSessions(id, currentToken models.HexID) ([]*models.Session, error)
 	// ResetUserPasswordByToken finds and resets a user's password for the given reset token, returning the
-	// corresponding entity
+	// corresponding entity. All the user's sessions get revoked
 	ResetUserPasswordByToken(token models.HexID, password string) (models.Entity, error)
-	// UpdateCommenter updates the given commenter's data in the database. If no idp is provided, the local auth
-	// provider is assumed
-	UpdateCommenter(commenterHex models.HexID, email, name, websiteURL, photoURL, idp string) error
-	// UpdateCommenterSession links a commenter token to the given commenter, by updating the session record
-	UpdateCommenterSession(token, id models.HexID) error
+	// UpdateSessionByHex links a session to the given user by its session hex ID (as opposed to its token), by
+	// updating the session record. totpVerified indicates whether the user has signed in with a second factor. The
+	// session's lifetime starts over
+	UpdateSessionByHex(sessionHex, id models.HexID, totpVerified bool) error
+	// UpdateUser updates the given user's profile in the database
+	UpdateUser(id models.HexID, name, websiteURL, photoURL string) error
+	// VerifyPassword returns whether the given password matches the user's password hash. If it does and the hash is
+	// outdated, it gets transparently replaced with a fresh one
+	VerifyPassword(user *data.User, password string) bool
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
+const (
+	sessionTouchInterval   = time.Minute // Min interval between updates of a session's last seen date
+	sessionUserAgentMaxLen = 255         // Max length of a session's stored user agent
+)
+
+// userSelect is the select list of a user query, which is to be processed with fetchUser(). The query must alias users
+// as "u"
+var userSelect = "select " +
+	"u.userhex, u.email, u.name, u.passwordhash, u.confirmedemail, u.websiteurl, u.avatarurl, u.joindate, u.totpenabled, " +
+	"u.superuser, u.suspended, " + userProviderColumn("u") + " "
+
 // userService is a blueprint UserService implementation
 type userService struct{}
 
-func (svc *userService) ConfirmOwner(confirmToken models.HexID) error {
-	logger.Debugf("userService.ConfirmOwner(%s)", confirmToken)
+func (svc *userService) ConfirmUser(confirmToken models.HexID) error {
+	logger.Debugf("userService.ConfirmUser(%s)", confirmToken)
 
-	// Update the owner's record
+	// Update the user's record
 	res, err := db.ExecRes(
-		"update owners set confirmedemail=true where ownerhex in (select ownerhex from ownerconfirmhexes where confirmhex=$1);",
-		confirmToken)
+		"update users set confirmedemail=true "+
+			"where userhex in (select ownerhex from ownerconfirmhexes where confirmhex=$1 and senddate>=$2);",
+		hashToken(confirmToken),
+		time.Now().UTC().Add(-util.ConfirmationTokenTTL))
 	if err != nil {
-		logger.Errorf("userService.ConfirmOwner: ExecRes() failed (owner update): %v", err)
+		logger.Errorf("userService.ConfirmUser: ExecRes() failed (user update): %v", err)
 		return translateDBErrors(err)
 	}
 
 	// Check if there was indeed an update
-	if count, err := res.RowsAffected(); err != nil {
-		logger.Errorf("userService.ConfirmOwner: res.RowsAffected() failed: %v", err)
-		return translateDBErrors(err)
-	} else if count == 0 {
-		return ErrNotFound
+	if err := checkRowsAffected(res); err != nil {
+		return err
 	}
 
 	// Remove the token from the database
-	if err := db.Exec("delete from ownerconfirmhexes where confirmhex=$1;", confirmToken); err != nil {
-		logger.Warningf("userService.ConfirmOwner: Exec() failed (token removal): %v", err)
+	if err := db.Exec("delete from ownerconfirmhexes where confirmhex=$1;", hashToken(confirmToken)); err != nil {
+		logger.Warningf("userService.ConfirmUser: Exec() failed (token removal): %v", err)
 	}
 
 	// Succeeded
 	return nil
 }
 
-func (svc *userService) CreateCommenter(email, name, websiteURL, photoURL, idp, password string) (*data.UserCommenter, error) {
-	logger.Debugf("userService.CreateCommenter(%s, %s, %s, %s, %s, %s)", email, name, websiteURL, photoURL, idp, password)
+func (svc *userService) ConfirmUserByID(id models.HexID) error {
+	logger.Debugf("userService.ConfirmUserByID(%s)", id)
 
-	// Register a new email
-	if _, err := TheEmailService.Create(email); err != nil {
-		return nil, err
+	// Update the user's record
+	res, err := db.ExecRes("update users set confirmedemail=true where userhex=$1;", id)
+	if err != nil {
+		logger.Errorf("userService.ConfirmUserByID: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
 	}
 
-	// Create an initial commenter instance
-	uc := data.UserCommenter{
-		User: data.User{
-			Email:   email,
-			Created: time.Now().UTC(),
-			Name:    name,
-		},
-		WebsiteURL: websiteURL,
-		PhotoURL:   photoURL,
-		Provider:   idp,
-	}
+	// Succeeded
+	return checkRowsAffected(res)
+}
 
-	// Generate a random hex ID
-	if id, err := data.RandomHexID(); err != nil {
-		return nil, err
-	} else {
-		uc.HexID = id
-	}
+func (svc *userService) CreateAPIToken(userID models.HexID, name string, scope models.APITokenScope, expiry time.Time) (models.HexID, *models.APIToken, error) {
+	logger.Debugf("userService.CreateAPIToken(%s, %s, %s, %v)", userID, name, scope, expiry)
 
-	// Hash the user's password, if any
-	if password != "" {
-		if h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
-			return nil, err
-		} else {
-			uc.PasswordHash = string(h)
-		}
+	// Generate a new random token and token hex ID
+	token, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("userService.CreateAPIToken: RandomHexID() failed: %v", err)
+		return "", nil, err
+	}
+	tokenHex, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("userService.CreateAPIToken: RandomHexID() failed: %v", err)
+		return "", nil, err
 	}
 
-	// Insert a commenter record
-	err := db.Exec(
-		"insert into commenters(commenterhex, email, name, link, photo, provider, passwordhash, joindate) values($1, $2, $3, $4, $5, $6, $7, $8);",
-		uc.HexID,
-		uc.Email,
-		uc.Name,
-		fixUndefined(uc.WebsiteURL),
-		fixUndefined(uc.PhotoURL),
-		fixIdP(uc.Provider),
-		uc.PasswordHash,
-		time.Now().UTC())
+	// Insert a new record, storing only the token's hash
+	t := &models.APIToken{
+		TokenHex:     tokenHex,
+		Name:         name,
+		Scope:        scope,
+		CreationDate: strfmt.DateTime(time.Now().UTC()),
+		ExpiryDate:   strfmt.DateTime(expiry.UTC()),
+	}
+	err = db.Exec(
+		"insert into apitokens(tokenhash, tokenhex, userhex, name, scope, creationdate, expirydate) "+
+			"values($1, $2, $3, $4, $5, $6, $7);",
+		hashToken(token), t.TokenHex, userID, t.Name, t.Scope, t.CreationDate, t.ExpiryDate)
 	if err != nil {
-		logger.Errorf("userService.CreateCommenter: Exec() failed: %v", err)
-		return nil, translateDBErrors(err)
+		logger.Errorf("userService.CreateAPIToken: Exec() failed: %v", err)
+		return "", nil, translateDBErrors(err)
 	}
 
 	// Succeeded
-	return &uc, nil
+	return token, t, nil
 }
 
-func (svc *userService) CreateCommenterSession(id models.HexID) (models.HexID, error) {
-	logger.Debugf("userService.CreateCommenterSession(%s)", id)
+func (svc *userService) CreateConfirmationToken(userID models.HexID) (models.HexID, error) {
+	logger.Debugf("userService.CreateConfirmationToken(%s)", userID)
 
 	// Generate a new random token
 	token, err := data.RandomHexID()
 	if err != nil {
-		logger.Errorf("userService.CreateCommenterSession: RandomHexID() failed: %v", err)
+		logger.Errorf("userService.CreateConfirmationToken: RandomHexID() failed: %v", err)
 		return "", err
 	}
 
-	// Insert a new record
+	// Insert a new record, storing only the token's hash
 	err = db.Exec(
-		"insert into commentersessions(commentertoken, commenterhex, creationdate) values($1, $2, $3);",
-		token, id, time.Now().UTC())
+		"insert into ownerconfirmhexes(confirmhex, ownerhex, senddate) values($1, $2, $3);",
+		hashToken(token), userID, time.Now().UTC())
 	if err != nil {
-		logger.Errorf("userService.CreateCommenterSession: Exec() failed: %v", err)
+		logger.Errorf("userService.CreateConfirmationToken: Exec() failed: %v", err)
 		return "", translateDBErrors(err)
 	}
 
@@ -178,62 +225,58 @@ func (svc *userService) CreateCommenterSession(id models.HexID) (models.HexID, e
 	return token, nil
 }
 
-func (svc *userService) CreateOwner(email, name, password string) (*data.UserOwner, error) {
-	logger.Debugf("userService.CreateOwner(%s, %s, %s)", email, name, password)
-
-	// Create an initial owner instance
-	uo := data.UserOwner{
-		User: data.User{
-			Email:   email,
-			Created: time.Now().UTC(),
-			Name:    name,
-		},
-		// If no SMTP is configured, mark the owner confirmed at once
-		EmailConfirmed: !config.SMTPConfigured,
-	}
-
-	// Generate a random hex ID
-	if id, err := data.RandomHexID(); err != nil {
-		return nil, err
-	} else {
-		uo.HexID = id
-	}
+func (svc *userService) CreateResetToken(userID models.HexID, entity models.Entity) (models.HexID, error) {
+	logger.Debugf("userService.CreateResetToken(%s, %s)", userID, entity)
 
-	// Hash the user's password
-	if h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
-		return nil, err
-	} else {
-		uo.PasswordHash = string(h)
+	// Generate a random reset token
+	token, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("userService.CreateResetToken: util.RandomHexID() failed: %v", err)
+		return "", err
 	}
 
-	// Insert a new owner record
-	err := db.Exec(
-		"insert into owners(ownerhex, email, name, passwordhash, joindate, confirmedemail) values($1, $2, $3, $4, $5, $6);",
-		uo.HexID, uo.Email, uo.Name, uo.PasswordHash, uo.Created, uo.EmailConfirmed)
+	// Persist the token's hash
+	err = db.Exec(
+		"insert into resethexes(resethex, hex, entity, senddate) values($1, $2, $3, $4);",
+		hashToken(token),
+		userID,
+		entity,
+		time.Now().UTC())
 	if err != nil {
-		return nil, translateDBErrors(err)
+		logger.Errorf("userService.CreateResetToken: Exec() failed: %v", err)
+		return "", translateDBErrors(err)
 	}
 
 	// Succeeded
-	return &uo, nil
+	return token, nil
 }
 
-func (svc *userService) CreateOwnerConfirmationToken(userID models.HexID) (models.HexID, error) {
-	logger.Debugf("userService.CreateOwnerConfirmationToken(%s)", userID)
+func (svc *userService) CreateSession(id models.HexID, totpVerified bool, userAgent, ip string) (models.HexID, error) {
+	logger.Debugf("userService.CreateSession(%s, %v, %s, %s)", id, totpVerified, userAgent, ip)
 
-	// Generate a new random token
+	// Generate a new random token and session hex ID
 	token, err := data.RandomHexID()
 	if err != nil {
-		logger.Errorf("userService.CreateOwnerConfirmationToken: RandomHexID() failed: %v", err)
+		logger.Errorf("userService.CreateSession: RandomHexID() failed: %v", err)
+		return "", err
+	}
+	sessionHex, err := data.RandomHexID()
+	if err != nil {
+		logger.Errorf("userService.CreateSession: RandomHexID() failed: %v", err)
 		return "", err
 	}
 
-	// Insert a new record
+	// Insert a new record, storing only the token's hash and cutting the user agent down to a sane length
+	if len(userAgent) > sessionUserAgentMaxLen {
+		userAgent = strings.ToValidUTF8(userAgent[:sessionUserAgentMaxLen], "")
+	}
+	now := time.Now().UTC()
 	err = db.Exec(
-		"insert into ownerconfirmhexes(confirmhex, ownerhex, senddate) values($1, $2, $3);",
-		token, userID, time.Now().UTC())
+		"insert into usersessions(token, sessionhex, userhex, creationdate, lastseendate, totpverified, useragent, ip) "+
+			"values($1, $2, $3, $4, $4, $5, $6, $7);",
+		hashToken(token), sessionHex, fixNone(id), now, totpVerified, userAgent, ip)
 	if err != nil {
-		logger.Errorf("userService.CreateOwnerConfirmationToken: Exec() failed: %v", err)
+		logger.Errorf("userService.CreateSession: Exec() failed: %v", err)
 		return "", translateDBErrors(err)
 	}
 
@@ -241,61 +284,123 @@ func (svc *userService) CreateOwnerConfirmationToken(userID models.HexID) (model
 	return token, nil
 }
 
-func (svc *userService) CreateOwnerSession(id models.HexID) (models.HexID, error) {
-	logger.Debugf("userService.CreateOwnerSession(%s)", id)
+func (svc *userService) CreateStreamTicket(sessionToken models.HexID) (models.HexID, error) {
+	logger.Debugf("userService.CreateStreamTicket(%s)", sessionToken)
 
-	// Generate a new random token
-	token, err := data.RandomHexID()
+	// Generate a new random ticket
+	ticket, err := data.RandomHexID()
 	if err != nil {
-		logger.Errorf("userService.CreateOwnerSession: RandomHexID() failed: %v", err)
+		logger.Errorf("userService.CreateStreamTicket: RandomHexID() failed: %v", err)
 		return "", err
 	}
 
-	// Insert a new record
-	err = db.Exec(
-		"insert into ownersessions(ownertoken, ownerhex, logindate) values($1, $2, $3);",
-		token, id, time.Now().UTC())
+	// Insert a new record, storing only the ticket's hash, and remove expired ones along the way
+	now := time.Now().UTC()
+	idleCutoff, maxCutoff := sessionCutoffs()
+	res, err := db.ExecRes(
+		"with x as (delete from streamtickets where creationdate<$1) "+
+			"insert into streamtickets(ticket, sessionhex, creationdate) "+
+			"select $2, sessionhex, $3 from usersessions where token=$4 and lastseendate>=$5 and creationdate>=$6;",
+		now.Add(-util.StreamTicketTTL), hashToken(ticket), now, hashToken(sessionToken), idleCutoff, maxCutoff)
 	if err != nil {
-		logger.Errorf("userService.CreateOwnerSession: Exec() failed: %v", err)
+		logger.Errorf("userService.CreateStreamTicket: ExecRes() failed: %v", err)
 		return "", translateDBErrors(err)
 	}
+	if err := checkRowsAffected(res); err != nil {
+		return "", err
+	}
 
 	// Succeeded
-	return token, nil
+	return ticket, nil
 }
 
-func (svc *userService) CreateResetToken(userID models.HexID, entity models.Entity) (models.HexID, error) {
-	logger.Debugf("userService.CreateResetToken(%s, %s)", userID, entity)
+func (svc *userService) CreateUser(email, name, websiteURL, photoURL, idp, password string, confirmed bool) (*data.User, error) {
+	logger.Debugf("userService.CreateUser(%s, %s, %s, %s, %s, ..., %v)", email, name, websiteURL, photoURL, idp, confirmed)
 
-	// Generate a random reset token
-	token, err := data.RandomHexID()
-	if err != nil {
-		logger.Errorf("userService.CreateResetToken: util.RandomHexID() failed: %v", err)
-		return "", err
+	// Register a new email
+	if _, err := TheEmailService.Create(email); err != nil {
+		return nil, err
 	}
 
-	// Persist the token
-	err = db.Exec(
-		"insert into resethexes(resethex, hex, entity, senddate) values($1, $2, $3, $4);",
-		token,
-		userID,
-		entity,
-		time.Now().UTC())
-	if err != nil {
-		logger.Errorf("userService.CreateResetToken: Exec() failed: %v", err)
-		return "", translateDBErrors(err)
+	// Create an initial user instance
+	u := data.User{
+		Email:          email,
+		Created:        time.Now().UTC(),
+		Name:           name,
+		EmailConfirmed: confirmed,
+		WebsiteURL:     websiteURL,
+		PhotoURL:       photoURL,
+	}
+
+	// Generate a random hex ID
+	if id, err := data.RandomHexID(); err != nil {
+		return nil, err
+	} else {
+		u.HexID = id
+	}
+
+	// Hash the user's password, if any. Otherwise, the user can only log in via the identity provider
+	if password != "" {
+		if h, err := ThePasswordService.Hash(password); err != nil {
+			return nil, err
+		} else {
+			u.PasswordHash = h
+		}
+	} else {
+		u.Provider = idp
+	}
+
+	// Insert a user record
+	err := db.QueryRow(
+		"insert into users(userhex, email, name, passwordhash, confirmedemail, websiteurl, avatarurl, joindate) "+
+			"values($1, $2, $3, $4, $5, $6, $7, $8) "+
+			"on conflict (email) do nothing "+
+			"returning userhex;",
+		u.HexID,
+		u.Email,
+		u.Name,
+		u.PasswordHash,
+		u.EmailConfirmed,
+		u.WebsiteURL,
+		u.PhotoURL,
+		u.Created).
+		Scan(&u.HexID)
+	if err == sql.ErrNoRows {
+		return nil, util.ErrorEmailAlreadyExists
+	} else if err != nil {
+		logger.Errorf("userService.CreateUser: QueryRow() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Add the user's identity
+	if err := svc.LinkIdentity(u.HexID, idp, email); err != nil {
+		return nil, err
 	}
 
 	// Succeeded
-	return token, nil
+	return &u, nil
 }
 
-func (svc *userService) DeleteCommenterSession(id, token models.HexID) error {
-	logger.Debugf("userService.DeleteCommenterSession(%s, %s)", id, token)
+func (svc *userService) DeleteAPIToken(userID, tokenHex models.HexID) error {
+	logger.Debugf("userService.DeleteAPIToken(%s, %s)", userID, tokenHex)
 
 	// Delete the record
-	if err := db.Exec("delete from commentersessions where commenterhex=$1 and commentertoken=$2;", id, token); err != nil {
-		logger.Errorf("userService.DeleteCommenterSession: Exec() failed: %v", err)
+	res, err := db.ExecRes("delete from apitokens where userhex=$1 and tokenhex=$2;", userID, tokenHex)
+	if err != nil {
+		logger.Errorf("userService.DeleteAPIToken: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+func (svc *userService) DeleteResetTokens(userID models.HexID) error {
+	logger.Debugf("userService.DeleteResetTokens(%s)", userID)
+
+	// Delete all tokens by user
+	if err := db.Exec("delete from resethexes where hex=$1;", userID); err != nil {
+		logger.Errorf("userService.DeleteResetTokens: Exec() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
@@ -303,23 +408,39 @@ func (svc *userService) DeleteCommenterSession(id, token models.HexID) error {
 	return nil
 }
 
-func (svc *userService) DeleteOwnerByID(id models.HexID) error {
-	logger.Debugf("userService.DeleteOwnerByID(%s)", id)
+func (svc *userService) DeleteSession(id, token models.HexID) error {
+	logger.Debugf("userService.DeleteSession(%s, %s)", id, token)
 
-	// Remove all user's reset tokens
-	if err := svc.DeleteResetTokens(id); err != nil {
-		return err
+	// Delete the record
+	if err := db.Exec("delete from usersessions where userhex=$1 and token=$2;", id, hashToken(token)); err != nil {
+		logger.Errorf("userService.DeleteSession: Exec() failed: %v", err)
+		return translateDBErrors(err)
 	}
 
-	// Remove all user's sessions
-	if err := db.Exec("delete from ownersessions where ownerhex=$1;", id); err != nil {
-		logger.Errorf("userService.DeleteOwnerByID: Exec() failed for ownersessions: %v", err)
+	// Succeeded
+	return nil
+}
+
+func (svc *userService) DeleteSessionByHex(id, sessionHex models.HexID) error {
+	logger.Debugf("userService.DeleteSessionByHex(%s, %s)", id, sessionHex)
+
+	// Delete the record
+	res, err := db.ExecRes("delete from usersessions where userhex=$1 and sessionhex=$2;", id, sessionHex)
+	if err != nil {
+		logger.Errorf("userService.DeleteSessionByHex: ExecRes() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
-	// Delete the owner user
-	if err := db.Exec("delete from owners where ownerhex=$1;", id); err != nil {
-		logger.Errorf("userService.DeleteOwnerByID: Exec() failed for owners: %v", err)
+	// Succeeded
+	return checkRowsAffected(res)
+}
+
+func (svc *userService) DeleteSessions(id, exceptToken models.HexID) error {
+	logger.Debugf("userService.DeleteSessions(%s, %s)", id, exceptToken)
+
+	// Delete the records
+	if err := db.Exec("delete from usersessions where userhex=$1 and token<>$2;", id, hashToken(exceptToken)); err != nil {
+		logger.Errorf("userService.DeleteSessions: Exec() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
@@ -327,143 +448,341 @@ func (svc *userService) DeleteOwnerByID(id models.HexID) error {
 	return nil
 }
 
-func (svc *userService) DeleteResetTokens(userID models.HexID) error {
-	logger.Debugf("userService.DeleteResetTokens(%s)", userID)
+func (svc *userService) DeleteUserByID(id models.HexID) error {
+	logger.Debugf("userService.DeleteUserByID(%s)", id)
 
-	// Delete all tokens by user
-	if err := db.Exec("delete from resethexes where hex=$1;", userID); err != nil {
-		logger.Errorf("userService.DeleteResetTokens: Exec() failed: %v", err)
-		return translateDBErrors(err)
+	// Remove all user's reset tokens
+	if err := svc.DeleteResetTokens(id); err != nil {
+		return err
+	}
+
+	// Remove everything else referring to the user, and the user themselves, last
+	for _, s := range []string{
+		"delete from ownerconfirmhexes where ownerhex=$1;",
+		"delete from usersessions where userhex=$1;",
+		"delete from apitokens where userhex=$1;",
+		"delete from domainclaims where ownerhex=$1;",
+		"delete from useridentities where userhex=$1;",
+		"delete from userformeremails where userhex=$1;",
+		"delete from userrecoverycodes where userhex=$1;",
+		"delete from userwebauthncredentials where userhex=$1;",
+		"delete from domainusers where userhex=$1;",
+		"update comments set commenterhex='anonymous' where commenterhex=$1;",
+		"delete from users where userhex=$1;",
+	} {
+		if err := db.Exec(s, id); err != nil {
+			logger.Errorf("userService.DeleteUserByID: Exec() failed for %q: %v", s, err)
+			return translateDBErrors(err)
+		}
 	}
 
 	// Succeeded
 	return nil
 }
 
-func (svc *userService) FindCommenterByEmail(email string) (*data.UserCommenter, error) {
-	logger.Debugf("userService.FindCommenterByEmail(%s)", email)
+func (svc *userService) FindOwnerBySession(token models.HexID) (*data.User, error) {
+	logger.Debugf("userService.FindOwnerBySession(%s)", token)
+
+	// Find the session's user
+	u, err := svc.FindUserBySession(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// A session that skipped the second factor is no good for the admin UI
+	if u.TOTPEnabled && !u.TOTPVerified {
+		return nil, ErrNotFound
+	}
+
+	// Succeeded
+	return u, nil
+}
+
+func (svc *userService) FindSessionHex(token models.HexID) (models.HexID, error) {
+	logger.Debugf("userService.FindSessionHex(%s)", token)
+
+	// Query the database
+	idleCutoff, maxCutoff := sessionCutoffs()
+	var sessionHex models.HexID
+	err := db.QueryRow(
+		"select sessionhex from usersessions where token=$1 and lastseendate>=$2 and creationdate>=$3;",
+		hashToken(token),
+		idleCutoff,
+		maxCutoff).
+		Scan(&sessionHex)
+	if err != nil {
+		return "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return sessionHex, nil
+}
+
+func (svc *userService) FindUserByAPIToken(token models.HexID) (*data.User, error) {
+	logger.Debugf("userService.FindUserByAPIToken(%s)", token)
 
 	// Query the database
 	row := db.QueryRow(
-		"select commenterhex, email, name, link, photo, provider, joindate, passwordhash from commenters where email=$1;",
-		email)
+		userSelect+", t.scope, t.lastuseddate "+
+			"from apitokens t "+
+			"join users u on u.userhex=t.userhex "+
+			"where t.tokenhash=$1 and t.expirydate>$2;",
+		hashToken(token),
+		time.Now().UTC())
+
+	// Fetch the user
+	var scope models.APITokenScope
+	var lastUsed sql.NullTime
+	u, err := svc.fetchUser(row, false, &scope, &lastUsed)
+	if err != nil {
+		return nil, translateDBErrors(err)
+	}
+	u.APIScope = scope
+
+	// Suspended users cannot use their tokens
+	if u.Suspended {
+		return nil, ErrNotFound
+	}
+
+	// The token could only be created in a fully signed-in session, so it counts as signed in with a second factor
+	u.TOTPVerified = true
+
+	// Update the last used date, but not more often than necessary
+	if now := time.Now().UTC(); !lastUsed.Valid || now.Sub(lastUsed.Time) >= sessionTouchInterval {
+		if err := db.Exec("update apitokens set lastuseddate=$1 where tokenhash=$2;", now, hashToken(token)); err != nil {
+			logger.Warningf("userService.FindUserByAPIToken: Exec() failed: %v", err)
+		}
+	}
+
+	// Succeeded
+	return u, nil
+}
+
+func (svc *userService) FindUserByEmail(email string, readPwdHash bool) (*data.User, error) {
+	logger.Debugf("userService.FindUserByEmail(%s)", email)
 
-	// Fetch the commenter user
-	if u, err := svc.fetchCommenter(row, false); err != nil {
+	// Query the database
+	row := db.QueryRow(userSelect+"from users u where u.email=$1;", email)
+
+	// Fetch the user
+	if u, err := svc.fetchUser(row, readPwdHash); err != nil {
 		return nil, translateDBErrors(err)
 	} else {
 		return u, nil
 	}
 }
 
-func (svc *userService) FindCommenterByID(id models.HexID) (*data.UserCommenter, error) {
-	logger.Debugf("userService.FindCommenterByID(%s)", id)
+func (svc *userService) FindUserByID(id models.HexID) (*data.User, error) {
+	logger.Debugf("userService.FindUserByID(%s)", id)
 
-	// Make sure we don't try to find an "anonymous" commenter
+	// Make sure we don't try to find an "anonymous" user
 	if id == data.AnonymousCommenter.HexID {
 		return nil, ErrNotFound
 	}
 
 	// Query the database
-	row := db.QueryRow(
-		"select commenterhex, email, name, link, photo, provider, joindate, passwordhash from commenters where commenterhex=$1;",
-		id)
+	row := db.QueryRow(userSelect+"from users u where u.userhex=$1;", id)
 
-	// Fetch the commenter user
-	if u, err := svc.fetchCommenter(row, false); err != nil {
+	// Fetch the user
+	if u, err := svc.fetchUser(row, false); err != nil {
 		return nil, translateDBErrors(err)
 	} else {
 		return u, nil
 	}
 }
 
-func (svc *userService) FindCommenterByIdPEmail(idp, email string, readPwdHash bool) (*data.UserCommenter, error) {
-	logger.Debugf("userService.FindCommenterByIdPEmail(%s, %s)", idp, email)
+func (svc *userService) FindUserByFormerEmail(email, password string) (*data.User, error) {
+	logger.Debugf("userService.FindUserByFormerEmail(%s, ...)", email)
+
+	// Query the database
+	rows, err := db.Query(
+		userSelect+"from users u join userformeremails f on f.userhex=u.userhex where f.email=$1;",
+		email)
+	if err != nil {
+		logger.Errorf("userService.FindUserByFormerEmail: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the users
+	var users []*data.User
+	for rows.Next() {
+		u, err := svc.fetchUser(rows, true)
+		if err != nil {
+			return nil, translateDBErrors(err)
+		}
+		users = append(users, u)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("userService.FindUserByFormerEmail: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Pick the user the password belongs to, if any
+	for _, u := range users {
+		if u.PasswordHash != "" && svc.VerifyPassword(u, password) {
+			return u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (svc *userService) FindUserByIdentity(idp, email string, readPwdHash bool) (*data.User, error) {
+	logger.Debugf("userService.FindUserByIdentity(%s, %s)", idp, email)
 
 	// Query the database
 	row := db.QueryRow(
-		"select commenterhex, email, name, link, photo, provider, joindate, passwordhash "+
-			"from commenters "+
-			"where provider=$1 and email=$2;",
+		userSelect+
+			"from users u "+
+			"join useridentities ui on ui.userhex=u.userhex "+
+			"where ui.provider=$1 and ui.email=$2;",
 		fixIdP(idp),
 		email)
 
-	// Fetch the commenter user
-	if u, err := svc.fetchCommenter(row, readPwdHash); err != nil {
+	// Fetch the user
+	if u, err := svc.fetchUser(row, readPwdHash); err != nil {
 		return nil, translateDBErrors(err)
 	} else {
 		return u, nil
 	}
 }
 
-func (svc *userService) FindCommenterByToken(token models.HexID) (*data.UserCommenter, error) {
-	logger.Debugf("userService.FindCommenterByToken(%s)", token)
+func (svc *userService) FindUserBySession(token models.HexID) (*data.User, error) {
+	logger.Debugf("userService.FindUserBySession(%s)", token)
 
-	// Make sure we don't try to find an "anonymous" commenter
+	// Make sure we don't try to find an "anonymous" user
 	if token == data.AnonymousCommenter.HexID {
 		return nil, ErrNotFound
 	}
 
 	// Query the database
+	idleCutoff, maxCutoff := sessionCutoffs()
 	row := db.QueryRow(
-		"select c.commenterHex, c.email, c.name, c.link, c.photo, c.provider, c.joinDate, c.passwordhash "+
-			"from commentersessions s "+
-			"join commenters c on s.commenterhex = c.commenterhex "+
-			"where s.commentertoken=$1;",
-		token)
-
-	// Fetch the commenter user
-	if u, err := svc.fetchCommenter(row, false); err != nil {
+		userSelect+", s.totpverified, s.lastseendate "+
+			"from usersessions s "+
+			"join users u on u.userhex=s.userhex "+
+			"where s.token=$1 and s.lastseendate>=$2 and s.creationdate>=$3;",
+		hashToken(token),
+		idleCutoff,
+		maxCutoff)
+
+	// Fetch the user
+	var verified bool
+	var lastSeen time.Time
+	u, err := svc.fetchUser(row, false, &verified, &lastSeen)
+	if err != nil {
 		return nil, translateDBErrors(err)
-	} else {
-		return u, nil
 	}
-}
+	u.TOTPVerified = verified
 
-func (svc *userService) FindOwnerByEmail(email string, readPwdHash bool) (*data.UserOwner, error) {
-	logger.Debugf("userService.FindOwnerByEmail(%s)", email)
-
-	// Query the database
-	row := db.QueryRow("select ownerhex, email, name, confirmedemail, joindate, passwordhash from owners where email=$1;", email)
+	// Suspended users cannot use their sessions
+	if u.Suspended {
+		return nil, ErrNotFound
+	}
 
-	// Fetch the owner user
-	if u, err := svc.fetchOwner(row, readPwdHash); err != nil {
-		return nil, translateDBErrors(err)
-	} else {
-		return u, nil
+	// Update the last seen date, but not more often than necessary
+	if now := time.Now().UTC(); now.Sub(lastSeen) >= sessionTouchInterval {
+		if err := db.Exec("update usersessions set lastseendate=$1 where token=$2;", now, hashToken(token)); err != nil {
+			logger.Warningf("userService.FindUserBySession: Exec() failed: %v", err)
+		}
 	}
-}
 
-func (svc *userService) FindOwnerByID(id models.HexID) (*data.UserOwner, error) {
-	logger.Debugf("userService.FindOwnerByID(%s)", id)
+	// Succeeded
+	return u, nil
+}
 
-	// Query the database
-	row := db.QueryRow("select ownerhex, email, name, confirmedemail, joindate, passwordhash from owners where ownerhex=$1;", id)
+func (svc *userService) FindUserByStreamTicket(ticket models.HexID) (*data.User, error) {
+	logger.Debugf("userService.FindUserByStreamTicket(%s)", ticket)
 
-	// Fetch the owner user
-	if u, err := svc.fetchOwner(row, false); err != nil {
+	// Take the ticket and query its session's user
+	idleCutoff, maxCutoff := sessionCutoffs()
+	row := db.QueryRow(
+		"with t as (delete from streamtickets where ticket=$1 and creationdate>=$2 returning sessionhex) "+
+			userSelect+", s.totpverified "+
+			"from t "+
+			"join usersessions s on s.sessionhex=t.sessionhex "+
+			"join users u on u.userhex=s.userhex "+
+			"where s.lastseendate>=$3 and s.creationdate>=$4;",
+		hashToken(ticket),
+		time.Now().UTC().Add(-util.StreamTicketTTL),
+		idleCutoff,
+		maxCutoff)
+
+	// Fetch the user
+	var verified bool
+	u, err := svc.fetchUser(row, false, &verified)
+	if err != nil {
 		return nil, translateDBErrors(err)
-	} else {
-		return u, nil
 	}
+	u.TOTPVerified = verified
+
+	// Suspended users cannot use their sessions
+	if u.Suspended {
+		return nil, ErrNotFound
+	}
+
+	// Succeeded
+	return u, nil
 }
 
-func (svc *userService) FindOwnerByToken(token models.HexID) (*data.UserOwner, error) {
-	logger.Debugf("userService.FindOwnerByToken(%s)", token)
+func (svc *userService) LinkIdentity(id models.HexID, idp, email string) error {
+	logger.Debugf("userService.LinkIdentity(%s, %s, %s)", id, idp, email)
 
-	// Query the database
-	row := db.QueryRow(
-		"select ownerhex, email, name, confirmedemail, joindate, passwordhash "+
-			"from owners "+
-			"where ownerhex in (select ownerhex from ownersessions where ownertoken=$1);",
-		token)
+	// Insert a new record, unless the identity's already there
+	err := db.Exec(
+		"insert into useridentities(provider, email, userhex, creationdate) values($1, $2, $3, $4) "+
+			"on conflict do nothing;",
+		fixIdP(idp), email, id, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("userService.LinkIdentity: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *userService) ListAPITokens(userID models.HexID) ([]*models.APIToken, error) {
+	logger.Debugf("userService.ListAPITokens(%s)", userID)
 
-	// Fetch the owner user
-	if u, err := svc.fetchOwner(row, false); err != nil {
+	// Query the user's tokens
+	rows, err := db.Query(
+		"select tokenhex, name, scope, creationdate, expirydate, lastuseddate "+
+			"from apitokens "+
+			"where userhex=$1 "+
+			"order by creationdate desc;",
+		userID)
+	if err != nil {
+		logger.Errorf("userService.ListAPITokens: Query() failed: %v", err)
 		return nil, translateDBErrors(err)
-	} else {
-		return u, nil
 	}
+	defer rows.Close()
+
+	// Fetch the tokens
+	res := []*models.APIToken{}
+	for rows.Next() {
+		t := models.APIToken{}
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&t.TokenHex, &t.Name, &t.Scope, &t.CreationDate, &t.ExpiryDate, &lastUsed); err != nil {
+			logger.Errorf("userService.ListAPITokens: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		if lastUsed.Valid {
+			t.LastUsedDate = strfmt.DateTime(lastUsed.Time)
+		}
+		res = append(res, &t)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("userService.ListAPITokens: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
 }
 
 func (svc *userService) ListCommentersByDomain(domain string) ([]models.Commenter, error) {
@@ -471,39 +790,68 @@ func (svc *userService) ListCommentersByDomain(domain string) ([]models.Commente
 
 	// Query all commenters of the domain's comments
 	rows, err := db.Query(
-		"select r.commenterhex, r.email, r.name, r.link, r.photo, r.provider, r.joindate "+
-			"from comments c "+
-			"join commenters r on r.commenterhex=c.commenterhex "+
-			"where c.domain=$1;",
+		userSelect+"from users u where u.userhex in (select c.commenterhex from comments c where c.domain=$1);",
 		domain)
 	if err != nil {
-		logger.Errorf("commentService.ListCommentersByDomain: Query() failed: %v", domain, err)
+		logger.Errorf("userService.ListCommentersByDomain: Query() failed: %v", err)
 		return nil, translateDBErrors(err)
 	}
 	defer rows.Close()
 
-	// Fetch the comments
+	// Fetch the users
 	var res []models.Commenter
-	var link, photo, provider string
 	for rows.Next() {
-		r := models.Commenter{}
-		if err = rows.Scan(&r.CommenterHex, &r.Email, &r.Name, &link, &photo, &provider, &r.JoinDate); err != nil {
-			logger.Errorf("commentService.ListCommentersByDomain: rows.Scan() failed: %v", err)
+		u, err := svc.fetchUser(rows, false)
+		if err != nil {
 			return nil, translateDBErrors(err)
 		}
+		res = append(res, *u.ToCommenter())
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("userService.ListCommentersByDomain: Next() failed: %v", err)
+		return nil, err
+	}
 
-		// Apply necessary conversions
-		r.WebsiteURL = strfmt.URI(unfixUndefined(link))
-		r.AvatarURL = strfmt.URI(unfixUndefined(photo))
-		r.Provider = unfixIdP(provider)
+	// Succeeded
+	return res, nil
+}
+
+func (svc *userService) ListSessions(id, currentToken models.HexID) ([]*models.Session, error) {
+	logger.Debugf("userService.ListSessions(%s, %s)", id, currentToken)
 
-		// Add the commenter to the result
-		res = append(res, r)
+	// Query the user's sessions
+	idleCutoff, maxCutoff := sessionCutoffs()
+	rows, err := db.Query(
+		"select sessionhex, token=$2, useragent, ip, creationdate, lastseendate "+
+			"from usersessions "+
+			"where userhex=$1 and lastseendate>=$3 and creationdate>=$4 "+
+			"order by lastseendate desc;",
+		id,
+		hashToken(currentToken),
+		idleCutoff,
+		maxCutoff)
+	if err != nil {
+		logger.Errorf("userService.ListSessions: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the sessions
+	res := []*models.Session{}
+	for rows.Next() {
+		s := models.Session{}
+		if err := rows.Scan(&s.SessionHex, &s.Current, &s.UserAgent, &s.IP, &s.CreationDate, &s.LastSeenDate); err != nil {
+			logger.Errorf("userService.ListSessions: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, &s)
 	}
 
 	// Check that Next() didn't error
 	if err := rows.Err(); err != nil {
-		logger.Errorf("commentService.ListCommentersByDomain: Next() failed: %v", err)
+		logger.Errorf("userService.ListSessions: Next() failed: %v", err)
 		return nil, err
 	}
 
@@ -512,12 +860,12 @@ func (svc *userService) ListCommentersByDomain(domain string) ([]models.Commente
 }
 
 func (svc *userService) ResetUserPasswordByToken(token models.HexID, password string) (models.Entity, error) {
-	logger.Debugf("userService.ResetUserPasswordByToken(%s, %s)", token, password)
+	logger.Debugf("userService.ResetUserPasswordByToken(..., ...)")
 
 	// Find and fetch the token record
 	var userID models.HexID
 	var entity models.Entity
-	row := db.QueryRow("select hex, entity from resethexes where resethex=$1;", token)
+	row := db.QueryRow("select hex, entity from resethexes where resethex=$1;", hashToken(token))
 	if err := row.Scan(&userID, &entity); err != nil {
 		// Do not log "not found" errors
 		if err != sql.ErrNoRows {
@@ -526,54 +874,59 @@ func (svc *userService) ResetUserPasswordByToken(token models.HexID, password st
 		return "", translateDBErrors(err)
 	}
 
+	// Validate the entity, which is only used for redirecting the user afterwards
+	if entity != models.EntityOwner && entity != models.EntityCommenter {
+		return "", ErrUnknownEntity
+	}
+
 	// Hash the new password
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := ThePasswordService.Hash(password)
 	if err != nil {
-		logger.Errorf("cannot generate hash from password: %v", err)
 		return "", err
 	}
 
-	// Fetch the user and update their password
-	switch entity {
-	// Owner
-	case models.EntityOwner:
-		if _, err := svc.FindOwnerByID(userID); err != nil {
-			return "", err
-		} else if err := db.Exec("update owners set passwordhash=$1 where ownerhex=$2;", string(hash), userID); err != nil {
-			logger.Errorf("userService.ResetUserPasswordByToken: Exec() failed for owner: %v", err)
-			return "", translateDBErrors(err)
-		}
-
-	// Commenter
-	case models.EntityCommenter:
-		if _, err := svc.FindCommenterByID(userID); err != nil {
-			return "", err
-		} else if err := db.Exec("update commenters set passwordhash=$1 where commenterhex=$2;", string(hash), userID); err != nil {
-			logger.Errorf("userService.ResetUserPasswordByToken: Exec() failed for commenter: %v", err)
-			return "", translateDBErrors(err)
-		}
+	// Update the user's password. Since the reset link was mailed to the user, their email is now confirmed as well
+	res, err := db.ExecRes("update users set passwordhash=$1, confirmedemail=true where userhex=$2;", hash, userID)
+	if err != nil {
+		logger.Errorf("userService.ResetUserPasswordByToken: ExecRes() failed: %v", err)
+		return "", translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err != nil {
+		return "", err
+	}
 
-	// Unknown entity
-	default:
-		return "", ErrUnknownEntity
+	// Make sure the user can log in locally
+	err = db.Exec(
+		"insert into useridentities(provider, email, userhex, creationdate) "+
+			"select $1, email, userhex, $2 from users where userhex=$3 "+
+			"on conflict do nothing;",
+		fixIdP(""), time.Now().UTC(), userID)
+	if err != nil {
+		logger.Errorf("userService.ResetUserPasswordByToken: Exec() failed: %v", err)
+		return "", translateDBErrors(err)
 	}
 
 	// Remove all the user's reset tokens, ignoring any error
 	_ = svc.DeleteResetTokens(userID)
 
+	// Revoke all the user's sessions: whoever knew the old password may have signed in with it
+	if err := svc.DeleteSessions(userID, ""); err != nil {
+		return "", err
+	}
+
 	// Succeeded
 	return entity, nil
 }
 
-func (svc *userService) UpdateCommenter(commenterHex models.HexID, email, name, websiteURL, photoURL, idp string) error {
-	logger.Debugf("userService.UpdateCommenter(%s, %s, %s, %s, %s, %s)", commenterHex, email, name, websiteURL, photoURL, idp)
+func (svc *userService) UpdateSessionByHex(sessionHex, id models.HexID, totpVerified bool) error {
+	logger.Debugf("userService.UpdateSessionByHex(%s, %s, %v)", sessionHex, id, totpVerified)
 
-	// Update the database record
+	// Update the record
+	now := time.Now().UTC()
 	err := db.Exec(
-		"update commenters set email=$1, name=$2, link=$3, photo=$4 where commenterhex=$5 and provider=$6;",
-		email, name, fixUndefined(websiteURL), fixUndefined(photoURL), commenterHex, fixIdP(idp))
+		"update usersessions set userhex=$1, creationdate=$2, lastseendate=$2, totpverified=$3 where sessionhex=$4;",
+		id, now, totpVerified, sessionHex)
 	if err != nil {
-		logger.Errorf("userService.UpdateCommenter: Exec() failed: %v", err)
+		logger.Errorf("userService.UpdateSessionByHex: Exec() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
@@ -581,12 +934,15 @@ func (svc *userService) UpdateCommenter(commenterHex models.HexID, email, name,
 	return nil
 }
 
-func (svc *userService) UpdateCommenterSession(token, id models.HexID) error {
-	logger.Debugf("userService.UpdateCommenterSession(%s, %s)", token, id)
+func (svc *userService) UpdateUser(id models.HexID, name, websiteURL, photoURL string) error {
+	logger.Debugf("userService.UpdateUser(%s, %s, %s, %s)", id, name, websiteURL, photoURL)
 
-	// Update the record
-	if err := db.Exec("update commentersessions set commenterhex=$1 where commentertoken=$2;", id, token); err != nil {
-		logger.Errorf("userService.UpdateCommenterSession: Exec() failed: %v", err)
+	// Update the database record
+	err := db.Exec(
+		"update users set name=$1, websiteurl=$2, avatarurl=$3 where userhex=$4;",
+		name, websiteURL, photoURL, id)
+	if err != nil {
+		logger.Errorf("userService.UpdateUser: Exec() failed: %v", err)
 		return translateDBErrors(err)
 	}
 
@@ -594,41 +950,63 @@ func (svc *userService) UpdateCommenterSession(token, id models.HexID) error {
 	return nil
 }
 
-// fetchCommenter returns a new commenter user from the provided database row
-func (svc *userService) fetchCommenter(s util.Scanner, readPwdHash bool) (*data.UserCommenter, error) {
-	u := data.UserCommenter{}
-	var pwdHash, websiteURL, photoURL, provider string
-	if err := s.Scan(&u.HexID, &u.Email, &u.Name, &websiteURL, &photoURL, &provider, &u.Created, &pwdHash); err != nil {
-		// Log "not found" errors only in debug
-		if err != sql.ErrNoRows || logger.IsEnabledFor(logging.DEBUG) {
-			logger.Errorf("userService.fetchCommenter: Scan() failed: %v", err)
+func (svc *userService) VerifyPassword(user *data.User, password string) bool {
+	logger.Debugf("userService.VerifyPassword(%s, ...)", user.HexID)
+
+	// Check the password against the hash
+	ok, outdated := ThePasswordService.Verify(user.PasswordHash, password)
+	if !ok {
+		return false
+	}
+
+	// Replace an outdated hash with a fresh one. Any error is ignored, since the password is correct regardless
+	if outdated {
+		if hash, err := ThePasswordService.Hash(password); err == nil {
+			if err := db.Exec("update users set passwordhash=$1 where userhex=$2;", hash, user.HexID); err != nil {
+				logger.Warningf("userService.VerifyPassword: Exec() failed: %v", err)
+			} else {
+				user.PasswordHash = hash
+			}
 		}
-		return nil, err
 	}
 
-	// Apply necessary conversions
-	u.WebsiteURL = unfixUndefined(websiteURL)
-	u.PhotoURL = unfixUndefined(photoURL)
-	u.Provider = unfixIdP(provider)
+	// Succeeded
+	return true
+}
 
-	// Copy password hash, if requested
-	if readPwdHash {
-		u.PasswordHash = pwdHash
-	}
-	return &u, nil
+// sessionCutoffs returns the earliest last seen date and the earliest creation date of an unexpired session
+func sessionCutoffs() (time.Time, time.Time) {
+	now := time.Now().UTC()
+	return now.AddDate(0, 0, -config.CLIFlags.SessionIdleDays), now.AddDate(0, 0, -config.CLIFlags.SessionMaxDays)
+}
+
+// userProviderColumn returns a column expression yielding the provider of the user aliased as alias, which is the
+// earliest identity provider of a user without a password, and empty otherwise
+func userProviderColumn(alias string) string {
+	return fmt.Sprintf(
+		"case when %s.passwordhash<>'' then '' else "+
+			"coalesce((select i.provider from useridentities i where i.userhex=%[1]s.userhex order by i.creationdate limit 1), '') end",
+		alias)
 }
 
-// fetchOwner returns a new owner user instance from the provided database row
-func (svc *userService) fetchOwner(s util.Scanner, readPwdHash bool) (*data.UserOwner, error) {
-	u := data.UserOwner{}
-	var pwdHash string
-	if err := s.Scan(&u.HexID, &u.Email, &u.Name, &u.EmailConfirmed, &u.Created, &pwdHash); err != nil {
+// fetchUser returns a new user instance from the provided database row, containing userSelect followed by the columns
+// to be scanned into extra, if any
+func (svc *userService) fetchUser(s util.Scanner, readPwdHash bool, extra ...any) (*data.User, error) {
+	u := data.User{}
+	var pwdHash, provider string
+	dest := []any{&u.HexID, &u.Email, &u.Name, &pwdHash, &u.EmailConfirmed, &u.WebsiteURL, &u.PhotoURL, &u.Created, &u.TOTPEnabled, &u.Superuser, &u.Suspended, &provider}
+	if err := s.Scan(append(dest, extra...)...); err != nil {
 		// Log "not found" errors only in debug
 		if err != sql.ErrNoRows || logger.IsEnabledFor(logging.DEBUG) {
-			logger.Errorf("userService.fetchOwner: Scan() failed: %v", err)
+			logger.Errorf("userService.fetchUser: Scan() failed: %v", err)
 		}
 		return nil, err
 	}
+
+	// Apply necessary conversions
+	u.Provider = unfixIdP(provider)
+
+	// Copy password hash, if requested
 	if readPwdHash {
 		u.PasswordHash = pwdHash
 	}
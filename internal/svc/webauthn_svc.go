@@ -0,0 +1,296 @@
+package svc
+
+import (
+	"database/sql"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/swag"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/config"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"time"
+)
+
+// TheWebAuthnService is a global WebAuthnService implementation
+var TheWebAuthnService WebAuthnService = &webAuthnService{}
+
+// WebAuthnService is a service interface for dealing with WebAuthn credentials (passkeys). Ceremonies are performed for
+// the relying party identified by the server's base URL, so they must take place on a page served from it
+type WebAuthnService interface {
+	// BeginLogin starts a new sign-in ceremony, returning its options
+	BeginLogin() (*models.WebauthnRequestOptions, error)
+	// BeginRegistration starts a new ceremony registering a credential for the given user, returning its options
+	BeginRegistration(user *data.User) (*models.WebauthnCreationOptions, error)
+	// DeleteCredential removes the credential with the given (base64url-encoded) ID from the given user
+	DeleteCredential(userID models.HexID, credentialID string) error
+	// FinishLogin verifies the response of a sign-in ceremony, and returns the hex ID of the credential's user. Returns
+	// util.ErrorWebAuthnFailed if the response doesn't check out
+	FinishLogin(assertion *models.WebauthnAssertion) (models.HexID, error)
+	// FinishRegistration verifies the response of a registration ceremony started for the given user, and persists and
+	// returns the new credential. Returns util.ErrorWebAuthnFailed if the response doesn't check out
+	FinishRegistration(userID models.HexID, attestation *models.WebauthnAttestation) (*models.WebauthnCredential, error)
+	// ListCredentials returns a list of credentials registered by the given user
+	ListCredentials(userID models.HexID) ([]*models.WebauthnCredential, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// webAuthnTimeout is the time a ceremony has to be completed within
+const webAuthnTimeout = 5 * time.Minute
+
+// webAuthnService is a blueprint WebAuthnService implementation
+type webAuthnService struct{}
+
+func (svc *webAuthnService) BeginLogin() (*models.WebauthnRequestOptions, error) {
+	logger.Debug("webAuthnService.BeginLogin()")
+
+	// Issue a challenge not bound to any user: the user is identified by the credential they pick
+	challenge, err := svc.createChallenge("")
+	if err != nil {
+		return nil, err
+	}
+
+	// Succeeded
+	return &models.WebauthnRequestOptions{
+		Challenge: challenge,
+		RpID:      svc.relyingParty().ID,
+		Timeout:   webAuthnTimeout.Milliseconds(),
+	}, nil
+}
+
+func (svc *webAuthnService) BeginRegistration(user *data.User) (*models.WebauthnCreationOptions, error) {
+	logger.Debugf("webAuthnService.BeginRegistration(%s)", user.HexID)
+
+	// Fetch the user's existing credentials, so that an authenticator doesn't get registered twice
+	creds, err := svc.ListCredentials(user.HexID)
+	if err != nil {
+		return nil, err
+	}
+	var exclude []string
+	for _, c := range creds {
+		exclude = append(exclude, c.CredentialID)
+	}
+
+	// Issue a challenge
+	challenge, err := svc.createChallenge(user.HexID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Succeeded
+	return &models.WebauthnCreationOptions{
+		Challenge:            challenge,
+		ExcludeCredentialIds: exclude,
+		RpID:                 svc.relyingParty().ID,
+		RpName:               "Comentario",
+		Timeout:              webAuthnTimeout.Milliseconds(),
+		UserDisplayName:      user.Name,
+		UserID:               util.WebAuthnEncoding.EncodeToString([]byte(user.HexID)),
+		UserName:             user.Email,
+	}, nil
+}
+
+func (svc *webAuthnService) DeleteCredential(userID models.HexID, credentialID string) error {
+	logger.Debugf("webAuthnService.DeleteCredential(%s, %s)", userID, credentialID)
+
+	// Delete the record
+	res, err := db.ExecRes("delete from userwebauthncredentials where credentialid=$1 and userhex=$2;", credentialID, userID)
+	if err != nil {
+		logger.Errorf("webAuthnService.DeleteCredential: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Check the credential existed
+	return checkRowsAffected(res)
+}
+
+func (svc *webAuthnService) FinishLogin(assertion *models.WebauthnAssertion) (models.HexID, error) {
+	logger.Debugf("webAuthnService.FinishLogin(%s)", swag.StringValue(assertion.CredentialID))
+
+	// Consume the challenge
+	challenge := swag.StringValue(assertion.Challenge)
+	if err := svc.takeChallenge(challenge, ""); err != nil {
+		return "", err
+	}
+
+	// Decode the response
+	clientData, err1 := util.WebAuthnEncoding.DecodeString(swag.StringValue(assertion.ClientDataJSON))
+	authData, err2 := util.WebAuthnEncoding.DecodeString(swag.StringValue(assertion.AuthenticatorData))
+	sig, err3 := util.WebAuthnEncoding.DecodeString(swag.StringValue(assertion.Signature))
+	if err := checkErrors(err1, err2, err3); err != nil {
+		logger.Warningf("webAuthnService.FinishLogin: failed to decode response: %v", err)
+		return "", util.ErrorWebAuthnFailed
+	}
+
+	// Find the credential
+	credID := swag.StringValue(assertion.CredentialID)
+	var userID models.HexID
+	var cred util.WebAuthnCredential
+	var signCount int64
+	err := db.QueryRow("select userhex, publickey, signcount from userwebauthncredentials where credentialid=$1;", credID).
+		Scan(&userID, &cred.PublicKey, &signCount)
+	if err == sql.ErrNoRows {
+		return "", util.ErrorWebAuthnFailed
+	} else if err != nil {
+		logger.Errorf("webAuthnService.FinishLogin: Scan() failed: %v", err)
+		return "", translateDBErrors(err)
+	}
+	cred.SignCount = uint32(signCount)
+
+	// Verify the response
+	newCount, err := svc.relyingParty().VerifyAssertion(challenge, &cred, clientData, authData, sig)
+	if err != nil {
+		logger.Warningf("webAuthnService.FinishLogin: VerifyAssertion() failed for credential %s: %v", credID, err)
+		return "", util.ErrorWebAuthnFailed
+	}
+
+	// Store the new counter value, making sure it's not been advanced concurrently
+	res, err := db.ExecRes(
+		"update userwebauthncredentials set signcount=$1, lastuseddate=$2 where credentialid=$3 and signcount=$4;",
+		newCount, time.Now().UTC(), credID, signCount)
+	if err != nil {
+		logger.Errorf("webAuthnService.FinishLogin: ExecRes() failed: %v", err)
+		return "", translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return "", util.ErrorWebAuthnFailed
+	} else if err != nil {
+		return "", err
+	}
+
+	// Succeeded
+	return userID, nil
+}
+
+func (svc *webAuthnService) FinishRegistration(userID models.HexID, attestation *models.WebauthnAttestation) (*models.WebauthnCredential, error) {
+	logger.Debugf("webAuthnService.FinishRegistration(%s)", userID)
+
+	// Consume the challenge
+	challenge := swag.StringValue(attestation.Challenge)
+	if err := svc.takeChallenge(challenge, userID); err != nil {
+		return nil, err
+	}
+
+	// Decode and verify the response
+	clientData, err1 := util.WebAuthnEncoding.DecodeString(swag.StringValue(attestation.ClientDataJSON))
+	attObj, err2 := util.WebAuthnEncoding.DecodeString(swag.StringValue(attestation.AttestationObject))
+	if err := checkErrors(err1, err2); err != nil {
+		logger.Warningf("webAuthnService.FinishRegistration: failed to decode response: %v", err)
+		return nil, util.ErrorWebAuthnFailed
+	}
+	cred, err := svc.relyingParty().ParseRegistration(challenge, clientData, attObj)
+	if err != nil {
+		logger.Warningf("webAuthnService.FinishRegistration: ParseRegistration() failed: %v", err)
+		return nil, util.ErrorWebAuthnFailed
+	}
+
+	// Persist the credential. A credential ID already taken means the authenticator has been registered before
+	c := &models.WebauthnCredential{
+		CreationDate: strfmt.DateTime(time.Now().UTC()),
+		CredentialID: util.WebAuthnEncoding.EncodeToString(cred.ID),
+		Name:         data.TrimmedString(attestation.Name),
+	}
+	res, err := db.ExecRes(
+		"insert into userwebauthncredentials(credentialid, userhex, name, publickey, signcount, creationdate) "+
+			"values($1, $2, $3, $4, $5, $6) "+
+			"on conflict do nothing;",
+		c.CredentialID, userID, c.Name, cred.PublicKey, cred.SignCount, c.CreationDate)
+	if err != nil {
+		logger.Errorf("webAuthnService.FinishRegistration: ExecRes() failed: %v", err)
+		return nil, translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return nil, util.ErrorWebAuthnFailed
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Succeeded
+	return c, nil
+}
+
+func (svc *webAuthnService) ListCredentials(userID models.HexID) ([]*models.WebauthnCredential, error) {
+	logger.Debugf("webAuthnService.ListCredentials(%s)", userID)
+
+	// Query the credentials
+	rows, err := db.Query(
+		"select credentialid, name, creationdate, lastuseddate from userwebauthncredentials "+
+			"where userhex=$1 "+
+			"order by creationdate;",
+		userID)
+	if err != nil {
+		logger.Errorf("webAuthnService.ListCredentials: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the credentials
+	var res []*models.WebauthnCredential
+	for rows.Next() {
+		c := models.WebauthnCredential{}
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&c.CredentialID, &c.Name, &c.CreationDate, &lastUsed); err != nil {
+			logger.Errorf("webAuthnService.ListCredentials: Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		if lastUsed.Valid {
+			c.LastUsedDate = strfmt.DateTime(lastUsed.Time)
+		}
+		res = append(res, &c)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("webAuthnService.ListCredentials: rows.Next() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+// createChallenge creates and persists a new challenge for a ceremony performed by the given user (empty for a
+// sign-in), returning the challenge
+func (svc *webAuthnService) createChallenge(userID models.HexID) (string, error) {
+	// Generate a new challenge
+	challenge, err := util.WebAuthnNewChallenge()
+	if err != nil {
+		logger.Errorf("webAuthnService.createChallenge: WebAuthnNewChallenge() failed: %v", err)
+		return "", err
+	}
+
+	// Insert a new record
+	err = db.Exec(
+		"insert into webauthnchallenges(challenge, userhex, creationdate) values($1, $2, $3);",
+		challenge, userID, time.Now().UTC())
+	if err != nil {
+		logger.Errorf("webAuthnService.createChallenge: Exec() failed: %v", err)
+		return "", translateDBErrors(err)
+	}
+
+	// Succeeded
+	return challenge, nil
+}
+
+// relyingParty returns the relying party ceremonies are performed for, derived from the server's base URL
+func (svc *webAuthnService) relyingParty() *util.WebAuthnRelyingParty {
+	return &util.WebAuthnRelyingParty{
+		ID:     config.BaseURL.Hostname(),
+		Origin: config.BaseURL.Scheme + "://" + config.BaseURL.Host,
+	}
+}
+
+// takeChallenge removes the given challenge, issued for the given user (empty for a sign-in). Returns
+// util.ErrorWebAuthnFailed if there's no such challenge or it's expired
+func (svc *webAuthnService) takeChallenge(challenge string, userID models.HexID) error {
+	res, err := db.ExecRes(
+		"delete from webauthnchallenges where challenge=$1 and userhex=$2 and creationdate>=$3;",
+		challenge, userID, time.Now().UTC().Add(-webAuthnTimeout))
+	if err != nil {
+		logger.Errorf("webAuthnService.takeChallenge: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	} else if err := checkRowsAffected(res); err == ErrNotFound {
+		return util.ErrorWebAuthnFailed
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
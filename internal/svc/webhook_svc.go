@@ -0,0 +1,519 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-openapi/strfmt"
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"gitlab.com/comentario/comentario/internal/data"
+	"gitlab.com/comentario/comentario/internal/util"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TheWebhookService is a global WebhookService implementation
+var TheWebhookService WebhookService = &webhookService{wake: make(chan struct{}, 1)}
+
+// WebhookService is a service interface for dealing with outgoing domain webhooks
+type WebhookService interface {
+	// Create creates, persists, and returns a new webhook for the given domain. Returns util.ErrorInvalidWebhookURL if
+	// the URL isn't an absolute http(s) one
+	Create(domain, url string, events []models.WebhookEvent) (*models.Webhook, error)
+	// Delete deletes the webhook with the given hex ID, belonging to the given domain, along with its delivery log
+	Delete(domain string, webhookHex models.HexID) error
+	// DeleteByDomain deletes all webhooks of the given domain, along with their delivery logs
+	DeleteByDomain(domain string) error
+	// Init starts the background delivery of webhook payloads
+	Init()
+	// ListByDomain returns a list of all webhooks of the given domain. The webhooks' secrets aren't returned, as they're
+	// only disclosed once, on creation
+	ListByDomain(domain string) ([]*models.Webhook, error)
+	// ListDeliveries returns the most recent deliveries of the webhook with the given hex ID, belonging to the given
+	// domain, newest first
+	ListDeliveries(domain string, webhookHex models.HexID) ([]*models.WebhookDelivery, error)
+	// Trigger schedules a delivery of the given event about the comment to all webhooks of the comment's domain that
+	// are subscribed to that event. Errors are only logged, since they must not affect the operation that triggered
+	// the event
+	Trigger(event models.WebhookEvent, comment *models.Comment)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+const (
+	webhookMaxAttempts    = 8                // Max number of attempts to deliver a payload
+	webhookRetryBaseDelay = 30 * time.Second // Delay before the first retry; doubles with every subsequent attempt
+	webhookPollInterval   = 15 * time.Second // Interval between checks for due deliveries
+	webhookBatchSize      = 50               // Max number of deliveries processed in one go
+	webhookDeliveryLimit  = 100              // Max number of deliveries reported by ListDeliveries()
+	webhookErrorMaxLen    = 500              // Max length of an error message stored in the delivery log
+	webhookClaimTimeout   = 5 * time.Minute  // Time a fetched delivery stays claimed, before another replica can retry it
+)
+
+// webhookClient is an HTTP client used to deliver webhook payloads. As webhook URLs are supplied by users, it only
+// connects to public addresses
+var webhookClient = util.NewPublicHTTPClient(10 * time.Second)
+
+// webhookService is a blueprint WebhookService implementation
+type webhookService struct {
+	wake chan struct{} // Signals the delivery loop there are new deliveries
+}
+
+// webhookDelivery is a due delivery, along with the target webhook's properties
+type webhookDelivery struct {
+	deliveryHex models.HexID
+	event       models.WebhookEvent
+	payload     string
+	attempts    int
+	url         string
+	secret      string
+}
+
+func (svc *webhookService) Create(domain, url string, events []models.WebhookEvent) (*models.Webhook, error) {
+	logger.Debugf("webhookService.Create(%s, %s, %v)", domain, url, events)
+
+	// Verify the URL is an http(s) one
+	if err := checkWebhookURL(url); err != nil {
+		return nil, util.ErrorInvalidWebhookURL
+	}
+
+	// Generate a new webhook hex ID and a secret
+	webhookHex, err := data.RandomHexID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := data.RandomHexID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Persist a new webhook record
+	w := models.Webhook{
+		CreationDate: strfmt.DateTime(time.Now().UTC()),
+		Domain:       domain,
+		Events:       events,
+		Secret:       string(secret),
+		URL:          strfmt.URI(url),
+		WebhookHex:   webhookHex,
+	}
+	err = db.Exec(
+		"insert into webhooks(webhookhex, domain, url, secret, events, creationdate) values($1, $2, $3, $4, $5, $6);",
+		w.WebhookHex, w.Domain, w.URL, w.Secret, joinWebhookEvents(w.Events), w.CreationDate)
+	if err != nil {
+		logger.Errorf("webhookService.Create: Exec() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+
+	// Succeeded
+	return &w, nil
+}
+
+func (svc *webhookService) Delete(domain string, webhookHex models.HexID) error {
+	logger.Debugf("webhookService.Delete(%s, %s)", domain, webhookHex)
+
+	// Delete the webhook record, making sure it belongs to the domain
+	res, err := db.ExecRes("delete from webhooks where webhookhex=$1 and domain=$2;", webhookHex, domain)
+	if err != nil {
+		logger.Errorf("webhookService.Delete: ExecRes() failed: %v", err)
+		return translateDBErrors(err)
+	}
+	if err = checkRowsAffected(res); err != nil {
+		return err
+	}
+
+	// Delete the delivery log
+	if err := db.Exec("delete from webhookdeliveries where webhookhex=$1;", webhookHex); err != nil {
+		logger.Errorf("webhookService.Delete: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *webhookService) DeleteByDomain(domain string) error {
+	logger.Debugf("webhookService.DeleteByDomain(%s)", domain)
+
+	// Delete the delivery logs and the webhooks
+	err := db.Exec(
+		"delete from webhookdeliveries d using webhooks w where w.webhookhex=d.webhookhex and w.domain=$1;"+
+			"delete from webhooks where domain=$1;",
+		domain)
+	if err != nil {
+		logger.Errorf("webhookService.DeleteByDomain: Exec() failed: %v", err)
+		return translateDBErrors(err)
+	}
+
+	// Succeeded
+	return nil
+}
+
+func (svc *webhookService) Init() {
+	logger.Debug("webhookService: initialising")
+	go func() {
+		for {
+			svc.deliverDue()
+
+			// Wait until there are new deliveries, or it's time to retry
+			select {
+			case <-svc.wake:
+			case <-time.After(webhookPollInterval):
+			}
+		}
+	}()
+}
+
+func (svc *webhookService) ListByDomain(domain string) ([]*models.Webhook, error) {
+	logger.Debugf("webhookService.ListByDomain(%s)", domain)
+
+	// Query the domain's webhooks
+	rows, err := db.Query(
+		"select webhookhex, domain, url, events, creationdate from webhooks where domain=$1 order by creationdate;",
+		domain)
+	if err != nil {
+		logger.Errorf("webhookService.ListByDomain: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the webhooks
+	var res []*models.Webhook
+	for rows.Next() {
+		w := models.Webhook{}
+		var events string
+		if err = rows.Scan(&w.WebhookHex, &w.Domain, &w.URL, &events, &w.CreationDate); err != nil {
+			logger.Errorf("webhookService.ListByDomain: rows.Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		w.Events = splitWebhookEvents(events)
+		res = append(res, &w)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("webhookService.ListByDomain: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *webhookService) ListDeliveries(domain string, webhookHex models.HexID) ([]*models.WebhookDelivery, error) {
+	logger.Debugf("webhookService.ListDeliveries(%s, %s)", domain, webhookHex)
+
+	// Query the webhook's deliveries, making sure it belongs to the domain
+	rows, err := db.Query(
+		"select d.deliveryhex, d.webhookhex, d.event, d.payload, d.status, d.attempts, d.responsecode, d.lasterror, "+
+			"d.creationdate, d.lastattemptdate, d.nextattemptdate "+
+			"from webhookdeliveries d "+
+			"join webhooks w on w.webhookhex=d.webhookhex "+
+			"where d.webhookhex=$1 and w.domain=$2 "+
+			"order by d.creationdate desc "+
+			"limit $3;",
+		webhookHex, domain, webhookDeliveryLimit)
+	if err != nil {
+		logger.Errorf("webhookService.ListDeliveries: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the deliveries
+	var res []*models.WebhookDelivery
+	for rows.Next() {
+		d := models.WebhookDelivery{}
+		var lastAttempt sql.NullTime
+		err = rows.Scan(
+			&d.DeliveryHex,
+			&d.WebhookHex,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseCode,
+			&d.LastError,
+			&d.CreationDate,
+			&lastAttempt,
+			&d.NextAttemptDate)
+		if err != nil {
+			logger.Errorf("webhookService.ListDeliveries: rows.Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		if lastAttempt.Valid {
+			d.LastAttemptDate = strfmt.DateTime(lastAttempt.Time)
+		}
+		res = append(res, &d)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("webhookService.ListDeliveries: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+func (svc *webhookService) Trigger(event models.WebhookEvent, comment *models.Comment) {
+	logger.Debugf("webhookService.Trigger(%s, %s)", event, comment.CommentHex)
+
+	// Fetch the domain's webhooks
+	hooks, err := svc.ListByDomain(comment.Domain)
+	if err != nil || len(hooks) == 0 {
+		return
+	}
+
+	// Prepare a payload. Vote direction is specific to each user, so it's never reported
+	c := *comment
+	c.Direction = 0
+	now := time.Now().UTC()
+	payload, err := json.Marshal(&models.WebhookPayload{
+		Comment:   &c,
+		Domain:    comment.Domain,
+		Event:     event,
+		Timestamp: strfmt.DateTime(now),
+	})
+	if err != nil {
+		logger.Errorf("webhookService.Trigger: json.Marshal() failed: %v", err)
+		return
+	}
+
+	// Schedule a delivery for every subscribed webhook
+	scheduled := false
+	for _, w := range hooks {
+		if !hasWebhookEvent(w.Events, event) {
+			continue
+		}
+
+		// Generate a new delivery hex ID
+		deliveryHex, err := data.RandomHexID()
+		if err != nil {
+			logger.Errorf("webhookService.Trigger: RandomHexID() failed: %v", err)
+			return
+		}
+
+		// Insert a delivery record
+		err = db.Exec(
+			"insert into webhookdeliveries(deliveryhex, webhookhex, event, payload, status, creationdate, nextattemptdate) "+
+				"values($1, $2, $3, $4, $5, $6, $6);",
+			deliveryHex, w.WebhookHex, event, string(payload), models.WebhookDeliveryStatusPending, now)
+		if err != nil {
+			logger.Errorf("webhookService.Trigger: Exec() failed: %v", err)
+			return
+		}
+		scheduled = true
+	}
+
+	// Wake up the delivery loop, unless it's already been woken up
+	if scheduled {
+		select {
+		case svc.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver makes an attempt to deliver the payload, and records the outcome in the delivery log
+func (svc *webhookService) deliver(d *webhookDelivery) {
+	logger.Debugf("webhookService.deliver(%s) to %s, attempt %d", d.deliveryHex, d.url, d.attempts+1)
+
+	// Make the attempt
+	code, err := postWebhookPayload(d)
+	now := time.Now().UTC()
+	d.attempts++
+
+	// Figure out the outcome
+	status := models.WebhookDeliveryStatusDelivered
+	errMsg := ""
+	if err != nil {
+		logger.Warningf("webhookService.deliver: attempt %d to deliver %s failed: %v", d.attempts, d.deliveryHex, err)
+		errMsg = err.Error()
+		if len(errMsg) > webhookErrorMaxLen {
+			errMsg = errMsg[:webhookErrorMaxLen]
+		}
+		if d.attempts < webhookMaxAttempts {
+			status = models.WebhookDeliveryStatusPending
+		} else {
+			status = models.WebhookDeliveryStatusFailed
+		}
+	}
+
+	// Update the delivery record
+	err = db.Exec(
+		"update webhookdeliveries "+
+			"set status=$1, attempts=$2, responsecode=$3, lasterror=$4, lastattemptdate=$5, nextattemptdate=$6 "+
+			"where deliveryhex=$7;",
+		status, d.attempts, code, errMsg, now, now.Add(webhookRetryDelay(d.attempts)), d.deliveryHex)
+	if err != nil {
+		logger.Errorf("webhookService.deliver: Exec() failed: %v", err)
+	}
+}
+
+// deliverDue attempts to deliver all payloads that are due
+func (svc *webhookService) deliverDue() {
+	for {
+		// Fetch a batch of due deliveries
+		ds, err := svc.fetchDue()
+		if err != nil || len(ds) == 0 {
+			return
+		}
+
+		// Deliver them one by one
+		for _, d := range ds {
+			svc.deliver(d)
+		}
+
+		// If the batch wasn't full, we're done
+		if len(ds) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// fetchDue returns a batch of pending deliveries, whose next attempt is due
+func (svc *webhookService) fetchDue() ([]*webhookDelivery, error) {
+	// Don't bother if the database is gone (e.g. the server is shutting down)
+	if db == nil {
+		return nil, nil
+	}
+
+	// Claim the deliveries by postponing their next attempt, so that other replicas don't pick them up as well. Should
+	// this replica fail to deliver them, they are retried once the claim expires
+	now := time.Now().UTC()
+	rows, err := db.Query(
+		"with due as ("+
+			"select deliveryhex from webhookdeliveries "+
+			"where status=$1 and nextattemptdate<=$2 "+
+			"order by nextattemptdate "+
+			"limit $3 "+
+			"for update skip locked) "+
+			"update webhookdeliveries d set nextattemptdate=$4 "+
+			"from due, webhooks w "+
+			"where d.deliveryhex=due.deliveryhex and w.webhookhex=d.webhookhex "+
+			"returning d.deliveryhex, d.event, d.payload, d.attempts, w.url, w.secret;",
+		models.WebhookDeliveryStatusPending, now, webhookBatchSize, now.Add(webhookClaimTimeout))
+	if err != nil {
+		logger.Errorf("webhookService.fetchDue: Query() failed: %v", err)
+		return nil, translateDBErrors(err)
+	}
+	defer rows.Close()
+
+	// Fetch the deliveries
+	var res []*webhookDelivery
+	for rows.Next() {
+		d := webhookDelivery{}
+		if err = rows.Scan(&d.deliveryHex, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			logger.Errorf("webhookService.fetchDue: rows.Scan() failed: %v", err)
+			return nil, translateDBErrors(err)
+		}
+		res = append(res, &d)
+	}
+
+	// Check that Next() didn't error
+	if err := rows.Err(); err != nil {
+		logger.Errorf("webhookService.fetchDue: Next() failed: %v", err)
+		return nil, err
+	}
+
+	// Succeeded
+	return res, nil
+}
+
+// checkWebhookURL verifies the given string is an absolute http(s) URL
+func checkWebhookURL(s string) error {
+	_, err := util.ParseAbsoluteURL(s)
+	return err
+}
+
+// hasWebhookEvent returns whether the given event is in the list
+func hasWebhookEvent(events []models.WebhookEvent, event models.WebhookEvent) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// joinWebhookEvents converts a list of events into a comma-separated string
+func joinWebhookEvents(events []models.WebhookEvent) string {
+	ss := make([]string, len(events))
+	for i, e := range events {
+		ss[i] = string(e)
+	}
+	return strings.Join(ss, ",")
+}
+
+// postWebhookPayload POSTs the delivery's payload to the webhook URL, returning the response status code (0 if there
+// was no response)
+func postWebhookPayload(d *webhookDelivery) (int, error) {
+	// Sign the payload
+	signature, err := webhookSignature(d.secret, []byte(d.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	// Make sure the URL is an http(s) one
+	if err := checkWebhookURL(d.url); err != nil {
+		return 0, err
+	}
+
+	// Prepare a request
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewBufferString(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Comentario-Event", string(d.event))
+	req.Header.Set("X-Comentario-Delivery", string(d.deliveryHex))
+	req.Header.Set("X-Comentario-Signature", "sha256="+signature)
+
+	// Post the request
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Only accept a success status code
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with HTTP status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// splitWebhookEvents converts a comma-separated string into a list of events
+func splitWebhookEvents(s string) []models.WebhookEvent {
+	var res []models.WebhookEvent
+	for _, e := range strings.Split(s, ",") {
+		if e != "" {
+			res = append(res, models.WebhookEvent(e))
+		}
+	}
+	return res
+}
+
+// webhookRetryDelay returns the delay before the next attempt, given the number of attempts made so far
+func webhookRetryDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	return webhookRetryBaseDelay << (attempts - 1)
+}
+
+// webhookSignature returns a hex-encoded HMAC-SHA256 signature of the payload, keyed with the given hex-encoded secret
+func webhookSignature(secret string, payload []byte) (string, error) {
+	key, err := hex.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
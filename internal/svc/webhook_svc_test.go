@@ -0,0 +1,146 @@
+package svc
+
+import (
+	"gitlab.com/comentario/comentario/internal/api/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_postWebhookPayload(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	const payload = `{"event":"new"}`
+	tests := []struct {
+		name     string
+		status   int
+		wantCode int
+		wantErr  bool
+	}{
+		{"accepted", http.StatusNoContent, http.StatusNoContent, false},
+		{"rejected", http.StatusInternalServerError, http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start a receiver that verifies the signature
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				sig, _ := webhookSignature(secret, body)
+				if got := r.Header.Get("X-Comentario-Signature"); got != "sha256="+sig {
+					t.Errorf("postWebhookPayload() signature = %v, want %v", got, "sha256="+sig)
+				}
+				if got := r.Header.Get("X-Comentario-Event"); got != "new" {
+					t.Errorf("postWebhookPayload() event = %v, want new", got)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			// The receiver listens on a loopback address, which the public client refuses to connect to
+			defer func(c *http.Client) { webhookClient = c }(webhookClient)
+			webhookClient = srv.Client()
+
+			code, err := postWebhookPayload(&webhookDelivery{event: models.WebhookEventNew, payload: payload, url: srv.URL, secret: secret})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("postWebhookPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.wantCode {
+				t.Errorf("postWebhookPayload() code = %v, want %v", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_splitWebhookEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []models.WebhookEvent
+	}{
+		{"empty   ", "", nil},
+		{"single  ", "new", []models.WebhookEvent{models.WebhookEventNew}},
+		{"multiple", "new,vote,flag", []models.WebhookEvent{models.WebhookEventNew, models.WebhookEventVote, models.WebhookEventFlag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitWebhookEvents(tt.s)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitWebhookEvents() = %v, want %v", got, tt.want)
+			}
+
+			// Joining must produce the original string
+			if s := joinWebhookEvents(got); s != tt.s {
+				t.Errorf("joinWebhookEvents() = %v, want %v", s, tt.s)
+			}
+		})
+	}
+}
+
+func Test_webhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		want     time.Duration
+	}{
+		{"none ", 0, 0},
+		{"first", 1, 30 * time.Second},
+		{"third", 3, 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := webhookRetryDelay(tt.attempts); got != tt.want {
+				t.Errorf("webhookRetryDelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_webhookSignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		payload string
+		want    string
+		wantErr bool
+	}{
+		{"invalid secret", "xyz", "", "", true},
+		// Reference value: echo -n 'Hello' | openssl dgst -sha256 -mac HMAC -macopt hexkey:00ff
+		{"valid secret  ", "00ff", "Hello", "1db6ef67c3d894cdf65c651aabc301d69e40364fa7e6559b90a591a0305ff920", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := webhookSignature(tt.secret, []byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("webhookSignature() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("webhookSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkWebhookURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"https", "https://example.com/hooks/comentario", false},
+		{"http without path", "http://example.com", false},
+		{"empty", "", true},
+		{"relative", "/hooks/comentario", true},
+		{"file", "file:///etc/passwd", true},
+		{"gopher", "gopher://example.com/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkWebhookURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("checkWebhookURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
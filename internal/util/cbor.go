@@ -0,0 +1,126 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// errCBORMalformed is returned when CBOR data cannot be decoded
+var errCBORMalformed = errors.New("malformed CBOR data")
+
+// cborDecode decodes a single CBOR (RFC 8949) data item from the beginning of b, and returns it along with the
+// remaining bytes. Only the subset used by WebAuthn is supported: integers (as int64), byte strings ([]byte), text
+// strings (string), arrays ([]any), maps (map[any]any), booleans and null. Tags are skipped, indefinite lengths and
+// floats aren't supported
+func cborDecode(b []byte) (any, []byte, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+// cborDecodeDepth decodes a data item at the given nesting depth, limiting the latter to protect against stack
+// exhaustion
+func cborDecodeDepth(b []byte, depth int) (any, []byte, error) {
+	if len(b) == 0 || depth > 16 {
+		return nil, nil, errCBORMalformed
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	// Simple values (major type 7) don't carry an argument
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		return nil, nil, errCBORMalformed
+	}
+
+	// Decode the argument
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errCBORMalformed
+	}
+
+	switch major {
+	// Unsigned integer
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBORMalformed
+		}
+		return int64(arg), b, nil
+
+	// Negative integer
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBORMalformed
+		}
+		return -1 - int64(arg), b, nil
+
+	// Byte or text string
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBORMalformed
+		}
+		if major == 2 {
+			return b[:arg], b[arg:], nil
+		}
+		return string(b[:arg]), b[arg:], nil
+
+	// Array
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBORMalformed
+		}
+		res := make([]any, arg)
+		for i := range res {
+			var err error
+			if res[i], b, err = cborDecodeDepth(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return res, b, nil
+
+	// Map
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBORMalformed
+		}
+		res := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := cborDecodeDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Only integer and text keys can be used in a Go map
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBORMalformed
+			}
+			if res[k], b, err = cborDecodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return res, b, nil
+
+	// Tag: skip it and return the tagged item
+	case 6:
+		return cborDecodeDepth(b, depth+1)
+	}
+	return nil, nil, errCBORMalformed
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"testing"
+)
+
+// cborHead returns the CBOR head of a data item of the given major type and argument
+func cborHead(major byte, arg int) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg < 256:
+		return []byte{major<<5 | 24, byte(arg)}
+	}
+	return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+}
+
+// cborInt returns the CBOR encoding of an integer
+func cborInt(i int) []byte {
+	if i < 0 {
+		return cborHead(1, -1-i)
+	}
+	return cborHead(0, i)
+}
+
+// cborBytes returns the CBOR encoding of a byte string
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+// cborText returns the CBOR encoding of a text string
+func cborText(s string) []byte {
+	return append(cborHead(3, len(s)), s...)
+}
+
+// cborMap returns the CBOR encoding of a map with the given number of entries, encoded as key-value pairs
+func cborMap(n int, kvs ...[]byte) []byte {
+	res := cborHead(5, n)
+	for _, b := range kvs {
+		res = append(res, b...)
+	}
+	return res
+}
+
+func Test_cborDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    any
+		wantErr bool
+	}{
+		{"small int   ", cborInt(10), int64(10), false},
+		{"byte int    ", cborInt(200), int64(200), false},
+		{"negative    ", cborInt(-257), int64(-257), false},
+		{"text        ", cborText("abc"), "abc", false},
+		{"true        ", []byte{0xf5}, true, false},
+		{"null        ", []byte{0xf6}, nil, false},
+		{"empty       ", nil, nil, true},
+		{"truncated   ", []byte{0x63, 'a'}, nil, true},
+		{"float       ", []byte{0xf9, 0, 0}, nil, true},
+		{"indefinite  ", []byte{0x5f}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := cborDecode(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("cborDecode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("cborDecode() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
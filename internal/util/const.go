@@ -14,23 +14,40 @@ const (
 
 	OneDay = 24 * time.Hour // Time unit representing one day
 
+	ConfirmationTokenTTL = 2 * OneDay       // How long an emailed confirmation link stays valid
+	InvitationTTL        = 7 * OneDay       // How long an emailed domain invitation stays valid
+	MagicLinkTTL         = 15 * time.Minute // How long an emailed sign-in link stays valid
+	StreamTicketTTL      = time.Minute      // How long a ticket for opening a comment event stream stays valid
+
+	APITokenMinDays = 1   // Min number of days an API token can stay valid for
+	APITokenMaxDays = 365 // Max number of days an API token can stay valid for
+
 	DBMaxAttempts = 10 // Max number of attempts to connect to the database
 
+	ModerationQueuePageSize = 25 // Default number of comments returned in a moderation queue page
+
 	CookieNameUserToken   = "comentario_user_token"    // Cookie name to store the token of the authenticated (owner) user
 	CookieNameAuthSession = "_comentario_auth_session" // Cookie name to store the federated authentication session ID
+	CookieNameMagicLink   = "_comentario_magic_link"   // Cookie name to store the nonce binding a sign-in link to the browser
 	LangCookieDuration    = 365 * OneDay               // How long the language cookie stays valid
 	HeaderCommenterToken  = "X-Commenter-Token"        // Name of the header that contains the token of the authenticated commenter user
+
+	MastodonIdPPrefix = "mastodon:" // Prefix of the IDs of Mastodon-compatible identity providers, followed by the instance host
+	OIDCIdPPrefix     = "oidc:"     // Prefix of the IDs of generic OpenID Connect identity providers
 )
 
 var (
 	WrongAuthDelay = 10 * time.Second // Delay to exercise on a wrong email, password etc.
 
-	// FederatedIdProviders maps all known federated identity providers from our IDs to goth IDs
-	FederatedIdProviders = map[string]string{
-		"github":  "github",
-		"gitlab":  "gitlab",
-		"google":  "google",
-		"twitter": "twitter",
+	EventStreamKeepAliveInterval = 30 * time.Second // Interval between keep-alive messages in an event stream
+
+	// FederatedIdProviders maps all known federated identity providers by their IDs. Generic OpenID Connect providers
+	// get added on configuration
+	FederatedIdProviders = map[string]FederatedIdProvider{
+		"github":  {GothID: "github", Name: "GitHub"},
+		"gitlab":  {GothID: "gitlab", Name: "GitLab"},
+		"google":  {GothID: "google", Name: "Google"},
+		"twitter": {GothID: "twitter", Name: "Twitter"},
 	}
 
 	// UILanguageTags stores tags of supported frontend languages
@@ -48,3 +65,10 @@ var (
 		"comentario.css": true,
 	}
 )
+
+// FederatedIdProvider describes a federated identity provider
+type FederatedIdProvider struct {
+	GothID string // ID of the goth provider
+	Name   string // Display name
+	Icon   string // Icon URL. Empty for built-in providers, which come with icons of their own
+}
@@ -5,31 +5,61 @@ import (
 )
 
 var (
+	ErrorAPITokenScope            = errors.New("the API token's scope doesn't allow doing that")
 	ErrorBadCommentoExportVersion = errors.New("unsupported Commento export format version")
+	ErrorBanned                   = errors.New("you are not allowed to comment on this domain")
 	ErrorCannotDeleteOwner        = errors.New("you cannot delete your account until all domains associated with your account are deleted")
 	ErrorCannotUpdateOauthProfile = errors.New("you cannot update the profile of an external account managed by third-party log in. Please use the appropriate platform to update your details")
 	ErrorCommentDeleted           = errors.New("this comment has been deleted")
+	ErrorCommentNotRestorable     = errors.New("this comment can no longer be restored")
 	ErrorDatabaseMigration        = errors.New("encountered error applying database migration")
-	ErrorDomainFrozen             = errors.New("cannot add a new comment because that domain is frozen")
+	ErrorDomainAlreadyExists      = errors.New("that domain has already been registered")
+	ErrorDomainFrozen             = errors.New("that domain is frozen and doesn't accept any changes")
+	ErrorDomainUnverified         = errors.New("cannot add a new comment because that domain's ownership hasn't been verified yet")
+	ErrorEmailAlreadyConfirmed    = errors.New("your email address is already confirmed")
 	ErrorEmailAlreadyExists       = errors.New("that email address has already been registered")
 	ErrorInternal                 = errors.New("an internal error has occurred. If you see this repeatedly, please contact support")
 	ErrorInvalidAction            = errors.New("invalid action")
+	ErrorInvalidCommenterToken    = errors.New("invalid or missing commenter token")
+	ErrorInvalidCursor            = errors.New("invalid pagination cursor")
 	ErrorInvalidDomainHost        = errors.New("invalid domain name; it must be a 'host' or 'host:port' value")
 	ErrorInvalidDomainURL         = errors.New("invalid input; provide a valid domain name or a complete URL")
+	ErrorInvalidEmailDomain       = errors.New("invalid email domain; it must be a host name, such as 'example.com'")
 	ErrorInvalidEmailPassword     = errors.New("invalid email/password combination")
+	ErrorInvalidIP                = errors.New("invalid IP address or range")
+	ErrorInvalidMastodonInstance  = errors.New("invalid Mastodon instance; it must be a host name, such as 'mastodon.social'")
+	ErrorInvalidTOTPCode          = errors.New("invalid two-factor authentication code")
+	ErrorInvalidTokenExpiry       = errors.New("invalid token expiry; it must be between 1 and 365 days")
+	ErrorInvalidWebhookURL        = errors.New("invalid webhook URL; it must be an absolute http or https URL")
+	ErrorInvitationEmail          = errors.New("this invitation was sent to a different email address. Please sign in with that address to accept it")
+	ErrorLastDomainOwner          = errors.New("a domain must have at least one owner")
 	ErrorMalformedTemplate        = errors.New("a template is malformed")
 	ErrorMissingConfig            = errors.New("missing config environment variable")
 	ErrorMissingField             = errors.New("one or more field(s) empty")
+	ErrorModerator2FARequired     = errors.New("this domain requires moderators to sign in with two-factor authentication")
 	ErrorNewOwnerForbidden        = errors.New("new owner registration is disabled")
 	ErrorNoDisqusURL              = errors.New("export file must be hosted on disqus.com")
-	ErrorNotDomainOwner           = errors.New("you need to be a domain owner to do that")
-	ErrorNotModerator             = errors.New("you need to be a moderator to do that")
+	ErrorNoDomainPermission       = errors.New("your role in the domain doesn't allow doing that")
+	ErrorNotSuperuser             = errors.New("only instance superusers are allowed to do that")
 	ErrorOAuthNotConfigured       = errors.New("OAuth is not configured for this identity provider")
 	ErrorPageLocked               = errors.New("unable to add comment: the page is locked")
-	ErrorSelfVote                 = errors.New("you cannot vote on your own comment")
+	ErrorPasswordBreached         = errors.New("this password is known to have leaked in a data breach. Please choose a different one")
+	ErrorPasswordTooShort         = errors.New("the password is too short")
 	ErrorSMTPNotConfigured        = errors.New("SMTP is not configured")
 	ErrorSSOURLMissing            = errors.New("SSO URL is missing")
+	ErrorSelfReport               = errors.New("you cannot report your own comment")
+	ErrorSelfSuspend              = errors.New("you cannot suspend yourself")
+	ErrorSelfVote                 = errors.New("you cannot vote on your own comment")
+	ErrorSignupNotAllowed         = errors.New("signing up with this email domain is not allowed")
+	ErrorTOTPAlreadyEnabled       = errors.New("two-factor authentication is already enabled")
+	ErrorTOTPLocked               = errors.New("too many wrong two-factor authentication codes. Please try again later")
+	ErrorTOTPNotEnabled           = errors.New("two-factor authentication is not enabled")
+	ErrorTOTPNotSetUp             = errors.New("two-factor authentication hasn't been set up yet")
+	ErrorTOTPRequired             = errors.New("you have to sign in with two-factor authentication in order to do that")
+	ErrorTooManyRequests          = errors.New("too many requests, please try again later")
 	ErrorUnauthenticated          = errors.New("you have to be authenticated in order to do that")
 	ErrorUnconfirmedEmail         = errors.New("your email address is still unconfirmed. Please confirm your email address before proceeding")
 	ErrorUnknownIdP               = errors.New("unknown identity provider")
+	ErrorUserSuspended            = errors.New("your account has been suspended")
+	ErrorWebAuthnFailed           = errors.New("passkey verification failed")
 )
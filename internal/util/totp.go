@@ -0,0 +1,88 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPDigits    = 6                // Number of digits in a TOTP code
+	TOTPPeriod    = 30 * time.Second // Validity period of a TOTP code
+	TOTPSkew      = 1                // Number of periods before and after the current one a code is still accepted for
+	totpSecretLen = 20               // Length of a generated TOTP secret, in bytes
+)
+
+// totpEncoding is the encoding of TOTP secrets, as understood by authenticator apps
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPCode returns the RFC 6238 code for the given (base32-encoded) secret and time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	// Calculate an HMAC of the step counter (RFC 4226)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	// Apply dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, code%uint32(math.Pow10(TOTPDigits))), nil
+}
+
+// TOTPNewSecret generates and returns a new random, base32-encoded TOTP secret
+func TOTPNewSecret() (string, error) {
+	b := make([]byte, totpSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPProvisioningURI returns an otpauth:// URI for registering the given secret with an authenticator app, usually
+// rendered as a QR code
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TOTPDigits))
+	q.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// TOTPStep returns the TOTP time step for the given time
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// TOTPVerify checks the given code against the secret for the given time, allowing for TOTPSkew periods of clock drift.
+// Returns the matching time step, or 0 if the code doesn't match. Steps not after notAfter are rejected, which prevents
+// a code from being used twice
+func TOTPVerify(secret, code string, t time.Time, notAfter int64) int64 {
+	step := TOTPStep(t)
+	for s := step - TOTPSkew; s <= step+TOTPSkew; s++ {
+		if s <= notAfter {
+			continue
+		}
+		if c, err := TOTPCode(secret, s); err == nil && subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return s
+		}
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 secret used in the RFC 6238 test vectors
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B vectors, truncated to 6 digits
+	tests := []struct {
+		name    string
+		unix    int64
+		want    string
+		wantErr bool
+	}{
+		{"59        ", 59, "287082", false},
+		{"1111111109", 1111111109, "081804", false},
+		{"1111111111", 1111111111, "050471", false},
+		{"1234567890", 1234567890, "005924", false},
+		{"2000000000", 2000000000, "279037", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TOTPCode() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("TOTPCode() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPCode_badSecret(t *testing.T) {
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Errorf("TOTPCode() expected an error")
+	}
+}
+
+func TestTOTPNewSecret(t *testing.T) {
+	s, err := TOTPNewSecret()
+	if err != nil {
+		t.Fatalf("TOTPNewSecret() error = %v", err)
+	}
+	if len(s) != 32 {
+		t.Errorf("TOTPNewSecret() got length %d, want 32", len(s))
+	}
+	if _, err := TOTPCode(s, 1); err != nil {
+		t.Errorf("TOTPNewSecret() produced an unusable secret: %v", err)
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	got := TOTPProvisioningURI("Comentario", "ace@comentario.app", "ABCD")
+	for _, want := range []string{"otpauth://totp/Comentario:ace@comentario.app?", "secret=ABCD", "issuer=Comentario", "digits=6", "period=30"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("TOTPProvisioningURI() = %v, want it to contain %v", got, want)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := TOTPStep(now)
+	tests := []struct {
+		name     string
+		code     string
+		t        time.Time
+		notAfter int64
+		want     int64
+	}{
+		{"current step     ", "081804", now, 0, step},
+		{"previous step    ", "081804", now.Add(TOTPPeriod), 0, step},
+		{"next step        ", "081804", now.Add(-TOTPPeriod), 0, step},
+		{"too old          ", "081804", now.Add(2 * TOTPPeriod), 0, 0},
+		{"already used     ", "081804", now, step, 0},
+		{"wrong code       ", "123456", now, 0, 0},
+		{"empty code       ", "", now, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TOTPVerify(rfc6238Secret, tt.code, tt.t, tt.notAfter); got != tt.want {
+				t.Errorf("TOTPVerify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package util
 
 import (
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/microcosm-cc/bluemonday"
@@ -17,6 +20,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -46,6 +50,28 @@ var (
 
 	// AppMailer is a Mailer implementation available application-wide. Defaults to a mailer that doesn't do anything
 	AppMailer Mailer = &noOpMailer{}
+
+	// TrustedProxies is a list of networks of the reverse proxies whose X-Forwarded-For header UserIP() relies on
+	TrustedProxies []*net.IPNet
+
+	// reservedNets is a list of special-purpose networks not covered by the net.IP methods, which aren't reachable on
+	// the public internet, or may be translated into a non-public address
+	reservedNets = mustParseCIDRs(
+		"0.0.0.0/8",       // "This" network
+		"100.64.0.0/10",   // Shared address space (carrier-grade NAT)
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // Documentation (TEST-NET-1)
+		"198.18.0.0/15",   // Benchmarking
+		"198.51.100.0/24", // Documentation (TEST-NET-2)
+		"203.0.113.0/24",  // Documentation (TEST-NET-3)
+		"240.0.0.0/4",     // Reserved, including the limited broadcast address
+		"64:ff9b::/96",    // IPv4/IPv6 translation
+		"64:ff9b:1::/48",  // Local-use IPv4/IPv6 translation
+		"100::/64",        // Discard-only
+		"2001::/23",       // IETF protocol assignments, including Teredo
+		"2001:db8::/32",   // Documentation
+		"2002::/16",       // 6to4
+	)
 )
 
 // ----------------------------------------------------------------------------------------------------------------------
@@ -79,6 +105,13 @@ func DownloadGzip(dataURL string) ([]byte, error) {
 	}
 }
 
+// HMACHex returns a hex-encoded HMAC-SHA256 of the given string, keyed with the given key
+func HMACHex(key, s string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // HTMLDocumentTitle parses and returns the title of an HTML document
 func HTMLDocumentTitle(body io.Reader) (string, error) {
 	// Iterate the body's tokens
@@ -129,6 +162,21 @@ func HTMLTitleFromURL(url string) (string, error) {
 	return HTMLDocumentTitle(resp.Body)
 }
 
+// IsPublicIP returns whether the given IP address is reachable on the public internet, i.e. isn't a loopback, private,
+// link-local, multicast, unspecified, or otherwise reserved one
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
 // IsValidURL returns whether the passed string is a valid absolute URL
 func IsValidURL(s string) bool {
 	_, err := ParseAbsoluteURL(s)
@@ -212,6 +260,39 @@ func MarkdownToHTML(markdown string) string {
 	return string(markdownPolicy.SanitizeBytes(unsafe))
 }
 
+// NewPublicHTTPClient returns a new HTTP client with the given timeout, which refuses to connect to any address that
+// isn't a public one, see IsPublicIP(). It's meant for requests to hosts supplied by users
+func NewPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// Verify the address after it's been resolved, so that DNS records can't point the request elsewhere
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !IsPublicIP(net.ParseIP(host)) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+		// Only follow redirects to http(s) URLs. The address they point to is verified by the dialer again
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing to follow redirect to '%s' URL", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
 // ParseAbsoluteURL parses and returns the passed string as an absolute URL
 func ParseAbsoluteURL(s string) (*url.URL, error) {
 	// Parse the base URL
@@ -231,8 +312,10 @@ func ParseAbsoluteURL(s string) (*url.URL, error) {
 		return nil, fmt.Errorf("invalid URL host: '%s'", u.Host)
 	}
 
-	// Verify it's a URL with a path starting with "/"
-	if !strings.HasPrefix(u.Path, "/") {
+	// Verify it's a URL with a path starting with "/". An empty path stands for the root
+	if u.Path == "" {
+		u.Path = "/"
+	} else if !strings.HasPrefix(u.Path, "/") {
 		return nil, fmt.Errorf("invalid URL path (must begin with '/'): '%s'", u.Path)
 	}
 
@@ -253,15 +336,60 @@ func UserAgent(r *http.Request) string {
 	return r.Header.Get("User-Agent")
 }
 
-// UserIP tries to determine the user IP
+// UserIP tries to determine the user IP, without a port. The X-Forwarded-For header is only taken into account when
+// the request comes from one of TrustedProxies, in which case the rightmost address not belonging to them is used: all
+// addresses to the left of it could have been made up by the client
 func UserIP(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = r.RemoteAddr
+	ip := stripPort(r.RemoteAddr)
+	if isTrustedProxy(ip) {
+		addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := stripPort(strings.TrimSpace(addrs[i]))
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !isTrustedProxy(addr) {
+				break
+			}
+		}
 	}
 	return ip
 }
 
+// isTrustedProxy returns whether the given IP address belongs to one of TrustedProxies
+func isTrustedProxy(s string) bool {
+	if ip := net.ParseIP(s); ip != nil {
+		for _, n := range TrustedProxies {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mustParseCIDRs parses the given CIDR strings into a list of networks, and panics if any of them is invalid
+func mustParseCIDRs(ss ...string) []*net.IPNet {
+	res := make([]*net.IPNet, len(ss))
+	for i, s := range ss {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		res[i] = n
+	}
+	return res
+}
+
+// stripPort removes the port, if any, from the given IP address, also removing brackets around an IPv6 one
+func stripPort(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return strings.Trim(s, "[]")
+}
+
 var markdownPolicy *bluemonday.Policy
 var markdownRenderer blackfriday.Renderer
 
@@ -3,11 +3,34 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
+func TestHMACHex(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		s    string
+		want string
+	}{
+		{"empty key and string", "", "", "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+		{"RFC 4231 test case 2", "Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HMACHex(tt.key, tt.s); got != tt.want {
+				t.Errorf("HMACHex() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestHTMLDocumentTitle(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -35,6 +58,44 @@ func TestHTMLDocumentTitle(t *testing.T) {
 	}
 }
 
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"invalid          ", "", false},
+		{"public IPv4      ", "93.184.216.34", true},
+		{"loopback         ", "127.0.0.1", false},
+		{"private          ", "10.1.2.3", false},
+		{"link-local       ", "169.254.169.254", false},
+		{"unspecified      ", "0.0.0.0", false},
+		{"this network     ", "0.1.2.3", false},
+		{"CGNAT            ", "100.64.0.1", false},
+		{"CGNAT last       ", "100.127.255.255", false},
+		{"after CGNAT      ", "100.128.0.1", true},
+		{"benchmarking     ", "198.18.0.1", false},
+		{"documentation    ", "203.0.113.7", false},
+		{"reserved         ", "240.0.0.1", false},
+		{"broadcast        ", "255.255.255.255", false},
+		{"mapped private   ", "::ffff:10.0.0.1", false},
+		{"mapped public    ", "::ffff:93.184.216.34", true},
+		{"public IPv6      ", "2606:2800:220:1::1", true},
+		{"loopback IPv6    ", "::1", false},
+		{"unique local IPv6", "fd00::1", false},
+		{"NAT64            ", "64:ff9b::a00:1", false},
+		{"6to4             ", "2002:a00:1::1", false},
+		{"Teredo           ", "2001:0:a00:1::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsPublicIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIsValidURL(t *testing.T) {
 	tests := []struct {
 		name string
@@ -50,6 +111,7 @@ func TestIsValidURL(t *testing.T) {
 		{"ftp URL path      ", "ftp://example.org/path", false},
 		{"ftp URL path#     ", "ftp://example.org/path#foo", false},
 		{"http URL root     ", "http://example.org/path#foo", true},
+		{"http URL no path  ", "http://example.org", true},
 		{"http URL path     ", "http://example.org/path", true},
 		{"http URL path,#   ", "http://example.org/path#foo", true},
 		{"http URL path,?,# ", "http://example.org/path?param=value&x=42#foo", true},
@@ -398,6 +460,24 @@ func TestMarkdownToHTML(t *testing.T) {
 	}
 }
 
+func TestNewPublicHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// The test server listens on a loopback address, so a plain client reaches it, but a public one must not
+	if resp, err := http.Get(srv.URL); err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	} else {
+		_ = resp.Body.Close()
+	}
+	if resp, err := NewPublicHTTPClient(time.Second).Get(srv.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Errorf("NewPublicHTTPClient().Get() expected an error for a loopback address")
+	}
+}
+
 func TestSafeStringMap(t *testing.T) {
 	m := SafeStringMap[string]{}
 	var wg sync.WaitGroup
@@ -430,3 +510,38 @@ func TestSafeStringMap(t *testing.T) {
 		t.Errorf("SafeStringMap.Len() returned %d, want 0", got)
 	}
 }
+
+func TestUserIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	TrustedProxies = []*net.IPNet{proxies}
+	defer func() { TrustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct IPv4", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"direct IPv6", "[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"direct, forwarded ignored", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"proxy, no forwarded", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"proxy, forwarded", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"proxy, forwarded with port", "10.0.0.1:1234", "198.51.100.7:5678", "198.51.100.7"},
+		{"proxy, spoofed list", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"proxy, garbage", "10.0.0.1:1234", "198.51.100.7, whatever", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := UserIP(r); got != tt.want {
+				t.Errorf("UserIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	webAuthnFlagUP = 0x01 // Authenticator data flag: user present
+	webAuthnFlagUV = 0x04 // Authenticator data flag: user verified
+	webAuthnFlagAT = 0x40 // Authenticator data flag: attested credential data included
+
+	webAuthnChallengeLen = 32 // Length of a generated challenge, in bytes
+)
+
+// WebAuthnEncoding is the encoding of binary values exchanged with WebAuthn clients
+var WebAuthnEncoding = base64.RawURLEncoding
+
+// WebAuthnCredential is a public key credential registered with an authenticator
+type WebAuthnCredential struct {
+	ID        []byte // Credential ID
+	PublicKey []byte // Credential public key, in the PKIX form
+	SignCount uint32 // Signature counter last reported by the authenticator
+}
+
+// WebAuthnRelyingParty is the party (that is, the server) WebAuthn ceremonies are performed for
+type WebAuthnRelyingParty struct {
+	ID     string // RP ID: the host name credentials are scoped to
+	Origin string // Origin of the pages performing ceremonies, such as "https://comments.example.com"
+}
+
+// WebAuthnNewChallenge generates and returns a new random, base64url-encoded challenge
+func WebAuthnNewChallenge() (string, error) {
+	b := make([]byte, webAuthnChallengeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return WebAuthnEncoding.EncodeToString(b), nil
+}
+
+// ParseRegistration verifies the response of a registration ceremony (navigator.credentials.create()) performed for
+// the given challenge, and returns the newly registered credential. Attestation statements aren't verified, as
+// credentials are requested with "none" attestation
+func (rp *WebAuthnRelyingParty) ParseRegistration(challenge string, clientDataJSON, attestationObject []byte) (*WebAuthnCredential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	// Decode the attestation object and extract the authenticator data from it
+	v, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	ao, ok := v.(map[any]any)
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	authData, ok := ao["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("attestation object has no authData")
+	}
+	signCount, err := rp.verifyAuthData(authData, webAuthnFlagAT)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the attested credential data: AAGUID (16 bytes), credential ID length (2 bytes), credential ID, and
+	// credential public key
+	acd := authData[37:]
+	if len(acd) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(acd[16:18]))
+	if idLen == 0 || len(acd) < 18+idLen {
+		return nil, errors.New("invalid credential ID length")
+	}
+	id := acd[18 : 18+idLen]
+	pubKey, err := webAuthnParseCOSEKey(acd[18+idLen:])
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Succeeded
+	return &WebAuthnCredential{ID: bytes.Clone(id), PublicKey: der, SignCount: signCount}, nil
+}
+
+// VerifyAssertion verifies the response of an authentication ceremony (navigator.credentials.get()) performed for
+// the given challenge with the given credential, and returns the new signature counter value
+func (rp *WebAuthnRelyingParty) VerifyAssertion(challenge string, cred *WebAuthnCredential, clientDataJSON, authData, signature []byte) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	signCount, err := rp.verifyAuthData(authData, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// Verify the signature, which covers the authenticator data followed by the client data hash
+	pubKey, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	cdHash := sha256.Sum256(clientDataJSON)
+	msg := append(bytes.Clone(authData), cdHash[:]...)
+	if err := webAuthnVerifySignature(pubKey, msg, signature); err != nil {
+		return 0, err
+	}
+
+	// A counter that doesn't increase signals a cloned authenticator. Authenticators not supporting counters always
+	// report zero
+	if (signCount != 0 || cred.SignCount != 0) && signCount <= cred.SignCount {
+		return 0, errors.New("signature counter did not increase")
+	}
+
+	// Succeeded
+	return signCount, nil
+}
+
+// verifyAuthData verifies the given authenticator data belongs to this relying party, and that the user was both
+// present and verified. Returns the signature counter value
+func (rp *WebAuthnRelyingParty) verifyAuthData(authData []byte, extraFlags byte) (uint32, error) {
+	// Authenticator data starts with RP ID hash (32 bytes), flags (1 byte), and signature counter (4 bytes)
+	if len(authData) < 37 {
+		return 0, errors.New("authenticator data is too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData[:32], rpIDHash[:]) != 1 {
+		return 0, errors.New("RP ID hash mismatch")
+	}
+	if flags := webAuthnFlagUP | webAuthnFlagUV | extraFlags; authData[32]&flags != flags {
+		return 0, fmt.Errorf("authenticator flags %#x lack %#x", authData[32], flags)
+	}
+	return binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+// verifyClientData verifies the given client data was collected by this relying party's origin for a ceremony of the
+// given type with the given challenge
+func (rp *WebAuthnRelyingParty) verifyClientData(clientDataJSON []byte, typ, challenge string) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return err
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("client data type is %q, want %q", cd.Type, typ)
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if cd.Origin != rp.Origin {
+		return fmt.Errorf("client data origin is %q, want %q", cd.Origin, rp.Origin)
+	}
+	return nil
+}
+
+// webAuthnParseCOSEKey parses a COSE_Key (RFC 9053) into a public key. Supported are the ES256 (P-256), RS256, and
+// EdDSA (Ed25519) algorithms
+func webAuthnParseCOSEKey(b []byte) (crypto.PublicKey, error) {
+	v, _, err := cborDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := v.(map[any]any)
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+	kty, _ := k[int64(1)].(int64)
+	alg, _ := k[int64(3)].(int64)
+	switch {
+	// EC2 key with ES256
+	case kty == 2 && alg == -7:
+		crv, _ := k[int64(-1)].(int64)
+		x, _ := k[int64(-2)].([]byte)
+		y, _ := k[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid EC2 COSE key")
+		}
+		pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pk.Curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("EC2 COSE key point is not on the curve")
+		}
+		return pk, nil
+
+	// RSA key with RS256
+	case kty == 3 && alg == -257:
+		n, _ := k[int64(-1)].([]byte)
+		e, _ := k[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA COSE key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	// OKP key with EdDSA
+	case kty == 1 && alg == -8:
+		crv, _ := k[int64(-1)].(int64)
+		x, _ := k[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP COSE key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+// webAuthnVerifySignature verifies the signature of the given message with the given public key
+func webAuthnVerifySignature(pubKey crypto.PublicKey, msg, sig []byte) error {
+	switch pk := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(msg)
+		if !ecdsa.VerifyASN1(pk, h[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		h := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(pk, crypto.SHA256, h[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pk, msg, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", pubKey)
+}
@@ -0,0 +1,166 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// testRP is the relying party used in WebAuthn tests
+var testRP = &WebAuthnRelyingParty{ID: "comentario.app", Origin: "https://comentario.app"}
+
+// testAuthenticator is a software authenticator holding a single ES256 credential
+type testAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	return &testAuthenticator{key: key, id: []byte("credential-1")}
+}
+
+func (a *testAuthenticator) authData(rpID string, flags byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	res := append(h[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(res[33:], a.signCount)
+	return res
+}
+
+func (a *testAuthenticator) clientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	return b
+}
+
+func (a *testAuthenticator) create(rpID string, flags byte) []byte {
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	coseKey := cborMap(5,
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(-7),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(x),
+		cborInt(-3), cborBytes(y))
+	authData := a.authData(rpID, flags)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.id)>>8), byte(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, coseKey...)
+	return cborMap(3,
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(0),
+		cborText("authData"), cborBytes(authData))
+}
+
+func (a *testAuthenticator) get(t *testing.T, rpID string, flags byte, clientData []byte) ([]byte, []byte) {
+	a.signCount++
+	authData := a.authData(rpID, flags)
+	cdHash := sha256.Sum256(clientData)
+	h := sha256.Sum256(append(authData, cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, h[:])
+	if err != nil {
+		t.Fatalf("SignASN1() failed: %v", err)
+	}
+	return authData, sig
+}
+
+func TestWebAuthnNewChallenge(t *testing.T) {
+	c, err := WebAuthnNewChallenge()
+	if err != nil {
+		t.Fatalf("WebAuthnNewChallenge() error = %v", err)
+	}
+	if b, err := WebAuthnEncoding.DecodeString(c); err != nil || len(b) != webAuthnChallengeLen {
+		t.Errorf("WebAuthnNewChallenge() got %q, decoded to %d bytes (err %v)", c, len(b), err)
+	}
+}
+
+func TestWebAuthnRelyingParty_ParseRegistration(t *testing.T) {
+	a := newTestAuthenticator(t)
+	const flags = webAuthnFlagUP | webAuthnFlagUV | webAuthnFlagAT
+	tests := []struct {
+		name       string
+		clientData []byte
+		attObj     []byte
+		wantErr    bool
+	}{
+		{"valid           ", a.clientData("webauthn.create", "chal", testRP.Origin), a.create(testRP.ID, flags), false},
+		{"wrong type      ", a.clientData("webauthn.get", "chal", testRP.Origin), a.create(testRP.ID, flags), true},
+		{"wrong challenge ", a.clientData("webauthn.create", "other", testRP.Origin), a.create(testRP.ID, flags), true},
+		{"wrong origin    ", a.clientData("webauthn.create", "chal", "https://evil.app"), a.create(testRP.ID, flags), true},
+		{"wrong RP ID     ", a.clientData("webauthn.create", "chal", testRP.Origin), a.create("evil.app", flags), true},
+		{"not verified    ", a.clientData("webauthn.create", "chal", testRP.Origin), a.create(testRP.ID, flags&^webAuthnFlagUV), true},
+		{"no credential   ", a.clientData("webauthn.create", "chal", testRP.Origin), a.create(testRP.ID, flags&^webAuthnFlagAT), true},
+		{"malformed       ", a.clientData("webauthn.create", "chal", testRP.Origin), []byte{0xa1}, true},
+		{"bad client data ", []byte("{"), a.create(testRP.ID, flags), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testRP.ParseRegistration("chal", tt.clientData, tt.attObj)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRegistration() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && string(got.ID) != string(a.id) {
+				t.Errorf("ParseRegistration() got ID %q, want %q", got.ID, a.id)
+			}
+		})
+	}
+}
+
+func TestWebAuthnRelyingParty_VerifyAssertion(t *testing.T) {
+	a := newTestAuthenticator(t)
+	cred, err := testRP.ParseRegistration(
+		"chal",
+		a.clientData("webauthn.create", "chal", testRP.Origin),
+		a.create(testRP.ID, webAuthnFlagUP|webAuthnFlagUV|webAuthnFlagAT))
+	if err != nil {
+		t.Fatalf("ParseRegistration() error = %v", err)
+	}
+
+	// Valid assertion
+	cd := a.clientData("webauthn.get", "chal2", testRP.Origin)
+	authData, sig := a.get(t, testRP.ID, webAuthnFlagUP|webAuthnFlagUV, cd)
+	if got, err := testRP.VerifyAssertion("chal2", cred, cd, authData, sig); err != nil {
+		t.Fatalf("VerifyAssertion() error = %v", err)
+	} else if got != 1 {
+		t.Errorf("VerifyAssertion() got counter %d, want 1", got)
+	} else {
+		cred.SignCount = got
+	}
+
+	// Replayed assertion: the counter doesn't increase
+	if _, err := testRP.VerifyAssertion("chal2", cred, cd, authData, sig); err == nil {
+		t.Errorf("VerifyAssertion() expected an error for a replayed assertion")
+	}
+
+	// Tampered signature
+	cd = a.clientData("webauthn.get", "chal3", testRP.Origin)
+	authData, sig = a.get(t, testRP.ID, webAuthnFlagUP|webAuthnFlagUV, cd)
+	sig[len(sig)-1] ^= 0xff
+	if _, err := testRP.VerifyAssertion("chal3", cred, cd, authData, sig); err == nil {
+		t.Errorf("VerifyAssertion() expected an error for a tampered signature")
+	}
+
+	// Wrong challenge
+	cd = a.clientData("webauthn.get", "chal4", testRP.Origin)
+	authData, sig = a.get(t, testRP.ID, webAuthnFlagUP|webAuthnFlagUV, cd)
+	if _, err := testRP.VerifyAssertion("chal5", cred, cd, authData, sig); err == nil {
+		t.Errorf("VerifyAssertion() expected an error for a wrong challenge")
+	}
+
+	// User not verified
+	cd = a.clientData("webauthn.get", "chal6", testRP.Origin)
+	authData, sig = a.get(t, testRP.ID, webAuthnFlagUP, cd)
+	if _, err := testRP.VerifyAssertion("chal6", cred, cd, authData, sig); err == nil {
+		t.Errorf("VerifyAssertion() expected an error for an unverified user")
+	}
+}